@@ -2,22 +2,27 @@ package timeliner
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/gob"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
+
+	"golang.org/x/oauth2"
 )
 
 // Account represents an account with a service.
 type Account struct {
-	ID            int64
-	DataSourceID  string
-	UserID        string
-	person        Person
-	authorization []byte
-	checkpoint    []byte
-	lastItemID    *int64
+	ID           int64
+	DataSourceID string
+	UserID       string
+	person       Person
+	checkpoint   []byte
+	lastItemID   *int64
+	options      interface{}
 
 	t  *Timeline
 	ds DataSource
@@ -46,6 +51,13 @@ func (acc Account) NewHTTPClient() (*http.Client, error) {
 	return httpClient, nil
 }
 
+// Options returns the options the account's client is
+// configured with (see DataSource.Options), or nil if the
+// data source has no options.
+func (acc Account) Options() interface{} {
+	return acc.options
+}
+
 func (acc Account) String() string {
 	return acc.DataSourceID + "/" + acc.UserID
 }
@@ -95,15 +107,17 @@ func (t *Timeline) Authenticate(dataSourceID, userID string) error {
 	}
 
 	// store the account along with our authorization to access it
-	_, err = t.db.Exec(`INSERT INTO accounts
-		(data_source_id, user_id, authorization)
-		VALUES (?, ?, ?)
-		ON CONFLICT (data_source_id, user_id)
-		DO UPDATE SET authorization=?`,
-		dataSourceID, userID, credsBytes,
-		credsBytes)
+	_, err = t.db.Exec(`INSERT OR IGNORE INTO accounts (data_source_id, user_id) VALUES (?, ?)`,
+		dataSourceID, userID)
 	if err != nil {
-		return fmt.Errorf("inserting into or updating DB: %v", err)
+		return fmt.Errorf("inserting into DB: %v", err)
+	}
+	if credsBytes == nil {
+		return nil
+	}
+	err = t.creds.Store(dataSourceID, userID, credsBytes)
+	if err != nil {
+		return fmt.Errorf("storing credentials: %v", err)
 	}
 
 	return nil
@@ -115,6 +129,14 @@ func (t *Timeline) Authenticate(dataSourceID, userID string) error {
 // actually wrapped by a type with unexported fields that are
 // necessary for internal use.
 func (t *Timeline) NewClient(dataSourceID, userID string) (WrappedClient, error) {
+	return t.NewClientWithOptions(dataSourceID, userID, nil)
+}
+
+// NewClientWithOptions is like NewClient, but the client is
+// configured with options, which should be a value returned
+// from DecodeOptions for the same data source. If options is
+// nil, the data source's default options are used.
+func (t *Timeline) NewClientWithOptions(dataSourceID, userID string, options interface{}) (WrappedClient, error) {
 	ds, ok := dataSources[dataSourceID]
 	if !ok {
 		return WrappedClient{}, fmt.Errorf("data source not registered: %s", dataSourceID)
@@ -128,6 +150,14 @@ func (t *Timeline) NewClient(dataSourceID, userID string) (WrappedClient, error)
 		return WrappedClient{}, fmt.Errorf("getting account: %v", err)
 	}
 
+	if options == nil && ds.Options != nil {
+		options, err = ds.Options(func(interface{}) error { return nil })
+		if err != nil {
+			return WrappedClient{}, fmt.Errorf("default %s options: %v", dataSourceID, err)
+		}
+	}
+	acc.options = options
+
 	cl, err := ds.NewClient(acc)
 	if err != nil {
 		return WrappedClient{}, fmt.Errorf("making client from data source: %v", err)
@@ -142,6 +172,86 @@ func (t *Timeline) NewClient(dataSourceID, userID string) (WrappedClient, error)
 	}, nil
 }
 
+// ImportClient returns a client that stores the items listed by cl
+// in the account on the data source with the given ID having the
+// given user ID, as if the data source had listed them. It is for
+// importing items that were exported from a timeline back into the
+// accounts they came from, using a client that reads the export.
+// If the account does not exist, it is added without authenticating
+// with the data source, so it has no credentials until reauth.
+func (t *Timeline) ImportClient(dataSourceID, userID string, cl Client) (WrappedClient, error) {
+	ds, ok := dataSources[dataSourceID]
+	if !ok {
+		return WrappedClient{}, fmt.Errorf("data source not registered: %s", dataSourceID)
+	}
+
+	_, err := t.db.Exec(`INSERT OR IGNORE INTO data_sources (id, name) VALUES (?, ?)`,
+		dataSourceID, ds.Name)
+	if err != nil {
+		return WrappedClient{}, fmt.Errorf("saving data source record: %v", err)
+	}
+	_, err = t.db.Exec(`INSERT OR IGNORE INTO accounts (data_source_id, user_id) VALUES (?, ?)`,
+		dataSourceID, userID)
+	if err != nil {
+		return WrappedClient{}, fmt.Errorf("inserting into DB: %v", err)
+	}
+
+	acc, err := t.getAccount(dataSourceID, userID)
+	if err != nil {
+		return WrappedClient{}, fmt.Errorf("getting account: %v", err)
+	}
+
+	return WrappedClient{
+		Client:     cl,
+		tl:         t,
+		acc:        acc,
+		ds:         ds,
+		lastItemMu: new(sync.Mutex),
+	}, nil
+}
+
+// Account returns the account on the data source with the
+// given ID having the given user ID.
+func (t *Timeline) Account(dataSourceID, userID string) (Account, error) {
+	return t.getAccount(dataSourceID, userID)
+}
+
+// Accounts returns all the accounts in the timeline, ordered
+// by row ID. Accounts on data sources that are not registered
+// (for example, if the program was built without them) are
+// included, but clients cannot be made for them.
+func (t *Timeline) Accounts() ([]Account, error) {
+	rows, err := t.db.Query(`SELECT
+		id, data_source_id, user_id, checkpoint, last_item_id
+		FROM accounts ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying accounts: %v", err)
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		acc := Account{t: t}
+		err := rows.Scan(&acc.ID, &acc.DataSourceID, &acc.UserID, &acc.checkpoint, &acc.lastItemID)
+		if err != nil {
+			return nil, fmt.Errorf("scanning account: %v", err)
+		}
+		acc.ds = dataSources[acc.DataSourceID]
+		if acc.checkpoint != nil {
+			err = UnmarshalGob(acc.checkpoint, &acc.cp)
+			if err != nil {
+				return nil, fmt.Errorf("decoding checkpoint wrapper of %s: %v", acc, err)
+			}
+		}
+		accounts = append(accounts, acc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating account rows: %v", err)
+	}
+
+	return accounts, nil
+}
+
 func (t *Timeline) getAccount(dsID, userID string) (Account, error) {
 	ds, ok := dataSources[dsID]
 	if !ok {
@@ -152,9 +262,9 @@ func (t *Timeline) getAccount(dsID, userID string) (Account, error) {
 		t:  t,
 	}
 	err := t.db.QueryRow(`SELECT
-		id, data_source_id, user_id, authorization, checkpoint, last_item_id
+		id, data_source_id, user_id, checkpoint, last_item_id
 		FROM accounts WHERE data_source_id=? AND user_id=? LIMIT 1`,
-		dsID, userID).Scan(&acc.ID, &acc.DataSourceID, &acc.UserID, &acc.authorization, &acc.checkpoint, &acc.lastItemID)
+		dsID, userID).Scan(&acc.ID, &acc.DataSourceID, &acc.UserID, &acc.checkpoint, &acc.lastItemID)
 	if err != nil {
 		return acc, fmt.Errorf("querying account %s/%s from DB: %v", dsID, userID, err)
 	}
@@ -178,3 +288,176 @@ func MarshalGob(v interface{}) ([]byte, error) {
 func UnmarshalGob(data []byte, v interface{}) error {
 	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 }
+
+// AccountSummary describes an account and its items.
+type AccountSummary struct {
+	ID             int64      `json:"id"`
+	DataSourceID   string     `json:"data_source_id"`
+	DataSourceName string     `json:"data_source_name,omitempty"` // empty if the data source is not registered
+	UserID         string     `json:"user_id"`
+	Items          int64      `json:"items"`
+	DataFiles      int64      `json:"data_files"`             // items with data files
+	FirstItem      *time.Time `json:"first_item,omitempty"`   // timestamp of the oldest item
+	LastItem       *time.Time `json:"last_item,omitempty"`    // timestamp of the most recent item
+	Trashed        int64      `json:"trashed"`                // items in the trash
+	Checkpoint     bool       `json:"checkpoint"`             // whether an interrupted run will be resumed
+	Credentials    bool       `json:"credentials"`            // whether credentials are stored
+	TokenExpiry    *time.Time `json:"token_expiry,omitempty"` // when the OAuth2 access token expires, if known
+}
+
+// Summarize returns a summary of acc and its items. Since the
+// credentials of acc are loaded to find out when its token
+// expires, this may run a credential helper.
+func (acc Account) Summarize(ctx context.Context) (AccountSummary, error) {
+	s := AccountSummary{
+		ID:             acc.ID,
+		DataSourceID:   acc.DataSourceID,
+		DataSourceName: acc.ds.Name,
+		UserID:         acc.UserID,
+		Checkpoint:     acc.checkpoint != nil,
+	}
+
+	var first, last *int64
+	err := acc.t.db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(data_file), MIN(timestamp), MAX(timestamp)
+		FROM items WHERE account_id=?`, acc.ID).Scan(&s.Items, &s.DataFiles, &first, &last)
+	if err != nil {
+		return s, fmt.Errorf("counting items of %s: %v", acc, err)
+	}
+	if first != nil {
+		ts := time.Unix(*first, 0)
+		s.FirstItem = &ts
+	}
+	if last != nil {
+		ts := time.Unix(*last, 0)
+		s.LastItem = &ts
+	}
+	err = acc.t.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM trash WHERE account_id=?`,
+		acc.ID).Scan(&s.Trashed)
+	if err != nil {
+		return s, fmt.Errorf("counting trashed items of %s: %v", acc, err)
+	}
+
+	creds, err := acc.t.loadCredentials(acc)
+	if err != nil {
+		return s, err
+	}
+	s.Credentials = creds != nil
+	if creds != nil && acc.ds.OAuth2.ProviderID != "" {
+		var tkn *oauth2.Token
+		if UnmarshalGob(creds, &tkn) == nil && tkn != nil && !tkn.Expiry.IsZero() {
+			expiry := tkn.Expiry
+			s.TokenExpiry = &expiry
+		}
+	}
+
+	return s, nil
+}
+
+// RemoveAccount permanently deletes the account on the data
+// source with the given ID having the given user ID, along with
+// its items (and their relationships and places in collections),
+// collections, trash, history, and credentials. Data files of its
+// items are deleted too, unless other items still use them. Persons
+// are kept, since they may be the owners of other items. It returns
+// the number of items that were deleted.
+func (t *Timeline) RemoveAccount(ctx context.Context, dataSourceID, userID string) (int, error) {
+	var accountID int64
+	err := t.db.QueryRowContext(ctx, `SELECT id FROM accounts WHERE data_source_id=? AND user_id=? LIMIT 1`,
+		dataSourceID, userID).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("account not found: %s/%s", dataSourceID, userID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("querying account %s/%s from DB: %v", dataSourceID, userID, err)
+	}
+
+	// the trash has data files of its own
+	_, err = t.EmptyTrash(ctx, dataSourceID, userID)
+	if err != nil {
+		return 0, fmt.Errorf("emptying trash: %v", err)
+	}
+
+	// remember the data files, to delete those that are
+	// no longer used once the items are gone
+	var dataFiles []string
+	rows, err := t.db.QueryContext(ctx, `SELECT DISTINCT data_file FROM items
+		WHERE account_id=? AND data_file IS NOT NULL`, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("querying data files: %v", err)
+	}
+	for rows.Next() {
+		var dataFile string
+		err := rows.Scan(&dataFile)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning data file: %v", err)
+		}
+		dataFiles = append(dataFiles, dataFile)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating data file rows: %v", err)
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if t.searchable {
+		_, err = tx.Exec(`DELETE FROM items_fts WHERE rowid IN (SELECT id FROM items WHERE account_id=?)`, accountID)
+		if err != nil {
+			return 0, fmt.Errorf("removing items from search index: %v", err)
+		}
+	}
+
+	// relationships and places in collections are
+	// deleted along with the items, and everything
+	// else that belongs to the account along with it
+	res, err := tx.Exec(`DELETE FROM items WHERE account_id=?`, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("deleting items: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("counting deleted items: %v", err)
+	}
+	_, err = tx.Exec(`DELETE FROM accounts WHERE id=?`, accountID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+	if err != nil {
+		return 0, fmt.Errorf("deleting account: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("committing transaction: %v", err)
+	}
+
+	// items of other accounts may use the same data files, and
+	// their items in the trash expect theirs to still be there
+	// if the files weren't quarantined
+	for _, dataFile := range dataFiles {
+		var count int
+		err := t.db.QueryRowContext(ctx, `SELECT
+			(SELECT COUNT(*) FROM items WHERE data_file=?) +
+			(SELECT COUNT(*) FROM trash WHERE data_file=? AND quarantined_file IS NULL)`,
+			dataFile, dataFile).Scan(&count)
+		if err != nil {
+			return int(n), fmt.Errorf("querying count of rows sharing data file: %v", err)
+		}
+		if count > 0 {
+			continue
+		}
+		err = t.store.Remove(dataFile)
+		if err != nil && !os.IsNotExist(err) {
+			return int(n), fmt.Errorf("deleting data file: %v", err)
+		}
+	}
+
+	err = t.creds.Erase(dataSourceID, userID)
+	if err != nil {
+		return int(n), fmt.Errorf("erasing credentials: %v", err)
+	}
+
+	return int(n), nil
+}
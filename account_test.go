@@ -0,0 +1,101 @@
+package timeliner
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRemoveAccount(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me", "you")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "mine", ts: ts, class: ClassImage, fileName: "mine.jpg", file: "only mine"}),
+		NewItemGraph(testItem{id: "ours", ts: ts, class: ClassImage, fileName: "ours.jpg", file: "shared"}),
+		NewItemGraph(testItem{id: "trashed", ts: ts, class: ClassPost, text: "gone"}))
+	testGetAll(t, tl, "you",
+		NewItemGraph(testItem{id: "yours", ts: ts, class: ClassImage, fileName: "yours.jpg", file: "shared"}),
+		NewItemGraph(testItem{id: "from me", ts: ts, class: ClassMessage, text: "hi", owner: "me"}))
+
+	mine := loadTestItem(t, tl, "mine")
+	yours := loadTestItem(t, tl, "yours")
+	fromMe := loadTestItem(t, tl, "from me")
+	err := tl.trashItem(loadTestItem(t, tl, "trashed").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// accounts can be listed while the timeline is open for writing
+	ro, err := OpenWithOptions(tl.repoDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("opening read-only: %v", err)
+	}
+	accts, err := ro.Accounts()
+	if err != nil {
+		ro.Close()
+		t.Fatal(err)
+	}
+	for _, acc := range accts {
+		_, err := acc.Summarize(context.Background())
+		if err != nil {
+			t.Errorf("summarizing %s read-only: %v", acc, err)
+		}
+	}
+	ro.Close()
+
+	n, err := tl.RemoveAccount(context.Background(), testDataSourceID, "me")
+	if err != nil {
+		t.Fatalf("removing account: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 items deleted, got %d", n)
+	}
+
+	if _, err := tl.Account(testDataSourceID, "me"); err == nil {
+		t.Error("expected account to be gone")
+	}
+	creds, err := dbCredentialStore{tl}.Get(testDataSourceID, "me")
+	if err != nil || creds != nil {
+		t.Errorf("expected credentials to be gone, got %q (err=%v)", creds, err)
+	}
+	var count int
+	err = tl.db.QueryRow(`SELECT COUNT(*) FROM items WHERE original_id IN ('mine', 'ours', 'trashed')`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected items of account to be gone, got %d", count)
+	}
+	trash, err := tl.Trash(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("expected trash of account to be emptied, got %+v", trash)
+	}
+
+	// data files that other items use are kept
+	if tl.datafileExists(*mine.DataFile) {
+		t.Error("expected data file of account to be deleted")
+	}
+	if !tl.datafileExists(*yours.DataFile) {
+		t.Error("expected shared data file to be kept")
+	}
+	if _, err := tl.LoadItem(context.Background(), yours.ID); err != nil {
+		t.Errorf("expected items of other account to be kept: %v", err)
+	}
+
+	// so is the person of the account, whose items other
+	// accounts have too
+	var personID int64
+	err = tl.db.QueryRow(`SELECT person_id FROM person_identities WHERE data_source_id=? AND user_id='me'`,
+		testDataSourceID).Scan(&personID)
+	if err != nil {
+		t.Fatalf("expected person of account to be kept: %v", err)
+	}
+	if after := loadTestItem(t, tl, "from me"); after.PersonID != personID || fromMe.PersonID != personID {
+		t.Errorf("expected item of other account to still belong to person %d, got %d", personID, after.PersonID)
+	}
+}
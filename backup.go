@@ -0,0 +1,407 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BackupOptions configures a backup or restore.
+type BackupOptions struct {
+	// If set, Progress is called with the name
+	// of each data file as it is copied.
+	Progress func(dataFile string)
+}
+
+// BackupStats counts the data files handled
+// by a backup or restore.
+type BackupStats struct {
+	Copied  int   `json:"copied"`
+	Bytes   int64 `json:"bytes"`   // of the data files that were copied
+	Skipped int   `json:"skipped"` // already in the backup and unchanged (backup only)
+	Removed int   `json:"removed"` // no longer part of the timeline (backup only)
+	Missing int   `json:"missing"` // didn't exist, so weren't copied
+	Corrupt int   `json:"corrupt"` // didn't match their checksums, so weren't copied
+}
+
+// backupTmpSuffix is added to the names of files
+// while they are being copied into place.
+const backupTmpSuffix = ".timeliner_tmp"
+
+// errChecksumMismatch is returned by copyDataFile if
+// the copy does not match the expected checksum.
+var errChecksumMismatch = errors.New("data file does not match its checksum")
+
+// Backup makes a backup of the timeline in the folder dest on
+// the local file system, which can be restored with Restore.
+// The database is copied with SQLite's online backup API, which
+// makes a consistent snapshot of it even while items are being
+// added, and then only the data files that belong to the items in
+// that snapshot are copied. If dest already contains a backup of
+// the timeline, only data files that are new or have changed since
+// then are copied, and data files that are no longer part of the
+// timeline are deleted. The previous backup remains usable until
+// the new one is complete, except for data files that were replaced
+// since (which only happens in the canonical layout). Backups of
+// encrypted timelines remain encrypted.
+//
+// A data file that is changed after the snapshot is made does not
+// match its checksum in the snapshot; it is not copied, and it is
+// counted as corrupt.
+func (t *Timeline) Backup(ctx context.Context, dest string, opt BackupOptions) (BackupStats, error) {
+	var stats BackupStats
+
+	err := os.MkdirAll(dest, 0700)
+	if err != nil {
+		return stats, fmt.Errorf("making backup folder: %v", err)
+	}
+
+	// the checksums of the data files that are already in the
+	// backup; a data file with the same checksum is unchanged
+	indexPath := filepath.Join(dest, "index.db")
+	var previous map[string]string
+	if _, err := os.Stat(indexPath); err == nil {
+		previous, err = loadBackupDataFiles(ctx, indexPath)
+		if err != nil {
+			return stats, fmt.Errorf("reading previous backup: %v", err)
+		}
+	}
+
+	snapshotPath := indexPath + backupTmpSuffix
+	defer os.Remove(snapshotPath)
+	err = t.snapshotDB(ctx, snapshotPath)
+	if err != nil {
+		return stats, fmt.Errorf("making snapshot of database: %v", err)
+	}
+	dataFiles, err := loadBackupDataFiles(ctx, snapshotPath)
+	if err != nil {
+		return stats, fmt.Errorf("reading snapshot of database: %v", err)
+	}
+
+	destStore := NewLocalStore(dest)
+	for _, dataFile := range sortedDataFiles(dataFiles) {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		checksum := dataFiles[dataFile]
+		if checksum != "" && previous[dataFile] == checksum {
+			if _, err := destStore.Stat(dataFile); err == nil {
+				stats.Skipped++
+				continue
+			}
+		}
+		if opt.Progress != nil {
+			opt.Progress(dataFile)
+		}
+		n, err := copyDataFile(t.plainStore(), destStore, t.keys, dataFile, checksum)
+		if err != nil && !stats.count(err, dataFile, checksum) {
+			return stats, fmt.Errorf("copying data file %s: %v", dataFile, err)
+		}
+		if err == nil {
+			stats.Copied++
+			stats.Bytes += n
+		}
+	}
+
+	// the snapshot replaces the previous one only
+	// now that its data files are all in the backup
+	err = os.Rename(snapshotPath, indexPath)
+	if err != nil {
+		return stats, fmt.Errorf("replacing previous backup of database: %v", err)
+	}
+
+	for _, folder := range []string{"data", blobsFolder, trashFolder} {
+		err = destStore.List(folder, func(name string, info os.FileInfo) error {
+			if _, ok := dataFiles[name]; ok {
+				return ctx.Err()
+			}
+			stats.Removed++
+			return destStore.Remove(name)
+		})
+		if err != nil {
+			return stats, fmt.Errorf("deleting files no longer in %s folder: %v", folder, err)
+		}
+	}
+
+	return stats, nil
+}
+
+// Restore restores the backup made by Backup in the folder backup
+// into a new timeline repository in the folder repo, with opts as
+// it would be opened (opts.Secret is required if the backup is
+// encrypted). Data files are restored into opts.Store, if set. Each
+// data file is checked against its checksum as it is restored; data
+// files that don't match, or that are missing from the backup, are
+// not restored (and counted in the returned stats), which can be
+// repaired with Fsck. The database is restored last, so an
+// interrupted restore can be started over.
+func Restore(ctx context.Context, backup, repo string, opts Options, opt BackupOptions) (BackupStats, error) {
+	var stats BackupStats
+
+	indexPath := filepath.Join(repo, "index.db")
+	if _, err := os.Stat(indexPath); err == nil {
+		return stats, fmt.Errorf("repository already exists: %s", repo)
+	}
+	backupIndexPath := filepath.Join(backup, "index.db")
+	if _, err := os.Stat(backupIndexPath); err != nil {
+		return stats, fmt.Errorf("no backup found: %v", err)
+	}
+
+	// nothing else should open the repository until
+	// its database is restored after its data files
+	err := os.MkdirAll(repo, 0755)
+	if err != nil {
+		return stats, fmt.Errorf("making repository folder: %v", err)
+	}
+	lock, err := lockRepo(repo)
+	if err != nil {
+		return stats, err
+	}
+	defer lock.unlock()
+
+	db, err := openBackupDB(backupIndexPath)
+	if err != nil {
+		return stats, err
+	}
+	keys, err := loadKeyring(db, opts.Secret)
+	if err != nil {
+		db.Close()
+		return stats, err
+	}
+	dataFiles, err := backupDataFiles(ctx, db)
+	db.Close()
+	if err != nil {
+		return stats, fmt.Errorf("reading backup of database: %v", err)
+	}
+
+	store := opts.Store
+	if store == nil {
+		store = NewLocalStore(repo)
+	}
+	backupStore := NewLocalStore(backup)
+	for _, dataFile := range sortedDataFiles(dataFiles) {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if opt.Progress != nil {
+			opt.Progress(dataFile)
+		}
+		checksum := dataFiles[dataFile]
+		n, err := copyDataFile(backupStore, store, keys, dataFile, checksum)
+		if err != nil && !stats.count(err, dataFile, checksum) {
+			return stats, fmt.Errorf("restoring data file %s: %v", dataFile, err)
+		}
+		if err == nil {
+			stats.Copied++
+			stats.Bytes += n
+		}
+	}
+
+	_, err = copyDataFile(backupStore, NewLocalStore(repo), nil, "index.db", "")
+	if err != nil {
+		return stats, fmt.Errorf("restoring database: %v", err)
+	}
+
+	return stats, nil
+}
+
+// count counts the data file that could not be copied because
+// of err, and reports whether it was counted; if not, err is
+// an error that should stop the backup or restore.
+func (s *BackupStats) count(err error, dataFile, checksum string) bool {
+	switch {
+	case os.IsNotExist(err):
+		// the data file of an item that is still being
+		// downloaded (which has no checksum) may not exist
+		if checksum != "" {
+			log.Printf("[ERROR] Data file is missing: %s", dataFile)
+			s.Missing++
+		}
+		return true
+	case err == errChecksumMismatch || isDecryptError(err):
+		log.Printf("[ERROR] Data file does not match its checksum: %s", dataFile)
+		s.Corrupt++
+		return true
+	}
+	return false
+}
+
+// snapshotDB copies the database of the timeline into a new
+// database at path with SQLite's online backup API. The copy
+// does not use write-ahead logging, so it is a single file.
+func (t *Timeline) snapshotDB(ctx context.Context, path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := t.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSQLite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected type of database connection: %T", destDriverConn)
+			}
+			srcSQLite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected type of database connection: %T", srcDriverConn)
+			}
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			// copying all pages in one step reads them
+			// all in the same transaction, so the copy
+			// is a consistent snapshot
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = destConn.ExecContext(ctx, `PRAGMA journal_mode=DELETE`)
+	return err
+}
+
+// openBackupDB opens the database of a backup for reading.
+func openBackupDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening backup of database: %v", err)
+	}
+	return db, nil
+}
+
+// loadBackupDataFiles is like backupDataFiles,
+// but for the database of a backup at path.
+func loadBackupDataFiles(ctx context.Context, path string) (map[string]string, error) {
+	db, err := openBackupDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return backupDataFiles(ctx, db)
+}
+
+// backupDataFiles returns the names of the data files of the
+// items in db, including items in the trash, mapped to their
+// checksums (which are empty for data files that are still
+// being downloaded).
+func backupDataFiles(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT data_file, MAX(data_hash) FROM (
+			SELECT data_file, data_hash FROM items WHERE data_file IS NOT NULL AND data_file != ''
+			UNION ALL
+			SELECT COALESCE(quarantined_file, data_file), data_hash FROM trash
+				WHERE COALESCE(quarantined_file, data_file) IS NOT NULL
+		) GROUP BY data_file`)
+	if err != nil {
+		return nil, fmt.Errorf("querying data files: %v", err)
+	}
+	defer rows.Close()
+
+	dataFiles := make(map[string]string)
+	for rows.Next() {
+		var dataFile string
+		var checksum *string
+		err := rows.Scan(&dataFile, &checksum)
+		if err != nil {
+			return nil, fmt.Errorf("scanning data file: %v", err)
+		}
+		dataFiles[dataFile] = ""
+		if checksum != nil {
+			dataFiles[dataFile] = *checksum
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating data file rows: %v", err)
+	}
+
+	return dataFiles, nil
+}
+
+// sortedDataFiles returns the names of dataFiles in order.
+func sortedDataFiles(dataFiles map[string]string) []string {
+	names := make([]string, 0, len(dataFiles))
+	for name := range dataFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyDataFile copies the file with the given name from src to
+// dst, replacing it only once the copy is complete. If checksum is
+// not empty, the copy must match it, or errChecksumMismatch is
+// returned and the copy is deleted; the files are encrypted with
+// keys, which is nil if they aren't. It returns the number of
+// bytes copied.
+func copyDataFile(src, dst BlobStore, keys *keyring, name, checksum string) (int64, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	tmp := name + backupTmpSuffix
+	err = dst.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	w, err := dst.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		w.Close()
+		dst.Remove(tmp)
+		return n, err
+	}
+	err = w.Close()
+	if err != nil {
+		dst.Remove(tmp)
+		return n, err
+	}
+
+	if checksum != "" {
+		actual, err := hashFile(keys.wrapStore(dst), keys.newDataHash(), tmp)
+		if err == nil && actual != checksum {
+			err = errChecksumMismatch
+		}
+		if err != nil {
+			dst.Remove(tmp)
+			return n, err
+		}
+	}
+
+	return n, dst.Rename(tmp, name)
+}
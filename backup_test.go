@@ -0,0 +1,193 @@
+package timeliner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testItemsWithFiles returns a graph for each item
+// with a data file containing the given contents.
+func testItemsWithFiles(contents ...string) []*ItemGraph {
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var graphs []*ItemGraph
+	for i, c := range contents {
+		graphs = append(graphs, NewItemGraph(testItem{
+			id:       c,
+			ts:       ts.Add(time.Duration(i) * time.Hour),
+			class:    ClassPost,
+			fileName: c + ".txt",
+			file:     c,
+		}))
+	}
+	return graphs
+}
+
+// loadTestItem loads the item with the given original ID.
+func loadTestItem(t *testing.T, tl *Timeline, originalID string) ItemRow {
+	t.Helper()
+	var id int64
+	err := tl.db.QueryRow(`SELECT id FROM items WHERE original_id=?`, originalID).Scan(&id)
+	if err != nil {
+		t.Fatalf("finding item %s: %v", originalID, err)
+	}
+	ir, err := tl.LoadItem(context.Background(), id)
+	if err != nil {
+		t.Fatalf("loading item %s: %v", originalID, err)
+	}
+	return ir
+}
+
+func TestBackupIncremental(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	dest, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	testGetAll(t, tl, "me", testItemsWithFiles("one", "two", "three")...)
+	stats, err := tl.Backup(context.Background(), dest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("first backup: %v", err)
+	}
+	if stats.Copied != 3 || stats.Skipped != 0 || stats.Removed != 0 {
+		t.Errorf("first backup: expected 3 copied, got %+v", stats)
+	}
+
+	stats, err = tl.Backup(context.Background(), dest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("second backup: %v", err)
+	}
+	if stats.Copied != 0 || stats.Skipped != 3 || stats.Removed != 0 {
+		t.Errorf("second backup: expected 3 skipped, got %+v", stats)
+	}
+
+	// one item is deleted for good, and another is added
+	three := loadTestItem(t, tl, "three")
+	err = tl.trashItem(three.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tl.EmptyTrash(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetAll(t, tl, "me", testItemsWithFiles("four")...)
+
+	stats, err = tl.Backup(context.Background(), dest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("third backup: %v", err)
+	}
+	if stats.Copied != 1 || stats.Skipped != 2 || stats.Removed != 1 {
+		t.Errorf("third backup: expected 1 copied, 2 skipped and 1 removed, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(*three.DataFile))); !os.IsNotExist(err) {
+		t.Errorf("expected data file of deleted item to be removed from backup, got %v", err)
+	}
+	four := loadTestItem(t, tl, "four")
+	contents, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(*four.DataFile)))
+	if err != nil || string(contents) != "four" {
+		t.Errorf("expected data file of new item in backup, got %q (err=%v)", contents, err)
+	}
+}
+
+func TestBackupCorruptFile(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	dest, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	testGetAll(t, tl, "me", testItemsWithFiles("good", "bad")...)
+	bad := loadTestItem(t, tl, "bad")
+	err = ioutil.WriteFile(filepath.Join(tl.repoDir, filepath.FromSlash(*bad.DataFile)), []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := tl.Backup(context.Background(), dest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if stats.Copied != 1 || stats.Corrupt != 1 {
+		t.Errorf("expected 1 copied and 1 corrupt, got %+v", stats)
+	}
+	badPath := filepath.Join(dest, filepath.FromSlash(*bad.DataFile))
+	for _, path := range []string{badPath, badPath + backupTmpSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected corrupt data file not to be copied to %s, got %v", path, err)
+		}
+	}
+}
+
+func TestBackupRestoreEncrypted(t *testing.T) {
+	secret := []byte("passphrase")
+	tl, cleanup := openTestTimeline(t, Options{Secret: secret}, "me")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "backup")
+
+	testGetAll(t, tl, "me", testItemsWithFiles("one", "two")...)
+	one := loadTestItem(t, tl, "one")
+	stats, err := tl.Backup(context.Background(), dest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if stats.Copied != 2 {
+		t.Errorf("expected 2 copied, got %+v", stats)
+	}
+
+	// the backup is as encrypted as the timeline
+	raw, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(*one.DataFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[:len(fileMagic)]) != fileMagic {
+		t.Error("expected data file in backup to be encrypted")
+	}
+
+	_, err = Restore(context.Background(), dest, filepath.Join(dir, "locked"), Options{}, BackupOptions{})
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked restoring without secret, got %v", err)
+	}
+	_, err = Restore(context.Background(), dest, filepath.Join(dir, "wrong"), Options{Secret: []byte("wrong")}, BackupOptions{})
+	if err != ErrWrongSecret {
+		t.Errorf("expected ErrWrongSecret restoring with wrong secret, got %v", err)
+	}
+
+	repo := filepath.Join(dir, "restored")
+	stats, err = Restore(context.Background(), dest, repo, Options{Secret: secret}, BackupOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if stats.Copied != 2 || stats.Corrupt != 0 || stats.Missing != 0 {
+		t.Errorf("expected 2 restored, got %+v", stats)
+	}
+
+	restored, err := OpenWithOptions(repo, Options{Secret: secret})
+	if err != nil {
+		t.Fatalf("opening restored timeline: %v", err)
+	}
+	defer restored.Close()
+	ir := loadTestItem(t, restored, "one")
+	f, err := restored.OpenDataFile(ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(contents) != "one" {
+		t.Errorf("expected restored data file to contain %q, got %q (err=%v)", "one", contents, err)
+	}
+}
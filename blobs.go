@@ -0,0 +1,370 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Layouts in which data files can be stored in the repository.
+const (
+	// LayoutCanonical stores each data file in the data folder,
+	// at a path made of the item's date, data source, and file
+	// name. Identical files are detected after downloading and
+	// stored only once.
+	LayoutCanonical = "canonical"
+
+	// LayoutBlobs stores each data file in the blobs folder,
+	// named by the SHA-256 checksum of its contents, so that
+	// identical files are stored only once by construction.
+	// The paths that the files would have in the canonical
+	// layout are kept, and a view of the files at those paths
+	// can be made with LinkDataFiles.
+	LayoutBlobs = "blobs"
+)
+
+const (
+	blobsFolder    = "blobs"
+	blobsTmpFolder = "blobs/tmp" // where data files are downloaded before their checksum is known
+)
+
+// Layout returns the layout in which data files are
+// stored in the repository: LayoutCanonical or LayoutBlobs.
+func (t *Timeline) Layout() string {
+	return t.layout
+}
+
+// loadLayout returns the data file layout of the repository.
+func loadLayout(db *sql.DB) (string, error) {
+	layout, err := loadSetting(db, "data_layout")
+	if err != nil {
+		return "", err
+	}
+	if layout == "" {
+		return LayoutCanonical, nil
+	}
+	if layout != LayoutCanonical && layout != LayoutBlobs {
+		return "", fmt.Errorf("unknown data file layout: %s", layout)
+	}
+	return layout, nil
+}
+
+// isBlob returns true if dataFile is in the blobs folder.
+func isBlob(dataFile string) bool {
+	return strings.HasPrefix(dataFile, blobsFolder+"/")
+}
+
+// blobPath returns the name of the data file with the
+// given base64-encoded SHA-256 checksum in the blobs
+// layout. The checksum is hex-encoded, since base64
+// is not safe for file names on all file systems.
+func blobPath(checksumBase64 string) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(checksumBase64)
+	if err != nil {
+		return "", fmt.Errorf("decoding checksum: %v", err)
+	}
+	h := hex.EncodeToString(sum)
+	if len(h) < 3 {
+		return "", fmt.Errorf("checksum too short: %s", checksumBase64)
+	}
+	return path.Join(blobsFolder, h[:2], h), nil
+}
+
+// openBlobTmpFile creates a temporary data file into which a
+// data file can be downloaded before its checksum is known.
+func (t *Timeline) openBlobTmpFile() (io.WriteCloser, *string, error) {
+	for i := 0; i < 100; i++ {
+		tmpPath := path.Join(blobsTmpFolder, randomString(24, true))
+		f, err := t.store.Create(tmpPath)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating data file: %v", err)
+		}
+		return f, &tmpPath, nil
+	}
+	return nil, nil, fmt.Errorf("unable to find available name for temporary data file")
+}
+
+// storeBlob moves the downloaded temporary data file tmpFile
+// into the blobs folder by its checksum, and returns its new
+// name. If the blob already exists, tmpFile is deleted.
+func (t *Timeline) storeBlob(tmpFile, checksumBase64 string) (string, error) {
+	blob, err := blobPath(checksumBase64)
+	if err != nil {
+		return "", err
+	}
+	if t.datafileExists(blob) {
+		err := t.store.Remove(tmpFile)
+		if err != nil {
+			return "", fmt.Errorf("removing duplicate data file: %v", err)
+		}
+		return blob, nil
+	}
+	err = t.store.Rename(tmpFile, blob)
+	if err != nil {
+		return "", fmt.Errorf("moving data file into blobs folder: %v", err)
+	}
+	return blob, nil
+}
+
+// ConvertToBlobs switches the repository to the blobs layout and
+// moves the data files that are in the canonical layout into the
+// blobs folder, keeping their old paths as the items' view paths.
+// Data files whose items have not finished downloading them, or
+// that are missing, are left where they are (see Fsck). If it is
+// interrupted, it can be run again to finish converting. It
+// returns the number of data files that were moved.
+func (t *Timeline) ConvertToBlobs(ctx context.Context) (int, error) {
+	// new data files go into the blobs folder from now on
+	err := saveSetting(t.db, "data_layout", LayoutBlobs)
+	if err != nil {
+		return 0, err
+	}
+	t.layout = LayoutBlobs
+
+	rows, err := t.db.QueryContext(ctx, `SELECT data_file, MIN(data_hash) FROM items
+		WHERE data_file IS NOT NULL AND data_file != '' AND data_hash IS NOT NULL
+		GROUP BY data_file`)
+	if err != nil {
+		return 0, fmt.Errorf("querying data files: %v", err)
+	}
+	type dataFileHash struct{ dataFile, hash string }
+	var dataFiles []dataFileHash
+	for rows.Next() {
+		var dfh dataFileHash
+		err := rows.Scan(&dfh.dataFile, &dfh.hash)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning data file: %v", err)
+		}
+		if !isBlob(dfh.dataFile) {
+			dataFiles = append(dataFiles, dfh)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating data file rows: %v", err)
+	}
+
+	var converted int
+	for _, dfh := range dataFiles {
+		if err := ctx.Err(); err != nil {
+			return converted, err
+		}
+		ok, err := t.convertDataFileToBlob(dfh.dataFile, dfh.hash)
+		if err != nil {
+			return converted, fmt.Errorf("%s: %v", dfh.dataFile, err)
+		}
+		if ok {
+			converted++
+		}
+	}
+
+	return converted, nil
+}
+
+// convertDataFileToBlob moves dataFile into the blobs folder and
+// updates the items that use it; expectedHash is the checksum
+// the items have for it. It returns false if the file was left
+// where it is because it is missing.
+func (t *Timeline) convertDataFileToBlob(dataFile, expectedHash string) (bool, error) {
+	b64hash, err := t.hashDataFile(dataFile)
+	missing := os.IsNotExist(err)
+	if missing {
+		// if we were interrupted after the file was moved
+		// but before the items were updated, it's in place
+		b64hash = expectedHash
+	} else if err != nil {
+		return false, fmt.Errorf("hashing data file: %v", err)
+	}
+	blob, err := blobPath(b64hash)
+	if err != nil {
+		return false, err
+	}
+	blobExists := t.datafileExists(blob)
+	if missing && !blobExists {
+		return false, nil
+	}
+
+	// items of which the file was changed keep their
+	// old checksum, so that Fsck can tell about them
+	moved := !missing && !blobExists
+	if moved {
+		err := t.store.Rename(dataFile, blob)
+		if err != nil {
+			return false, fmt.Errorf("moving data file into blobs folder: %v", err)
+		}
+	}
+
+	err = t.useBlob(dataFile, blob)
+	if err != nil {
+		if moved {
+			t.store.Rename(blob, dataFile)
+		}
+		return false, err
+	}
+
+	// the same file was already stored as a blob
+	if !missing && !moved {
+		err = t.store.Remove(dataFile)
+		if err != nil {
+			return false, fmt.Errorf("removing converted data file: %v", err)
+		}
+	}
+
+	return true, nil
+}
+
+// useBlob updates the items that use dataFile, including
+// items in the trash that share it with other items, to use
+// blob instead, keeping dataFile as their view path.
+func (t *Timeline) useBlob(dataFile, blob string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	viewPath := strings.TrimPrefix(dataFile, "data/")
+	_, err = tx.Exec(`UPDATE items SET data_file=?, view_path=? WHERE data_file=?`,
+		blob, viewPath, dataFile)
+	if err != nil {
+		return fmt.Errorf("updating items: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE trash SET data_file=?, view_path=?
+		WHERE data_file=? AND quarantined_file IS NULL`,
+		blob, viewPath, dataFile)
+	if err != nil {
+		return fmt.Errorf("updating trashed items: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// LinkDataFiles makes a view of the data files in the blobs
+// layout in the folder dir, with each data file at its view
+// path: the path it would have in the canonical layout. Links
+// are hard links if possible, or symbolic links otherwise.
+// Files that are already in the view are left alone, so it
+// can be run again to update the view. If view paths of
+// different files collide, they are made unique. It returns
+// the number of links that were made. Data files of encrypted
+// repositories can't be linked.
+func (t *Timeline) LinkDataFiles(ctx context.Context, dir string) (int, error) {
+	if t.keys != nil {
+		return 0, fmt.Errorf("data files are encrypted, so they can't be linked")
+	}
+
+	rows, err := t.db.QueryContext(ctx, `SELECT data_file, view_path FROM items
+		WHERE data_file IS NOT NULL AND data_hash IS NOT NULL AND view_path IS NOT NULL
+		ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("querying data files: %v", err)
+	}
+	defer rows.Close()
+
+	var linked int
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return linked, err
+		}
+		var dataFile, viewPath string
+		err := rows.Scan(&dataFile, &viewPath)
+		if err != nil {
+			return linked, fmt.Errorf("scanning data file: %v", err)
+		}
+		ok, err := t.linkDataFile(dir, dataFile, viewPath)
+		if err != nil {
+			return linked, fmt.Errorf("%s: %v", viewPath, err)
+		}
+		if ok {
+			linked++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return linked, fmt.Errorf("iterating data file rows: %v", err)
+	}
+
+	return linked, nil
+}
+
+// linkDataFile links dataFile into dir at viewPath, or at a
+// unique variation of it if another file is already there. It
+// returns false if the file was already in the view.
+func (t *Timeline) linkDataFile(dir, dataFile, viewPath string) (bool, error) {
+	ls, ok := t.store.(localStore)
+	if !ok {
+		return false, fmt.Errorf("data files can only be linked if they are stored locally")
+	}
+	src := ls.path(dataFile)
+	srcInfo, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return false, nil // fsck will tell the user about it
+	}
+	if err != nil {
+		return false, err
+	}
+
+	dst := filepath.Join(dir, filepath.FromSlash(t.safeViewPath(viewPath)))
+	err = os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return false, fmt.Errorf("making directory for link: %v", err)
+	}
+
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	for i := 0; i < 100; i++ {
+		tryPath := dst
+		if i > 0 {
+			tryPath = fmt.Sprintf("%s_%d%s", base, i+1, ext)
+		}
+		dstInfo, err := os.Stat(tryPath)
+		if err == nil {
+			if os.SameFile(srcInfo, dstInfo) {
+				return false, nil
+			}
+			continue
+		}
+		if _, lerr := os.Lstat(tryPath); lerr == nil {
+			continue // a broken symlink; leave it be
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+
+		err = os.Link(src, tryPath)
+		if err != nil {
+			// maybe the view is on another file system
+			absSrc, aerr := filepath.Abs(src)
+			if aerr != nil {
+				return false, aerr
+			}
+			err = os.Symlink(absSrc, tryPath)
+		}
+		if err != nil {
+			return false, fmt.Errorf("linking data file: %v", err)
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unable to find available name for link")
+}
+
+// safeViewPath cleans each component of viewPath so
+// that it can't point outside of the view's folder.
+func (t *Timeline) safeViewPath(viewPath string) string {
+	parts := strings.Split(viewPath, "/")
+	for i, part := range parts {
+		parts[i] = t.safePathComponent(part)
+	}
+	return path.Join(parts...)
+}
@@ -0,0 +1,196 @@
+package timeliner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertToBlobs(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	repoPath := func(dataFile string) string {
+		return filepath.Join(tl.repoDir, filepath.FromSlash(dataFile))
+	}
+
+	// identical files are stored once in the canonical layout,
+	// but copies made some other way are not, so make one
+	testGetAll(t, tl, "me", testItemsWithFiles("same", "other", "missing")...)
+	same, other, missing := loadTestItem(t, tl, "same"), loadTestItem(t, tl, "other"), loadTestItem(t, tl, "missing")
+	copied := "data/2019/01/copy/same.txt"
+	err := os.MkdirAll(filepath.Dir(repoPath(copied)), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(repoPath(copied), []byte("same"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tl.db.Exec(`UPDATE items SET data_file=? WHERE id=?`, copied, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tl.db.Exec(`UPDATE items SET data_hash=? WHERE id=?`, *same.DataHash, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(repoPath(*missing.DataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFile := *other.DataFile
+
+	converted, err := tl.ConvertToBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 2 {
+		t.Errorf("expected 2 data files to be converted, got %d", converted)
+	}
+	if tl.Layout() != LayoutBlobs {
+		t.Errorf("expected blobs layout, got %s", tl.Layout())
+	}
+
+	// both copies are now the same blob, named by its checksum,
+	// and their old paths are kept as their view paths
+	blob, err := blobPath(*same.DataHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, before := range []ItemRow{same, {OriginalID: "other", DataFile: &copied}} {
+		after := loadTestItem(t, tl, before.OriginalID)
+		if after.DataFile == nil || *after.DataFile != blob {
+			t.Errorf("expected item %s to use blob %s, got %v", before.OriginalID, blob, after.DataFile)
+		}
+		if expect := strings.TrimPrefix(*before.DataFile, "data/"); after.ViewPath == nil || *after.ViewPath != expect {
+			t.Errorf("expected item %s to have view path %s, got %v", before.OriginalID, expect, after.ViewPath)
+		}
+		if _, err := os.Stat(repoPath(*before.DataFile)); !os.IsNotExist(err) {
+			t.Errorf("expected converted data file %s to be removed, got %v", *before.DataFile, err)
+		}
+	}
+	contents, err := ioutil.ReadFile(repoPath(blob))
+	if err != nil || string(contents) != "same" {
+		t.Errorf("expected blob contents, got %q (err=%v)", contents, err)
+	}
+	if b64hash, err := tl.hashDataFile(blob); err != nil || b64hash != *same.DataHash {
+		t.Errorf("expected blob to match its checksum, got %s (err=%v)", b64hash, err)
+	}
+
+	// the file that the item of the copy used before is not
+	// converted, and neither is the missing one; fsck tells
+	// about both
+	if _, err := os.Stat(repoPath(otherFile)); err != nil {
+		t.Errorf("expected unused data file to be left alone: %v", err)
+	}
+	if ir := loadTestItem(t, tl, "missing"); *ir.DataFile != *missing.DataFile || ir.ViewPath != nil {
+		t.Errorf("expected item with missing data file to be left alone, got %+v", ir)
+	}
+
+	// converting again does nothing more
+	converted, err = tl.ConvertToBlobs(context.Background())
+	if err != nil || converted != 0 {
+		t.Errorf("expected nothing to be converted again, got %d (err=%v)", converted, err)
+	}
+
+	// and new data files are stored as blobs
+	testGetAll(t, tl, "me", testItemsWithFiles("new")...)
+	if ir := loadTestItem(t, tl, "new"); ir.DataFile == nil || !isBlob(*ir.DataFile) {
+		t.Errorf("expected new data file to be a blob, got %v", ir.DataFile)
+	}
+}
+
+func TestLinkDataFiles(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	view, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(view)
+
+	testGetAll(t, tl, "me", testItemsWithFiles("one", "two", "collides", "escapes")...)
+	_, err = tl.ConvertToBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := loadTestItem(t, tl, "one")
+	_, err = tl.db.Exec(`UPDATE items SET view_path=? WHERE original_id='collides'`, *one.ViewPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tl.db.Exec(`UPDATE items SET view_path='../../escaped.txt' WHERE original_id='escapes'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := tl.LinkDataFiles(context.Background(), view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked != 4 {
+		t.Errorf("expected 4 links, got %d", linked)
+	}
+
+	// the colliding view path is made unique, and
+	// the one with ".." is kept inside the view
+	collision := strings.TrimSuffix(*one.ViewPath, ".txt") + "_2.txt"
+	for originalID, viewPath := range map[string]string{
+		"one":      *one.ViewPath,
+		"two":      *loadTestItem(t, tl, "two").ViewPath,
+		"collides": collision,
+		"escapes":  "escaped.txt",
+	} {
+		ir := loadTestItem(t, tl, originalID)
+		blobInfo, err := os.Stat(filepath.Join(tl.repoDir, filepath.FromSlash(*ir.DataFile)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		linkInfo, err := os.Stat(filepath.Join(view, filepath.FromSlash(viewPath)))
+		if err != nil {
+			t.Errorf("expected %s to be linked at %s: %v", originalID, viewPath, err)
+			continue
+		}
+		if !os.SameFile(blobInfo, linkInfo) {
+			t.Errorf("expected %s to be linked to its blob", viewPath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(view)), "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected no link outside of the view, got %v", err)
+	}
+
+	// files that are already in the view are left alone
+	linked, err = tl.LinkDataFiles(context.Background(), view)
+	if err != nil || linked != 0 {
+		t.Errorf("expected no new links, got %d (err=%v)", linked, err)
+	}
+}
+
+func TestSafeViewPath(t *testing.T) {
+	tl := new(Timeline)
+	for _, test := range []struct {
+		in, expect string
+	}{
+		{"2019/01/test/photo.jpg", "2019/01/test/photo.jpg"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"2019/../../photo.jpg", "2019/photo.jpg"},
+		{"/etc/passwd", "etc/passwd"},
+		{"//abs//photo.jpg", "abs/photo.jpg"},
+		{"./a/./b.jpg", "a/b.jpg"},
+		{".../x", "x"},
+		{"my photos/a?b*.jpg", "myphotos/ab.jpg"},
+		{"..", ""},
+	} {
+		got := tl.safeViewPath(test.in)
+		if got != test.expect {
+			t.Errorf("safeViewPath(%q): expected %q, got %q", test.in, test.expect, got)
+		}
+		if path.IsAbs(got) || strings.HasPrefix(got, "..") {
+			t.Errorf("safeViewPath(%q): %q is outside of the view", test.in, got)
+		}
+	}
+}
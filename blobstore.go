@@ -0,0 +1,160 @@
+package timeliner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// BlobStore stores the data files of a timeline. Names of
+// files are slash-separated paths relative to the root of
+// the store, such as "data/2019/01/twitter/photo.jpg"; any
+// folders in a name are created as needed. Errors about
+// files that don't exist must satisfy os.IsNotExist. A
+// BlobStore must be safe for concurrent use.
+type BlobStore interface {
+	// Create creates a new file with the given name and
+	// opens it for writing. If the file already exists,
+	// an error satisfying os.IsExist is returned. The
+	// file is complete once Close returns without error.
+	Create(name string) (io.WriteCloser, error)
+
+	// Open opens the file with the given name for reading.
+	Open(name string) (BlobFile, error)
+
+	// Stat returns information about the file.
+	Stat(name string) (os.FileInfo, error)
+
+	// Remove deletes the file.
+	Remove(name string) error
+
+	// Rename moves the file named from to the name to,
+	// replacing any file that is already there.
+	Rename(from, to string) error
+
+	// List calls fn with the name and information of each
+	// file in the given folder and its subfolders. If the
+	// folder does not exist, fn is not called. If fn returns
+	// an error, List stops and returns that error.
+	List(folder string, fn func(name string, info os.FileInfo) error) error
+}
+
+// BlobFile is a file opened for reading from a BlobStore.
+type BlobFile interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// NewLocalStore returns a BlobStore that keeps data
+// files in the folder dir on the local file system.
+// This is where data files are stored by default,
+// with dir being the folder of the repository.
+func NewLocalStore(dir string) BlobStore {
+	return localStore{root: dir}
+}
+
+// localStore is a BlobStore on the local file system.
+type localStore struct {
+	root string
+}
+
+// path returns the path of the file with the given name.
+func (ls localStore) path(name string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(name))
+}
+
+func (ls localStore) Create(name string) (io.WriteCloser, error) {
+	err := os.MkdirAll(filepath.Dir(ls.path(name)), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("making folder for file: %v", err)
+	}
+	f, err := os.OpenFile(ls.path(name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{File: f}, nil
+}
+
+func (ls localStore) Open(name string) (BlobFile, error) {
+	return os.Open(ls.path(name))
+}
+
+func (ls localStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(ls.path(name))
+}
+
+func (ls localStore) Remove(name string) error {
+	err := os.Remove(ls.path(name))
+	if err != nil {
+		return err
+	}
+	ls.removeEmptyFolders(name)
+	return nil
+}
+
+func (ls localStore) Rename(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(ls.path(to)), 0700)
+	if err != nil {
+		return fmt.Errorf("making folder for file: %v", err)
+	}
+	err = os.Rename(ls.path(from), ls.path(to))
+	if err != nil {
+		return err
+	}
+	ls.removeEmptyFolders(from)
+	return nil
+}
+
+func (ls localStore) List(folder string, fn func(name string, info os.FileInfo) error) error {
+	dir := ls.path(folder)
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if fpath == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.root, fpath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// removeEmptyFolders deletes the folders of the file with
+// the given name that are left empty after it was removed,
+// so that folders of files that were moved or deleted,
+// like those in the trash, don't pile up.
+func (ls localStore) removeEmptyFolders(name string) {
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(ls.path(dir)) != nil {
+			return // not empty
+		}
+	}
+}
+
+// localFile is a file being written to a localStore;
+// it is synced to disk when it is closed.
+type localFile struct {
+	*os.File
+	closed bool
+}
+
+func (lf *localFile) Close() error {
+	if lf.closed {
+		return nil
+	}
+	lf.closed = true
+	if err := lf.Sync(); err != nil {
+		lf.File.Close()
+		return fmt.Errorf("syncing file: %v", err)
+	}
+	return lf.File.Close()
+}
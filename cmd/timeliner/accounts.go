@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// accounts lists, shows, or removes accounts.
+func accounts(tl *timeliner.Timeline, args []string) error {
+	const usage = "expecting: accounts list | show <data_source>/<user_id> | remove <data_source>/<user_id>"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) > 1 {
+			return fmt.Errorf(usage)
+		}
+		return listAccounts(tl)
+
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		accts, err := getAccounts(args[1:])
+		if err != nil {
+			return err
+		}
+		return showAccount(tl, accts[0])
+
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		accts, err := getAccounts(args[1:])
+		if err != nil {
+			return err
+		}
+		n, err := tl.RemoveAccount(context.Background(), accts[0].dataSourceID, accts[0].userID)
+		fmt.Printf("Permanently deleted %d items.\n", n)
+		return err
+
+	}
+
+	return fmt.Errorf(usage)
+}
+
+func listAccounts(tl *timeliner.Timeline) error {
+	accts, err := tl.Accounts()
+	if err != nil {
+		return err
+	}
+	if len(accts) == 0 {
+		fmt.Println("No accounts.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDATA SOURCE\tUSER ID\tITEMS\tLAST ITEM\tCHECKPOINT\tTOKEN EXPIRY")
+	for _, acc := range accts {
+		s, err := acc.Summarize(context.Background())
+		if err != nil {
+			return err
+		}
+		checkpoint := "-"
+		if s.Checkpoint {
+			checkpoint = "pending"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			s.ID, s.DataSourceID, s.UserID, s.Items, formatTime(s.LastItem), checkpoint, formatTime(s.TokenExpiry))
+	}
+	return w.Flush()
+}
+
+func showAccount(tl *timeliner.Timeline, a accountInfo) error {
+	accts, err := tl.Accounts()
+	if err != nil {
+		return err
+	}
+	for _, acc := range accts {
+		if acc.DataSourceID != a.dataSourceID || acc.UserID != a.userID {
+			continue
+		}
+		s, err := acc.Summarize(context.Background())
+		if err != nil {
+			return err
+		}
+		dataSource := s.DataSourceID
+		if s.DataSourceName != "" {
+			dataSource += " (" + s.DataSourceName + ")"
+		} else {
+			dataSource += " (not registered)"
+		}
+		checkpoint := "none"
+		if s.Checkpoint {
+			checkpoint = "pending (the next run will resume the interrupted one)"
+		}
+		credentials := "none"
+		if s.Credentials {
+			credentials = "stored"
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID:\t%d\n", s.ID)
+		fmt.Fprintf(w, "Data source:\t%s\n", dataSource)
+		fmt.Fprintf(w, "User ID:\t%s\n", s.UserID)
+		fmt.Fprintf(w, "Items:\t%d (%d with data files, %d in the trash)\n", s.Items, s.DataFiles, s.Trashed)
+		fmt.Fprintf(w, "First item:\t%s\n", formatTime(s.FirstItem))
+		fmt.Fprintf(w, "Last item:\t%s\n", formatTime(s.LastItem))
+		fmt.Fprintf(w, "Checkpoint:\t%s\n", checkpoint)
+		fmt.Fprintf(w, "Credentials:\t%s\n", credentials)
+		fmt.Fprintf(w, "Token expiry:\t%s\n", formatTime(s.TokenExpiry))
+
+		runs, err := tl.Runs(context.Background(), s.DataSourceID, s.UserID, 1)
+		if err != nil {
+			return err
+		}
+		lastRun := "-"
+		if len(runs) > 0 {
+			r := runs[0]
+			status := "unfinished"
+			if r.Finished() {
+				status = "ok"
+				if r.Error == timeliner.ErrInterrupted.Error() {
+					status = "interrupted"
+				} else if r.Error != "" {
+					status = "failed"
+				}
+			}
+			lastRun = fmt.Sprintf("%s at %s (%s)", r.Command, r.Stats.Started.Format("2006/01/02 15:04:05"), status)
+		}
+		fmt.Fprintf(w, "Last run:\t%s\n", lastRun)
+		return w.Flush()
+	}
+	return fmt.Errorf("account not found: %s/%s", a.dataSourceID, a.userID)
+}
+
+// formatTime formats t for display, or
+// returns "-" if t is nil.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006/01/02 15:04:05")
+}
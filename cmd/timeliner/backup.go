@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mholt/timeliner"
+)
+
+// backup makes a backup of the repository in a folder,
+// or updates the backup that is already there.
+func backup(tl *timeliner.Timeline, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expecting: backup <folder>")
+	}
+
+	stats, err := tl.Backup(context.Background(), args[0], backupOptions())
+	fmt.Printf("Copied %d data files (%d bytes), skipped %d unchanged, deleted %d no longer in the timeline.\n",
+		stats.Copied, stats.Bytes, stats.Skipped, stats.Removed)
+	if err != nil {
+		return err
+	}
+	if n := stats.Missing + stats.Corrupt; n > 0 {
+		return fmt.Errorf("%d data files were missing or did not match their checksums, so they are not in the backup (use fsck to check the repository)", n)
+	}
+	return nil
+}
+
+// restore restores a backup into the repository
+// folder, which must not contain a repository.
+func restore(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expecting: restore <folder>")
+	}
+	secret, err := loadSecret()
+	if err != nil {
+		return err
+	}
+
+	stats, err := timeliner.Restore(context.Background(), args[0], repoDir, timeliner.Options{
+		Store:  blobStore,
+		Secret: secret,
+	}, backupOptions())
+	fmt.Printf("Restored %d data files (%d bytes).\n", stats.Copied, stats.Bytes)
+	if err != nil {
+		return err
+	}
+	if n := stats.Missing + stats.Corrupt; n > 0 {
+		return fmt.Errorf("%d data files were missing or did not match their checksums, so they were not restored (use fsck -repair to download them again)", n)
+	}
+	return nil
+}
+
+func backupOptions() timeliner.BackupOptions {
+	var opt timeliner.BackupOptions
+	if verbose {
+		opt.Progress = func(dataFile string) {
+			log.Printf("[INFO] Copying %s", dataFile)
+		}
+	}
+	return opt
+}
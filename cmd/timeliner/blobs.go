@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mholt/timeliner"
+)
+
+// blobs converts the repository to the blobs layout,
+// or makes a view of the data files in that layout.
+func blobs(tl *timeliner.Timeline, args []string) error {
+	const usage = "expecting: blobs convert | link <folder>"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+
+	switch args[0] {
+	case "convert":
+		if len(args) != 1 {
+			return fmt.Errorf(usage)
+		}
+		n, err := tl.ConvertToBlobs(context.Background())
+		fmt.Printf("Moved %d data files into the blobs folder.\n", n)
+		return err
+
+	case "link":
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		if tl.Layout() != timeliner.LayoutBlobs {
+			return fmt.Errorf("data files are not in the blobs layout (use 'blobs convert' first)")
+		}
+		n, err := tl.LinkDataFiles(context.Background(), args[1])
+		fmt.Printf("Linked %d data files into %s.\n", n, args[1])
+		return err
+	}
+
+	return fmt.Errorf(usage)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mholt/timeliner"
+)
+
+// credentialsPassphraseEnv is the environment variable from
+// which the passphrase of the credentials file is read.
+const credentialsPassphraseEnv = "TIMELINER_CREDENTIALS_PASSPHRASE"
+
+// credentialsConfig configures where the credentials of
+// accounts are stored, if not in the database.
+type credentialsConfig struct {
+	Type string `toml:"type"` // "db", "file", or "command"
+
+	// file
+	File string `toml:"file"` // default: credentials.json in the repository folder
+
+	// command
+	Command []string `toml:"command"`
+}
+
+func (cc credentialsConfig) credentialStore() (timeliner.CredentialStore, error) {
+	switch cc.Type {
+	case "db":
+		return nil, nil
+	case "file":
+		passphrase := os.Getenv(credentialsPassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("a passphrase is required (set %s)", credentialsPassphraseEnv)
+		}
+		file := cc.File
+		if file == "" {
+			file = filepath.Join(repoDir, "credentials.json")
+		}
+		return timeliner.NewPassphraseCredentialStore(file, []byte(passphrase))
+	case "command":
+		if len(cc.Command) == 0 {
+			return nil, fmt.Errorf("missing command")
+		}
+		return timeliner.NewCommandCredentialStore(cc.Command[0], cc.Command[1:]...), nil
+	}
+	return nil, fmt.Errorf("unknown type: %s", cc.Type)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// daemon gets the latest items of the configured accounts (or of
+// the accounts given in args) periodically, until the process is
+// interrupted. Runs of an account never overlap, and because the
+// timeline stays open, the rate limits of the data sources are
+// kept across runs.
+func daemon(tl *timeliner.Timeline, args []string) error {
+	accounts, err := getAccounts(args)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		for _, ca := range configuredAccounts {
+			accounts = append(accounts, ca.accountInfo)
+		}
+	}
+	if len(accounts) == 0 {
+		return fmt.Errorf("no accounts specified (and none are configured)")
+	}
+
+	if reprocess || prune || integrity || tfStartInput != "" {
+		return fmt.Errorf("the daemon does not support -reprocess, -prune, -integrity, or -start")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if _, err := parseTimeframe(); err != nil {
+		return err
+	}
+	mergeOpt, err := mergeOptions()
+	if err != nil {
+		return err
+	}
+	procOpt := timeliner.ProcessingOptions{
+		Merge:     mergeOpt,
+		Verbose:   verbose,
+		Workers:   workers,
+		BatchSize: batchSize,
+		DryRun:    dryRun,
+	}
+
+	// find problems with the accounts now rather
+	// than when their first run comes around
+	for _, a := range accounts {
+		if _, err := newDaemonClient(tl, a); err != nil {
+			return fmt.Errorf("%s/%s: %v", a.dataSourceID, a.userID, err)
+		}
+	}
+
+	// stop gracefully when interrupted, so that runs in
+	// progress can save their checkpoints and finish
+	// storing the items they have listed
+	ctx, cancel := interruptible("Shutting down; waiting for runs in progress to stop")
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, a := range accounts {
+		every := accountInterval(a)
+		log.Printf("[INFO][%s/%s] Getting latest items every %s", a.dataSourceID, a.userID, every)
+		wg.Add(1)
+		go func(a accountInfo) {
+			defer wg.Done()
+			syncPeriodically(ctx, a, every, func(ctx context.Context) (timeliner.RunStats, error) {
+				return getLatestOnce(ctx, tl, a, procOpt)
+			})
+		}(a)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// accountInterval returns how often the daemon gets the latest
+// items of account a: its interval in the config file, if it
+// has one, or else -interval.
+func accountInterval(a accountInfo) time.Duration {
+	for _, ca := range configuredAccounts {
+		if ca.accountInfo == a && ca.interval > 0 {
+			return ca.interval
+		}
+	}
+	return interval
+}
+
+// syncPeriodically calls run to get the latest items of account
+// a every interval, until ctx is cancelled. Failed runs are
+// retried sooner, backing off up to the interval.
+func syncPeriodically(ctx context.Context, a accountInfo, every time.Duration, run func(context.Context) (timeliner.RunStats, error)) {
+	sched := syncSchedule{every: every}
+	wait := sched.first()
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		stats, err := run(ctx)
+		if ctx.Err() != nil {
+			log.Printf("[INFO][%s/%s] Stopped", a.dataSourceID, a.userID)
+			return
+		}
+		wait = sched.next(err)
+		if err != nil {
+			log.Printf("[ERROR][%s/%s] Getting latest: %v (retrying in %s)",
+				a.dataSourceID, a.userID, err, wait.Round(time.Second))
+			continue
+		}
+		log.Printf("[INFO][%s/%s] Got latest: %d new, %d updated, %d merged, %d failed, %s downloaded in %s (next run in %s)",
+			a.dataSourceID, a.userID, stats.ItemsNew, stats.ItemsUpdated, stats.ItemsMerged, stats.ItemsFailed,
+			formatBytes(stats.BytesDownloaded), stats.Finished.Sub(stats.Started).Round(time.Second), wait.Round(time.Second))
+	}
+}
+
+// syncSchedule decides how long the daemon waits
+// before each run of an account.
+type syncSchedule struct {
+	every    time.Duration // the account's interval
+	failures int           // consecutive failed runs
+}
+
+// first returns how long to wait before the first run. The
+// first runs are staggered, so that accounts don't all start
+// at the same time.
+func (s *syncSchedule) first() time.Duration {
+	return jitter(s.every)
+}
+
+// next returns how long to wait before the next run, given
+// the error of the run that just ended (nil if it succeeded).
+func (s *syncSchedule) next(err error) time.Duration {
+	if err != nil {
+		s.failures++
+		return backoff(s.failures, s.every)
+	}
+	s.failures = 0
+	return s.every + jitter(s.every)
+}
+
+// getLatestOnce gets the latest items of account a with a new
+// client, so that the run starts from the account's state in the
+// database (such as its latest item and its checkpoint).
+func getLatestOnce(ctx context.Context, tl *timeliner.Timeline, a accountInfo, procOpt timeliner.ProcessingOptions) (timeliner.RunStats, error) {
+	wc, err := newDaemonClient(tl, a)
+	if err != nil {
+		return timeliner.RunStats{}, err
+	}
+
+	// a relative end is relative to when each run starts
+	procOpt.Timeframe, err = parseTimeframe()
+	if err != nil {
+		return timeliner.RunStats{}, err
+	}
+
+	return wc.GetLatest(ctx, procOpt)
+}
+
+// newDaemonClient makes a client for account a
+// with the account's configured options.
+func newDaemonClient(tl *timeliner.Timeline, a accountInfo) (*timeliner.WrappedClient, error) {
+	opts, err := accountOptions(a)
+	if err != nil {
+		return nil, err
+	}
+	wc, err := tl.NewClientWithOptions(a.dataSourceID, a.userID, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating data source client: %v", err)
+	}
+	return &wc, nil
+}
+
+// jitter returns a random duration of up to a
+// tenth of d, to spread out runs over time.
+func jitter(d time.Duration) time.Duration {
+	if d < 10 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(d / 10)))
+}
+
+// backoff returns how long to wait before retrying after the
+// given number of consecutive failures: -retry-after (or one
+// minute), doubled for each failure, but no longer than every.
+func backoff(failures int, every time.Duration) time.Duration {
+	d := retryAfter
+	if d <= 0 {
+		d = time.Minute
+	}
+	for i := 1; i < failures && d < every; i++ {
+		d *= 2
+	}
+	if d > every {
+		d = every
+	}
+	return d + jitter(d)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+func TestSyncSchedule(t *testing.T) {
+	oldRetryAfter := retryAfter
+	defer func() { retryAfter = oldRetryAfter }()
+
+	// waits are jittered by up to a tenth
+	expectWait := func(which string, got, expect time.Duration) {
+		t.Helper()
+		if got < expect || got >= expect+expect/10 {
+			t.Errorf("%s: expected to wait %s (plus up to a tenth), got %s", which, expect, got)
+		}
+	}
+
+	retryAfter = time.Minute
+	sched := syncSchedule{every: time.Hour}
+	if first := sched.first(); first < 0 || first >= 6*time.Minute {
+		t.Errorf("expected first run within a tenth of the interval, got %s", first)
+	}
+
+	// failures back off, doubling up to the interval
+	fail := errors.New("failed")
+	for i, expect := range []time.Duration{
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour,
+	} {
+		expectWait(fmt.Sprintf("failure %d", i+1), sched.next(fail), expect)
+	}
+
+	// and success resets them
+	expectWait("success", sched.next(nil), time.Hour)
+	expectWait("failure after success", sched.next(fail), time.Minute)
+	expectWait("second failure after success", sched.next(fail), 2*time.Minute)
+
+	// retries are never later than the next run would be
+	sched = syncSchedule{every: 30 * time.Second}
+	expectWait("failure with short interval", sched.next(fail), 30*time.Second)
+
+	// they start at -retry-after, or a minute if it is not set
+	retryAfter = 0
+	sched = syncSchedule{every: time.Hour}
+	expectWait("failure without -retry-after", sched.next(fail), time.Minute)
+	retryAfter = 10 * time.Second
+	sched = syncSchedule{every: time.Hour}
+	expectWait("failure with -retry-after", sched.next(fail), 10*time.Second)
+	expectWait("second failure with -retry-after", sched.next(fail), 20*time.Second)
+}
+
+func TestAccountInterval(t *testing.T) {
+	oldInterval := interval
+	defer func() {
+		interval = oldInterval
+		configuredAccounts = nil
+	}()
+
+	interval = time.Hour
+	configuredAccounts = []configuredAccount{
+		{accountInfo: accountInfo{"twitter", "often"}, interval: 5 * time.Minute},
+		{accountInfo: accountInfo{"twitter", "default"}},
+	}
+	for _, test := range []struct {
+		account accountInfo
+		expect  time.Duration
+	}{
+		{accountInfo{"twitter", "often"}, 5 * time.Minute},
+		{accountInfo{"twitter", "default"}, time.Hour},
+		{accountInfo{"twitter", "unconfigured"}, time.Hour},
+		{accountInfo{"smsbackuprestore", "often"}, time.Hour},
+	} {
+		if got := accountInterval(test.account); got != test.expect {
+			t.Errorf("%s/%s: expected %s, got %s", test.account.dataSourceID, test.account.userID, test.expect, got)
+		}
+	}
+}
+
+func TestSyncPeriodicallyStops(t *testing.T) {
+	oldRetryAfter := retryAfter
+	defer func() { retryAfter = oldRetryAfter }()
+
+	a := accountInfo{"twitter", "me"}
+	for i, test := range []struct {
+		every       time.Duration
+		retryAfter  time.Duration
+		cancelFirst bool
+		// run is given the number of the call and the
+		// function that cancels the context
+		run         func(call int, cancel func()) error
+		expectCalls int
+	}{
+		{
+			// cancelled before the first run
+			every:       time.Second,
+			cancelFirst: true,
+			expectCalls: 0,
+		},
+		{
+			// cancelled during a run
+			every: time.Second,
+			run: func(call int, cancel func()) error {
+				cancel()
+				return timeliner.ErrInterrupted
+			},
+			expectCalls: 1,
+		},
+		{
+			// cancelled while waiting for the next run
+			every: time.Second,
+			run: func(call int, cancel func()) error {
+				time.AfterFunc(time.Millisecond, cancel)
+				return nil
+			},
+			expectCalls: 1,
+		},
+		{
+			// or for a retry
+			every:      time.Second,
+			retryAfter: 500 * time.Millisecond,
+			run: func(call int, cancel func()) error {
+				time.AfterFunc(time.Millisecond, cancel)
+				return errors.New("failed")
+			},
+			expectCalls: 1,
+		},
+		{
+			// runs go on, whether they fail or not, until then
+			every:      10 * time.Millisecond,
+			retryAfter: time.Millisecond,
+			run: func(call int, cancel func()) error {
+				switch call {
+				case 1, 2:
+					return errors.New("failed")
+				case 5:
+					cancel()
+				}
+				return nil
+			},
+			expectCalls: 5,
+		},
+	} {
+		retryAfter = test.retryAfter
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancelFirst {
+			cancel()
+		}
+		var calls int
+		start := time.Now()
+		syncPeriodically(ctx, a, test.every, func(ctx context.Context) (timeliner.RunStats, error) {
+			calls++
+			return timeliner.RunStats{}, test.run(calls, cancel)
+		})
+		elapsed := time.Since(start)
+		cancel()
+
+		if calls != test.expectCalls {
+			t.Errorf("test %d: expected %d runs, got %d", i, test.expectCalls, calls)
+		}
+		if test.expectCalls <= 1 && elapsed >= test.every/2 {
+			t.Errorf("test %d: expected to stop as soon as cancelled, but took %s", i, elapsed)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mholt/timeliner"
+)
+
+// passphraseEnv is the environment variable from which the
+// passphrase of an encrypted repository is read, unless a
+// key file is given with the -key-file flag.
+const passphraseEnv = "TIMELINER_PASSPHRASE"
+
+// loadSecret returns the contents of the key file, or
+// the passphrase, if either is given.
+func loadSecret() ([]byte, error) {
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %v", err)
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("key file is empty: %s", keyFile)
+		}
+		return key, nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// openTimeline opens the repository, unlocking it
+// with the key file or passphrase if either is given.
+func openTimeline(readOnly bool) (*timeliner.Timeline, error) {
+	secret, err := loadSecret()
+	if err != nil {
+		return nil, err
+	}
+	tl, err := timeliner.OpenWithOptions(repoDir, timeliner.Options{
+		Store:       blobStore,
+		Secret:      secret,
+		Credentials: credentialStore,
+		ReadOnly:    readOnly,
+	})
+	if err == timeliner.ErrLocked {
+		err = fmt.Errorf("%v (use -key-file or set %s)", err, passphraseEnv)
+	}
+	if err == timeliner.ErrNotEncrypted {
+		err = fmt.Errorf("%v (use the encrypt command to encrypt it)", err)
+	}
+	return tl, err
+}
+
+// encrypt encrypts the repository with the key file or
+// passphrase, or finishes encrypting it if it was
+// interrupted.
+func encrypt(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("expecting: encrypt")
+	}
+	secret, err := loadSecret()
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("a key file (-key-file) or passphrase (%s) is required", passphraseEnv)
+	}
+
+	// the secret is only needed to open the repository
+	// once it is encrypted, or partly encrypted
+	opts := timeliner.Options{Store: blobStore, Credentials: credentialStore}
+	tl, err := timeliner.OpenWithOptions(repoDir, opts)
+	if err == timeliner.ErrLocked {
+		opts.Secret = secret
+		tl, err = timeliner.OpenWithOptions(repoDir, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("opening timeline: %v", err)
+	}
+	defer tl.Close()
+
+	n, err := tl.EnableEncryption(context.Background(), secret)
+	fmt.Printf("Encrypted %d data files.\n", n)
+	return err
+}
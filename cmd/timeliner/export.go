@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/timeliner"
+)
+
+// export writes the items of the given accounts (or of all
+// accounts, if none are given) in JSON Lines format to the
+// output file or, if the output file is an archive, bundles
+// the export with the data files it references.
+func export(tl *timeliner.Timeline, args []string) error {
+	tf, err := parseTimeframe()
+	if err != nil {
+		return err
+	}
+	filter := timeliner.ItemQuery{Timeframe: tf}
+
+	accounts, err := getAccounts(args)
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		acc, err := tl.Account(a.dataSourceID, a.userID)
+		if err != nil {
+			return err
+		}
+		filter.AccountIDs = append(filter.AccountIDs, acc.ID)
+	}
+
+	opt := timeliner.ExportOptions{Filter: filter}
+
+	switch strings.ToLower(filepath.Ext(outputFile)) {
+	case "":
+		if outputFile != "" && outputFile != "-" {
+			return fmt.Errorf("output file must have an extension: .jsonl or an archive format")
+		}
+		_, err = tl.Export(context.Background(), os.Stdout, opt)
+		return err
+
+	case ".jsonl", ".json":
+		return exportJSONL(tl, opt)
+
+	default:
+		return tl.ExportArchive(context.Background(), outputFile, opt)
+	}
+}
+
+func exportJSONL(tl *timeliner.Timeline, opt timeliner.ExportOptions) error {
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = tl.Export(context.Background(), out, opt)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mholt/timeliner"
+)
+
+// fsck checks the integrity of the repository, and
+// repairs what it can if the -repair flag is set.
+func fsck(tl *timeliner.Timeline, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("expecting: fsck")
+	}
+
+	opt := timeliner.FsckOptions{Repair: repair}
+	if verbose {
+		opt.Progress = func(dataFile string) {
+			log.Printf("[INFO] Checking %s", dataFile)
+		}
+	}
+
+	report, err := tl.Fsck(context.Background(), opt)
+	for _, p := range report.Problems {
+		fmt.Printf("%s: %s", p.Kind, p.Detail)
+		if p.Path != "" {
+			fmt.Printf(": %s", p.Path)
+		}
+		if p.ItemID != 0 {
+			fmt.Printf(" (item %d)", p.ItemID)
+		}
+		fmt.Println()
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked %d data files of items and %d files in the data folders: %d problems, %d repaired.\n",
+		report.ItemsChecked, report.FilesChecked, len(report.Problems), len(report.Problems)-report.Unrepaired())
+	if n := report.Unrepaired(); n > 0 {
+		if !repair {
+			return fmt.Errorf("found %d problems (use -repair to fix what can be fixed)", n)
+		}
+		return fmt.Errorf("%d problems could not be repaired", n)
+	}
+
+	return nil
+}
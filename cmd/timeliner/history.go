@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// history prints the most recent runs, either of
+// all accounts or of the account given in args.
+func history(tl *timeliner.Timeline, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expecting: history [<data_source>/<user_id>]")
+	}
+
+	var dataSourceID, userID string
+	if len(args) == 1 {
+		accounts, err := getAccounts(args)
+		if err != nil {
+			return err
+		}
+		dataSourceID, userID = accounts[0].dataSourceID, accounts[0].userID
+	}
+
+	runs, err := tl.Runs(context.Background(), dataSourceID, userID, limit)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACCOUNT\tCOMMAND\tSTARTED\tDURATION\tSTATUS\tITEMS\tNEW\tUPDATED\tSKIPPED\tMERGED\tFAILED\tPRUNED\tDOWNLOADED\tOPTIONS\tERROR")
+	for _, r := range runs {
+		status, duration := "unfinished", "-"
+		if r.Finished() {
+			status = "ok"
+			if r.Error == timeliner.ErrInterrupted.Error() {
+				status = "interrupted"
+			} else if r.Error != "" {
+				status = "failed"
+			}
+			duration = r.Stats.Finished.Sub(r.Stats.Started).String()
+		}
+		fmt.Fprintf(w, "%d\t%s/%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			r.ID, r.DataSourceID, r.UserID, r.Command,
+			r.Stats.Started.Format("2006/01/02 15:04:05"), duration, status,
+			r.Stats.ItemsSeen, r.Stats.ItemsNew, r.Stats.ItemsUpdated, r.Stats.ItemsSkipped,
+			r.Stats.ItemsMerged, r.Stats.ItemsFailed, r.Stats.ItemsPruned,
+			formatBytes(r.Stats.BytesDownloaded), runOptions(r), strings.Join(strings.Fields(r.Error), " "))
+	}
+	return w.Flush()
+}
+
+// runOptions describes the options of r with the
+// flags that were used to start it.
+func runOptions(r timeliner.Run) string {
+	var opts []string
+	if r.Filename != "" {
+		opts = append(opts, r.Filename)
+	}
+	if r.Since != nil {
+		opts = append(opts, "-start="+r.Since.Format(time.RFC3339))
+	}
+	if r.Until != nil {
+		opts = append(opts, "-end="+r.Until.Format(time.RFC3339))
+	}
+	if r.Options.Reprocess {
+		opts = append(opts, "-reprocess")
+	}
+	if r.Options.Prune {
+		opts = append(opts, "-prune")
+	}
+	if r.Options.Integrity {
+		opts = append(opts, "-integrity")
+	}
+	if m := r.Options.Merge; m.SoftMerge {
+		merge := []string{"soft"}
+		if m.PreferNewID {
+			merge = append(merge, "id")
+		}
+		if m.PreferNewDataText {
+			merge = append(merge, "text")
+		}
+		if m.PreferNewDataFile {
+			merge = append(merge, "file")
+		}
+		if m.PreferNewMetadata {
+			merge = append(merge, "meta")
+		}
+		opts = append(opts, "-merge="+strings.Join(merge, ","))
+	}
+	if len(opts) == 0 {
+		return "-"
+	}
+	return strings.Join(opts, " ")
+}
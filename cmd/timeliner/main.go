@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -20,6 +22,7 @@ import (
 	_ "github.com/mholt/timeliner/datasources/googlelocation"
 	_ "github.com/mholt/timeliner/datasources/googlephotos"
 	_ "github.com/mholt/timeliner/datasources/instagram"
+	"github.com/mholt/timeliner/datasources/jsonl"
 	"github.com/mholt/timeliner/datasources/smsbackuprestore"
 	"github.com/mholt/timeliner/datasources/twitter"
 )
@@ -27,22 +30,33 @@ import (
 func init() {
 	flag.StringVar(&configFile, "config", configFile, "The path to the config file to load")
 	flag.StringVar(&repoDir, "repo", repoDir, "The path to the folder of the repository")
+	flag.StringVar(&keyFile, "key-file", keyFile, "The path to the key file of an encrypted repository (or set "+passphraseEnv+" to use a passphrase)")
 	flag.IntVar(&maxRetries, "max-retries", maxRetries, "If > 0, will retry on failure at most this many times")
 	flag.DurationVar(&retryAfter, "retry-after", retryAfter, "If > 0, will wait this long between retries")
 	flag.BoolVar(&verbose, "v", verbose, "Verbose output (can be very slow if data source isn't bottlenecked by network)")
 
-	flag.BoolVar(&prune, "prune", prune, "When finishing, delete items not found on remote (download-all or import only)")
+	flag.BoolVar(&prune, "prune", prune, "When finishing, move items not found on remote to the trash (download-all or import only)")
+	flag.IntVar(&pruneMax, "prune-max", pruneMax, "Abort a prune that would trash more than this percentage of an account's items (download-all or import only)")
 	flag.BoolVar(&integrity, "integrity", integrity, "Perform integrity check on existing items and reprocess if needed (download-all or import only)")
 	flag.BoolVar(&reprocess, "reprocess", reprocess, "Reprocess every item that has not been modified locally (download-all or import only)")
+	flag.IntVar(&workers, "workers", workers, "Number of items to process concurrently (download-all, get-latest, or import only)")
+	flag.IntVar(&batchSize, "batch-size", batchSize, "Maximum number of items to store per database transaction (download-all, get-latest, or import only)")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "Only report what would be added, updated, merged, or pruned without changing anything (download-all, get-latest, or import only)")
 	flag.StringVar(&merge, "merge", merge, "Comma-separated list of merge options: soft (required, enables 'soft' merging on: account+timestamp+text or filename), and values to overwrite: id,text,file,metadata")
 
+	flag.IntVar(&limit, "limit", limit, "Maximum number of results to show (search, history, and trash list only)")
+	flag.StringVar(&outputFile, "out", outputFile, "Output file; .jsonl or an archive such as .zip or .tar.gz (export only; default stdout)")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "The address on which to serve the API (serve only)")
+	flag.BoolVar(&repair, "repair", repair, "Fix the problems that are found, where possible (fsck only)")
+	flag.DurationVar(&interval, "interval", interval, "How often to get the latest items of each account, unless configured otherwise (daemon only)")
+
 	flag.StringVar(&tfStartInput, "start", "", "Timeframe start (relative=duration, absolute=YYYY/MM/DD)")
 	flag.StringVar(&tfEndInput, "end", "", "Timeframe end (relative=duration, absolute=YYYY/MM/DD)")
 
-	flag.BoolVar(&twitterRetweets, "twitter-retweets", twitterRetweets, "Twitter: include retweets")
-	flag.BoolVar(&twitterReplies, "twitter-replies", twitterReplies, "Twitter: include replies that are not just replies to self")
+	flag.BoolVar(&twitterRetweets, "twitter-retweets", twitterRetweets, "Twitter: include retweets (applies to all accounts; prefer the retweets option in the config file)")
+	flag.BoolVar(&twitterReplies, "twitter-replies", twitterReplies, "Twitter: include replies that are not just replies to self (applies to all accounts; prefer the replies option in the config file)")
 
-	flag.StringVar(&phoneDefaultRegion, "phone-default-region", phoneDefaultRegion, "SMS Backup & Restore: default region")
+	flag.StringVar(&phoneDefaultRegion, "phone-default-region", phoneDefaultRegion, "SMS Backup & Restore: default region (applies to all accounts; prefer the default_region option in the config file)")
 }
 
 func main() {
@@ -58,15 +72,64 @@ func main() {
 		log.Fatal("[FATAL] Missing subcommand and account arguments (specify one or more of 'data_source_id/user_id')")
 	}
 	subcmd := args[0]
+
+	// some subcommands open the repository in their own way
+	if standaloneCmd, ok := standaloneCommands[subcmd]; ok {
+		err := loadConfig()
+		if err != nil {
+			log.Fatalf("[FATAL] Loading configuration: %v", err)
+		}
+		err = standaloneCmd(args[1:])
+		if err != nil {
+			log.Fatalf("[FATAL] %s: %v", subcmd, err)
+		}
+		return
+	}
+
+	// some subcommands operate on the whole repository
+	// rather than on a list of accounts
+	if repoCmd, ok := repoCommands[subcmd]; ok {
+		err := loadConfig()
+		if err != nil {
+			log.Fatalf("[FATAL] Loading configuration: %v", err)
+		}
+		readOnly := readOnlyCommands[subcmd]
+		if subcmd == "accounts" && len(args) > 1 && args[1] == "remove" {
+			readOnly = false
+		}
+		tl, err := openTimeline(readOnly)
+		if err != nil {
+			log.Fatalf("[FATAL] Opening timeline: %v", err)
+		}
+		err = repoCmd(tl, args[1:])
+		tl.Close()
+		if err != nil {
+			log.Fatalf("[FATAL] %s: %v", subcmd, err)
+		}
+		return
+	}
+
 	accountList := args[1:]
+	var importExport bool
 	if subcmd == "import" {
 		// special case; import takes an extra argument before account list
-		if len(args) != 3 {
-			log.Fatal("[FATAL] Expecting: import <filename> <data_source_id/user_id>")
-		}
-		accountList = args[2:]
-		if len(args) == 0 {
-			log.Fatal("[FATAL] No accounts to use (specify one or more 'data_source_id/user_id' arguments)")
+		switch len(args) {
+		case 2:
+			// without an account, the file is an export in JSON
+			// Lines whose items go in the accounts they name
+			exported, err := jsonl.Accounts(args[1])
+			if err != nil {
+				log.Fatalf("[FATAL] Reading accounts of export (give the account to import into if it has none): %v", err)
+			}
+			accountList = nil
+			for _, ea := range exported {
+				accountList = append(accountList, ea.String())
+			}
+			importExport = true
+		case 3:
+			accountList = args[2:]
+		default:
+			log.Fatal("[FATAL] Expecting: import <filename> [<data_source_id/user_id>]")
 		}
 	}
 
@@ -76,17 +139,23 @@ func main() {
 		log.Fatalf("[FATAL] Loading configuration: %v", err)
 	}
 
-	// parse the accounts out of the CLI
+	// parse the accounts out of the CLI; if there are none,
+	// some subcommands use the accounts in the config file
 	accounts, err := getAccounts(accountList)
 	if err != nil {
 		log.Fatalf("[FATAL] %v", err)
 	}
+	if len(accounts) == 0 && (subcmd == "get-all" || subcmd == "get-latest" || subcmd == "add-account") {
+		for _, ca := range configuredAccounts {
+			accounts = append(accounts, ca.accountInfo)
+		}
+	}
 	if len(accounts) == 0 {
-		log.Fatalf("[FATAL] No accounts specified")
+		log.Fatalf("[FATAL] No accounts specified (and none are configured)")
 	}
 
 	// open the timeline
-	tl, err := timeliner.Open(repoDir)
+	tl, err := openTimeline(false)
 	if err != nil {
 		log.Fatalf("[FATAL] Opening timeline: %v", err)
 	}
@@ -96,6 +165,12 @@ func main() {
 	switch subcmd {
 	case "add-account":
 		for _, a := range accounts {
+			if len(accountList) == 0 {
+				// configured accounts only need adding once
+				if _, err := tl.Account(a.dataSourceID, a.userID); err == nil {
+					continue
+				}
+			}
 			err := tl.AddAccount(a.dataSourceID, a.userID)
 			if err != nil {
 				log.Fatalf("[FATAL] Adding account: %v", err)
@@ -119,24 +194,9 @@ func main() {
 	}
 
 	// make the processing options
-	var mergeOpt timeliner.MergeOptions
-	mergeOptVals := strings.Split(merge, ",")
-	for _, val := range mergeOptVals {
-		switch val {
-		case "":
-		case "soft":
-			mergeOpt.SoftMerge = true
-		case "id":
-			mergeOpt.PreferNewID = true
-		case "text":
-			mergeOpt.PreferNewDataText = true
-		case "file":
-			mergeOpt.PreferNewDataFile = true
-		case "meta":
-			mergeOpt.PreferNewMetadata = true
-		default:
-			log.Fatalf("[FATAL] Unrecognized merge option: '%s'", val)
-		}
+	mergeOpt, err := mergeOptions()
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
 	}
 	if !mergeOpt.SoftMerge && (mergeOpt.PreferNewID || mergeOpt.PreferNewDataText || mergeOpt.PreferNewDataFile || mergeOpt.PreferNewMetadata) {
 		// for now, the only kind of merging is "soft" merging, so if it is not enabled but other merge options are set, that's probably a user error
@@ -149,28 +209,51 @@ func main() {
 		Timeframe: tf,
 		Merge:     mergeOpt,
 		Verbose:   verbose,
+		Workers:   workers,
+		BatchSize: batchSize,
+		DryRun:    dryRun,
+
+		PruneMaxPercent: pruneMax,
 	}
 
 	// make a client for each account
 	var clients []timeliner.WrappedClient
 	for _, a := range accounts {
-		wc, err := tl.NewClient(a.dataSourceID, a.userID)
+		if importExport {
+			if _, err := tl.Account(a.dataSourceID, a.userID); err != nil && dryRun {
+				log.Printf("[INFO][%s/%s] Account is not in the timeline; all of its items would be new", a.dataSourceID, a.userID)
+				continue
+			}
+			wc, err := tl.ImportClient(a.dataSourceID, a.userID, &jsonl.Client{Account: a.dataSourceID + "/" + a.userID})
+			if err != nil {
+				log.Fatalf("[FATAL][%s/%s] Creating import client: %v", a.dataSourceID, a.userID, err)
+			}
+			clients = append(clients, wc)
+			continue
+		}
+		opts, err := accountOptions(a)
 		if err != nil {
-			log.Fatalf("[FATAL][%s/%s] Creating data source client: %v", a.dataSourceID, a.userID, err)
+			log.Fatalf("[FATAL][%s/%s] %v", a.dataSourceID, a.userID, err)
 		}
-
-		// configure the client (TODO: this is not good design; should happen in their own packages)
-		switch v := wc.Client.(type) {
-		case *twitter.Client:
-			v.Retweets = twitterRetweets
-			v.Replies = twitterReplies
-		case *smsbackuprestore.Client:
-			v.DefaultRegion = phoneDefaultRegion
+		wc, err := tl.NewClientWithOptions(a.dataSourceID, a.userID, opts)
+		if err != nil {
+			log.Fatalf("[FATAL][%s/%s] Creating data source client: %v", a.dataSourceID, a.userID, err)
 		}
-
 		clients = append(clients, wc)
 	}
 
+	// show the progress of each account as items are processed
+	progress := newProgressDisplay(os.Stderr)
+	progress.dryRun = dryRun
+	log.SetOutput(progress)
+	defer progress.done()
+
+	// when interrupted, stop listing items, but finish the
+	// ones in progress and keep the checkpoint, so that
+	// running the command again resumes where it left off
+	ctx, cancel := interruptible("Interrupted; finishing the items in progress")
+	defer cancel()
+
 	switch subcmd {
 	case "get-latest":
 		if procOpt.Reprocess || procOpt.Prune || procOpt.Integrity || procOpt.Timeframe.Since != nil {
@@ -182,23 +265,29 @@ func main() {
 			wg.Add(1)
 			go func(wc timeliner.WrappedClient) {
 				defer wg.Done()
-				ctx, cancel := context.WithCancel(context.Background())
-				for retryNum := 0; retryNum < 1+maxRetries; retryNum++ {
+				opt := procOpt
+				opt.Progress = progress.progressFunc(wc.DataSourceID() + "/" + wc.UserID())
+				for retryNum := 0; retryNum < 1+maxRetries && ctx.Err() == nil; retryNum++ {
 					if retryNum > 0 {
 						log.Println("[INFO] Retrying command")
 					}
-					err := wc.GetLatest(ctx, procOpt)
+					_, err := wc.GetLatest(ctx, opt)
+					if err == timeliner.ErrInterrupted {
+						break
+					}
 					if err != nil {
 						log.Printf("[ERROR][%s/%s] Getting latest: %v",
 							wc.DataSourceID(), wc.UserID(), err)
 						if retryAfter > 0 {
-							time.Sleep(retryAfter)
+							select {
+							case <-time.After(retryAfter):
+							case <-ctx.Done():
+							}
 						}
 						continue
 					}
 					break
 				}
-				defer cancel() // TODO: Make this useful, maybe?
 			}(wc)
 		}
 		wg.Wait()
@@ -209,42 +298,146 @@ func main() {
 			wg.Add(1)
 			go func(wc timeliner.WrappedClient) {
 				defer wg.Done()
-				ctx, cancel := context.WithCancel(context.Background())
-				for retryNum := 0; retryNum < 1+maxRetries; retryNum++ {
+				opt := procOpt
+				opt.Progress = progress.progressFunc(wc.DataSourceID() + "/" + wc.UserID())
+				for retryNum := 0; retryNum < 1+maxRetries && ctx.Err() == nil; retryNum++ {
 					if retryNum > 0 {
 						log.Println("[INFO] Retrying command")
 					}
-					err := wc.GetAll(ctx, procOpt)
+					_, err := wc.GetAll(ctx, opt)
+					if err == timeliner.ErrInterrupted {
+						break
+					}
 					if err != nil {
 						log.Printf("[ERROR][%s/%s] Downloading all: %v",
 							wc.DataSourceID(), wc.UserID(), err)
 						if retryAfter > 0 {
-							time.Sleep(retryAfter)
+							select {
+							case <-time.After(retryAfter):
+							case <-ctx.Done():
+							}
 						}
 						continue
 					}
 					break
 				}
-				defer cancel() // TODO: Make this useful, maybe?
 			}(wc)
 		}
 		wg.Wait()
 
 	case "import":
 		file := args[1]
-		wc := clients[0]
-
-		ctx, cancel := context.WithCancel(context.Background())
-		err = wc.Import(ctx, file, procOpt)
-		if err != nil {
-			log.Printf("[ERROR][%s/%s] Importing: %v",
-				wc.DataSourceID(), wc.UserID(), err)
+		for _, wc := range clients {
+			if ctx.Err() != nil {
+				break
+			}
+			opt := procOpt
+			opt.Progress = progress.progressFunc(wc.DataSourceID() + "/" + wc.UserID())
+			_, err = wc.Import(ctx, file, opt)
+			if err != nil && err != timeliner.ErrInterrupted {
+				log.Printf("[ERROR][%s/%s] Importing: %v",
+					wc.DataSourceID(), wc.UserID(), err)
+			}
 		}
-		defer cancel() // TODO: Make this useful, maybe?
 
 	default:
 		log.Fatalf("[FATAL] Unrecognized subcommand: %s", subcmd)
 	}
+
+	if ctx.Err() != nil {
+		// deferred functions don't run after os.Exit
+		progress.done()
+		tl.Close()
+		log.Println("[INFO] Interrupted; run the same command again to resume")
+		os.Exit(130)
+	}
+}
+
+// interruptible returns a context that is cancelled when the
+// process is interrupted (with Ctrl+C or SIGTERM), after logging
+// stopping, so that work in progress can stop gracefully. If the
+// process is interrupted again, it exits immediately.
+func interruptible(stopping string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sig:
+			log.Printf("[INFO] %s (interrupt again to quit immediately)", stopping)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sig)
+			return
+		}
+		<-sig
+		log.Println("[INFO] Quitting immediately; items being stored may be incomplete")
+		os.Exit(130)
+	}()
+	return ctx, cancel
+}
+
+// repoCommands are subcommands which operate on the
+// repository as a whole instead of a list of accounts.
+var repoCommands = map[string]func(tl *timeliner.Timeline, args []string) error{
+	"search":     search,
+	"export":     export,
+	"site":       site,
+	"serve":      serve,
+	"history":    history,
+	"trash":      trash,
+	"fsck":       fsck,
+	"blobs":      blobs,
+	"backup":     backup,
+	"merge-repo": mergeRepo,
+	"accounts":   accounts,
+	"daemon":     daemon,
+}
+
+// readOnlyCommands are the repoCommands which only read
+// the repository, so they can run while another process
+// is writing to it. Of the accounts subcommands, only
+// remove writes.
+var readOnlyCommands = map[string]bool{
+	"search":   true,
+	"export":   true,
+	"site":     true,
+	"serve":    true,
+	"history":  true,
+	"backup":   true,
+	"accounts": true,
+}
+
+// standaloneCommands are subcommands which open the
+// repository themselves, or make a new one.
+var standaloneCommands = map[string]func(args []string) error{
+	"encrypt": encrypt,
+	"restore": restore,
+}
+
+// mergeOptions returns the merge options
+// given with the -merge flag.
+func mergeOptions() (timeliner.MergeOptions, error) {
+	var mergeOpt timeliner.MergeOptions
+	mergeOptVals := strings.Split(merge, ",")
+	for _, val := range mergeOptVals {
+		switch val {
+		case "":
+		case "soft":
+			mergeOpt.SoftMerge = true
+		case "id":
+			mergeOpt.PreferNewID = true
+		case "text":
+			mergeOpt.PreferNewDataText = true
+		case "file":
+			mergeOpt.PreferNewDataFile = true
+		case "meta":
+			mergeOpt.PreferNewMetadata = true
+		default:
+			return mergeOpt, fmt.Errorf("unrecognized merge option: '%s'", val)
+		}
+	}
+	return mergeOpt, nil
 }
 
 // parseTimeframe parses tfStartInput and/or tfEndInput and returns
@@ -298,6 +491,48 @@ func loadConfig() error {
 	if err != nil {
 		return fmt.Errorf("decoding config file: %v", err)
 	}
+
+	// each data source decodes the options of its accounts
+	// (before checking for unrecognized keys, since options
+	// are not decoded until then)
+	configuredAccounts = nil
+	for i, ac := range cmdConfig.Accounts {
+		if ac.DataSource == "" || ac.UserID == "" {
+			return fmt.Errorf("accounts[%d]: data_source and user_id are required", i)
+		}
+		a := accountInfo{dataSourceID: ac.DataSource, userID: ac.UserID}
+		for _, other := range configuredAccounts {
+			if other.accountInfo == a {
+				return fmt.Errorf("account %s/%s is configured more than once", a.dataSourceID, a.userID)
+			}
+		}
+		opts, err := timeliner.DecodeOptions(a.dataSourceID, func(v interface{}) error {
+			err := decodeFlagOptions(a.dataSourceID, v)
+			if err != nil {
+				return err
+			}
+			return md.PrimitiveDecode(ac.Options, v)
+		})
+		if err != nil {
+			return fmt.Errorf("account %s/%s: %v", a.dataSourceID, a.userID, err)
+		}
+		var every time.Duration
+		if ac.Interval != "" {
+			every, err = time.ParseDuration(ac.Interval)
+			if err != nil {
+				return fmt.Errorf("account %s/%s: interval: %v", a.dataSourceID, a.userID, err)
+			}
+			if every <= 0 {
+				return fmt.Errorf("account %s/%s: interval must be positive", a.dataSourceID, a.userID)
+			}
+		}
+		configuredAccounts = append(configuredAccounts, configuredAccount{
+			accountInfo: a,
+			options:     opts,
+			interval:    every,
+		})
+	}
+
 	if len(md.Undecoded()) > 0 {
 		return fmt.Errorf("unrecognized key(s) in config file: %+v", md.Undecoded())
 	}
@@ -323,6 +558,19 @@ func loadConfig() error {
 		}
 	}
 
+	if cmdConfig.Storage.Type != "" {
+		blobStore, err = cmdConfig.Storage.blobStore()
+		if err != nil {
+			return fmt.Errorf("storage: %v", err)
+		}
+	}
+	if cmdConfig.Credentials.Type != "" {
+		credentialStore, err = cmdConfig.Credentials.credentialStore()
+		if err != nil {
+			return fmt.Errorf("credentials: %v", err)
+		}
+	}
+
 	// TODO: Should this be passed into timeliner.Open() instead?
 	timeliner.OAuth2AppSource = func(providerID string, scopes []string) (oauth2client.App, error) {
 		cfg, ok := oauth2Configs[providerID]
@@ -356,8 +604,83 @@ type accountInfo struct {
 	userID       string
 }
 
+// accountOptions returns the options for the client of account a:
+// those in the config file on top of those given with command line
+// flags, if it is configured there, or else only those of the flags.
+func accountOptions(a accountInfo) (interface{}, error) {
+	for _, ca := range configuredAccounts {
+		if ca.accountInfo == a {
+			return ca.options, nil
+		}
+	}
+	if flagOptions(a.dataSourceID) == "" {
+		return nil, nil
+	}
+	return timeliner.DecodeOptions(a.dataSourceID, func(v interface{}) error {
+		return decodeFlagOptions(a.dataSourceID, v)
+	})
+}
+
+// decodeFlagOptions decodes the options of the data source
+// with the given ID that were set with command line flags
+// into v. Options that an account sets in the config file
+// are decoded after, so that they override the flags.
+func decodeFlagOptions(dataSourceID string, v interface{}) error {
+	opts := flagOptions(dataSourceID)
+	if opts == "" {
+		return nil
+	}
+	_, err := toml.Decode(opts, v)
+	return err
+}
+
+// flagOptions returns the options of the data source with
+// the given ID that were set with command line flags, as
+// TOML. The flags predate options in the config file, and
+// they apply to every account on the data source.
+func flagOptions(dataSourceID string) string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var opts []string
+	switch dataSourceID {
+	case twitter.DataSourceID:
+		if set["twitter-retweets"] {
+			opts = append(opts, fmt.Sprintf("retweets = %t", twitterRetweets))
+		}
+		if set["twitter-replies"] {
+			opts = append(opts, fmt.Sprintf("replies = %t", twitterReplies))
+		}
+	case smsbackuprestore.DataSourceID:
+		if set["phone-default-region"] {
+			opts = append(opts, fmt.Sprintf("default_region = %q", phoneDefaultRegion))
+		}
+	}
+	return strings.Join(opts, "\n")
+}
+
 type commandConfig struct {
-	OAuth2 oauth2Config `toml:"oauth2"`
+	OAuth2      oauth2Config      `toml:"oauth2"`
+	Storage     storageConfig     `toml:"storage"`
+	Credentials credentialsConfig `toml:"credentials"`
+	Accounts    []accountConfig   `toml:"accounts"`
+}
+
+// accountConfig configures an account, so that it can be
+// used without naming it on the command line, and so that
+// its client can have options of its own.
+type accountConfig struct {
+	DataSource string         `toml:"data_source"`
+	UserID     string         `toml:"user_id"`
+	Interval   string         `toml:"interval"` // how often the daemon gets the latest items
+	Options    toml.Primitive `toml:"options"`  // decoded by the data source
+}
+
+// configuredAccount is an account in the config file.
+type configuredAccount struct {
+	accountInfo
+	options  interface{}
+	interval time.Duration // 0 if not configured
 }
 
 type oauth2Config struct {
@@ -375,17 +698,33 @@ type oauth2ProviderConfig struct {
 var (
 	repoDir    = "./timeliner_repo"
 	configFile = "timeliner.toml"
+	keyFile    string
+	blobStore  timeliner.BlobStore // where data files are stored, if not in the repo folder
 	maxRetries int
 	retryAfter time.Duration
 	verbose    bool
 
 	integrity bool
 	prune     bool
+	pruneMax  = timeliner.DefaultPruneMaxPercent
 	reprocess bool
 	merge     string
+	dryRun    bool
+	workers   = timeliner.DefaultWorkers
+	batchSize = timeliner.DefaultBatchSize
+
+	limit      = 20
+	outputFile string
+	listenAddr = "127.0.0.1:8008"
+	repair     bool
+	interval   = time.Hour
 
 	tfStartInput, tfEndInput string
 
+	credentialStore timeliner.CredentialStore // where credentials are stored, if not in the database
+
+	configuredAccounts []configuredAccount // accounts in the config file, in order
+
 	twitterRetweets bool
 	twitterReplies  bool
 
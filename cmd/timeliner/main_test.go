@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/timeliner/datasources/smsbackuprestore"
+	"github.com/mholt/timeliner/datasources/twitter"
+)
+
+// setConfig makes configFile a file with the given contents (or
+// one that doesn't exist, if they are empty) and parses args as
+// the command line flags. Call the returned function to undo it.
+func setConfig(t *testing.T, contents string, args ...string) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfigFile := configFile
+	configFile = filepath.Join(dir, "timeliner.toml")
+	if contents != "" {
+		err := ioutil.WriteFile(configFile, []byte(contents), 0600)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	// only the flags given here are set
+	oldCommandLine := flag.CommandLine
+	oldRetweets, oldReplies, oldRegion := twitterRetweets, twitterReplies, phoneDefaultRegion
+	fs := flag.NewFlagSet("timeliner", flag.ContinueOnError)
+	oldCommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(args); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	flag.CommandLine = fs
+
+	return func() {
+		flag.CommandLine = oldCommandLine
+		twitterRetweets, twitterReplies, phoneDefaultRegion = oldRetweets, oldReplies, oldRegion
+		configFile = oldConfigFile
+		configuredAccounts = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for i, test := range []struct {
+		config    string
+		flags     []string
+		expect    []configuredAccount
+		expectErr string
+	}{
+		{
+			// no config file is fine
+			config: "",
+			expect: nil,
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+interval = "2h"
+[accounts.options]
+retweets = true
+
+[[accounts]]
+data_source = "twitter"
+user_id = "other"
+
+[[accounts]]
+data_source = "smsbackuprestore"
+user_id = "phone"
+[accounts.options]
+default_region = "gb"
+
+[[accounts]]
+data_source = "jsonl"
+user_id = "export"
+`,
+			expect: []configuredAccount{
+				{accountInfo: accountInfo{"twitter", "you"}, options: &twitter.Options{Retweets: true}, interval: 2 * time.Hour},
+				{accountInfo: accountInfo{"twitter", "other"}, options: &twitter.Options{}},
+				{accountInfo: accountInfo{"smsbackuprestore", "phone"}, options: &smsbackuprestore.Options{DefaultRegion: "GB"}},
+				{accountInfo: accountInfo{"jsonl", "export"}, options: nil},
+			},
+		},
+		{
+			// flags apply to every account on their data source,
+			// unless the account sets the same option itself
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+[accounts.options]
+retweets = true
+replies = false
+
+[[accounts]]
+data_source = "twitter"
+user_id = "other"
+
+[[accounts]]
+data_source = "smsbackuprestore"
+user_id = "phone"
+[accounts.options]
+default_region = "GB"
+
+[[accounts]]
+data_source = "smsbackuprestore"
+user_id = "other_phone"
+`,
+			flags: []string{"-twitter-replies", "-phone-default-region=de"},
+			expect: []configuredAccount{
+				{accountInfo: accountInfo{"twitter", "you"}, options: &twitter.Options{Retweets: true}},
+				{accountInfo: accountInfo{"twitter", "other"}, options: &twitter.Options{Replies: true}},
+				{accountInfo: accountInfo{"smsbackuprestore", "phone"}, options: &smsbackuprestore.Options{DefaultRegion: "GB"}},
+				{accountInfo: accountInfo{"smsbackuprestore", "other_phone"}, options: &smsbackuprestore.Options{DefaultRegion: "DE"}},
+			},
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+`,
+			expectErr: "accounts[0]: data_source and user_id are required",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+`,
+			expectErr: "account twitter/you is configured more than once",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "nope"
+user_id = "you"
+`,
+			expectErr: "account nope/you: data source not registered: nope",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+[accounts.options]
+retweet = true
+`,
+			expectErr: "unrecognized key(s) in config file: [accounts.options.retweet]",
+		},
+		{
+			config: `
+colour = "blue"
+`,
+			expectErr: "unrecognized key(s) in config file: [colour]",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "smsbackuprestore"
+user_id = "phone"
+[accounts.options]
+default_region = "USA"
+`,
+			expectErr: "account smsbackuprestore/phone: smsbackuprestore options: default region must be a two-letter region code",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+[accounts.options]
+retweets = "yes"
+`,
+			expectErr: "account twitter/you: twitter options:",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+interval = "soon"
+`,
+			expectErr: "account twitter/you: interval:",
+		},
+		{
+			config: `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+interval = "-1h"
+`,
+			expectErr: "account twitter/you: interval must be positive",
+		},
+	} {
+		undo := setConfig(t, test.config, test.flags...)
+		err := loadConfig()
+		got := configuredAccounts
+		undo()
+
+		if test.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectErr) {
+				t.Errorf("test %d: expected error %q, got %v", i, test.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if len(got) != len(test.expect) {
+			t.Errorf("test %d: expected %d accounts, got %d: %+v", i, len(test.expect), len(got), got)
+			continue
+		}
+		for j, expect := range test.expect {
+			if got[j].accountInfo != expect.accountInfo || got[j].interval != expect.interval ||
+				!reflect.DeepEqual(got[j].options, expect.options) {
+				t.Errorf("test %d: expected account %d to be %+v with options %+v, got %+v with options %+v",
+					i, j, expect, expect.options, got[j], got[j].options)
+			}
+		}
+	}
+}
+
+func TestAccountOptions(t *testing.T) {
+	config := `
+[[accounts]]
+data_source = "twitter"
+user_id = "you"
+[accounts.options]
+retweets = true
+`
+	for i, test := range []struct {
+		flags   []string
+		account accountInfo
+		expect  interface{}
+	}{
+		{
+			account: accountInfo{"twitter", "you"},
+			expect:  &twitter.Options{Retweets: true},
+		},
+		{
+			// accounts that are not configured have no options...
+			account: accountInfo{"twitter", "someone"},
+			expect:  nil,
+		},
+		{
+			// ...other than those of the flags
+			flags:   []string{"-twitter-replies"},
+			account: accountInfo{"twitter", "someone"},
+			expect:  &twitter.Options{Replies: true},
+		},
+		{
+			flags:   []string{"-twitter-replies"},
+			account: accountInfo{"twitter", "you"},
+			expect:  &twitter.Options{Retweets: true, Replies: true},
+		},
+		{
+			flags:   []string{"-twitter-replies"},
+			account: accountInfo{"smsbackuprestore", "phone"},
+			expect:  nil,
+		},
+		{
+			flags:   []string{"-phone-default-region=fr"},
+			account: accountInfo{"smsbackuprestore", "phone"},
+			expect:  &smsbackuprestore.Options{DefaultRegion: "FR"},
+		},
+		{
+			flags:   []string{"-twitter-replies", "-phone-default-region=fr"},
+			account: accountInfo{"jsonl", "export"},
+			expect:  nil,
+		},
+	} {
+		undo := setConfig(t, config, test.flags...)
+		err := loadConfig()
+		var opts interface{}
+		if err == nil {
+			opts, err = accountOptions(test.account)
+		}
+		undo()
+
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.expect) {
+			t.Errorf("test %d: expected options %#v, got %#v", i, test.expect, opts)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mholt/timeliner"
+)
+
+// mergeRepo merges another repository into the timeline.
+func mergeRepo(tl *timeliner.Timeline, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expecting: merge-repo <other-repo>")
+	}
+	mergeOpt, err := mergeOptions()
+	if err != nil {
+		return err
+	}
+
+	// opening a folder that has no repository would make one
+	if _, err := os.Stat(filepath.Join(args[0], "index.db")); err != nil {
+		return fmt.Errorf("no repository in %s: %v", args[0], err)
+	}
+
+	// the other repository is only read from; its data files
+	// are in its own folder, and its credentials in its database
+	other, err := timeliner.OpenWithOptions(args[0], timeliner.Options{ReadOnly: true})
+	if err == timeliner.ErrLocked {
+		var secret []byte
+		secret, err = loadSecret()
+		if err != nil {
+			return err
+		}
+		other, err = timeliner.OpenWithOptions(args[0], timeliner.Options{Secret: secret, ReadOnly: true})
+		if err == timeliner.ErrLocked {
+			err = fmt.Errorf("%v (use -key-file or set %s)", err, passphraseEnv)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("opening other repository: %v", err)
+	}
+	defer other.Close()
+
+	stats, err := tl.MergeRepository(context.Background(), other, timeliner.MergeRepoOptions{
+		Merge:   mergeOpt,
+		Verbose: verbose,
+	})
+	fmt.Printf("Added %d accounts and %d persons.\n", stats.AccountsNew, stats.PersonsNew)
+	fmt.Printf("Items: %d new, %d merged, %d skipped (modified locally), %d failed.\n",
+		stats.ItemsNew, stats.ItemsMerged, stats.ItemsSkipped, stats.ItemsFailed)
+	fmt.Printf("Copied %d data files (%d bytes); %d were incomplete, missing, or corrupt.\n",
+		stats.DataFilesCopied, stats.BytesCopied, stats.DataFilesMissing)
+	fmt.Printf("Added %d relationships and %d collections.\n", stats.Relationships, stats.Collections)
+	if err != nil {
+		return err
+	}
+	if stats.ItemsFailed > 0 {
+		return fmt.Errorf("%d items could not be merged", stats.ItemsFailed)
+	}
+	return nil
+}
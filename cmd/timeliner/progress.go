@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// progressDisplay shows a live progress line for each account
+// being processed. It is also the output of the log, so that
+// log lines can be printed above the progress lines instead of
+// getting mixed up with them. If the output is not a terminal,
+// progress lines are not shown; only a summary at the end.
+type progressDisplay struct {
+	mu       sync.Mutex
+	out      *os.File
+	live     bool
+	accounts []string // in the order they are displayed
+	stats    map[string]timeliner.RunStats
+	drawn    int // number of progress lines on the screen
+	lastDraw time.Time
+	dryRun   bool // if true, the summary describes what would change
+}
+
+func newProgressDisplay(out *os.File) *progressDisplay {
+	info, err := out.Stat()
+	return &progressDisplay{
+		out:   out,
+		live:  err == nil && info.Mode()&os.ModeCharDevice != 0,
+		stats: make(map[string]timeliner.RunStats),
+	}
+}
+
+// progressFunc returns a function that updates the
+// progress of the given account; it is suitable for
+// use as timeliner.ProcessingOptions.Progress.
+func (pd *progressDisplay) progressFunc(account string) func(timeliner.RunStats) {
+	return func(rs timeliner.RunStats) {
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		if _, ok := pd.stats[account]; !ok {
+			pd.accounts = append(pd.accounts, account)
+		}
+		pd.stats[account] = rs
+		// redrawing the screen for every item would slow things down
+		if pd.live && (!rs.Finished.IsZero() || time.Since(pd.lastDraw) > 100*time.Millisecond) {
+			pd.clear()
+			pd.draw()
+		}
+	}
+}
+
+// Write writes p above the progress lines.
+func (pd *progressDisplay) Write(p []byte) (int, error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.clear()
+	n, err := pd.out.Write(p)
+	pd.draw()
+	return n, err
+}
+
+// done removes the progress lines and logs
+// the final stats of each account instead.
+func (pd *progressDisplay) done() {
+	pd.mu.Lock()
+	pd.clear()
+	pd.live = false
+	pd.mu.Unlock()
+
+	if pd.dryRun {
+		log.Println("[INFO] Dry run finished; nothing was changed. Summary of what would change:")
+		for _, account := range pd.accounts {
+			log.Printf("[INFO] %s", formatDryRunStats(account, pd.stats[account]))
+		}
+		return
+	}
+
+	for _, account := range pd.accounts {
+		log.Printf("[INFO] %s", formatRunStats(account, pd.stats[account]))
+	}
+}
+
+func (pd *progressDisplay) clear() {
+	for ; pd.drawn > 0; pd.drawn-- {
+		// move up a line and erase it
+		fmt.Fprint(pd.out, "\x1b[1A\x1b[2K")
+	}
+}
+
+func (pd *progressDisplay) draw() {
+	if !pd.live {
+		return
+	}
+	for _, account := range pd.accounts {
+		fmt.Fprintln(pd.out, formatRunStats(account, pd.stats[account]))
+	}
+	pd.drawn = len(pd.accounts)
+	pd.lastDraw = time.Now()
+}
+
+// formatRunStats formats rs as a line of text. Counts
+// that are zero are left out to keep the line short, as
+// a line that wraps on the terminal can't be redrawn.
+func formatRunStats(account string, rs timeliner.RunStats) string {
+	end := rs.Finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(rs.Started)
+
+	line := fmt.Sprintf("%s: %d items", account, rs.ItemsSeen)
+	for _, count := range []struct {
+		n    int64
+		what string
+	}{
+		{rs.ItemsNew, "new"},
+		{rs.ItemsUpdated, "updated"},
+		{rs.ItemsSkipped, "skipped"},
+		{rs.ItemsMerged, "merged"},
+		{rs.ItemsFailed, "failed"},
+		{rs.ItemsPruned, "pruned"},
+	} {
+		if count.n > 0 {
+			line += fmt.Sprintf(", %d %s", count.n, count.what)
+		}
+	}
+	if rs.BytesDownloaded > 0 {
+		line += fmt.Sprintf(", %s downloaded", formatBytes(rs.BytesDownloaded))
+	}
+	if elapsed > 0 {
+		line += fmt.Sprintf(" (%.0f items/s)", float64(rs.ItemsSeen)/elapsed.Seconds())
+	}
+	return line + " in " + elapsed.Round(100*time.Millisecond).String()
+}
+
+// formatDryRunStats formats rs, the stats of a dry run,
+// as a summary of the changes the run would have made.
+func formatDryRunStats(account string, rs timeliner.RunStats) string {
+	return fmt.Sprintf("%s: %d items listed: +%d new, ~%d updated, %d merged, -%d pruned, %d unchanged, %d failed",
+		account, rs.ItemsSeen, rs.ItemsNew, rs.ItemsUpdated, rs.ItemsMerged,
+		rs.ItemsPruned, rs.ItemsSkipped, rs.ItemsFailed)
+}
+
+// formatBytes formats n as a human-readable size.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+func TestFormatRunStats(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, test := range []struct {
+		rs     timeliner.RunStats
+		expect string
+	}{
+		{
+			rs:     timeliner.RunStats{Started: start, Finished: start.Add(2 * time.Second)},
+			expect: "twitter/me: 0 items (0 items/s) in 2s",
+		},
+		{
+			rs: timeliner.RunStats{ItemsSeen: 10, ItemsNew: 4, ItemsUpdated: 3, ItemsSkipped: 1, ItemsMerged: 1, ItemsFailed: 1,
+				ItemsPruned: 2, BytesDownloaded: 1536, Started: start, Finished: start.Add(2*time.Second + 520*time.Millisecond)},
+			expect: "twitter/me: 10 items, 4 new, 3 updated, 1 skipped, 1 merged, 1 failed, 2 pruned, 1.5 KiB downloaded (4 items/s) in 2.5s",
+		},
+		{
+			// counts that are zero are left out
+			rs:     timeliner.RunStats{ItemsSeen: 5, ItemsSkipped: 5, Started: start, Finished: start.Add(time.Second)},
+			expect: "twitter/me: 5 items, 5 skipped (5 items/s) in 1s",
+		},
+	} {
+		if got := formatRunStats("twitter/me", test.rs); got != test.expect {
+			t.Errorf("test %d: expected %q, got %q", i, test.expect, got)
+		}
+	}
+
+	// runs that are not finished are timed until now
+	got := formatRunStats("twitter/me", timeliner.RunStats{ItemsSeen: 1, Started: time.Now().Add(-time.Minute)})
+	if !strings.HasPrefix(got, "twitter/me: 1 items (0 items/s) in 1m0") {
+		t.Errorf("expected unfinished run to be timed until now, got %q", got)
+	}
+}
+
+func TestFormatDryRunStats(t *testing.T) {
+	rs := timeliner.RunStats{ItemsSeen: 10, ItemsNew: 4, ItemsUpdated: 2, ItemsMerged: 1, ItemsSkipped: 3, ItemsPruned: 5}
+	expect := "twitter/me: 10 items listed: +4 new, ~2 updated, 1 merged, -5 pruned, 3 unchanged, 0 failed"
+	if got := formatDryRunStats("twitter/me", rs); got != expect {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, test := range []struct {
+		n      int64
+		expect string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	} {
+		if got := formatBytes(test.n); got != test.expect {
+			t.Errorf("formatBytes(%d): expected %q, got %q", test.n, test.expect, got)
+		}
+	}
+}
+
+func TestProgressDisplaySummary(t *testing.T) {
+	out, err := ioutil.TempFile("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// progress lines are not drawn if the output is not a terminal
+	pd := newProgressDisplay(out)
+	if pd.live {
+		t.Fatal("expected a file not to be a live display")
+	}
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	pd.progressFunc("twitter/me")(timeliner.RunStats{ItemsSeen: 1, ItemsNew: 1, Started: start})
+	pd.progressFunc("twitter/you")(timeliner.RunStats{ItemsSeen: 2, ItemsSkipped: 2, Started: start, Finished: start.Add(time.Second)})
+	pd.progressFunc("twitter/me")(timeliner.RunStats{ItemsSeen: 3, ItemsNew: 3, Started: start, Finished: start.Add(time.Second)})
+	if pd.drawn != 0 {
+		t.Errorf("expected no progress lines to be drawn, got %d", pd.drawn)
+	}
+
+	// the summary lists each account once, in the order they started
+	var summary strings.Builder
+	pd.dryRun = true
+	log.SetOutput(&summary)
+	pd.done()
+	log.SetOutput(os.Stderr)
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	if len(lines) != 3 ||
+		!strings.Contains(lines[0], "Dry run finished") ||
+		!strings.HasSuffix(lines[1], "twitter/me: 3 items listed: +3 new, ~0 updated, 0 merged, -0 pruned, 0 unchanged, 0 failed") ||
+		!strings.HasSuffix(lines[2], "twitter/you: 2 items listed: +0 new, ~0 updated, 0 merged, -0 pruned, 2 unchanged, 0 failed") {
+		t.Errorf("unexpected dry run summary:\n%s", summary.String())
+	}
+}
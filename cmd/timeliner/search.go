@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mholt/timeliner"
+)
+
+// search runs a full-text search of the timeline
+// and prints the best-matching items.
+func search(tl *timeliner.Timeline, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expecting: search <query>")
+	}
+
+	tf, err := parseTimeframe()
+	if err != nil {
+		return err
+	}
+
+	results, err := tl.Search(context.Background(), timeliner.SearchQuery{
+		Text:   strings.Join(args, " "),
+		Filter: timeliner.ItemQuery{Timeframe: tf},
+		Limit:  limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sr := range results {
+		snippet := strings.Join(strings.Fields(sr.Snippet), " ")
+		fmt.Printf("%s  [item %d]  %s\n", sr.Item.Timestamp.Format("2006/01/02 15:04"), sr.Item.ID, snippet)
+	}
+	if len(results) == 0 {
+		fmt.Println("No matching items.")
+	}
+
+	return nil
+}
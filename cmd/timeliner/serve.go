@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// serve serves the read-only HTTP API over the timeline
+// until the process is interrupted.
+func serve(tl *timeliner.Timeline, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           timeliner.NewAPIHandler(tl),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// shut down gracefully when interrupted, so that the
+	// timeline can be closed after in-flight requests finish
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig)
+		log.Println("[INFO] Shutting down server")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Printf("[ERROR] Shutting down server: %v", err)
+		}
+	}()
+
+	log.Printf("[INFO] Serving API at http://%s/api/", listenAddr)
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+
+	return nil
+}
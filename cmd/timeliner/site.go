@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mholt/timeliner"
+)
+
+// site renders the items of the given accounts (or of all
+// accounts, if none are given) into a static website in
+// the output folder, which is the first argument.
+func site(tl *timeliner.Timeline, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expecting: site <output_folder> [<data_source_id/user_id>...]")
+	}
+	outDir := args[0]
+
+	tf, err := parseTimeframe()
+	if err != nil {
+		return err
+	}
+	filter := timeliner.ItemQuery{Timeframe: tf}
+
+	accounts, err := getAccounts(args[1:])
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		acc, err := tl.Account(a.dataSourceID, a.userID)
+		if err != nil {
+			return err
+		}
+		filter.AccountIDs = append(filter.AccountIDs, acc.ID)
+	}
+
+	err = tl.GenerateSite(context.Background(), outDir, timeliner.SiteOptions{Filter: filter})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Generated site in %s", outDir)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mholt/timeliner"
+	"github.com/mholt/timeliner/s3store"
+)
+
+// storageConfig configures where data files are
+// stored, if not in the folder of the repository.
+type storageConfig struct {
+	Type string `toml:"type"` // "local" or "s3"
+
+	// local
+	Dir string `toml:"dir"`
+
+	// s3
+	Endpoint        string `toml:"endpoint"`
+	Region          string `toml:"region"`
+	Bucket          string `toml:"bucket"`
+	Prefix          string `toml:"prefix"`
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+}
+
+func (sc storageConfig) blobStore() (timeliner.BlobStore, error) {
+	switch sc.Type {
+	case "local":
+		if sc.Dir == "" {
+			return nil, fmt.Errorf("missing dir")
+		}
+		return timeliner.NewLocalStore(sc.Dir), nil
+	case "s3":
+		return s3store.New(s3store.Config{
+			Endpoint:        sc.Endpoint,
+			Region:          sc.Region,
+			Bucket:          sc.Bucket,
+			Prefix:          sc.Prefix,
+			AccessKeyID:     sc.AccessKeyID,
+			SecretAccessKey: sc.SecretAccessKey,
+		})
+	}
+	return nil, fmt.Errorf("unknown type: %s", sc.Type)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mholt/timeliner"
+)
+
+// trash lists, restores, or permanently
+// deletes the items that were pruned.
+func trash(tl *timeliner.Timeline, args []string) error {
+	const usage = "expecting: trash list [<data_source>/<user_id>] | restore <data_source>/<user_id>|<trash_id>... | empty [<data_source>/<user_id>]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) > 2 {
+			return fmt.Errorf(usage)
+		}
+		dataSourceID, userID, err := trashAccount(args[1:])
+		if err != nil {
+			return err
+		}
+		return listTrash(tl, dataSourceID, userID)
+
+	case "restore":
+		if len(args) < 2 {
+			return fmt.Errorf(usage)
+		}
+		trashIDs, err := trashIDsToRestore(tl, args[1:])
+		if err != nil {
+			return err
+		}
+		n, err := tl.RestoreTrash(context.Background(), trashIDs)
+		fmt.Printf("Restored %d items.\n", n)
+		return err
+
+	case "empty":
+		if len(args) > 2 {
+			return fmt.Errorf(usage)
+		}
+		dataSourceID, userID, err := trashAccount(args[1:])
+		if err != nil {
+			return err
+		}
+		n, err := tl.EmptyTrash(context.Background(), dataSourceID, userID)
+		fmt.Printf("Permanently deleted %d items.\n", n)
+		return err
+	}
+
+	return fmt.Errorf(usage)
+}
+
+// trashAccount returns the account given in args, if any.
+func trashAccount(args []string) (dataSourceID, userID string, err error) {
+	if len(args) == 0 {
+		return "", "", nil
+	}
+	accounts, err := getAccounts(args)
+	if err != nil {
+		return "", "", err
+	}
+	return accounts[0].dataSourceID, accounts[0].userID, nil
+}
+
+// trashIDsToRestore returns the trash IDs given in args,
+// or those of all the trashed items of the account
+// given in args.
+func trashIDsToRestore(tl *timeliner.Timeline, args []string) ([]int64, error) {
+	if len(args) == 1 && strings.Contains(args[0], "/") {
+		dataSourceID, userID, err := trashAccount(args)
+		if err != nil {
+			return nil, err
+		}
+		items, err := tl.Trash(context.Background(), dataSourceID, userID, 0)
+		if err != nil {
+			return nil, err
+		}
+		var trashIDs []int64
+		for _, ti := range items {
+			trashIDs = append(trashIDs, ti.ID)
+		}
+		return trashIDs, nil
+	}
+
+	var trashIDs []int64
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad trash ID '%s': %v", arg, err)
+		}
+		trashIDs = append(trashIDs, id)
+	}
+	return trashIDs, nil
+}
+
+func listTrash(tl *timeliner.Timeline, dataSourceID, userID string) error {
+	items, err := tl.Trash(context.Background(), dataSourceID, userID, limit)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("The trash is empty.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACCOUNT\tTRASHED\tTIMESTAMP\tORIGINAL ID\tDATA FILE\tTEXT")
+	for _, ti := range items {
+		dataFile, text := "-", "-"
+		if ti.QuarantinedFile != nil {
+			dataFile = *ti.QuarantinedFile
+		} else if ti.Item.DataFile != nil {
+			dataFile = *ti.Item.DataFile
+		}
+		if ti.Item.DataText != nil {
+			text = strings.Join(strings.Fields(*ti.Item.DataText), " ")
+			if r := []rune(text); len(r) > 40 {
+				text = string(r[:40]) + "…"
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s/%s\t%s\t%s\t%s\t%s\t%s\n",
+			ti.ID, ti.DataSourceID, ti.UserID,
+			ti.Trashed.Format("2006/01/02 15:04:05"),
+			ti.Item.Timestamp.Format("2006/01/02 15:04:05"),
+			ti.Item.OriginalID, dataFile, text)
+	}
+	return w.Flush()
+}
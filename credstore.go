@@ -0,0 +1,349 @@
+package timeliner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CredentialStore stores the credentials of accounts, such as
+// OAuth2 tokens, which are needed to access the accounts on their
+// data sources. Credentials are opaque bytes, and accounts are
+// identified by their data source ID and user ID. By default,
+// credentials are stored in the database of the timeline (encrypted,
+// if the repository is); a different CredentialStore can keep them
+// out of the database, so that it can be shared or backed up without
+// them. A CredentialStore must be safe for concurrent use.
+type CredentialStore interface {
+	// Get returns the credentials of the account, or nil
+	// (and no error) if there are none.
+	Get(dataSourceID, userID string) ([]byte, error)
+
+	// Store stores the credentials of the account,
+	// replacing any that are already stored.
+	Store(dataSourceID, userID string, creds []byte) error
+
+	// Erase deletes the credentials of the account, if any.
+	Erase(dataSourceID, userID string) error
+}
+
+// loadCredentials returns the credentials of acc from the
+// credential store. Credentials that are still in the database
+// from before a different credential store was used are moved
+// into the credential store.
+func (t *Timeline) loadCredentials(acc Account) ([]byte, error) {
+	creds, err := t.creds.Get(acc.DataSourceID, acc.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials of %s: %v", acc, err)
+	}
+	if creds != nil {
+		return creds, nil
+	}
+	if _, ok := t.creds.(dbCredentialStore); ok {
+		return nil, nil
+	}
+	db := dbCredentialStore{t}
+	creds, err = db.Get(acc.DataSourceID, acc.UserID)
+	if err != nil || creds == nil || t.readOnly {
+		return creds, err
+	}
+	err = t.creds.Store(acc.DataSourceID, acc.UserID, creds)
+	if err != nil {
+		return nil, fmt.Errorf("moving credentials of %s out of the database: %v", acc, err)
+	}
+	err = db.Erase(acc.DataSourceID, acc.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// dbCredentialStore stores credentials in the authorization
+// column of the accounts table. This is the default.
+type dbCredentialStore struct {
+	t *Timeline
+}
+
+func (s dbCredentialStore) Get(dataSourceID, userID string) ([]byte, error) {
+	var creds []byte
+	err := s.t.db.QueryRow(`SELECT authorization FROM accounts WHERE data_source_id=? AND user_id=? LIMIT 1`,
+		dataSourceID, userID).Scan(&creds)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying authorization: %v", err)
+	}
+	return s.t.openColumn("authorization", creds)
+}
+
+func (s dbCredentialStore) Store(dataSourceID, userID string, creds []byte) error {
+	_, err := s.t.db.Exec(`UPDATE accounts SET authorization=? WHERE data_source_id=? AND user_id=?`,
+		s.t.sealColumn("authorization", creds), dataSourceID, userID)
+	if err != nil {
+		return fmt.Errorf("storing authorization: %v", err)
+	}
+	return nil
+}
+
+func (s dbCredentialStore) Erase(dataSourceID, userID string) error {
+	_, err := s.t.db.Exec(`UPDATE accounts SET authorization=NULL WHERE data_source_id=? AND user_id=?`,
+		dataSourceID, userID)
+	if err != nil {
+		return fmt.Errorf("erasing authorization: %v", err)
+	}
+	return nil
+}
+
+// NewPassphraseCredentialStore returns a CredentialStore that keeps
+// credentials in the file at filename, encrypted with a key derived
+// from passphrase. If the file does not exist, it is created; if it
+// does, ErrWrongSecret is returned if passphrase does not unlock it.
+func NewPassphraseCredentialStore(filename string, passphrase []byte) (CredentialStore, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase is required")
+	}
+	s := &passphraseCredentialStore{filename: filename}
+	cf, err := s.load()
+	if os.IsNotExist(err) {
+		var key []byte
+		key, cf.Encryption, err = newSealedKey(passphrase, sealedCredentialsKeyAD)
+		if err != nil {
+			return nil, err
+		}
+		s.aead, err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		return s, s.save(cf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := unsealKey(cf.Encryption, passphrase, sealedCredentialsKeyAD)
+	if err != nil {
+		return nil, err
+	}
+	s.aead, err = newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+const sealedCredentialsKeyAD = "timeliner credentials key"
+
+// passphraseCredentialStore is a CredentialStore that keeps
+// credentials encrypted in a file. The file is read again for
+// every operation, since other processes may change it.
+type passphraseCredentialStore struct {
+	filename string
+	aead     cipher.AEAD
+	mu       sync.Mutex
+}
+
+// credentialFile is the contents of the file of a
+// passphraseCredentialStore.
+type credentialFile struct {
+	Encryption  encryptionParams  `json:"encryption"`
+	Credentials map[string][]byte `json:"credentials"` // by account; nonce, then sealed credentials
+}
+
+func (s *passphraseCredentialStore) Get(dataSourceID, userID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	account := dataSourceID + "/" + userID
+	sealed, ok := cf.Credentials[account]
+	if !ok {
+		return nil, nil
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("credentials of %s are malformed", account)
+	}
+	creds, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(account))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting credentials of %s: %v", account, err)
+	}
+	if creds == nil {
+		creds = []byte{}
+	}
+	return creds, nil
+}
+
+func (s *passphraseCredentialStore) Store(dataSourceID, userID string, creds []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cf, err := s.load()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("generating nonce: %v", err)
+	}
+	account := dataSourceID + "/" + userID
+	cf.Credentials[account] = s.aead.Seal(nonce, nonce, creds, []byte(account))
+	return s.save(cf)
+}
+
+func (s *passphraseCredentialStore) Erase(dataSourceID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cf, err := s.load()
+	if err != nil {
+		return err
+	}
+	account := dataSourceID + "/" + userID
+	if _, ok := cf.Credentials[account]; !ok {
+		return nil
+	}
+	delete(cf.Credentials, account)
+	return s.save(cf)
+}
+
+// load reads the file. Errors about a file
+// that doesn't exist satisfy os.IsNotExist.
+func (s *passphraseCredentialStore) load() (credentialFile, error) {
+	cf := credentialFile{Credentials: make(map[string][]byte)}
+	contents, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return cf, err
+	}
+	err = json.Unmarshal(contents, &cf)
+	if err != nil {
+		return cf, fmt.Errorf("decoding credentials file: %v", err)
+	}
+	if cf.Credentials == nil {
+		cf.Credentials = make(map[string][]byte)
+	}
+	return cf, nil
+}
+
+// save writes the file, replacing it only once
+// the new contents are completely written.
+func (s *passphraseCredentialStore) save(cf credentialFile) error {
+	contents, err := json.MarshalIndent(cf, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding credentials file: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(s.filename), 0700)
+	if err != nil {
+		return fmt.Errorf("making folder for credentials file: %v", err)
+	}
+	tmp := s.filename + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("writing credentials file: %v", err)
+	}
+	err = os.Rename(tmp, s.filename)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replacing credentials file: %v", err)
+	}
+	return nil
+}
+
+// NewCommandCredentialStore returns a CredentialStore that runs an
+// external program (a "credential helper") to get, store, and erase
+// credentials, much like the credential helpers of git. The program
+// is run with the given arguments followed by the name of the
+// operation: "get", "store", or "erase". It is given the account on
+// its standard input as lines of attributes, terminated by a blank
+// line:
+//
+//	data_source=<data source ID>
+//	user=<user ID>
+//	credentials=<credentials, base64-encoded; store only>
+//
+// For "get", the program prints the credentials to its standard
+// output as a credentials attribute in the same format, or nothing
+// if it has none. Attributes it doesn't know should be ignored. The
+// operation fails if the program exits with a non-zero status.
+func NewCommandCredentialStore(command string, args ...string) CredentialStore {
+	return commandCredentialStore{command: command, args: args}
+}
+
+// commandCredentialStore is a CredentialStore
+// that runs a credential helper.
+type commandCredentialStore struct {
+	command string
+	args    []string
+}
+
+func (s commandCredentialStore) Get(dataSourceID, userID string) ([]byte, error) {
+	output, err := s.run("get", dataSourceID, userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "credentials=") {
+			creds, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "credentials="))
+			if err != nil {
+				return nil, fmt.Errorf("decoding credentials from %s: %v", s.command, err)
+			}
+			return creds, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading output of %s: %v", s.command, err)
+	}
+	return nil, nil
+}
+
+func (s commandCredentialStore) Store(dataSourceID, userID string, creds []byte) error {
+	_, err := s.run("store", dataSourceID, userID, creds)
+	return err
+}
+
+func (s commandCredentialStore) Erase(dataSourceID, userID string) error {
+	_, err := s.run("erase", dataSourceID, userID, nil)
+	return err
+}
+
+// run runs the credential helper for the operation
+// on the account, and returns its standard output.
+func (s commandCredentialStore) run(operation, dataSourceID, userID string, creds []byte) ([]byte, error) {
+	if strings.ContainsAny(dataSourceID+userID, "\n\x00") {
+		return nil, fmt.Errorf("account %s/%s can't be given to a credential helper", dataSourceID, userID)
+	}
+	input := new(bytes.Buffer)
+	fmt.Fprintf(input, "data_source=%s\nuser=%s\n", dataSourceID, userID)
+	if creds != nil {
+		fmt.Fprintf(input, "credentials=%s\n", base64.StdEncoding.EncodeToString(creds))
+	}
+	input.WriteString("\n")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.command, append(s.args, operation)...)
+	cmd.Stdin = input
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running %s %s: %v", s.command, operation, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,280 @@
+package timeliner
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPassphraseCredentialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "creds", "credentials.json")
+
+	if _, err := NewPassphraseCredentialStore(filename, nil); err == nil {
+		t.Error("expected error without passphrase")
+	}
+
+	// the file is made when the store is
+	store, err := NewPassphraseCredentialStore(filename, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("expected credentials file: %v", err)
+	}
+	testCredentialStoreRoundTrip(t, store)
+
+	// credentials are kept encrypted, and can be read
+	// again by a store opened with the same passphrase
+	err = store.Store(testDataSourceID, "me", []byte("secret token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "secret token") ||
+		strings.Contains(string(contents), base64.StdEncoding.EncodeToString([]byte("secret token"))) {
+		t.Error("expected credentials to be encrypted")
+	}
+	reopened, err := NewPassphraseCredentialStore(filename, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := reopened.Get(testDataSourceID, "me"); err != nil || string(creds) != "secret token" {
+		t.Errorf("expected credentials in reopened store, got %q (err=%v)", creds, err)
+	}
+
+	if _, err := NewPassphraseCredentialStore(filename, []byte("wrong")); err != ErrWrongSecret {
+		t.Errorf("expected ErrWrongSecret, got %v", err)
+	}
+
+	// credentials that were changed, or moved to another
+	// account, can't be decrypted
+	var cf credentialFile
+	if err := json.Unmarshal(contents, &cf); err != nil {
+		t.Fatal(err)
+	}
+	sealed := cf.Credentials[testDataSourceID+"/me"]
+	cf.Credentials[testDataSourceID+"/you"] = sealed
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	cf.Credentials[testDataSourceID+"/me"] = tampered
+	contents, err = json.Marshal(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{"me", "you"} {
+		if creds, err := store.Get(testDataSourceID, userID); err == nil {
+			t.Errorf("expected error getting changed credentials of %s, got %q", userID, creds)
+		}
+	}
+
+	// and a file that is corrupt can't be used at all
+	if err := ioutil.WriteFile(filename, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPassphraseCredentialStore(filename, []byte("passphrase")); err == nil {
+		t.Error("expected error opening corrupt credentials file")
+	}
+	if _, err := store.Get(testDataSourceID, "me"); err == nil {
+		t.Error("expected error getting credentials from corrupt file")
+	}
+}
+
+func TestCommandCredentialStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the credential helper is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the helper keeps the input of each operation so the
+	// protocol can be checked, and fails for the user "fail"
+	helper := filepath.Join(dir, "helper.sh")
+	err = ioutil.WriteFile(helper, []byte(`#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args"
+cat > "$dir/$2.input"
+user=$(sed -n 's/^user=//p' "$dir/$2.input")
+if [ "$user" = "fail" ]; then
+	echo "no access" >&2
+	exit 3
+fi
+case "$2" in
+get)
+	if [ -f "$dir/$user.creds" ]; then
+		echo "other=ignored"
+		echo "credentials=$(cat "$dir/$user.creds")"
+	fi
+	;;
+store)
+	sed -n 's/^credentials=//p' "$dir/$2.input" > "$dir/$user.creds"
+	;;
+erase)
+	rm -f "$dir/$user.creds"
+	;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewCommandCredentialStore(helper, "--flag")
+	testCredentialStoreRoundTrip(t, store)
+
+	readFile := func(name string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	err = store.Store(testDataSourceID, "me", []byte("token\nwith newline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := readFile("args"); args != "--flag store\n" {
+		t.Errorf("expected arguments followed by operation, got %q", args)
+	}
+	expect := "data_source=test\nuser=me\ncredentials=" +
+		base64.StdEncoding.EncodeToString([]byte("token\nwith newline")) + "\n\n"
+	if input := readFile("store.input"); input != expect {
+		t.Errorf("expected store input %q, got %q", expect, input)
+	}
+	if creds, err := store.Get(testDataSourceID, "me"); err != nil || string(creds) != "token\nwith newline" {
+		t.Errorf("expected credentials, got %q (err=%v)", creds, err)
+	}
+	if input := readFile("get.input"); input != "data_source=test\nuser=me\n\n" {
+		t.Errorf("expected get input without credentials, got %q", input)
+	}
+
+	// a helper that fails fails the operation, with its message
+	for _, op := range []func() error{
+		func() error { _, err := store.Get(testDataSourceID, "fail"); return err },
+		func() error { return store.Store(testDataSourceID, "fail", []byte("x")) },
+		func() error { return store.Erase(testDataSourceID, "fail") },
+	} {
+		err := op()
+		if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "no access") {
+			t.Errorf("expected error with exit status and message, got %v", err)
+		}
+	}
+
+	// accounts that can't be written as attributes are refused
+	if err := store.Store(testDataSourceID, "me\ncredentials=x", []byte("x")); err == nil {
+		t.Error("expected error for user ID with newline")
+	}
+
+	if _, err := NewCommandCredentialStore(filepath.Join(dir, "missing")).Get(testDataSourceID, "me"); err == nil {
+		t.Error("expected error running missing helper")
+	}
+}
+
+// testCredentialStoreRoundTrip checks that credentials can be
+// stored in, gotten from, and erased from store, by account.
+func testCredentialStoreRoundTrip(t *testing.T, store CredentialStore) {
+	t.Helper()
+	if creds, err := store.Get(testDataSourceID, "me"); err != nil || creds != nil {
+		t.Errorf("expected no credentials, got %q (err=%v)", creds, err)
+	}
+	for _, userID := range []string{"me", "you"} {
+		err := store.Store(testDataSourceID, userID, []byte("credentials of "+userID))
+		if err != nil {
+			t.Fatalf("storing credentials: %v", err)
+		}
+	}
+	err := store.Store(testDataSourceID, "me", []byte("new credentials"))
+	if err != nil {
+		t.Fatalf("replacing credentials: %v", err)
+	}
+	for userID, expect := range map[string]string{"me": "new credentials", "you": "credentials of you"} {
+		if creds, err := store.Get(testDataSourceID, userID); err != nil || string(creds) != expect {
+			t.Errorf("expected %q for %s, got %q (err=%v)", expect, userID, creds, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Erase(testDataSourceID, "you"); err != nil {
+			t.Errorf("erasing credentials: %v", err)
+		}
+	}
+	if creds, err := store.Get(testDataSourceID, "you"); err != nil || creds != nil {
+		t.Errorf("expected erased credentials to be gone, got %q (err=%v)", creds, err)
+	}
+	if err := store.Erase(testDataSourceID, "me"); err != nil {
+		t.Errorf("erasing credentials: %v", err)
+	}
+}
+
+func TestLoadCredentialsMovesThemOutOfDatabase(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewPassphraseCredentialStore(filepath.Join(dir, "credentials.json"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a read-only timeline can use the credentials, but
+	// leaves them where they are
+	ro, err := OpenWithOptions(tl.repoDir, Options{ReadOnly: true, Credentials: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := ro.Account(testDataSourceID, "me")
+	if err != nil {
+		ro.Close()
+		t.Fatal(err)
+	}
+	creds, err := ro.loadCredentials(acc)
+	ro.Close()
+	if err != nil || string(creds) != "credentials of me" {
+		t.Errorf("expected credentials from database, got %q (err=%v)", creds, err)
+	}
+	if creds, err := store.Get(testDataSourceID, "me"); err != nil || creds != nil {
+		t.Errorf("expected read-only timeline not to store credentials, got %q (err=%v)", creds, err)
+	}
+	if creds, err := (dbCredentialStore{tl}).Get(testDataSourceID, "me"); err != nil || creds == nil {
+		t.Errorf("expected read-only timeline to leave credentials in database, got %q (err=%v)", creds, err)
+	}
+
+	// otherwise they are moved into the credential store
+	tl.creds = store
+	acc, err = tl.Account(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		creds, err := tl.loadCredentials(acc)
+		if err != nil || string(creds) != "credentials of me" {
+			t.Errorf("expected credentials, got %q (err=%v)", creds, err)
+		}
+		if creds, err := store.Get(testDataSourceID, "me"); err != nil || string(creds) != "credentials of me" {
+			t.Errorf("expected credentials in credential store, got %q (err=%v)", creds, err)
+		}
+		if creds, err := (dbCredentialStore{tl}).Get(testDataSourceID, "me"); err != nil || creds != nil {
+			t.Errorf("expected credentials to be gone from database, got %q (err=%v)", creds, err)
+		}
+	}
+}
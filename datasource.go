@@ -11,12 +11,27 @@ import (
 )
 
 func init() {
+	// the first value written by an encoder is preceded by its
+	// type definition, but subsequent values are not; the prefix
+	// that can be trimmed is the difference between the two
 	tdBuf := new(bytes.Buffer)
-	err := gob.NewEncoder(tdBuf).Encode(Metadata{})
+	enc := gob.NewEncoder(tdBuf)
+	err := enc.Encode(Metadata{})
 	if err != nil {
 		log.Fatalf("[FATAL] Unable to gob-encode metadata struct: %v", err)
 	}
-	metadataGobPrefix = tdBuf.Bytes()
+	firstLen := tdBuf.Len()
+	err = enc.Encode(Metadata{})
+	if err != nil {
+		log.Fatalf("[FATAL] Unable to gob-encode metadata struct: %v", err)
+	}
+	valueLen := tdBuf.Len() - firstLen
+	metadataGobPrefix = tdBuf.Bytes()[:firstLen-valueLen]
+	legacyMetadataGobPrefix = tdBuf.Bytes()[:firstLen]
+	metadataTypeID, _, err = splitMetadataMessage(tdBuf.Bytes()[firstLen:])
+	if err != nil {
+		log.Fatalf("[FATAL] Unable to find type ID of metadata struct: %v", err)
+	}
 }
 
 // RegisterDataSource registers ds as a data source.
@@ -102,6 +117,13 @@ type DataSource struct {
 	// returns a type which can facilitate
 	// transactions with the service.
 	NewClient NewClientFn
+
+	// If clients of the service can be
+	// configured, Options is a function
+	// which returns the options for an
+	// account. The options are available
+	// to NewClient from the Account.
+	Options OptionsFn
 }
 
 // authFunc gets the authentication function for this
@@ -139,6 +161,30 @@ type AuthenticateFn func(userID string) ([]byte, error)
 // the account passed in, can interact with a service provider.
 type NewClientFn func(acc Account) (Client, error)
 
+// OptionsFn is a function that returns the options for an account on a
+// service. It should make a new value of its options type (usually a
+// pointer to a struct) with the defaults filled in, then call decode
+// on it to set the options that were configured, and return it. The
+// format of the configured options is up to the caller of decode.
+type OptionsFn func(decode func(v interface{}) error) (interface{}, error)
+
+// DecodeOptions returns the options of the data source with the given ID,
+// as decoded by decode. It returns nil if the data source has no options.
+func DecodeOptions(dataSourceID string, decode func(v interface{}) error) (interface{}, error) {
+	ds, ok := dataSources[dataSourceID]
+	if !ok {
+		return nil, fmt.Errorf("data source not registered: %s", dataSourceID)
+	}
+	if ds.Options == nil {
+		return nil, nil
+	}
+	opts, err := ds.Options(decode)
+	if err != nil {
+		return nil, fmt.Errorf("%s options: %v", dataSourceID, err)
+	}
+	return opts, nil
+}
+
 // Client is a type that can interact with a data source.
 type Client interface {
 	// ListItems lists the items on the account. Items should be
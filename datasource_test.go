@@ -0,0 +1,104 @@
+package timeliner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testOptionsDataSourceID is the ID of a data
+// source whose accounts have options.
+const testOptionsDataSourceID = "test_options"
+
+// testOptions are the options of testOptionsDataSourceID.
+type testOptions struct {
+	Limit int    `json:"limit"`
+	Label string `json:"label"`
+}
+
+func init() {
+	err := RegisterDataSource(DataSource{
+		ID:   testOptionsDataSourceID,
+		Name: "Test With Options",
+		NewClient: func(acc Account) (Client, error) {
+			return new(testClient), nil
+		},
+		Options: func(decode func(v interface{}) error) (interface{}, error) {
+			opt := &testOptions{Limit: 10}
+			err := decode(opt)
+			if err != nil {
+				return nil, err
+			}
+			if opt.Limit <= 0 {
+				return nil, fmt.Errorf("limit must be positive: %d", opt.Limit)
+			}
+			return opt, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	decodeJSON := func(s string) func(v interface{}) error {
+		return func(v interface{}) error { return json.Unmarshal([]byte(s), v) }
+	}
+
+	for i, test := range []struct {
+		dataSourceID string
+		decode       func(v interface{}) error
+		expect       interface{}
+		expectErr    string
+	}{
+		{
+			dataSourceID: testOptionsDataSourceID,
+			decode:       decodeJSON(`{}`),
+			expect:       &testOptions{Limit: 10},
+		},
+		{
+			dataSourceID: testOptionsDataSourceID,
+			decode:       decodeJSON(`{"limit": 3, "label": "mine"}`),
+			expect:       &testOptions{Limit: 3, Label: "mine"},
+		},
+		{
+			dataSourceID: testOptionsDataSourceID,
+			decode:       func(v interface{}) error { return errors.New("unknown key") },
+			expectErr:    "test_options options: unknown key",
+		},
+		{
+			dataSourceID: testOptionsDataSourceID,
+			decode:       decodeJSON(`{"limit": -1}`),
+			expectErr:    "test_options options: limit must be positive: -1",
+		},
+		{
+			// data sources without options don't decode anything
+			dataSourceID: testDataSourceID,
+			decode:       func(v interface{}) error { return errors.New("decoded") },
+			expect:       nil,
+		},
+		{
+			dataSourceID: "nope",
+			decode:       decodeJSON(`{}`),
+			expectErr:    "data source not registered: nope",
+		},
+	} {
+		opts, err := DecodeOptions(test.dataSourceID, test.decode)
+		if test.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectErr) {
+				t.Errorf("test %d: expected error %q, got %v", i, test.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.expect) {
+			t.Errorf("test %d: expected %#v, got %#v", i, test.expect, opts)
+		}
+	}
+}
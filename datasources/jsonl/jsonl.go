@@ -0,0 +1,513 @@
+// Package jsonl implements a Timeliner data source for importing
+// items from files in JSON Lines format, the same format written
+// by `timeliner export`. It lets other programs feed a timeline
+// without implementing a data source of their own, and it can
+// import a timeline that was exported from another repository.
+//
+// Each line of the file is a JSON object with a "type" field and
+// a field of the same name holding the record. Records of these
+// types are recognized; unknown types are skipped:
+//
+//	{"type": "person", "person": {
+//		"id": 1,                // any number unique within the file
+//		"name": "Jane Doe",
+//		"identities": [{"data_source": "twitter", "user_id": "janedoe"}]
+//	}}
+//
+//	{"type": "collection", "collection": {
+//		"account": "twitter/janedoe", // optional
+//		"id": "album1",               // required
+//		"name": "Vacation",
+//		"description": "Summer 2019"
+//	}}
+//
+//	{"type": "item", "item": {
+//		"account": "twitter/janedoe",       // optional
+//		"id": "12345",                      // required; unique within the file
+//		"timestamp": "2019-07-04T12:00:00Z", // required; RFC 3339
+//		"class": "post",       // unknown, image, video, audio, post, location,
+//		                       // email, private_message, or message
+//		"owner": {"user_id": "janedoe", "name": "Jane Doe"},
+//		"person_id": 1,        // used if owner is absent
+//		"text": "Hello world",
+//		"data_file": "data/2019/07/photo.jpg", // relative to the input file
+//		"data_hash": "...",    // base64-encoded SHA-256 of the data file, to verify it
+//		"mime_type": "image/jpeg",
+//		"latitude": 40.7, "longitude": -111.9,
+//		"metadata": {"name": "...", "description": "...", "link": "..."},
+//		"collections": [{"id": "album1", "position": 3}]
+//	}}
+//
+//	{"type": "relationship", "relationship": {
+//		"from_item": {"account": "twitter/janedoe", "id": "12345"},
+//		"to_item": {"account": "twitter/janedoe", "id": "12344"},
+//		"from_person_id": 1,  // either end may be a person instead of an item
+//		"to_person_id": 2,
+//		"label": "reply_to",
+//		"bidirectional": false
+//	}}
+//
+// Accounts are given as "data_source/user_id". Items, collections,
+// and relationships that name an account are only imported into that
+// account; when importing into another account, they are skipped.
+// Those that don't name an account are imported into any account, so
+// their IDs must be unique within the file. To import a file into the
+// accounts it names, adding the accounts that are not in the timeline
+// yet, import it with a Client for each of the accounts that Accounts
+// returns (this is what `timeliner import` does if no account is
+// given). If an item has no owner, the owner is the person with the
+// item's person_id, and if that is not set either, the account owner.
+//
+// Collections are created from the items that name them, using the
+// name and description of the collection record with the same ID and
+// account. Relationships are added after all items have been stored,
+// so they can refer to items anywhere in the file; those whose items
+// or persons are not in the timeline are skipped.
+//
+// To import an archive made by `timeliner export`, extract it and
+// import the timeline.jsonl file at its root.
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// Data source name and ID
+const (
+	DataSourceName = "JSON Lines"
+	DataSourceID   = "jsonl"
+)
+
+var dataSource = timeliner.DataSource{
+	ID:   DataSourceID,
+	Name: DataSourceName,
+	NewClient: func(acc timeliner.Account) (timeliner.Client, error) {
+		return &Client{Account: acc.DataSourceID + "/" + acc.UserID}, nil
+	},
+}
+
+func init() {
+	err := timeliner.RegisterDataSource(dataSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Client implements the timeliner.Client interface.
+type Client struct {
+	// The account being imported into, as "data_source/user_id".
+	// Records that name another account are skipped. If empty,
+	// all records are imported.
+	Account string
+}
+
+// includes returns true if records of the given
+// account are imported by c.
+func (c *Client) includes(account string) bool {
+	return c.Account == "" || account == "" || account == c.Account
+}
+
+// ListItems lists items from the data source. opt.Filename must be non-empty.
+func (c *Client) ListItems(ctx context.Context, itemChan chan<- *timeliner.ItemGraph, opt timeliner.ListingOptions) error {
+	defer close(itemChan)
+
+	if opt.Filename == "" {
+		return fmt.Errorf("filename is required")
+	}
+
+	file, err := os.Open(opt.Filename)
+	if err != nil {
+		return fmt.Errorf("opening data file: %v", err)
+	}
+	defer file.Close()
+
+	l := &listing{
+		dir:         filepath.Dir(opt.Filename),
+		timeframe:   opt.Timeframe,
+		persons:     make(map[int64]timeliner.ExportPerson),
+		collections: make(map[collectionKey]timeliner.ExportCollection),
+	}
+
+	var relationships []timeliner.ExportRelationship
+	var skipped int
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for line := 1; ; line++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		var rec timeliner.ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decoding record %d: %v", line, err)
+		}
+
+		switch rec.Type {
+		case "person":
+			if rec.Person != nil {
+				l.persons[rec.Person.ID] = *rec.Person
+			}
+		case "collection":
+			if rec.Collection != nil && c.includes(rec.Collection.Account) {
+				l.collections[collectionKey{rec.Collection.Account, rec.Collection.ID}] = *rec.Collection
+			}
+		case "item":
+			if rec.Item == nil {
+				continue
+			}
+			if !c.includes(rec.Item.Account) {
+				skipped++
+				continue
+			}
+			ig, err := l.itemGraph(*rec.Item)
+			if err != nil {
+				return fmt.Errorf("record %d: %v", line, err)
+			}
+			if ig != nil {
+				itemChan <- ig
+			}
+		case "relationship":
+			if rec.Relationship != nil && c.includesRelationship(*rec.Relationship) {
+				relationships = append(relationships, *rec.Relationship)
+			}
+		case "account":
+		default:
+			if opt.Verbose {
+				log.Printf("[DEBUG] Skipping record %d with unknown type: %s", line, rec.Type)
+			}
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("[INFO] Skipped %d items of accounts other than %s", skipped, c.Account)
+	}
+
+	// relationships refer to items by their IDs, so they can
+	// only be added once the items have been processed
+	for _, rel := range relationships {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		itemChan <- &timeliner.ItemGraph{
+			Relations: []timeliner.RawRelation{l.rawRelation(rel)},
+		}
+	}
+
+	return nil
+}
+
+// includesRelationship returns true if the items
+// of rel (if any) are imported by c.
+func (c *Client) includesRelationship(rel timeliner.ExportRelationship) bool {
+	for _, ref := range []*timeliner.ExportItemRef{rel.FromItem, rel.ToItem} {
+		if ref != nil && !c.includes(ref.Account) {
+			return false
+		}
+	}
+	return true
+}
+
+// Accounts returns the accounts named in the file, in the order
+// they first appear. It is an error if the file has items that
+// don't name an account, since they could go in any account.
+func Accounts(filename string) ([]timeliner.ExportAccount, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening data file: %v", err)
+	}
+	defer file.Close()
+
+	var accounts []timeliner.ExportAccount
+	seen := make(map[string]struct{})
+	add := func(account string) error {
+		if _, ok := seen[account]; ok {
+			return nil
+		}
+		parts := strings.SplitN(account, "/", 2)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("malformed account: %s", account)
+		}
+		seen[account] = struct{}{}
+		accounts = append(accounts, timeliner.ExportAccount{DataSourceID: parts[0], UserID: parts[1]})
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for line := 1; ; line++ {
+		var rec timeliner.ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding record %d: %v", line, err)
+		}
+
+		switch {
+		case rec.Type == "account" && rec.Account != nil:
+			err = add(rec.Account.String())
+		case rec.Type == "item" && rec.Item != nil:
+			if rec.Item.Account == "" {
+				return nil, fmt.Errorf("record %d: item %s does not name an account", line, rec.Item.ID)
+			}
+			err = add(rec.Item.Account)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", line, err)
+		}
+	}
+
+	return accounts, nil
+}
+
+// listing holds the state of reading a file.
+type listing struct {
+	dir         string
+	timeframe   timeliner.Timeframe
+	persons     map[int64]timeliner.ExportPerson             // by ID in the file
+	collections map[collectionKey]timeliner.ExportCollection // by account and ID
+}
+
+// collectionKey identifies a collection in the file.
+type collectionKey struct {
+	account, id string
+}
+
+// itemGraph returns the graph for ei, or nil if the
+// item is outside the timeframe of the listing.
+func (l *listing) itemGraph(ei timeliner.ExportItem) (*timeliner.ItemGraph, error) {
+	if ei.ID == "" {
+		return nil, fmt.Errorf("item is missing ID")
+	}
+	if ei.Timestamp.IsZero() {
+		return nil, fmt.Errorf("item %s is missing timestamp", ei.ID)
+	}
+	if l.timeframe.Since != nil && ei.Timestamp.Before(*l.timeframe.Since) {
+		return nil, nil
+	}
+	if l.timeframe.Until != nil && !ei.Timestamp.Before(*l.timeframe.Until) {
+		return nil, nil
+	}
+
+	it := &item{ExportItem: ei, dir: l.dir}
+
+	if ei.Owner != nil {
+		it.ownerID, it.ownerName = ei.Owner.UserID, ei.Owner.Name
+	} else if ei.PersonID != 0 {
+		it.ownerID, it.ownerName = l.personUserID(ei.PersonID, accountDataSource(ei.Account))
+	}
+
+	if ei.DataHash != nil {
+		hash, err := base64.StdEncoding.DecodeString(*ei.DataHash)
+		if err != nil {
+			return nil, fmt.Errorf("item %s: decoding data hash: %v", ei.ID, err)
+		}
+		it.dataHash = hash
+	}
+
+	ig := timeliner.NewItemGraph(it)
+	for _, incl := range ei.Collections {
+		coll := timeliner.Collection{
+			OriginalID: incl.ID,
+			Items: []timeliner.CollectionItem{
+				{Item: it, Position: incl.Position},
+			},
+		}
+		ec, ok := l.collections[collectionKey{ei.Account, incl.ID}]
+		if !ok {
+			ec, ok = l.collections[collectionKey{"", incl.ID}]
+		}
+		if ok {
+			coll.Name = ec.Name
+			coll.Description = ec.Description
+		}
+		ig.Collections = append(ig.Collections, coll)
+	}
+
+	return ig, nil
+}
+
+func (l *listing) rawRelation(rel timeliner.ExportRelationship) timeliner.RawRelation {
+	rr := timeliner.RawRelation{
+		Relation: timeliner.Relation{
+			Label:         rel.Label,
+			Bidirectional: rel.Bidirectional,
+		},
+	}
+
+	// persons are identified by their user ID on the
+	// data source of the items they're related to
+	var dataSourceID string
+	if rel.FromItem != nil {
+		rr.FromItemID = rel.FromItem.ID
+		dataSourceID = accountDataSource(rel.FromItem.Account)
+	}
+	if rel.ToItem != nil {
+		rr.ToItemID = rel.ToItem.ID
+		if dataSourceID == "" {
+			dataSourceID = accountDataSource(rel.ToItem.Account)
+		}
+	}
+	if rel.FromPersonID != nil {
+		rr.FromPersonUserID, _ = l.personUserID(*rel.FromPersonID, dataSourceID)
+	}
+	if rel.ToPersonID != nil {
+		rr.ToPersonUserID, _ = l.personUserID(*rel.ToPersonID, dataSourceID)
+	}
+
+	return rr
+}
+
+// personUserID returns the user ID and name of the person with
+// the given ID in the file, preferring their identity on the
+// given data source. If the person is unknown, the ID is empty.
+func (l *listing) personUserID(personID int64, dataSourceID string) (string, string) {
+	p, ok := l.persons[personID]
+	if !ok || len(p.Identities) == 0 {
+		return "", ""
+	}
+	for _, ident := range p.Identities {
+		if ident.DataSourceID == dataSourceID {
+			return ident.UserID, p.Name
+		}
+	}
+	return p.Identities[0].UserID, p.Name
+}
+
+// accountDataSource returns the data source ID
+// of an account in "data_source/user_id" form.
+func accountDataSource(account string) string {
+	if i := strings.Index(account, "/"); i >= 0 {
+		return account[:i]
+	}
+	return ""
+}
+
+// item implements timeliner.Item.
+type item struct {
+	timeliner.ExportItem
+	dir       string
+	ownerID   string
+	ownerName string
+	dataHash  []byte
+}
+
+func (i *item) ID() string {
+	return i.ExportItem.ID
+}
+
+func (i *item) Timestamp() time.Time {
+	return i.ExportItem.Timestamp
+}
+
+func (i *item) Class() timeliner.ItemClass {
+	return timeliner.ParseItemClass(i.ExportItem.Class)
+}
+
+func (i *item) Owner() (*string, *string) {
+	if i.ownerID == "" {
+		return nil, nil
+	}
+	return &i.ownerID, &i.ownerName
+}
+
+func (i *item) DataText() (*string, error) {
+	return i.Text, nil
+}
+
+func (i *item) DataFileName() *string {
+	if i.DataFile == nil || *i.DataFile == "" {
+		return nil
+	}
+	name := path.Base(filepath.ToSlash(*i.DataFile))
+	return &name
+}
+
+func (i *item) DataFileReader() (io.ReadCloser, error) {
+	if i.DataFile == nil || *i.DataFile == "" {
+		return nil, nil
+	}
+	fpath := filepath.FromSlash(*i.DataFile)
+	if !filepath.IsAbs(fpath) {
+		fpath = filepath.Join(i.dir, fpath)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if i.dataHash == nil {
+		return f, nil
+	}
+	return &verifyingReader{ReadCloser: f, h: sha256.New(), name: *i.DataFile, expect: i.dataHash}, nil
+}
+
+// DataFileHash returns the hash that the data source of the item
+// gave for its data file, if it was exported; data_hash is the hash
+// of the file in the timeline, which is only used to verify the file.
+func (i *item) DataFileHash() []byte {
+	if i.ExportItem.Metadata == nil {
+		return nil
+	}
+	return i.ExportItem.Metadata.ServiceHash
+}
+
+func (i *item) DataFileMIMEType() *string {
+	return i.MIMEType
+}
+
+func (i *item) Metadata() (*timeliner.Metadata, error) {
+	if i.ExportItem.Metadata == nil {
+		// the data file hash is stored in the metadata
+		return new(timeliner.Metadata), nil
+	}
+	return i.ExportItem.Metadata, nil
+}
+
+func (i *item) Location() (*timeliner.Location, error) {
+	return &timeliner.Location{
+		Latitude:  i.Latitude,
+		Longitude: i.Longitude,
+	}, nil
+}
+
+// verifyingReader returns an error instead of io.EOF if what
+// was read from it does not have the expected SHA-256 hash.
+type verifyingReader struct {
+	io.ReadCloser
+	h      hash.Hash
+	name   string
+	expect []byte
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	vr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(vr.h.Sum(nil), vr.expect) {
+		return n, fmt.Errorf("data file %s does not match its hash", vr.name)
+	}
+	return n, err
+}
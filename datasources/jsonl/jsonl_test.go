@@ -0,0 +1,364 @@
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/archiver/v3"
+	"github.com/mholt/timeliner"
+)
+
+func TestListItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_jsonl_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "data", "2019"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "data", "2019", "photo.jpg"), []byte("not really a photo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := `{"type":"account","account":{"data_source":"twitter","user_id":"janedoe"}}
+{"type":"collection","collection":{"account":"twitter/janedoe","id":"album1","name":"Vacation"}}
+{"type":"person","person":{"id":1,"name":"Jane Doe","identities":[{"data_source":"twitter","user_id":"janedoe"}]}}
+{"type":"person","person":{"id":2,"name":"John Doe","identities":[{"data_source":"twitter","user_id":"johndoe"}]}}
+{"type":"item","item":{"account":"twitter/janedoe","id":"1","timestamp":"2019-07-04T12:00:00Z","class":"image","person_id":1,"data_file":"data/2019/photo.jpg","metadata":{"description":"fireworks"},"latitude":40.5,"longitude":-111.5,"collections":[{"id":"album1","position":2}]}}
+{"type":"item","item":{"account":"twitter/janedoe","id":"2","timestamp":"2019-07-05T12:00:00Z","class":"post","owner":{"user_id":"johndoe","name":"John"},"text":"Hello"}}
+{"type":"something_new","something_new":{}}
+{"type":"relationship","relationship":{"from_item":{"account":"twitter/janedoe","id":"2"},"to_person_id":1,"label":"reply_to"}}
+`
+	filename := filepath.Join(dir, "timeline.jsonl")
+	err = ioutil.WriteFile(filename, []byte(input), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *timeliner.ItemGraph, 10)
+	err = new(Client).ListItems(context.Background(), ch, timeliner.ListingOptions{Filename: filename})
+	if err != nil {
+		t.Fatalf("listing items: %v", err)
+	}
+	var graphs []*timeliner.ItemGraph
+	for ig := range ch {
+		graphs = append(graphs, ig)
+	}
+	if len(graphs) != 3 {
+		t.Fatalf("expected 3 item graphs, got %d", len(graphs))
+	}
+
+	// the first item has a data file and is in a collection
+	photo := graphs[0].Node
+	if photo.ID() != "1" || photo.Class() != timeliner.ClassImage {
+		t.Errorf("unexpected photo item: id=%s class=%s", photo.ID(), photo.Class())
+	}
+	if ownerID, ownerName := photo.Owner(); ownerID == nil || *ownerID != "janedoe" || *ownerName != "Jane Doe" {
+		t.Errorf("expected photo owner from person 1, got %v %v", ownerID, ownerName)
+	}
+	if name := photo.DataFileName(); name == nil || *name != "photo.jpg" {
+		t.Errorf("expected data file name photo.jpg, got %v", name)
+	}
+	rc, err := photo.DataFileReader()
+	if err != nil {
+		t.Fatalf("opening data file: %v", err)
+	}
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(content) != "not really a photo" {
+		t.Errorf("unexpected data file content: %q (err=%v)", content, err)
+	}
+	if meta, _ := photo.Metadata(); meta == nil || meta.Description != "fireworks" {
+		t.Errorf("expected metadata description, got %+v", meta)
+	}
+	if loc, _ := photo.Location(); loc.Latitude == nil || *loc.Latitude != 40.5 {
+		t.Errorf("expected latitude 40.5, got %+v", loc)
+	}
+	colls := graphs[0].Collections
+	if len(colls) != 1 || colls[0].OriginalID != "album1" || colls[0].Name == nil || *colls[0].Name != "Vacation" ||
+		len(colls[0].Items) != 1 || colls[0].Items[0].Position != 2 {
+		t.Errorf("unexpected collections: %+v", colls)
+	}
+
+	// the second item has an explicit owner and text
+	post := graphs[1].Node
+	if ownerID, _ := post.Owner(); ownerID == nil || *ownerID != "johndoe" {
+		t.Errorf("expected post owner johndoe, got %v", ownerID)
+	}
+	if txt, _ := post.DataText(); txt == nil || *txt != "Hello" {
+		t.Errorf("expected post text, got %v", txt)
+	}
+	if rc, _ := post.DataFileReader(); rc != nil {
+		t.Errorf("expected no data file for post")
+	}
+
+	// relationships come last
+	if graphs[2].Node != nil || len(graphs[2].Relations) != 1 {
+		t.Fatalf("expected a graph with only a relation, got %+v", graphs[2])
+	}
+	rr := graphs[2].Relations[0]
+	if rr.FromItemID != "2" || rr.ToPersonUserID != "janedoe" || rr.Label != "reply_to" || rr.Bidirectional {
+		t.Errorf("unexpected relation: %+v", rr)
+	}
+}
+
+func init() {
+	// a data source of the accounts that are exported and imported
+	// back, so that they are not accounts of this data source
+	err := timeliner.RegisterDataSource(timeliner.DataSource{
+		ID:   "roundtrip",
+		Name: "Round trip",
+		NewClient: func(acc timeliner.Account) (timeliner.Client, error) {
+			return new(Client), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// importAccounts imports filename into the accounts it names.
+func importAccounts(t *testing.T, tl *timeliner.Timeline, filename string) {
+	t.Helper()
+	accounts, err := Accounts(filename)
+	if err != nil {
+		t.Fatalf("reading accounts: %v", err)
+	}
+	for _, acc := range accounts {
+		wc, err := tl.ImportClient(acc.DataSourceID, acc.UserID, &Client{Account: acc.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wc.Import(context.Background(), filename, timeliner.ProcessingOptions{})
+		if err != nil {
+			t.Fatalf("importing %s: %v", acc, err)
+		}
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_jsonl_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), []byte("not really a photo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both accounts have an item with ID 1, and one of them has no items
+	input := `{"type":"account","account":{"data_source":"roundtrip","user_id":"me"}}
+{"type":"account","account":{"data_source":"roundtrip","user_id":"nobody"}}
+{"type":"collection","collection":{"account":"roundtrip/me","id":"album1","name":"Vacation","description":"Summer"}}
+{"type":"person","person":{"id":7,"name":"Me","identities":[{"data_source":"roundtrip","user_id":"me"}]}}
+{"type":"person","person":{"id":8,"name":"You","identities":[{"data_source":"roundtrip","user_id":"you"}]}}
+{"type":"item","item":{"account":"roundtrip/me","id":"1","timestamp":"2019-07-04T12:00:00Z","class":"image","person_id":7,"data_file":"photo.jpg","metadata":{"description":"fireworks"},"latitude":40.5,"longitude":-111.5,"collections":[{"id":"album1","position":2}]}}
+{"type":"item","item":{"account":"roundtrip/me","id":"2","timestamp":"2019-07-05T12:00:00Z","class":"post","person_id":7,"text":"Look"}}
+{"type":"item","item":{"account":"roundtrip/you","id":"1","timestamp":"2019-07-06T12:00:00Z","class":"message","person_id":8,"text":"Nice photo"}}
+{"type":"relationship","relationship":{"from_item":{"account":"roundtrip/me","id":"2"},"to_item":{"account":"roundtrip/me","id":"1"},"label":"attached"}}
+{"type":"relationship","relationship":{"from_item":{"account":"roundtrip/you","id":"1"},"to_person_id":7,"label":"sent_to"}}
+`
+	filename := filepath.Join(dir, "input.jsonl")
+	err = ioutil.WriteFile(filename, []byte(input), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := timeliner.Open(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	importAccounts(t, src, filename)
+
+	// only the items of the account being imported into are imported
+	wc, err := src.ImportClient("roundtrip", "you", &Client{Account: "roundtrip/you"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := wc.Import(context.Background(), filename, timeliner.ProcessingOptions{Reprocess: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ItemsSeen != 1 {
+		t.Errorf("expected 1 item of account to be imported, got %+v", stats)
+	}
+
+	archive := filepath.Join(dir, "export.zip")
+	err = src.ExportArchive(context.Background(), archive, timeliner.ExportOptions{})
+	if err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+	extracted := filepath.Join(dir, "extracted")
+	err = archiver.Unarchive(archive, extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := timeliner.Open(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	importAccounts(t, dst, filepath.Join(extracted, timeliner.ExportArchiveIndex))
+
+	// the timeline that was imported from the export
+	// exports the same as the one it was exported from
+	var expected, got bytes.Buffer
+	_, err = src.Export(context.Background(), &expected, timeliner.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dst.Export(context.Background(), &got, timeliner.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != expected.String() {
+		t.Errorf("expected export of imported timeline to be:\n%s\ngot:\n%s", expected.String(), got.String())
+	}
+	for _, want := range []string{`"user_id":"nobody"`, `"data_source":"roundtrip","user_id":"you"`,
+		`"name":"Vacation","description":"Summer"`, `"label":"attached"`, `"text":"Nice photo"`,
+		`{"from_item":{"account":"roundtrip/you","id":"1"},"to_person_id":1,"label":"sent_to"}`} {
+		if !strings.Contains(got.String(), want) {
+			t.Errorf("expected export of imported timeline to contain %s", want)
+		}
+	}
+
+	results, err := dst.QueryItems(context.Background(), timeliner.ItemQuery{Classes: []timeliner.ItemClass{timeliner.ClassImage}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Items) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(results.Items))
+	}
+	f, err := dst.OpenDataFile(results.Items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "not really a photo" {
+		t.Errorf("unexpected data file content: %q (err=%v)", content, err)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_jsonl_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		input     string
+		expect    []string
+		shouldErr bool
+	}{
+		{
+			input: `{"type":"item","item":{"account":"twitter/b","id":"1"}}
+{"type":"account","account":{"data_source":"twitter","user_id":"a"}}
+{"type":"item","item":{"account":"twitter/a","id":"2"}}
+{"type":"item","item":{"account":"twitter/b","id":"3"}}`,
+			expect: []string{"twitter/b", "twitter/a"},
+		},
+		{
+			input:     `{"type":"item","item":{"id":"1"}}`,
+			shouldErr: true,
+		},
+		{
+			input:     `{"type":"item","item":{"account":"twitter","id":"1"}}`,
+			shouldErr: true,
+		},
+	} {
+		filename := filepath.Join(dir, "input.jsonl")
+		err := ioutil.WriteFile(filename, []byte(test.input), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts, err := Accounts(filename)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("test %d: expected error, got %v", i, accounts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		var got []string
+		for _, acc := range accounts {
+			got = append(got, acc.String())
+		}
+		if strings.Join(got, " ") != strings.Join(test.expect, " ") {
+			t.Errorf("test %d: expected %v, got %v", i, test.expect, got)
+		}
+	}
+}
+
+func TestImportRelationshipsToItemsWithDataFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_jsonl_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// items with data files are stored one at a time while the
+	// relationships after them are batched, so without waiting
+	// for the items, relationships would be processed first
+	const n = 20
+	var input bytes.Buffer
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("photo%d.jpg", i)
+		err := ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte{byte(i)}, 1<<16), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&input, `{"type":"item","item":{"id":"%d","timestamp":"2019-07-04T12:00:%02dZ","class":"image","data_file":"%s"}}`+"\n",
+			i, i, name)
+	}
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&input, `{"type":"relationship","relationship":{"from_item":{"id":"%d"},"to_item":{"id":"%d"},"label":"next"}}`+"\n",
+			i-1, i)
+	}
+	filename := filepath.Join(dir, "input.jsonl")
+	err = ioutil.WriteFile(filename, input.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := timeliner.Open(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	wc, err := tl.ImportClient(DataSourceID, "me", &Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wc.Import(context.Background(), filename, timeliner.ProcessingOptions{Workers: 4, BatchSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	_, err = tl.Export(context.Background(), &out, timeliner.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out.String(), `"label":"next"`); got != n-1 {
+		t.Errorf("expected %d relationships, got %d", n-1, got)
+	}
+}
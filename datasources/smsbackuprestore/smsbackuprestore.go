@@ -10,6 +10,7 @@ import (
 	"hash/fnv"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/mholt/timeliner"
 	"github.com/ttacon/libphonenumber"
@@ -25,10 +26,35 @@ var dataSource = timeliner.DataSource{
 	ID:   DataSourceID,
 	Name: DataSourceName,
 	NewClient: func(acc timeliner.Account) (timeliner.Client, error) {
-		return &Client{account: acc}, nil
+		c := &Client{account: acc}
+		if opt, ok := acc.Options().(*Options); ok {
+			c.DefaultRegion = opt.DefaultRegion
+		}
+		return c, nil
+	},
+	Options: func(decode func(interface{}) error) (interface{}, error) {
+		opt := &Options{DefaultRegion: "US"}
+		err := decode(opt)
+		if err != nil {
+			return nil, err
+		}
+		opt.DefaultRegion = strings.ToUpper(opt.DefaultRegion)
+		if len(opt.DefaultRegion) != 2 {
+			return nil, fmt.Errorf("default region must be a two-letter region code: '%s'", opt.DefaultRegion)
+		}
+		return opt, nil
 	},
 }
 
+// Options configures the client of an account.
+type Options struct {
+	// The region to assume for phone numbers that
+	// do not have an explicit country calling code,
+	// as an ISO 3166-1 alpha-2 region code.
+	// Default: US
+	DefaultRegion string `toml:"default_region"`
+}
+
 func init() {
 	err := timeliner.RegisterDataSource(dataSource)
 	if err != nil {
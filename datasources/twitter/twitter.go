@@ -42,14 +42,34 @@ var dataSource = timeliner.DataSource{
 		if err != nil {
 			return nil, err
 		}
-		return &Client{
+		c := &Client{
 			HTTPClient:    httpClient,
 			acc:           acc,
 			otherAccounts: make(map[string]twitterAccount),
-		}, nil
+		}
+		if opt, ok := acc.Options().(*Options); ok {
+			c.Retweets = opt.Retweets
+			c.Replies = opt.Replies
+		}
+		return c, nil
+	},
+	Options: func(decode func(interface{}) error) (interface{}, error) {
+		opt := new(Options)
+		err := decode(opt)
+		return opt, err
 	},
 }
 
+// Options configures the client of an account.
+type Options struct {
+	// Whether to include retweets.
+	Retweets bool `toml:"retweets"`
+
+	// Whether to include replies to tweets
+	// that are not our own.
+	Replies bool `toml:"replies"`
+}
+
 func init() {
 	err := timeliner.RegisterDataSource(dataSource)
 	if err != nil {
@@ -10,7 +10,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func openDB(dataDir string) (*sql.DB, error) {
+func openDB(dataDir string, readOnly bool) (*sql.DB, error) {
 	var db *sql.DB
 	var err error
 	defer func() {
@@ -19,20 +19,40 @@ func openDB(dataDir string) (*sql.DB, error) {
 		}
 	}()
 
+	dbPath := filepath.Join(dataDir, "index.db")
+
+	// a reader must not take the write lock, nor change anything
+	// (the journal mode is given only because the driver would
+	// change it otherwise); the writer keeps the schema up to date
+	if readOnly {
+		db, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=true&_journal_mode=WAL&_busy_timeout=5000&_query_only=true")
+		if err != nil {
+			return nil, fmt.Errorf("opening database: %v", err)
+		}
+		err = checkSchemaVersion(db)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+
 	err = os.MkdirAll(dataDir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("making data directory: %v", err)
 	}
 
-	dbPath := filepath.Join(dataDir, "index.db")
-
-	db, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=true")
+	// write-ahead logging lets the timeline be read (for example,
+	// by the API server) while another process is writing to it;
+	// transactions take the write lock immediately, because a
+	// transaction that reads before it writes cannot wait for
+	// another writer to finish once it has a read snapshot
+	db, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=true&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %v", err)
 	}
 
-	// ensure DB is provisioned
-	_, err = db.Exec(createDB)
+	// ensure DB is provisioned and its schema is up to date
+	err = migrateDB(db)
 	if err != nil {
 		return nil, fmt.Errorf("setting up database: %v", err)
 	}
@@ -46,6 +66,241 @@ func openDB(dataDir string) (*sql.DB, error) {
 	return db, nil
 }
 
+// loadSetting returns the value of the repository setting
+// with the given key, or an empty string if it is not set.
+func loadSetting(db *sql.DB, key string) (string, error) {
+	var value *string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key=? LIMIT 1`, key).Scan(&value)
+	if err == sql.ErrNoRows || (err == nil && value == nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("loading setting %s: %v", key, err)
+	}
+	return *value, nil
+}
+
+// saveSetting sets the repository setting with the given key.
+func saveSetting(db *sql.DB, key, value string) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)`, key, value)
+	if err != nil {
+		return fmt.Errorf("saving setting %s: %v", key, err)
+	}
+	return nil
+}
+
+// migrateDB brings the schema of db up to date by applying, in
+// order, each migration that has not yet been applied. Each
+// migration is applied in its own transaction. It is an error
+// if the schema is newer than this program knows about, since
+// writing to it could corrupt data.
+func migrateDB(db *sql.DB) error {
+	_, err := db.Exec(createSchemaVersion)
+	if err != nil {
+		return fmt.Errorf("creating schema version table: %v", err)
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("querying schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest version supported by this program (%d); please upgrade",
+			version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err := applyMigration(db, i+1, migrations[i])
+		if err != nil {
+			return fmt.Errorf("migrating schema to version %d (%s): %v", i+1, migrations[i].description, err)
+		}
+	}
+
+	return nil
+}
+
+// checkSchemaVersion returns an error if the schema of db
+// is not the latest version, for when it can't be migrated.
+func checkSchemaVersion(db *sql.DB) error {
+	// databases from before the schema was versioned
+	// have no schema_version table; they are version 0
+	var tables int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type='table' AND name='schema_version'`).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("looking for schema version table: %v", err)
+	}
+	var version int
+	if tables > 0 {
+		err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	}
+	if err != nil {
+		return fmt.Errorf("querying schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest version supported by this program (%d); please upgrade",
+			version, len(migrations))
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("database schema version %d is out of date; open the repository for writing to upgrade it to version %d",
+			version, len(migrations))
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = m.up(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`,
+		version, m.description)
+	if err != nil {
+		return fmt.Errorf("recording schema version: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// migration is a change to the database schema.
+type migration struct {
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// execMigration returns a migration function that executes
+// the given SQL script.
+func execMigration(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+// migrations is the ordered list of changes that make up the
+// database schema; the schema version of a database is the
+// number of these that have been applied to it. To change the
+// schema, append a migration; never modify, remove, or reorder
+// existing ones, since they may have already been applied to
+// existing timelines. (The full-text search index is not part
+// of this list because its availability depends on how the
+// program was built.)
+var migrations = []migration{
+	// timelines created before versioned migrations already
+	// have these tables, which is why they are created only
+	// if they do not exist
+	{description: "initial schema", up: execMigration(createDB)},
+	{description: "add runs table", up: execMigration(createRuns)},
+	{description: "add trash table", up: execMigration(createTrash)},
+	{description: "add prune listing tables", up: execMigration(createPruneListings)},
+	{description: "add settings table and view paths", up: execMigration(createSettings)},
+}
+
+const createRuns = `
+-- A run is a single time that items were downloaded or imported for an account.
+CREATE TABLE "runs" (
+	"id" INTEGER PRIMARY KEY,
+	"account_id" INTEGER NOT NULL,
+	"command" TEXT NOT NULL, -- get-latest, get-all, or import
+	"filename" TEXT, -- the file that was imported, if any
+	"since" INTEGER, -- requested timeframe, if any
+	"until" INTEGER,
+	"options" TEXT, -- processing options, JSON-encoded
+	"started" INTEGER NOT NULL,
+	"finished" INTEGER, -- null if the run is in progress or was killed
+	"items_seen" INTEGER NOT NULL DEFAULT 0,
+	"items_new" INTEGER NOT NULL DEFAULT 0,
+	"items_updated" INTEGER NOT NULL DEFAULT 0,
+	"items_skipped" INTEGER NOT NULL DEFAULT 0,
+	"items_merged" INTEGER NOT NULL DEFAULT 0,
+	"items_failed" INTEGER NOT NULL DEFAULT 0,
+	"items_pruned" INTEGER NOT NULL DEFAULT 0,
+	"bytes_downloaded" INTEGER NOT NULL DEFAULT 0,
+	"error" TEXT, -- null if the run succeeded
+	FOREIGN KEY ("account_id") REFERENCES "accounts"("id") ON DELETE CASCADE
+);
+
+CREATE INDEX "idx_runs_account_id_started" ON "runs"("account_id", "started");
+`
+
+const createTrash = `
+-- Items that are pruned are moved to the trash, from which they can be restored until it is emptied.
+CREATE TABLE "trash" (
+	"id" INTEGER PRIMARY KEY,
+	"trashed" INTEGER NOT NULL, -- timestamp when the item was moved to the trash
+	"item_id" INTEGER NOT NULL, -- row ID the item had in the items table
+	"account_id" INTEGER NOT NULL,
+	"original_id" TEXT NOT NULL,
+	"person_id" INTEGER NOT NULL,
+	"timestamp" INTEGER,
+	"stored" INTEGER NOT NULL,
+	"modified" INTEGER,
+	"class" INTEGER,
+	"mime_type" TEXT,
+	"data_text" TEXT,
+	"data_file" TEXT, -- where the data file was, and is restored to
+	"data_hash" TEXT,
+	"metadata" BLOB,
+	"latitude" REAL,
+	"longitude" REAL,
+	"quarantined_file" TEXT, -- where the data file is in the trash folder, if the item was the only one using it
+	"relationships" TEXT, -- the item's relationships, JSON-encoded
+	"collections" TEXT, -- the item's places in collections, JSON-encoded
+	FOREIGN KEY ("account_id") REFERENCES "accounts"("id") ON DELETE CASCADE
+);
+
+CREATE INDEX "idx_trash_account_id_trashed" ON "trash"("account_id", "trashed");
+`
+
+const createPruneListings = `
+-- A prune listing is a listing of all of an account's items, possibly resumed
+-- across several runs, during which the items that are seen are recorded so that
+-- the items which were not seen can be pruned at the end.
+CREATE TABLE "prune_listings" (
+	"account_id" INTEGER PRIMARY KEY,
+	"started" INTEGER NOT NULL,
+	FOREIGN KEY ("account_id") REFERENCES "accounts"("id") ON DELETE CASCADE
+);
+
+-- The original IDs of the items seen during an account's prune listing.
+CREATE TABLE "prune_seen" (
+	"account_id" INTEGER NOT NULL,
+	"original_id" TEXT NOT NULL,
+	PRIMARY KEY ("account_id", "original_id"),
+	FOREIGN KEY ("account_id") REFERENCES "accounts"("id") ON DELETE CASCADE
+) WITHOUT ROWID;
+`
+
+const createSettings = `
+-- Settings of the repository, such as how data files are stored.
+CREATE TABLE "settings" (
+	"key" TEXT PRIMARY KEY,
+	"value" TEXT
+);
+
+-- In the blobs layout, data files are named by their checksum, so the path they
+-- would have in the canonical layout is kept to make a friendlier view of them.
+ALTER TABLE "items" ADD COLUMN "view_path" TEXT;
+ALTER TABLE "trash" ADD COLUMN "view_path" TEXT;
+`
+
+const createSchemaVersion = `
+-- Each row records a migration that has been applied to the schema.
+CREATE TABLE IF NOT EXISTS "schema_version" (
+	"version" INTEGER PRIMARY KEY,
+	"description" TEXT,
+	"applied" INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+`
+
 const createDB = `
 -- A data source is a content provider, like a cloud photo service, social media site, or exported archive format.
 CREATE TABLE IF NOT EXISTS "data_sources" (
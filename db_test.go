@@ -0,0 +1,124 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createBaselineDB makes an index.db in dir as it was before
+// the schema was versioned: the initial schema (which has not
+// changed since) and no schema_version table.
+func createBaselineDB(t *testing.T, dir string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "index.db")+"?_foreign_keys=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(createDB)
+	if err != nil {
+		t.Fatalf("creating baseline schema: %v", err)
+	}
+	for _, q := range []string{
+		`INSERT INTO data_sources (id, name) VALUES ('` + testDataSourceID + `', 'Test')`,
+		`INSERT INTO accounts (id, data_source_id, user_id) VALUES (1, '` + testDataSourceID + `', 'me')`,
+		`INSERT INTO persons (id, name) VALUES (1, 'Me')`,
+		`INSERT INTO person_identities (person_id, data_source_id, user_id) VALUES (1, '` + testDataSourceID + `', 'me')`,
+		`INSERT INTO items (id, account_id, original_id, person_id, timestamp, class, data_text)
+			VALUES (1, 1, 'item1', 1, 1546300800, 4, 'hello')`,
+	} {
+		_, err := db.Exec(q)
+		if err != nil {
+			t.Fatalf("inserting baseline rows: %v", err)
+		}
+	}
+}
+
+func TestMigrateBaselineDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	createBaselineDB(t, dir)
+
+	// a reader can't upgrade the schema
+	_, err = OpenWithOptions(dir, Options{ReadOnly: true})
+	if err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("expected out-of-date error when opening read-only, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		tl, err := Open(dir)
+		if err != nil {
+			t.Fatalf("opening baseline timeline (time %d): %v", i, err)
+		}
+
+		// each migration is applied exactly once
+		var count, version int
+		err = tl.db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_version`).Scan(&count, &version)
+		if err != nil {
+			tl.Close()
+			t.Fatal(err)
+		}
+		if count != len(migrations) || version != len(migrations) {
+			t.Errorf("expected %d versions up to %d, got %d up to %d", len(migrations), len(migrations), count, version)
+		}
+
+		// the rows from before are still there, with the new columns
+		ir, err := tl.LoadItem(context.Background(), 1)
+		if err != nil {
+			t.Errorf("loading baseline item: %v", err)
+		} else if ir.OriginalID != "item1" || ir.DataText == nil || *ir.DataText != "hello" || ir.ViewPath != nil {
+			t.Errorf("unexpected baseline item: %+v", ir)
+		}
+		for _, table := range []string{"runs", "trash", "prune_listings", "settings"} {
+			_, err := tl.db.Exec(`SELECT COUNT(*) FROM ` + table)
+			if err != nil {
+				t.Errorf("table %s: %v", table, err)
+			}
+		}
+		tl.Close()
+	}
+
+	// once migrated, it can be read
+	tl, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("opening migrated timeline read-only: %v", err)
+	}
+	tl.Close()
+}
+
+func TestNewerSchemaVersion(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{})
+	defer cleanup()
+
+	_, err := tl.db.Exec(`INSERT INTO schema_version (version, description) VALUES (?, 'from the future')`,
+		len(migrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateDB(tl.db)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected migrating a newer schema to fail, got %v", err)
+	}
+	err = checkSchemaVersion(tl.db)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected checking a newer schema to fail, got %v", err)
+	}
+
+	var count int
+	err = tl.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(migrations)+1 {
+		t.Errorf("expected schema versions to be left alone, got %d", count)
+	}
+}
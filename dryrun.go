@@ -0,0 +1,64 @@
+package timeliner
+
+import (
+	"log"
+	"sync"
+)
+
+// dryRunItems keeps track of the items a dry run would have
+// stored, since they aren't actually stored in the database;
+// otherwise an item that is listed more than once would be
+// counted as new every time.
+type dryRunItems struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+// add adds the item ID and reports whether it was already added.
+func (d *dryRunItems) add(originalID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.ids[originalID]
+	d.ids[originalID] = struct{}{}
+	return ok
+}
+
+// dryRunItem is like storeItemFromService, except it only counts
+// and reports what would happen to it without changing anything.
+// Additions are only logged in verbose mode, because there are
+// usually a lot of them; changes to existing items always are.
+// It returns the row ID of the existing item, if any.
+func (wc *WrappedClient) dryRunItem(state *recursiveState, it Item, itemOriginalID string, doingSoftMerge bool, procOpt ProcessingOptions) (int64, error) {
+	var ir ItemRow
+	var seenBefore bool
+	if itemOriginalID != "" {
+		var err error
+		ir, err = wc.loadItemRow(state.db, wc.acc.ID, itemOriginalID)
+		if err != nil {
+			return 0, err
+		}
+		seenBefore = state.dryRun.add(itemOriginalID)
+	}
+
+	switch {
+	case ir.ID == 0 && !seenBefore:
+		state.stats.ItemsNew++
+		if procOpt.Verbose {
+			log.Printf("[INFO] %s: dry run: would add item (item_id=%s timestamp=%s class=%s)",
+				wc.acc, itemOriginalID, it.Timestamp(), it.Class())
+		}
+	case ir.ID == 0 && seenBefore && !procOpt.Reprocess,
+		ir.ID > 0 && !wc.shouldProcessExistingItem(it, ir, doingSoftMerge, procOpt):
+		state.stats.ItemsSkipped++
+	case doingSoftMerge:
+		state.stats.ItemsMerged++
+		log.Printf("[INFO] %s: dry run: would merge item into existing item (item_id=%s item_row_id=%d)",
+			wc.acc, it.ID(), ir.ID)
+	default:
+		state.stats.ItemsUpdated++
+		log.Printf("[INFO] %s: dry run: would update item (item_id=%s item_row_id=%d)",
+			wc.acc, itemOriginalID, ir.ID)
+	}
+
+	return ir.ID, nil
+}
@@ -0,0 +1,186 @@
+package timeliner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotRepo returns the rows of every table in tl's
+// database and the contents of every file in its
+// repository other than the database itself.
+func snapshotRepo(t *testing.T, tl *Timeline) map[string][]string {
+	t.Helper()
+	snapshot := make(map[string][]string)
+
+	var tables []string
+	rows, err := tl.db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		rows, err := tl.db.Query(`SELECT * FROM "` + table + `"`)
+		if err != nil {
+			t.Fatalf("selecting from %s: %v", table, err)
+		}
+		cols, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for rows.Next() {
+			vals := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, fmt.Sprintf("%v", vals))
+		}
+		rows.Close()
+		sort.Strings(values)
+		snapshot["table "+table] = values
+	}
+
+	err = filepath.Walk(tl.repoDir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), "index.db") {
+			return err
+		}
+		contents, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		snapshot["file "+fpath] = []string{string(contents)}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	one := testItem{id: "one", ts: ts, class: ClassPost, text: "one"}
+	two := testItem{id: "two", ts: ts.Add(time.Hour), class: ClassPost, text: "two"}
+	photo := testItem{id: "photo", ts: ts.Add(2 * time.Hour), class: ClassImage, fileName: "photo.jpg", file: "jpeg data"}
+	gone := testItem{id: "gone", ts: ts.Add(3 * time.Hour), class: ClassPost, text: "gone"}
+	four := testItem{id: "four", ts: ts.Add(4 * time.Hour), class: ClassImage, fileName: "four.jpg", file: "more jpeg data"}
+	graphs := func(items ...Item) []*ItemGraph {
+		var igs []*ItemGraph
+		for _, it := range items {
+			igs = append(igs, NewItemGraph(it))
+		}
+		return igs
+	}
+
+	// populate the repository with items, one of them in the
+	// trash, and the checkpoint and prune listing of a run
+	// that was interrupted
+	testGetAll(t, tl, "me", graphs(one, two, photo, gone)...)
+	pruneOpts := ProcessingOptions{Workers: 1, Prune: true, PruneMaxPercent: 50}
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Client = &testClient{graphs: graphs(one, two, photo)}
+	stats, err := wc.GetAll(context.Background(), pruneOpts)
+	if err != nil || stats.ItemsPruned != 1 {
+		t.Fatalf("expected an item to be pruned, got %+v (err=%v)", stats, err)
+	}
+	_, err = testInterrupted(t, tl, "me", graphs(one, two, photo), 0, func(ctx context.Context, wc *WrappedClient) (RunStats, error) {
+		return wc.GetAll(ctx, pruneOpts)
+	})
+	if err != ErrInterrupted {
+		t.Fatalf("expected run to be interrupted, got %v", err)
+	}
+
+	before := snapshotRepo(t, tl)
+	if len(before["table trash"]) != 1 || len(before["table prune_listings"]) != 1 || len(before["table runs"]) != 3 {
+		t.Fatalf("expected populated repository, got %v", before)
+	}
+	if storedCheckpoint(t, tl, wc.acc.ID) == nil {
+		t.Fatal("expected a checkpoint")
+	}
+
+	for i, test := range []struct {
+		po     ProcessingOptions
+		items  []Item
+		expect RunStats
+	}{
+		{
+			// the new item is listed twice, but only new once
+			po:     ProcessingOptions{Prune: true, PruneMaxPercent: 50},
+			items:  []Item{one, two, four, four},
+			expect: RunStats{ItemsSeen: 4, ItemsNew: 1, ItemsSkipped: 3, ItemsPruned: 1},
+		},
+		{
+			po: ProcessingOptions{Reprocess: true, Merge: MergeOptions{SoftMerge: true}},
+			items: []Item{
+				testItem{id: "one again", ts: one.ts, class: ClassPost, text: "one"},
+				two,
+				four,
+				four,
+			},
+			expect: RunStats{ItemsSeen: 4, ItemsNew: 1, ItemsUpdated: 2, ItemsMerged: 1},
+		},
+	} {
+		wc, err := tl.NewClient(testDataSourceID, "me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = &testClient{
+			graphs: graphs(test.items...),
+			afterSend: func(ctx context.Context, i int) {
+				Checkpoint(ctx, []byte("dry run"))
+			},
+		}
+
+		test.po.Workers = 1
+		test.po.DryRun = true
+		stats, err := wc.GetAll(context.Background(), test.po)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		stats.Started, stats.Finished = time.Time{}, time.Time{}
+		if stats != test.expect {
+			t.Errorf("test %d: expected %+v, got %+v", i, test.expect, stats)
+		}
+
+		after := snapshotRepo(t, tl)
+		if !reflect.DeepEqual(before, after) {
+			for key := range after {
+				if !reflect.DeepEqual(before[key], after[key]) {
+					t.Errorf("test %d: dry run changed %s: expected %v, got %v", i, key, before[key], after[key])
+				}
+			}
+			for key := range before {
+				if _, ok := after[key]; !ok {
+					t.Errorf("test %d: dry run removed %s", i, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,925 @@
+package timeliner
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrLocked is returned by Open if the repository is
+// encrypted and no passphrase or key file was given.
+var ErrLocked = errors.New("repository is encrypted; a passphrase or key file is required to open it")
+
+// ErrWrongSecret is returned by Open if the passphrase
+// or key file does not unlock the repository.
+var ErrWrongSecret = errors.New("incorrect passphrase or key file")
+
+// ErrNotEncrypted is returned by Open if a passphrase or
+// key file is given for an existing repository that is not
+// encrypted. Use EnableEncryption to encrypt it.
+var ErrNotEncrypted = errors.New("repository is not encrypted")
+
+// encryptionParams are stored in the settings of an encrypted
+// repository. The key of the repository is random; it is stored
+// sealed with a key derived from the passphrase or key file,
+// so that the secret is needed to unlock it.
+type encryptionParams struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	SealedKey  []byte `json:"sealed_key"` // nonce, then sealed key
+}
+
+const (
+	kdfPBKDF2SHA256 = "pbkdf2-sha256"
+	kdfIterations   = 600000
+	sealedKeyAD     = "timeliner repository key"
+)
+
+// keyring holds the keys of an encrypted repository, each
+// derived from the key of the repository for one purpose.
+type keyring struct {
+	files       []byte      // derives the key of each data file
+	columns     cipher.AEAD // encrypts values in the database
+	columnNonce []byte      // derives the nonces of values from their plaintext
+	hashes      []byte      // keys the checksums of data files
+}
+
+func newKeyring(repoKey []byte) (*keyring, error) {
+	columns, err := newAEAD(deriveKey(repoKey, []byte("timeliner columns")))
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{
+		files:       deriveKey(repoKey, []byte("timeliner data files")),
+		columns:     columns,
+		columnNonce: deriveKey(repoKey, []byte("timeliner column nonces")),
+		hashes:      deriveKey(repoKey, []byte("timeliner data file checksums")),
+	}, nil
+}
+
+// loadKeyring unlocks the keys of the repository with
+// secret. It returns nil if the repository isn't encrypted.
+func loadKeyring(db *sql.DB, secret []byte) (*keyring, error) {
+	val, err := loadSetting(db, "encryption")
+	if err != nil || val == "" {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, ErrLocked
+	}
+	var params encryptionParams
+	err = json.Unmarshal([]byte(val), &params)
+	if err != nil {
+		return nil, fmt.Errorf("decoding encryption parameters: %v", err)
+	}
+	repoKey, err := unsealKey(params, secret, sealedKeyAD)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(repoKey)
+}
+
+// initKeyring makes a new key for the repository, stores it
+// sealed with secret, and returns the keys derived from it.
+func initKeyring(db *sql.DB, secret []byte) (*keyring, error) {
+	repoKey, params, err := newSealedKey(secret, sealedKeyAD)
+	if err != nil {
+		return nil, err
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("encoding encryption parameters: %v", err)
+	}
+	err = saveSetting(db, "encryption", string(paramsJSON))
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(repoKey)
+}
+
+// newSealedKey makes a new random key, and seals it with
+// a key derived from secret so it can be stored.
+func newSealedKey(secret []byte, ad string) ([]byte, encryptionParams, error) {
+	key := make([]byte, 32)
+	salt := make([]byte, 16)
+	nonce := make([]byte, 12)
+	for _, b := range [][]byte{key, salt, nonce} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, encryptionParams{}, fmt.Errorf("generating key: %v", err)
+		}
+	}
+	kek, err := newAEAD(pbkdf2.Key(secret, salt, kdfIterations, 32, sha256.New))
+	if err != nil {
+		return nil, encryptionParams{}, err
+	}
+	return key, encryptionParams{
+		KDF:        kdfPBKDF2SHA256,
+		Iterations: kdfIterations,
+		Salt:       salt,
+		SealedKey:  kek.Seal(nonce, nonce, key, []byte(ad)),
+	}, nil
+}
+
+// unsealKey returns the key sealed by newSealedKey, or
+// ErrWrongSecret if secret is not the one it was sealed with.
+func unsealKey(params encryptionParams, secret []byte, ad string) ([]byte, error) {
+	if params.KDF != kdfPBKDF2SHA256 {
+		return nil, fmt.Errorf("unknown key derivation function: %s", params.KDF)
+	}
+	kek, err := newAEAD(pbkdf2.Key(secret, params.Salt, params.Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	if len(params.SealedKey) < kek.NonceSize() {
+		return nil, fmt.Errorf("malformed encryption parameters")
+	}
+	nonce, sealed := params.SealedKey[:kek.NonceSize()], params.SealedKey[kek.NonceSize():]
+	key, err := kek.Open(nil, nonce, sealed, []byte(ad))
+	if err != nil {
+		return nil, ErrWrongSecret
+	}
+	return key, nil
+}
+
+// encryptNewRepository encrypts the repository with secret
+// if it is empty; otherwise ErrNotEncrypted is returned,
+// since its contents would have to be encrypted first.
+func encryptNewRepository(db *sql.DB, secret []byte) (*keyring, error) {
+	var count int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM accounts) + (SELECT COUNT(*) FROM items)`).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("checking if repository is empty: %v", err)
+	}
+	if count > 0 {
+		return nil, ErrNotEncrypted
+	}
+	_, err = db.Exec(`DROP TABLE IF EXISTS items_fts`)
+	if err != nil {
+		return nil, fmt.Errorf("deleting search index: %v", err)
+	}
+	return initKeyring(db, secret)
+}
+
+// deriveKey derives a key for the given purpose from key.
+func deriveKey(key, purpose []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(purpose)
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("making cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted returns true if the repository is encrypted.
+func (t *Timeline) Encrypted() bool {
+	return t.keys != nil
+}
+
+// newDataHash returns a hash with which checksums of data files
+// are computed: SHA-256, keyed if the repository is encrypted,
+// so that checksums don't reveal which files it contains.
+func (t *Timeline) newDataHash() hash.Hash {
+	return t.keys.newDataHash()
+}
+
+// newDataHash is like Timeline.newDataHash; kr
+// is nil if the repository is not encrypted.
+func (kr *keyring) newDataHash() hash.Hash {
+	if kr != nil {
+		return hmac.New(sha256.New, kr.hashes)
+	}
+	return sha256.New()
+}
+
+// wrapStore returns store, encrypting and decrypting its
+// files; kr is nil if the repository is not encrypted.
+func (kr *keyring) wrapStore(store BlobStore) BlobStore {
+	if kr != nil {
+		return encryptedStore{BlobStore: store, keys: kr}
+	}
+	return store
+}
+
+// columnPrefix begins each encrypted value in the database.
+const columnPrefix = "\x00tle1"
+
+func isSealedColumn(value []byte) bool {
+	return strings.HasPrefix(string(value), columnPrefix)
+}
+
+// sealColumn encrypts value for storage in the given column, if
+// the repository is encrypted. Values are encrypted deterministically
+// (the nonce is derived from the value), so that identical values
+// can still be matched by queries, as when soft merging items.
+func (t *Timeline) sealColumn(column string, value []byte) []byte {
+	if t.keys == nil || value == nil {
+		return value
+	}
+	mac := hmac.New(sha256.New, t.keys.columnNonce)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write(value)
+	nonce := mac.Sum(nil)[:t.keys.columns.NonceSize()]
+	sealed := append([]byte(columnPrefix), nonce...)
+	return t.keys.columns.Seal(sealed, nonce, value, []byte(column))
+}
+
+// openColumn decrypts value from the given column. Values that
+// are not encrypted (which are only found in repositories of
+// which encryption was interrupted) are returned as they are.
+func (t *Timeline) openColumn(column string, value []byte) ([]byte, error) {
+	if t.keys == nil || !isSealedColumn(value) {
+		return value, nil
+	}
+	value = value[len(columnPrefix):]
+	nonceSize := t.keys.columns.NonceSize()
+	if len(value) < nonceSize {
+		return nil, fmt.Errorf("decrypting %s: value is too short", column)
+	}
+	plaintext, err := t.keys.columns.Open(nil, value[:nonceSize], value[nonceSize:], []byte(column))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", column, err)
+	}
+	if plaintext == nil {
+		plaintext = []byte{} // empty, not NULL
+	}
+	return plaintext, nil
+}
+
+// sealText is like sealColumn, but for text values.
+func (t *Timeline) sealText(column string, s *string) interface{} {
+	if t.keys == nil || s == nil {
+		return s
+	}
+	return t.sealColumn(column, []byte(*s))
+}
+
+// openText is like openColumn, but for text values.
+func (t *Timeline) openText(column string, s *string) (*string, error) {
+	if t.keys == nil || s == nil {
+		return s, nil
+	}
+	plaintext, err := t.openColumn(column, []byte(*s))
+	if err != nil {
+		return nil, err
+	}
+	str := string(plaintext)
+	return &str, nil
+}
+
+// plainStore returns the store in which data files
+// are kept, without encrypting or decrypting them.
+func (t *Timeline) plainStore() BlobStore {
+	if es, ok := t.store.(encryptedStore); ok {
+		return es.BlobStore
+	}
+	return t.store
+}
+
+// EnableEncryption encrypts the repository with a new key, which
+// is stored sealed with secret (a passphrase or the contents of a
+// key file); from then on, the secret is required to open it. The
+// text and metadata of items and the authorizations of accounts
+// are encrypted in the database, data files are encrypted in the
+// store, and the checksums of data files are replaced with keyed
+// checksums. The full-text search index can't be encrypted, so it
+// is deleted. If it is interrupted, it can be run again with the
+// same secret to finish. It returns the number of data files that
+// were encrypted.
+func (t *Timeline) EnableEncryption(ctx context.Context, secret []byte) (int, error) {
+	if len(secret) == 0 {
+		return 0, fmt.Errorf("missing passphrase or key file")
+	}
+
+	if t.keys == nil {
+		err := saveSetting(t.db, "encryption_pending", "true")
+		if err != nil {
+			return 0, err
+		}
+		keys, err := initKeyring(t.db, secret)
+		if err != nil {
+			return 0, err
+		}
+		t.keys = keys
+		t.store = encryptedStore{BlobStore: t.store, keys: keys}
+		t.searchable = false
+	} else {
+		pending, err := loadSetting(t.db, "encryption_pending")
+		if err != nil {
+			return 0, err
+		}
+		if pending == "" {
+			return 0, fmt.Errorf("repository is already encrypted")
+		}
+		_, err = loadKeyring(t.db, secret)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the search index would reveal the text of items
+	_, err := t.db.ExecContext(ctx, `DROP TABLE IF EXISTS items_fts`)
+	if err != nil {
+		return 0, fmt.Errorf("deleting search index: %v", err)
+	}
+
+	for _, tc := range []struct {
+		table   string
+		columns []string
+	}{
+		{"items", []string{"data_text", "metadata"}},
+		{"trash", []string{"data_text", "metadata"}},
+		{"accounts", []string{"authorization"}},
+	} {
+		err := t.encryptColumns(ctx, tc.table, tc.columns...)
+		if err != nil {
+			return 0, fmt.Errorf("encrypting %s: %v", tc.table, err)
+		}
+	}
+
+	encrypted, err := t.encryptDataFiles(ctx)
+	if err != nil {
+		return encrypted, err
+	}
+
+	// the plaintext may linger in free pages of the database
+	// and in its write-ahead log until they are overwritten
+	_, err = t.db.ExecContext(ctx, `VACUUM`)
+	if err != nil {
+		return encrypted, fmt.Errorf("vacuuming database: %v", err)
+	}
+	_, err = t.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+	if err != nil {
+		return encrypted, fmt.Errorf("truncating write-ahead log: %v", err)
+	}
+
+	return encrypted, saveSetting(t.db, "encryption_pending", "")
+}
+
+// encryptColumns encrypts the values in the given columns
+// of table that are not encrypted yet, in batches of rows.
+func (t *Timeline) encryptColumns(ctx context.Context, table string, columns ...string) error {
+	const batchSize = 1000
+	type row struct {
+		id     int64
+		values [][]byte
+	}
+
+	var lastRowID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, err := t.db.QueryContext(ctx, `SELECT id, `+strings.Join(columns, ", ")+` FROM `+table+`
+			WHERE id > ? ORDER BY id LIMIT ?`, lastRowID, batchSize)
+		if err != nil {
+			return fmt.Errorf("querying rows: %v", err)
+		}
+		var batch []row
+		for rows.Next() {
+			r := row{values: make([][]byte, len(columns))}
+			dest := []interface{}{&r.id}
+			for i := range r.values {
+				dest = append(dest, &r.values[i])
+			}
+			err := rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("scanning row: %v", err)
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("iterating rows: %v", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		tx, err := t.db.Begin()
+		if err != nil {
+			return fmt.Errorf("beginning transaction: %v", err)
+		}
+		for _, r := range batch {
+			for i, column := range columns {
+				if r.values[i] == nil || isSealedColumn(r.values[i]) {
+					continue
+				}
+				_, err := tx.Exec(`UPDATE `+table+` SET `+column+`=? WHERE id=?`,
+					t.sealColumn(column, r.values[i]), r.id)
+				if err != nil {
+					tx.Rollback()
+					return fmt.Errorf("updating %s: %v (id=%d)", column, err, r.id)
+				}
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("committing transaction: %v", err)
+		}
+
+		lastRowID = batch[len(batch)-1].id
+	}
+}
+
+// encryptingSuffix is appended to the name of a data file
+// to name its encrypted copy while it is being written.
+const encryptingSuffix = ".timeliner_encrypting"
+
+// encryptDataFiles encrypts the files in the data, blobs, and
+// trash folders that are not encrypted yet. It returns the
+// number of files that were encrypted.
+func (t *Timeline) encryptDataFiles(ctx context.Context) (int, error) {
+	plain := t.plainStore()
+
+	var names []string
+	for _, folder := range []string{"data", blobsFolder, trashFolder} {
+		err := plain.List(folder, func(name string, _ os.FileInfo) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("listing %s folder: %v", folder, err)
+		}
+	}
+
+	var encrypted int
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return encrypted, err
+		}
+		if strings.HasSuffix(name, encryptingSuffix) {
+			// left behind by an interrupted run, unless
+			// it was already used when its file was
+			err := plain.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				return encrypted, fmt.Errorf("removing partly encrypted file: %v", err)
+			}
+			continue
+		}
+		ok, err := t.encryptDataFile(name)
+		if err != nil {
+			return encrypted, fmt.Errorf("%s: %v", name, err)
+		}
+		if ok {
+			encrypted++
+		}
+	}
+
+	return encrypted, nil
+}
+
+// encryptDataFile encrypts the file with the given name, if it
+// isn't encrypted yet, and updates the items that use it with
+// its keyed checksum. Blobs are renamed by their keyed checksum,
+// unless their contents don't match their name (which fsck will
+// find). It returns false if the file was already encrypted.
+func (t *Timeline) encryptDataFile(name string) (bool, error) {
+	plain := t.plainStore()
+
+	f, err := plain.Open(name)
+	if err != nil {
+		return false, err
+	}
+	magic := make([]byte, len(fileMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == nil && string(magic) == fileMagic {
+		f.Close()
+		return false, nil
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return false, fmt.Errorf("reading file: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return false, fmt.Errorf("seeking to start of file: %v", err)
+	}
+
+	// write the encrypted copy next to the file, computing
+	// its old and new checksums along the way
+	tmp := name + encryptingSuffix
+	err = plain.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return false, fmt.Errorf("removing partly encrypted file: %v", err)
+	}
+	w, err := t.store.Create(tmp)
+	if err != nil {
+		f.Close()
+		return false, fmt.Errorf("creating encrypted file: %v", err)
+	}
+	oldHash, newHash := sha256.New(), t.newDataHash()
+	_, err = io.Copy(w, io.TeeReader(f, io.MultiWriter(oldHash, newHash)))
+	f.Close()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		plain.Remove(tmp)
+		return false, fmt.Errorf("encrypting file: %v", err)
+	}
+	oldB64 := base64.StdEncoding.EncodeToString(oldHash.Sum(nil))
+	newB64 := base64.StdEncoding.EncodeToString(newHash.Sum(nil))
+
+	newName := name
+	if isBlob(name) && !strings.HasPrefix(name, blobsTmpFolder+"/") {
+		if expected, err := blobPath(oldB64); err == nil && expected == name {
+			newName, err = blobPath(newB64)
+			if err != nil {
+				plain.Remove(tmp)
+				return false, err
+			}
+		}
+	}
+
+	// the items are updated before the file is replaced; if we
+	// are interrupted in between, the file is simply encrypted
+	// again next time and the update matches nothing
+	err = t.useEncryptedDataFile(name, newName, oldB64, newB64)
+	if err != nil {
+		plain.Remove(tmp)
+		return false, err
+	}
+
+	if newName == name {
+		err = plain.Rename(tmp, name)
+		if err != nil {
+			return false, fmt.Errorf("replacing file with encrypted file: %v", err)
+		}
+		return true, nil
+	}
+	if t.datafileExists(newName) {
+		err = plain.Remove(tmp)
+	} else {
+		err = plain.Rename(tmp, newName)
+	}
+	if err != nil {
+		return false, fmt.Errorf("storing encrypted blob: %v", err)
+	}
+	err = plain.Remove(name)
+	if err != nil {
+		return false, fmt.Errorf("removing unencrypted blob: %v", err)
+	}
+	return true, nil
+}
+
+// useEncryptedDataFile updates the items and trashed items that
+// use the data file oldName to use newName instead, and replaces
+// the file's checksum oldHash with newHash where they have it.
+// Files of trashed items that are quarantined in the trash folder
+// are restored to blobs named by their checksum, so the blob
+// names of those items are updated as well.
+func (t *Timeline) useEncryptedDataFile(oldName, newName, oldHash, newHash string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE items SET data_file=?,
+		data_hash=CASE WHEN data_hash=? THEN ? ELSE data_hash END
+		WHERE data_file=?`, newName, oldHash, newHash, oldName)
+	if err != nil {
+		return fmt.Errorf("updating items: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE trash SET data_file=?,
+		data_hash=CASE WHEN data_hash=? THEN ? ELSE data_hash END
+		WHERE data_file=? AND quarantined_file IS NULL`, newName, oldHash, newHash, oldName)
+	if err != nil {
+		return fmt.Errorf("updating trashed items: %v", err)
+	}
+
+	oldBlob, err := blobPath(oldHash)
+	if err != nil {
+		return err
+	}
+	newBlob, err := blobPath(newHash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE trash SET
+		data_file=CASE WHEN data_file=? THEN ? ELSE data_file END,
+		data_hash=CASE WHEN data_hash=? THEN ? ELSE data_hash END
+		WHERE quarantined_file=?`, oldBlob, newBlob, oldHash, newHash, oldName)
+	if err != nil {
+		return fmt.Errorf("updating quarantined files of trashed items: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// Encrypted data files begin with fileMagic and a random salt,
+// from which the key of the file is derived. The contents
+// follow in chunks of fileChunkSize bytes (the last chunk may
+// be shorter), each sealed separately so that the file can be
+// read from any offset. Each chunk's nonce is its index, and
+// the last chunk is marked in its nonce, so that a truncated
+// file can't be mistaken for a complete one.
+const (
+	fileMagic      = "\x89TLENC1\n"
+	fileSaltSize   = 16
+	fileHeaderSize = len(fileMagic) + fileSaltSize
+	fileChunkSize  = 64 * 1024
+	fileTagSize    = 16
+)
+
+// errCannotDecrypt is the error of an *os.PathError that is
+// returned when reading a data file that can't be decrypted.
+var errCannotDecrypt = errors.New("data file is corrupt or was not encrypted with the key of this repository")
+
+// isDecryptError returns true if err was returned because
+// a data file could not be decrypted.
+func isDecryptError(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == errCannotDecrypt
+}
+
+func (kr *keyring) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	return newAEAD(deriveKey(kr.files, salt))
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedStore is the BlobStore of an encrypted repository;
+// it encrypts data files before they are stored in the
+// underlying BlobStore and decrypts them when they are read.
+type encryptedStore struct {
+	BlobStore
+	keys *keyring
+}
+
+func (es encryptedStore) Create(name string) (io.WriteCloser, error) {
+	salt := make([]byte, fileSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %v", err)
+	}
+	aead, err := es.keys.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	w, err := es.BlobStore.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append([]byte(fileMagic), salt...))
+	if err != nil {
+		w.Close()
+		es.BlobStore.Remove(name)
+		return nil, err
+	}
+	return &encryptingWriter{w: w, aead: aead, buf: make([]byte, 0, fileChunkSize)}, nil
+}
+
+func (es encryptedStore) Open(name string) (BlobFile, error) {
+	f, err := es.BlobStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	df, err := es.keys.decryptFile(f, name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+func (es encryptedStore) Stat(name string) (os.FileInfo, error) {
+	info, err := es.BlobStore.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plaintextFileInfo{info}, nil
+}
+
+func (es encryptedStore) List(folder string, fn func(name string, info os.FileInfo) error) error {
+	return es.BlobStore.List(folder, func(name string, info os.FileInfo) error {
+		return fn(name, plaintextFileInfo{info})
+	})
+}
+
+// plaintextFileInfo describes an encrypted
+// file by the size of its plaintext.
+type plaintextFileInfo struct {
+	os.FileInfo
+}
+
+func (fi plaintextFileInfo) Size() int64 {
+	_, size := fileChunks(fi.FileInfo.Size())
+	return size
+}
+
+// fileChunks returns the number of chunks in an encrypted
+// file of the given size, and the size of its plaintext.
+// If the size is impossible, the number of chunks is 0.
+func fileChunks(encryptedSize int64) (chunks, size int64) {
+	n := encryptedSize - int64(fileHeaderSize)
+	chunks = (n + fileChunkSize + fileTagSize - 1) / (fileChunkSize + fileTagSize)
+	if chunks <= 0 || n-(chunks-1)*(fileChunkSize+fileTagSize) < fileTagSize {
+		return 0, 0
+	}
+	return chunks, n - chunks*fileTagSize
+}
+
+// encryptingWriter encrypts a data file as it is written.
+type encryptingWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	buf    []byte // plaintext of the chunk being written
+	sealed []byte
+	chunk  int64 // index of the chunk being written
+	err    error
+	closed bool
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if ew.err != nil {
+			return n, ew.err
+		}
+		// a full chunk isn't sealed until more is written,
+		// since the last chunk is sealed differently
+		if len(ew.buf) == fileChunkSize {
+			ew.err = ew.seal(false)
+			continue
+		}
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, ew.err
+}
+
+func (ew *encryptingWriter) seal(last bool) error {
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], chunkNonce(ew.chunk, last), ew.buf, nil)
+	ew.buf = ew.buf[:0]
+	ew.chunk++
+	_, err := ew.w.Write(ew.sealed)
+	return err
+}
+
+// Close seals the last chunk and closes the file.
+func (ew *encryptingWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	err := ew.err
+	if err == nil {
+		err = ew.seal(true)
+	}
+	if cerr := ew.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// decryptingFile decrypts a data file as it is read.
+type decryptingFile struct {
+	f             BlobFile
+	name          string
+	aead          cipher.AEAD
+	encryptedSize int64
+	size          int64 // size of the plaintext
+	chunks        int64
+	offset        int64  // offset of the next read in the plaintext
+	chunk         int64  // index of the chunk in buf, or -1
+	buf           []byte // plaintext of a chunk
+	sealed        []byte
+}
+
+func (kr *keyring) decryptFile(f BlobFile, name string) (*decryptingFile, error) {
+	cannotDecrypt := &os.PathError{Op: "decrypt", Path: name, Err: errCannotDecrypt}
+
+	header := make([]byte, fileHeaderSize)
+	_, err := io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, cannotDecrypt
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(fileMagic)]) != fileMagic {
+		return nil, cannotDecrypt
+	}
+	aead, err := kr.fileAEAD(header[len(fileMagic):])
+	if err != nil {
+		return nil, err
+	}
+	encryptedSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	chunks, size := fileChunks(encryptedSize)
+	if chunks == 0 {
+		return nil, cannotDecrypt
+	}
+	return &decryptingFile{
+		f:             f,
+		name:          name,
+		aead:          aead,
+		encryptedSize: encryptedSize,
+		size:          size,
+		chunks:        chunks,
+		chunk:         -1,
+	}, nil
+}
+
+func (df *decryptingFile) Read(p []byte) (int, error) {
+	if df.offset >= df.size {
+		return 0, io.EOF
+	}
+	index := df.offset / fileChunkSize
+	if index != df.chunk {
+		err := df.load(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, df.buf[df.offset-index*fileChunkSize:])
+	df.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts the chunk with the given index.
+func (df *decryptingFile) load(index int64) error {
+	df.chunk = -1
+	start := int64(fileHeaderSize) + index*(fileChunkSize+fileTagSize)
+	end := start + fileChunkSize + fileTagSize
+	if end > df.encryptedSize {
+		end = df.encryptedSize
+	}
+	_, err := df.f.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if df.sealed == nil {
+		df.sealed = make([]byte, fileChunkSize+fileTagSize)
+	}
+	sealed := df.sealed[:end-start]
+	_, err = io.ReadFull(df.f, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &os.PathError{Op: "decrypt", Path: df.name, Err: errCannotDecrypt}
+	}
+	if err != nil {
+		return err
+	}
+	df.buf, err = df.aead.Open(df.buf[:0], chunkNonce(index, index == df.chunks-1), sealed, nil)
+	if err != nil {
+		return &os.PathError{Op: "decrypt", Path: df.name, Err: errCannotDecrypt}
+	}
+	df.chunk = index
+	return nil
+}
+
+func (df *decryptingFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += df.offset
+	case io.SeekEnd:
+		offset += df.size
+	default:
+		return df.offset, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return df.offset, fmt.Errorf("negative offset: %d", offset)
+	}
+	df.offset = offset
+	return offset, nil
+}
+
+func (df *decryptingFile) Close() error {
+	return df.f.Close()
+}
@@ -0,0 +1,308 @@
+package timeliner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnableEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tl, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tl.AddAccount(testDataSourceID, "me")
+	if err != nil {
+		tl.Close()
+		t.Fatal(err)
+	}
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	meta := Metadata{Name: "secret name"}
+	photo := testItem{id: "photo", ts: ts, class: ClassImage, fileName: "photo.jpg",
+		file: string(bytes.Repeat([]byte("secret file "), 20000))}
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "post", ts: ts, class: ClassPost, text: "secret text", meta: &meta}),
+		NewItemGraph(photo))
+
+	var postID, photoID int64
+	err = tl.db.QueryRow(`SELECT id FROM items WHERE original_id='post'`).Scan(&postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tl.db.QueryRow(`SELECT id FROM items WHERE original_id='photo'`).Scan(&photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPhoto, err := tl.LoadItem(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := tl.EnableEncryption(context.Background(), []byte("passphrase"))
+	if err != nil {
+		tl.Close()
+		t.Fatalf("enabling encryption: %v", err)
+	}
+	if encrypted != 1 {
+		t.Errorf("expected 1 data file encrypted, got %d", encrypted)
+	}
+
+	// nothing is left in plaintext, in the database or the store
+	for _, col := range []struct {
+		table, column string
+		id            int64
+	}{
+		{"items", "data_text", postID},
+		{"items", "metadata", postID},
+		{"accounts", "authorization", 1},
+	} {
+		var value []byte
+		err := tl.db.QueryRow(`SELECT `+col.column+` FROM `+col.table+` WHERE id=?`, col.id).Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isSealedColumn(value) {
+			t.Errorf("expected %s.%s to be encrypted, got %q", col.table, col.column, value)
+		}
+	}
+	encPhoto, err := tl.LoadItem(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *encPhoto.DataHash == *plainPhoto.DataHash {
+		t.Error("expected the checksum of the data file to be replaced")
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(*encPhoto.DataFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(fileMagic)) || bytes.Contains(raw, []byte("secret file")) {
+		t.Error("expected data file to be encrypted")
+	}
+	tl.Close()
+
+	// the repository can only be opened with the right secret
+	_, err = Open(dir)
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked without a secret, got %v", err)
+	}
+	_, err = OpenWithOptions(dir, Options{Secret: []byte("wrong")})
+	if err != ErrWrongSecret {
+		t.Errorf("expected ErrWrongSecret, got %v", err)
+	}
+
+	tl, err = OpenWithOptions(dir, Options{Secret: []byte("passphrase")})
+	if err != nil {
+		t.Fatalf("opening encrypted repository: %v", err)
+	}
+	defer tl.Close()
+	post, err := tl.LoadItem(context.Background(), postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.DataText == nil || *post.DataText != "secret text" || !reflect.DeepEqual(*post.Metadata, meta) {
+		t.Errorf("expected text and metadata to be decrypted, got %v and %+v", post.DataText, post.Metadata)
+	}
+	f, err := tl.OpenDataFile(encPhoto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("reading encrypted data file: %v", err)
+	}
+	if string(contents) != photo.file {
+		t.Error("expected data file to be decrypted to its original contents")
+	}
+	creds, err := dbCredentialStore{tl}.Get(testDataSourceID, "me")
+	if err != nil || string(creds) != "credentials of me" {
+		t.Errorf("expected decrypted credentials, got %q (err=%v)", creds, err)
+	}
+
+	_, err = tl.EnableEncryption(context.Background(), []byte("passphrase"))
+	if err == nil {
+		t.Error("expected error encrypting an encrypted repository")
+	}
+}
+
+// newTestEncryptedStore returns an encryptedStore in
+// dir with a random key.
+func newTestEncryptedStore(t *testing.T, dir string) encryptedStore {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := newKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptedStore{BlobStore: NewLocalStore(dir), keys: kr}
+}
+
+func TestEncryptedFileReadSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es := newTestEncryptedStore(t, dir)
+
+	for _, size := range []int{0, 1, fileChunkSize - 1, fileChunkSize, fileChunkSize + 1, 2*fileChunkSize + 100} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("file%d", size)
+		w, err := es.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write in pieces that don't line up with chunks
+		for rest := data; len(rest) > 0; {
+			n := 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err = w.Write(rest[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := es.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(size) {
+			t.Errorf("size %d: Stat reported size %d", size, info.Size())
+		}
+
+		f, err := es.Open(name)
+		if err != nil {
+			t.Fatalf("size %d: opening: %v", size, err)
+		}
+		all, err := ioutil.ReadAll(f)
+		if err != nil || !bytes.Equal(all, data) {
+			t.Errorf("size %d: reading all: got %d bytes (err=%v)", size, len(all), err)
+		}
+
+		// read across chunk boundaries, in any order
+		for _, rng := range [][2]int{
+			{fileChunkSize - 10, 20},
+			{0, 5},
+			{fileChunkSize, 10},
+			{2*fileChunkSize - 1, 2},
+			{size - 3, 10},
+			{1, fileChunkSize + 50},
+		} {
+			off, n := rng[0], rng[1]
+			if off < 0 || off > size {
+				continue
+			}
+			expected := data[off:]
+			if len(expected) > n {
+				expected = expected[:n]
+			}
+			_, err := f.Seek(int64(off), io.SeekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, n)
+			got, err := io.ReadFull(f, buf)
+			if (err != nil && err != io.ErrUnexpectedEOF && err != io.EOF) || !bytes.Equal(buf[:got], expected) {
+				t.Errorf("size %d: reading %d bytes at %d: got %d bytes (err=%v)", size, n, off, got, err)
+			}
+		}
+
+		pos, err := f.Seek(-1, io.SeekEnd)
+		if size > 0 && (err != nil || pos != int64(size-1)) {
+			t.Errorf("size %d: seeking from end: got %d (err=%v)", size, pos, err)
+		}
+		f.Close()
+	}
+}
+
+func TestEncryptedFileCannotDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	es := newTestEncryptedStore(t, dir)
+
+	data := bytes.Repeat([]byte("0123456789"), fileChunkSize/5)
+	w, err := es.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readAll := func(es encryptedStore) error {
+		f, err := es.Open("file")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = ioutil.ReadAll(f)
+		return err
+	}
+
+	// another key
+	other := newTestEncryptedStore(t, dir)
+	if err := readAll(other); !isDecryptError(err) {
+		t.Errorf("reading with another key: expected decrypt error, got %v", err)
+	}
+
+	// a file that was truncated at a chunk boundary
+	fullName := filepath.Join(dir, "file")
+	raw, err := ioutil.ReadFile(fullName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fullName, raw[:fileHeaderSize+fileChunkSize+fileTagSize], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(es); !isDecryptError(err) {
+		t.Errorf("reading truncated file: expected decrypt error, got %v", err)
+	}
+
+	// a file that was not encrypted
+	err = ioutil.WriteFile(fullName, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(es); !isDecryptError(err) {
+		t.Errorf("reading plaintext file: expected decrypt error, got %v", err)
+	}
+}
@@ -0,0 +1,630 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/mholt/archiver/v3"
+)
+
+// ExportRecord is a single line of a timeline exported in
+// JSON Lines format. Type is one of "account", "person",
+// "collection", "item", or "relationship", and only the
+// field of that name is set. Records appear in that order,
+// except that persons are written just before the first
+// record that refers to them.
+type ExportRecord struct {
+	Type         string              `json:"type"`
+	Account      *ExportAccount      `json:"account,omitempty"`
+	Person       *ExportPerson       `json:"person,omitempty"`
+	Collection   *ExportCollection   `json:"collection,omitempty"`
+	Item         *ExportItem         `json:"item,omitempty"`
+	Relationship *ExportRelationship `json:"relationship,omitempty"`
+}
+
+// ExportAccount is an exported account.
+type ExportAccount struct {
+	DataSourceID string `json:"data_source"`
+	UserID       string `json:"user_id"`
+}
+
+func (ea ExportAccount) String() string {
+	return ea.DataSourceID + "/" + ea.UserID
+}
+
+// ExportPerson is an exported person. The ID is only
+// meaningful within the export it came from.
+type ExportPerson struct {
+	ID         int64                  `json:"id"`
+	Name       string                 `json:"name,omitempty"`
+	Identities []ExportPersonIdentity `json:"identities,omitempty"`
+}
+
+// ExportPersonIdentity is a user ID of a person on a data source.
+type ExportPersonIdentity struct {
+	DataSourceID string `json:"data_source"`
+	UserID       string `json:"user_id"`
+}
+
+// ExportCollection is an exported collection. Its items
+// are listed with each item rather than with the collection.
+type ExportCollection struct {
+	Account     string  `json:"account"` // "data_source/user_id"
+	ID          string  `json:"id"`
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// ExportItem is an exported item. DataFile, if set, is a path
+// relative to the root of the export (or of the timeline).
+type ExportItem struct {
+	Account     string          `json:"account"` // "data_source/user_id"
+	ID          string          `json:"id"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Class       string          `json:"class"`
+	PersonID    int64           `json:"person_id,omitempty"`
+	Owner       *ExportOwner    `json:"owner,omitempty"`
+	MIMEType    *string         `json:"mime_type,omitempty"`
+	Text        *string         `json:"text,omitempty"`
+	DataFile    *string         `json:"data_file,omitempty"`
+	DataHash    *string         `json:"data_hash,omitempty"`
+	Metadata    *Metadata       `json:"metadata,omitempty"`
+	Latitude    *float64        `json:"latitude,omitempty"`
+	Longitude   *float64        `json:"longitude,omitempty"`
+	Collections []ExportInclude `json:"collections,omitempty"`
+}
+
+// ExportOwner identifies the owner of an item on
+// the data source of the item's account.
+type ExportOwner struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+}
+
+// ExportInclude describes an item's membership in a collection.
+type ExportInclude struct {
+	ID       string `json:"id"` // original ID of the collection
+	Position int    `json:"position"`
+}
+
+// ExportRelationship is an exported relationship. Each end
+// is either an item or a person (by its ID in the export).
+type ExportRelationship struct {
+	FromItem      *ExportItemRef `json:"from_item,omitempty"`
+	FromPersonID  *int64         `json:"from_person_id,omitempty"`
+	ToItem        *ExportItemRef `json:"to_item,omitempty"`
+	ToPersonID    *int64         `json:"to_person_id,omitempty"`
+	Label         string         `json:"label"`
+	Bidirectional bool           `json:"bidirectional,omitempty"`
+}
+
+// ExportItemRef refers to an exported item.
+type ExportItemRef struct {
+	Account string `json:"account"` // "data_source/user_id"
+	ID      string `json:"id"`      // original ID of the item
+}
+
+// ExportOptions configures an export.
+type ExportOptions struct {
+	// Only items matching the timeframe, account, data
+	// source, person, and class fields of this query are
+	// exported, along with the accounts, persons, and
+	// collections they belong to and the relationships
+	// among them.
+	Filter ItemQuery
+}
+
+// Export writes the items that match opt, along with related
+// accounts, persons, collections, and relationships, to w in
+// JSON Lines format: one ExportRecord per line. It returns the
+// names of the data files referenced by exported items; they
+// are relative to the repository folder, and can be bundled
+// with the export (see ExportArchive).
+func (t *Timeline) Export(ctx context.Context, w io.Writer, opt ExportOptions) ([]string, error) {
+	ex := &exporter{
+		tl:        t,
+		ctx:       ctx,
+		enc:       json.NewEncoder(w),
+		accounts:  make(map[int64]ExportAccount),
+		persons:   make(map[int64]struct{}),
+		owners:    make(map[string]*ExportOwner),
+		items:     make(map[int64]ExportItemRef),
+		seenFiles: make(map[string]struct{}),
+	}
+	ex.enc.SetEscapeHTML(false)
+
+	err := ex.exportAccounts(opt.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("exporting accounts: %v", err)
+	}
+	err = ex.exportItems(opt.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("exporting items: %v", err)
+	}
+	err = ex.exportRelationships()
+	if err != nil {
+		return nil, fmt.Errorf("exporting relationships: %v", err)
+	}
+
+	return ex.dataFiles, nil
+}
+
+// ExportArchive exports the timeline like Export does, but into
+// an archive file that also contains the data files referenced
+// by exported items, using their paths relative to the repository.
+// The export itself is stored at the root of the archive as
+// ExportArchiveIndex. The archive format is determined by the
+// extension of filename (for example .zip, .tar, or .tar.gz).
+func (t *Timeline) ExportArchive(ctx context.Context, filename string, opt ExportOptions) error {
+	iface, err := archiver.ByExtension(filename)
+	if err != nil {
+		return err
+	}
+	arc, ok := iface.(archiver.Writer)
+	if !ok {
+		return fmt.Errorf("format does not support writing archives: %s", filename)
+	}
+
+	// archives need to know the size of each file before adding
+	// it, so stage the export in a temporary file first
+	tmp, err := ioutil.TempFile("", "timeliner_export_")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	dataFiles, err := t.Export(ctx, tmp, opt)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("creating archive file: %v", err)
+	}
+	defer out.Close()
+
+	err = arc.Create(out)
+	if err != nil {
+		return fmt.Errorf("creating archive: %v", err)
+	}
+	defer arc.Close()
+
+	err = addFileToArchive(arc, tmp.Name(), ExportArchiveIndex)
+	if err != nil {
+		return err
+	}
+	for _, dataFile := range dataFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := t.addDataFileToArchive(arc, dataFile)
+		if os.IsNotExist(err) {
+			log.Printf("[ERROR] Exporting data file: %v (skipping)", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = arc.Close()
+	if err != nil {
+		return fmt.Errorf("finishing archive: %v", err)
+	}
+	return out.Close()
+}
+
+func addFileToArchive(arc archiver.Writer, filePath, nameInArchive string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %v", err)
+	}
+	return writeToArchive(arc, f, info, nameInArchive)
+}
+
+// addDataFileToArchive adds the data file with the
+// given name, from the timeline's store, to arc.
+func (t *Timeline) addDataFileToArchive(arc archiver.Writer, dataFile string) error {
+	info, err := t.store.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	f, err := t.store.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeToArchive(arc, f, info, path.Clean(dataFile))
+}
+
+func writeToArchive(arc archiver.Writer, f io.ReadCloser, info os.FileInfo, nameInArchive string) error {
+	err := arc.Write(archiver.File{
+		FileInfo: archiver.FileInfo{
+			FileInfo:   info,
+			CustomName: nameInArchive,
+		},
+		ReadCloser: f,
+	})
+	if err != nil {
+		return fmt.Errorf("adding %s to archive: %v", nameInArchive, err)
+	}
+	return nil
+}
+
+// exporter keeps track of what has been exported so far.
+type exporter struct {
+	tl  *Timeline
+	ctx context.Context
+	enc *json.Encoder
+
+	accounts  map[int64]ExportAccount // by account row ID
+	persons   map[int64]struct{}      // persons already written
+	owners    map[string]*ExportOwner // by person ID and data source ID
+	items     map[int64]ExportItemRef // by item row ID
+	seenFiles map[string]struct{}     // data files already listed
+	dataFiles []string
+}
+
+func (ex *exporter) write(rec ExportRecord) error {
+	return ex.enc.Encode(rec)
+}
+
+// exportAccounts writes the accounts that may have items matching
+// the filter, followed by each of their collections.
+func (ex *exporter) exportAccounts(filter ItemQuery) error {
+	rows, err := ex.tl.db.QueryContext(ex.ctx, `SELECT id, data_source_id, user_id FROM accounts ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var accountIDs []int64
+	for rows.Next() {
+		var id int64
+		var acc ExportAccount
+		err := rows.Scan(&id, &acc.DataSourceID, &acc.UserID)
+		if err != nil {
+			return err
+		}
+		if len(filter.AccountIDs) > 0 && !containsInt64(filter.AccountIDs, id) {
+			continue
+		}
+		if len(filter.DataSourceIDs) > 0 && !containsString(filter.DataSourceIDs, acc.DataSourceID) {
+			continue
+		}
+		ex.accounts[id] = acc
+		accountIDs = append(accountIDs, id)
+		err = ex.write(ExportRecord{Type: "account", Account: &acc})
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, accountID := range accountIDs {
+		err := ex.exportCollections(accountID)
+		if err != nil {
+			return fmt.Errorf("exporting collections: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (ex *exporter) exportCollections(accountID int64) error {
+	rows, err := ex.tl.db.QueryContext(ex.ctx, `SELECT original_id, name, description
+		FROM collections WHERE account_id=? ORDER BY id`, accountID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var originalID *string
+		coll := ExportCollection{Account: ex.accounts[accountID].String()}
+		err := rows.Scan(&originalID, &coll.Name, &coll.Description)
+		if err != nil {
+			return err
+		}
+		if originalID != nil {
+			coll.ID = *originalID
+		}
+		err = ex.write(ExportRecord{Type: "collection", Collection: &coll})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (ex *exporter) exportItems(filter ItemQuery) error {
+	q := filter
+	q.Reverse = false
+	q.Cursor = ""
+	q.Limit = 500
+
+	for {
+		if err := ex.ctx.Err(); err != nil {
+			return err
+		}
+
+		results, err := ex.tl.QueryItems(ex.ctx, q)
+		if err != nil {
+			return err
+		}
+
+		for _, ir := range results.Items {
+			err := ex.exportItem(ir)
+			if err != nil {
+				return fmt.Errorf("item %d: %v", ir.ID, err)
+			}
+		}
+
+		if results.NextCursor == "" {
+			return nil
+		}
+		q.Cursor = results.NextCursor
+	}
+}
+
+func (ex *exporter) exportItem(ir ItemRow) error {
+	acc, ok := ex.accounts[ir.AccountID]
+	if !ok {
+		return nil // filtered out
+	}
+
+	err := ex.exportPerson(ir.PersonID)
+	if err != nil {
+		return fmt.Errorf("exporting person: %v", err)
+	}
+	owner, err := ex.owner(ir.PersonID, acc.DataSourceID)
+	if err != nil {
+		return fmt.Errorf("getting owner: %v", err)
+	}
+
+	item := ExportItem{
+		Account:   acc.String(),
+		ID:        ir.OriginalID,
+		Timestamp: ir.Timestamp.UTC(),
+		Class:     ir.Class.String(),
+		PersonID:  ir.PersonID,
+		Owner:     owner,
+		MIMEType:  ir.MIMEType,
+		Text:      ir.DataText,
+		DataFile:  ir.DataFile,
+		DataHash:  ir.DataHash,
+		Latitude:  ir.Latitude,
+		Longitude: ir.Longitude,
+	}
+	if ir.Metadata != nil && !ir.Metadata.isEmpty() {
+		item.Metadata = ir.Metadata
+	}
+
+	rows, err := ex.tl.db.QueryContext(ex.ctx, `SELECT collections.original_id, collection_items.position
+		FROM collection_items, collections
+		WHERE collection_items.item_id=? AND collections.id = collection_items.collection_id`, ir.ID)
+	if err != nil {
+		return fmt.Errorf("querying collections: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var originalID *string
+		var incl ExportInclude
+		err := rows.Scan(&originalID, &incl.Position)
+		if err != nil {
+			return fmt.Errorf("scanning collection: %v", err)
+		}
+		if originalID != nil {
+			incl.ID = *originalID
+		}
+		item.Collections = append(item.Collections, incl)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating collections: %v", err)
+	}
+	rows.Close()
+
+	// the data file is only usable if it was completely downloaded
+	if ir.DataFile != nil && ir.DataHash != nil {
+		if _, seen := ex.seenFiles[*ir.DataFile]; !seen {
+			ex.seenFiles[*ir.DataFile] = struct{}{}
+			ex.dataFiles = append(ex.dataFiles, *ir.DataFile)
+		}
+	} else {
+		item.DataFile = nil
+	}
+
+	ex.items[ir.ID] = ExportItemRef{Account: item.Account, ID: item.ID}
+
+	return ex.write(ExportRecord{Type: "item", Item: &item})
+}
+
+// exportPerson writes the person with the given row
+// ID, if it has not been written already.
+func (ex *exporter) exportPerson(personID int64) error {
+	if _, ok := ex.persons[personID]; ok {
+		return nil
+	}
+
+	person := ExportPerson{ID: personID}
+	var name *string
+	err := ex.tl.db.QueryRowContext(ex.ctx, `SELECT name FROM persons WHERE id=? LIMIT 1`,
+		personID).Scan(&name)
+	if err != nil {
+		return err
+	}
+	if name != nil {
+		person.Name = *name
+	}
+
+	rows, err := ex.tl.db.QueryContext(ex.ctx, `SELECT data_source_id, user_id
+		FROM person_identities WHERE person_id=? ORDER BY id`, personID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ident ExportPersonIdentity
+		err := rows.Scan(&ident.DataSourceID, &ident.UserID)
+		if err != nil {
+			return err
+		}
+		person.Identities = append(person.Identities, ident)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	ex.persons[personID] = struct{}{}
+
+	return ex.write(ExportRecord{Type: "person", Person: &person})
+}
+
+// owner returns the identity of the person with the
+// given row ID on the given data source, if any.
+func (ex *exporter) owner(personID int64, dataSourceID string) (*ExportOwner, error) {
+	key := fmt.Sprintf("%d/%s", personID, dataSourceID)
+	if owner, ok := ex.owners[key]; ok {
+		return owner, nil
+	}
+
+	var owner ExportOwner
+	var name *string
+	err := ex.tl.db.QueryRowContext(ex.ctx, `SELECT person_identities.user_id, persons.name
+		FROM person_identities, persons
+		WHERE person_identities.person_id=?
+			AND person_identities.data_source_id=?
+			AND persons.id = person_identities.person_id
+		LIMIT 1`, personID, dataSourceID).Scan(&owner.UserID, &name)
+	if err == sql.ErrNoRows {
+		ex.owners[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if name != nil {
+		owner.Name = *name
+	}
+
+	ex.owners[key] = &owner
+	return &owner, nil
+}
+
+// exportRelationships writes the relationships whose
+// items (if any) were all exported.
+func (ex *exporter) exportRelationships() error {
+	rows, err := ex.tl.db.QueryContext(ex.ctx, `SELECT from_person_id, from_item_id,
+		to_person_id, to_item_id, directed, label
+		FROM relationships ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fromPersonID, fromItemID, toPersonID, toItemID *int64
+		var directed *bool
+		var rel ExportRelationship
+		err := rows.Scan(&fromPersonID, &fromItemID, &toPersonID, &toItemID, &directed, &rel.Label)
+		if err != nil {
+			return err
+		}
+		rel.Bidirectional = directed != nil && !*directed
+
+		var exported bool
+		if rel.FromItem, exported = ex.itemRef(fromItemID); !exported {
+			continue
+		}
+		if rel.ToItem, exported = ex.itemRef(toItemID); !exported {
+			continue
+		}
+		if rel.FromItem == nil && rel.ToItem == nil {
+			// relationships between persons only are
+			// exported if both persons were exported
+			if !ex.personExported(fromPersonID) || !ex.personExported(toPersonID) {
+				continue
+			}
+		}
+
+		for _, personID := range []*int64{fromPersonID, toPersonID} {
+			if personID != nil {
+				err := ex.exportPerson(*personID)
+				if err != nil {
+					return fmt.Errorf("exporting person: %v", err)
+				}
+			}
+		}
+		rel.FromPersonID = fromPersonID
+		rel.ToPersonID = toPersonID
+
+		err = ex.write(ExportRecord{Type: "relationship", Relationship: &rel})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// itemRef returns a reference to the item with the given
+// row ID if it was exported; a nil row ID is a nil ref.
+func (ex *exporter) itemRef(rowID *int64) (*ExportItemRef, bool) {
+	if rowID == nil {
+		return nil, true
+	}
+	ref, ok := ex.items[*rowID]
+	if !ok {
+		return nil, false
+	}
+	return &ref, true
+}
+
+func (ex *exporter) personExported(personID *int64) bool {
+	if personID == nil {
+		return true
+	}
+	_, ok := ex.persons[*personID]
+	return ok
+}
+
+func containsInt64(list []int64, v int64) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportArchiveIndex is the name of the JSON Lines file
+// at the root of an archive made by ExportArchive.
+const ExportArchiveIndex = "timeline.jsonl"
@@ -0,0 +1,463 @@
+package timeliner
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// FsckOptions configures a check of the repository.
+type FsckOptions struct {
+	// If true, problems that can be fixed are fixed.
+	Repair bool
+
+	// If set, Progress is called with the path of
+	// each data file as it is checked.
+	Progress func(dataFile string)
+}
+
+// FsckProblem is a problem found in the repository.
+type FsckProblem struct {
+	Kind     string `json:"kind"`
+	ItemID   int64  `json:"item_id,omitempty"`
+	Path     string `json:"path,omitempty"` // data file, relative to the repository
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// Kinds of problems found by Fsck.
+const (
+	// An item's data file is missing. Repaired by clearing
+	// the item's checksum, which causes the file to be
+	// downloaded again the next time the item is listed.
+	FsckMissingFile = "missing_file"
+
+	// The contents of an item's data file don't match its
+	// checksum. Repaired the same way as a missing file;
+	// if the data file is a blob of which the contents no
+	// longer match its name, it is also moved into the
+	// trash folder, so that it can be downloaded again.
+	FsckHashMismatch = "hash_mismatch"
+
+	// A file in the data or blobs folder is not the data file
+	// of any item. Repaired by moving it into the trash folder.
+	FsckUnreferencedFile = "unreferenced_file"
+
+	// A backup of a data file that was being replaced was
+	// left behind. Repaired by restoring it if the data file
+	// is missing, or by deleting it otherwise.
+	FsckStrayBackup = "stray_backup"
+
+	// A relationship refers to an item or person that does
+	// not exist. Repaired by deleting the relationship.
+	FsckDanglingRelationship = "dangling_relationship"
+
+	// An item's place in a collection refers to an item or
+	// collection that does not exist. Repaired by deleting it.
+	FsckDanglingCollectionItem = "dangling_collection_item"
+
+	// An item's metadata was stored in the original format,
+	// which trimmed part of it. Repaired by storing it again
+	// in the current format, unless it was shorter than 128
+	// bytes, which lost the number of its first field: that
+	// can't be recovered, and its metadata reads as empty
+	// until the item is stored again with -reprocess.
+	FsckLegacyMetadata = "legacy_metadata"
+)
+
+// FsckReport is the result of checking the repository.
+type FsckReport struct {
+	ItemsChecked int64         `json:"items_checked"`
+	FilesChecked int64         `json:"files_checked"`
+	Problems     []FsckProblem `json:"problems"`
+}
+
+// Unrepaired returns the number of problems
+// in the report that were not repaired.
+func (r FsckReport) Unrepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck checks the integrity of the whole repository: that the
+// data files of items exist and match their checksums, that all
+// files in the data and blobs folders belong to an item, that no
+// backups of data files were left behind, that relationships and
+// collections only refer to rows that exist, and that the metadata of
+// items is in the current format. Items of which the
+// data file has not been completely downloaded yet are skipped,
+// since that is fixed the next time they are listed. If
+// opt.Repair is true, problems are fixed where possible.
+func (t *Timeline) Fsck(ctx context.Context, opt FsckOptions) (FsckReport, error) {
+	var report FsckReport
+
+	// backups are handled first, since restoring
+	// one may fix an item's missing data file
+	err := t.fsckDataFolder(ctx, opt, &report)
+	if err != nil {
+		return report, err
+	}
+	err = t.fsckItemDataFiles(ctx, opt, &report)
+	if err != nil {
+		return report, err
+	}
+	err = t.fsckDanglingRows(ctx, opt, &report)
+	if err != nil {
+		return report, err
+	}
+	err = t.fsckMetadata(ctx, opt, &report)
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// fsckItemDataFiles checks that the data file of each
+// item exists and matches the item's checksum.
+func (t *Timeline) fsckItemDataFiles(ctx context.Context, opt FsckOptions, report *FsckReport) error {
+	rows, err := t.db.QueryContext(ctx, `SELECT id, data_file, data_hash FROM items
+		WHERE data_file IS NOT NULL AND data_file != '' AND data_hash IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("querying items with data files: %v", err)
+	}
+
+	// the table would be locked while iterating its
+	// rows, so load them all before making repairs
+	type itemDataFile struct {
+		id             int64
+		dataFile, hash string
+	}
+	var items []itemDataFile
+	for rows.Next() {
+		var idf itemDataFile
+		err := rows.Scan(&idf.id, &idf.dataFile, &idf.hash)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning item: %v", err)
+		}
+		items = append(items, idf)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating item rows: %v", err)
+	}
+
+	for _, idf := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if opt.Progress != nil {
+			opt.Progress(idf.dataFile)
+		}
+		report.ItemsChecked++
+
+		p := FsckProblem{ItemID: idf.id, Path: idf.dataFile}
+		b64hash, err := t.hashDataFile(idf.dataFile)
+		if os.IsNotExist(err) {
+			p.Kind = FsckMissingFile
+			p.Detail = "data file is missing"
+		} else if isDecryptError(err) {
+			p.Kind = FsckHashMismatch
+			p.Detail = "data file can't be decrypted; it is corrupt"
+		} else if err != nil {
+			return fmt.Errorf("checking data file: %v (item_id=%d)", err, idf.id)
+		} else if b64hash != idf.hash {
+			p.Kind = FsckHashMismatch
+			p.Detail = fmt.Sprintf("checksum of data file is %s, but expected %s", b64hash, idf.hash)
+		} else {
+			continue
+		}
+
+		if opt.Repair {
+			if p.Kind == FsckHashMismatch && isBlob(idf.dataFile) {
+				err := t.quarantineCorruptBlob(idf.dataFile, b64hash)
+				if err != nil {
+					return fmt.Errorf("moving corrupt blob to trash: %v (item_id=%d)", err, idf.id)
+				}
+			}
+			_, err := t.db.ExecContext(ctx, `UPDATE items SET data_hash=NULL WHERE id=?`, idf.id) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+			if err != nil {
+				return fmt.Errorf("clearing checksum of item: %v (item_id=%d)", err, idf.id)
+			}
+			p.Repaired = true
+			p.Detail += "; it will be downloaded again the next time the item is listed"
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	return nil
+}
+
+// fsckDataFolder checks that each file in the data and blobs
+// folders is the data file of an item, and that there are no
+// stray backups of data files.
+func (t *Timeline) fsckDataFolder(ctx context.Context, opt FsckOptions, report *FsckReport) error {
+	// files of items in the trash still belong to them
+	referenced := make(map[string]struct{})
+	rows, err := t.db.QueryContext(ctx, `SELECT data_file FROM items WHERE data_file IS NOT NULL
+		UNION SELECT data_file FROM trash WHERE data_file IS NOT NULL AND quarantined_file IS NULL`)
+	if err != nil {
+		return fmt.Errorf("querying data files: %v", err)
+	}
+	for rows.Next() {
+		var dataFile string
+		err := rows.Scan(&dataFile)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning data file: %v", err)
+		}
+		referenced[dataFile] = struct{}{}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating data file rows: %v", err)
+	}
+
+	var dataFiles []string
+	for _, folder := range []string{"data", blobsFolder} {
+		err = t.store.List(folder, func(name string, info os.FileInfo) error {
+			dataFiles = append(dataFiles, name)
+			return ctx.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("walking %s folder: %v", folder, err)
+		}
+	}
+
+	for _, dataFile := range dataFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.FilesChecked++
+		if _, ok := referenced[dataFile]; ok {
+			continue
+		}
+
+		p := FsckProblem{Path: dataFile}
+		if orig := strings.TrimSuffix(dataFile, ".bak"); orig != dataFile {
+			_, isDataFile := referenced[orig]
+			restore := isDataFile && !t.datafileExists(orig)
+			p.Kind = FsckStrayBackup
+			p.Detail = "backup of data file was left behind"
+			if opt.Repair {
+				if restore {
+					err = t.store.Rename(dataFile, orig)
+					p.Detail += "; restored it, since the data file was missing"
+				} else {
+					err = t.store.Remove(dataFile)
+					p.Detail += "; deleted it"
+				}
+				if err != nil {
+					return fmt.Errorf("repairing stray backup: %v", err)
+				}
+				p.Repaired = true
+			}
+			report.Problems = append(report.Problems, p)
+			continue
+		}
+
+		p.Kind = FsckUnreferencedFile
+		p.Detail = "file is not the data file of any item"
+		if opt.Repair {
+			dest := path.Join(trashFolder, "unreferenced", strings.TrimPrefix(dataFile, "data/"))
+			if t.datafileExists(dest) {
+				dest = path.Join(path.Dir(dest), randomString(4, true)+"_"+path.Base(dest))
+			}
+			err := t.store.Rename(dataFile, dest)
+			if err != nil {
+				return fmt.Errorf("moving unreferenced file to trash: %v", err)
+			}
+			p.Repaired = true
+			p.Detail += "; moved it to " + dest
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	return nil
+}
+
+// fsckDanglingRows checks that relationships and collection
+// items refer only to rows that exist. (Foreign keys prevent
+// this, but only if they were enforced when rows were deleted.)
+func (t *Timeline) fsckDanglingRows(ctx context.Context, opt FsckOptions, report *FsckReport) error {
+	checks := []struct {
+		kind, table, where, detail string
+	}{
+		{
+			kind:  FsckDanglingRelationship,
+			table: "relationships",
+			where: `(from_item_id IS NOT NULL AND from_item_id NOT IN (SELECT id FROM items))
+				OR (to_item_id IS NOT NULL AND to_item_id NOT IN (SELECT id FROM items))
+				OR (from_person_id IS NOT NULL AND from_person_id NOT IN (SELECT id FROM persons))
+				OR (to_person_id IS NOT NULL AND to_person_id NOT IN (SELECT id FROM persons))`,
+			detail: "relationship refers to an item or person that does not exist",
+		},
+		{
+			kind:  FsckDanglingCollectionItem,
+			table: "collection_items",
+			where: `item_id NOT IN (SELECT id FROM items)
+				OR collection_id NOT IN (SELECT id FROM collections)`,
+			detail: "place in collection refers to an item or collection that does not exist",
+		},
+	}
+
+	for _, check := range checks {
+		rows, err := t.db.QueryContext(ctx, `SELECT id FROM `+check.table+` WHERE `+check.where)
+		if err != nil {
+			return fmt.Errorf("querying %s: %v", check.table, err)
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			err := rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("scanning row of %s: %v", check.table, err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("iterating rows of %s: %v", check.table, err)
+		}
+
+		for _, id := range ids {
+			p := FsckProblem{
+				Kind:   check.kind,
+				Detail: fmt.Sprintf("%s (%s_id=%d)", check.detail, strings.TrimSuffix(check.table, "s"), id),
+			}
+			if opt.Repair {
+				_, err := t.db.ExecContext(ctx, `DELETE FROM `+check.table+` WHERE id=?`, id)
+				if err != nil {
+					return fmt.Errorf("deleting row of %s: %v", check.table, err)
+				}
+				p.Repaired = true
+				p.Detail += "; deleted it"
+			}
+			report.Problems = append(report.Problems, p)
+		}
+	}
+
+	return nil
+}
+
+// quarantineCorruptBlob moves the blob named blob, of which
+// the actual checksum is checksumBase64, into the trash folder
+// if its contents don't match its name. (If they do match, the
+// item's checksum is what's wrong, and the blob is left alone.)
+// If the checksum is empty, the blob couldn't be decrypted.
+func (t *Timeline) quarantineCorruptBlob(blob, checksumBase64 string) error {
+	if checksumBase64 != "" {
+		expected, err := blobPath(checksumBase64)
+		if err != nil {
+			return err
+		}
+		if expected == blob {
+			return nil
+		}
+	}
+	dest := path.Join(trashFolder, "corrupt", path.Base(blob)+"_"+randomString(4, true))
+	return t.store.Rename(blob, dest)
+}
+
+// hashDataFile returns the base64 encoding of the SHA-256
+// checksum of the given data file (keyed, if the repository
+// is encrypted).
+func (t *Timeline) hashDataFile(dataFile string) (string, error) {
+	return hashFile(t.store, t.newDataHash(), dataFile)
+}
+
+// hashFile returns the base64 encoding of the checksum,
+// computed with h, of the file in store with the given name.
+func hashFile(store BlobStore, h hash.Hash, name string) (string, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// fsckMetadata finds items of which the metadata was stored
+// in the original format (see Metadata.decodeLegacy).
+func (t *Timeline) fsckMetadata(ctx context.Context, opt FsckOptions, report *FsckReport) error {
+	type legacyRow struct {
+		id   int64
+		meta Metadata
+		lost bool
+	}
+	var legacy []legacyRow
+
+	rows, err := t.db.QueryContext(ctx, `SELECT id, metadata FROM items WHERE metadata IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("querying metadata of items: %v", err)
+	}
+	for rows.Next() {
+		var id int64
+		var metaGob []byte
+		err := rows.Scan(&id, &metaGob)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning metadata of item: %v", err)
+		}
+		metaGob, err = t.openColumn("metadata", metaGob)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("%v (item_id=%d)", err, id)
+		}
+		var m Metadata
+		isLegacy, err := m.decodeStored(metaGob)
+		if err != nil && err != errMetadataLost {
+			rows.Close()
+			return fmt.Errorf("gob-decoding metadata: %v (item_id=%d)", err, id)
+		}
+		if isLegacy {
+			legacy = append(legacy, legacyRow{id: id, meta: m, lost: err == errMetadataLost})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating metadata of items: %v", err)
+	}
+
+	for _, lr := range legacy {
+		p := FsckProblem{
+			Kind:   FsckLegacyMetadata,
+			ItemID: lr.id,
+			Detail: "metadata is stored in the original format",
+		}
+		if lr.lost {
+			p.Detail = errMetadataLost.Error() + "; get the item again with -reprocess"
+		} else if opt.Repair {
+			metaGob, err := lr.meta.encode()
+			if err != nil {
+				return fmt.Errorf("gob-encoding metadata: %v (item_id=%d)", err, lr.id)
+			}
+			_, err = t.db.ExecContext(ctx, `UPDATE items SET metadata=? WHERE id=?`,
+				t.sealColumn("metadata", metaGob), lr.id)
+			if err != nil {
+				return fmt.Errorf("storing metadata: %v (item_id=%d)", err, lr.id)
+			}
+			p.Repaired = true
+			p.Detail += "; stored it in the current format"
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	return nil
+}
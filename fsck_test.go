@@ -0,0 +1,160 @@
+package timeliner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsck(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	post := NewItemGraph(testItem{id: "post", ts: ts, class: ClassPost, text: "post"})
+	post.Add(testItem{id: "reply", ts: ts.Add(time.Hour), class: ClassPost, text: "reply"}, RelReplyTo)
+	testGetAll(t, tl, "me", append(testItemsWithFiles("intact", "missing", "mismatch"), post)...)
+	intact, missing, mismatch := loadTestItem(t, tl, "intact"), loadTestItem(t, tl, "missing"), loadTestItem(t, tl, "mismatch")
+	repoPath := func(dataFile string) string {
+		return filepath.Join(tl.repoDir, filepath.FromSlash(dataFile))
+	}
+
+	// break the repository: remove a data file, change one, add
+	// a file of no item, and refer to rows that don't exist
+	// (which foreign keys prevent, unless they are disabled)
+	err := os.Remove(repoPath(*missing.DataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(repoPath(*mismatch.DataFile), []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := "data/2019/01/orphan.txt"
+	err = ioutil.WriteFile(repoPath(orphan), []byte("orphan"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tl.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`PRAGMA foreign_keys=OFF`,
+		`INSERT INTO relationships (from_item_id, to_item_id, directed, label) VALUES (?, 9999, 1, 'reply_to')`,
+		`INSERT INTO collection_items (item_id, collection_id) VALUES (?, 9999)`,
+		`PRAGMA foreign_keys=ON`,
+	} {
+		var args []interface{}
+		if strings.HasPrefix(q, "INSERT") {
+			args = append(args, intact.ID)
+		}
+		if _, err := conn.ExecContext(context.Background(), q, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	countRows := func(table string) int {
+		t.Helper()
+		var n int
+		err := tl.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	problemsByKind := func(report FsckReport) map[string]FsckProblem {
+		problems := make(map[string]FsckProblem)
+		for _, p := range report.Problems {
+			if _, ok := problems[p.Kind]; ok {
+				t.Errorf("expected one problem of kind %s, got %+v", p.Kind, report.Problems)
+			}
+			problems[p.Kind] = p
+		}
+		return problems
+	}
+	expectProblems := func(report FsckReport, repaired bool) {
+		t.Helper()
+		if report.ItemsChecked != 3 || report.FilesChecked != 3 {
+			t.Errorf("expected 3 items and 3 files checked, got %d and %d", report.ItemsChecked, report.FilesChecked)
+		}
+		problems := problemsByKind(report)
+		if len(problems) != 5 {
+			t.Errorf("expected 5 problems, got %+v", report.Problems)
+		}
+		for _, expect := range []FsckProblem{
+			{Kind: FsckMissingFile, ItemID: missing.ID, Path: *missing.DataFile},
+			{Kind: FsckHashMismatch, ItemID: mismatch.ID, Path: *mismatch.DataFile},
+			{Kind: FsckUnreferencedFile, Path: orphan},
+			{Kind: FsckDanglingRelationship},
+			{Kind: FsckDanglingCollectionItem},
+		} {
+			p, ok := problems[expect.Kind]
+			if !ok || p.ItemID != expect.ItemID || p.Path != expect.Path || p.Repaired != repaired {
+				t.Errorf("expected %s problem %+v with repaired=%t, got %+v", expect.Kind, expect, repaired, p)
+			}
+		}
+		var unrepaired int
+		if !repaired {
+			unrepaired = len(problems)
+		}
+		if report.Unrepaired() != unrepaired {
+			t.Errorf("expected %d unrepaired problems, got %d", unrepaired, report.Unrepaired())
+		}
+	}
+
+	// problems are only reported...
+	report, err := tl.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectProblems(report, false)
+	if _, err := os.Stat(repoPath(orphan)); err != nil {
+		t.Errorf("expected unreferenced file to be left alone: %v", err)
+	}
+	if ir := loadTestItem(t, tl, "missing"); ir.DataHash == nil {
+		t.Error("expected checksum of item with missing file to be left alone")
+	}
+	if countRows("relationships") != 2 || countRows("collection_items") != 1 {
+		t.Error("expected dangling rows to be left alone")
+	}
+
+	// ...unless they are to be repaired
+	report, err = tl.Fsck(context.Background(), FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectProblems(report, true)
+	if _, err := os.Stat(repoPath(orphan)); !os.IsNotExist(err) {
+		t.Errorf("expected unreferenced file to be moved, got %v", err)
+	}
+	moved, err := ioutil.ReadFile(repoPath(trashFolder + "/unreferenced/2019/01/orphan.txt"))
+	if err != nil || string(moved) != "orphan" {
+		t.Errorf("expected unreferenced file in trash, got %q (err=%v)", moved, err)
+	}
+	for _, originalID := range []string{"missing", "mismatch"} {
+		if ir := loadTestItem(t, tl, originalID); ir.DataHash != nil {
+			t.Errorf("expected checksum of %s item to be cleared", originalID)
+		}
+	}
+	if ir := loadTestItem(t, tl, "intact"); ir.DataHash == nil || *ir.DataHash != *intact.DataHash {
+		t.Error("expected intact item to be left alone")
+	}
+	if countRows("relationships") != 1 || countRows("collection_items") != 0 {
+		t.Error("expected only dangling rows to be deleted")
+	}
+
+	// and then the repository is fine
+	report, err = tl.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.ItemsChecked != 1 {
+		t.Errorf("expected no problems after repair and 1 item checked, got %+v", report)
+	}
+}
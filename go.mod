@@ -4,11 +4,10 @@ go 1.13
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/dgryski/go-metro v0.0.0-20180109044635-280f6062b5bc // indirect
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/mholt/archiver/v3 v3.3.0
-	github.com/seiflotfy/cuckoofilter v0.0.0-20200323075608-c8f23b6b6cef
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
 	github.com/ttacon/libphonenumber v1.1.0
+	golang.org/x/crypto v0.20.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
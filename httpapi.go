@@ -0,0 +1,431 @@
+package timeliner
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewAPIHandler returns an HTTP handler that serves a read-only
+// JSON API over the timeline. All endpoints accept only GET (and
+// HEAD) requests:
+//
+//	/api/items                items by time range, oldest first, one page
+//	                          at a time (see below)
+//	/api/items/{id}           an item, with its relationships and collections
+//	/api/items/{id}/data      the item's data file; supports Range requests
+//	/api/persons              all persons, with their identities
+//	/api/persons/{id}         a person, with their identities
+//	/api/accounts             all accounts
+//	/api/search?q=...         full-text search, if available; also accepts
+//	                          limit and offset
+//
+// The items endpoint accepts these query string parameters, all
+// optional: start and end (RFC 3339 timestamps or Unix seconds;
+// start is inclusive, end is exclusive), account and person (row
+// IDs), data_source, and class, each of which may be repeated to
+// match any of the values; reverse=true to list newest first;
+// limit (at most 1000); and cursor, to get the next page of a
+// previous listing using the next_cursor value of its response.
+//
+// Data files are served with a sandboxing content security policy,
+// and those of types that can run script, such as HTML and SVG, are
+// served as attachments rather than inline.
+//
+// Errors are returned as a JSON object with an "error" field.
+func NewAPIHandler(t *Timeline) http.Handler {
+	api := &apiHandler{tl: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/items", api.handleItems)
+	mux.HandleFunc("/api/items/", api.handleItem)
+	mux.HandleFunc("/api/persons", api.handlePersons)
+	mux.HandleFunc("/api/persons/", api.handlePerson)
+	mux.HandleFunc("/api/accounts", api.handleAccounts)
+	mux.HandleFunc("/api/search", api.handleSearch)
+	return api.readOnly(mux)
+}
+
+type apiHandler struct {
+	tl *Timeline
+}
+
+// readOnly rejects requests that are not GET or HEAD.
+func (api *apiHandler) readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			api.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *apiHandler) handleItems(w http.ResponseWriter, r *http.Request) {
+	q, err := parseItemQuery(r)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := api.tl.QueryItems(r.Context(), q)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if results.Items == nil {
+		results.Items = []ItemRow{}
+	}
+
+	api.writeJSON(w, struct {
+		Items      []ItemRow `json:"items"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+		PrevCursor string    `json:"prev_cursor,omitempty"`
+	}{
+		Items:      results.Items,
+		NextCursor: results.NextCursor,
+		PrevCursor: results.PrevCursor,
+	})
+}
+
+// handleItem serves /api/items/{id} and /api/items/{id}/data.
+func (api *apiHandler) handleItem(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/items/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "data") {
+		api.writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+	itemID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid item ID: %s", parts[0]))
+		return
+	}
+
+	ir, err := api.tl.LoadItem(r.Context(), itemID)
+	if err == sql.ErrNoRows {
+		api.writeError(w, http.StatusNotFound, fmt.Errorf("item not found: %d", itemID))
+		return
+	}
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(parts) == 2 {
+		api.serveDataFile(w, r, ir)
+		return
+	}
+
+	rels, err := api.tl.ItemRelationships(r.Context(), itemID)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	colls, err := api.tl.ItemCollections(r.Context(), itemID)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rels == nil {
+		rels = []Relationship{}
+	}
+	if colls == nil {
+		colls = []CollectionMembership{}
+	}
+
+	api.writeJSON(w, struct {
+		Item          ItemRow                `json:"item"`
+		Relationships []Relationship         `json:"relationships"`
+		Collections   []CollectionMembership `json:"collections"`
+	}{
+		Item:          ir,
+		Relationships: rels,
+		Collections:   colls,
+	})
+}
+
+// serveDataFile streams the data file of ir. Range and
+// conditional requests are handled by http.ServeContent.
+func (api *apiHandler) serveDataFile(w http.ResponseWriter, r *http.Request, ir ItemRow) {
+	f, err := api.tl.OpenDataFile(ir)
+	if os.IsNotExist(err) {
+		api.writeError(w, http.StatusNotFound, fmt.Errorf("item %d has no data file", ir.ID))
+		return
+	}
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := api.tl.StatDataFile(ir)
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// determine the content type as http.ServeContent would,
+	// so we know whether the file is one that can run script
+	var ctype string
+	if ir.MIMEType != nil && *ir.MIMEType != "" {
+		ctype = *ir.MIMEType
+	} else if ctype = mime.TypeByExtension(filepath.Ext(ir.DataFileName())); ctype == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		ctype = http.DetectContentType(buf[:n])
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			api.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// data files come from elsewhere and are not to be trusted;
+	// don't let them run script in the origin of the API
+	disposition := "inline"
+	if canRunScript(ctype) {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, ir.DataFileName()))
+	if ir.DataHash != nil {
+		w.Header().Set("ETag", `"`+*ir.DataHash+`"`)
+	}
+
+	http.ServeContent(w, r, ir.DataFileName(), info.ModTime(), f)
+}
+
+// canRunScript returns true if a browser may run
+// script in a document of the MIME type ctype.
+func canRunScript(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return true
+	}
+	switch mediaType {
+	case "text/html",
+		"application/xhtml+xml",
+		"image/svg+xml",
+		"text/xml",
+		"application/xml",
+		"text/xsl",
+		"application/xslt+xml",
+		"text/javascript",
+		"application/javascript",
+		"application/ecmascript",
+		"application/pdf":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+func (api *apiHandler) handlePersons(w http.ResponseWriter, r *http.Request) {
+	persons, err := api.tl.Persons(r.Context())
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if persons == nil {
+		persons = []Person{}
+	}
+	api.writeJSON(w, persons)
+}
+
+func (api *apiHandler) handlePerson(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/persons/")
+	personID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid person ID: %s", idStr))
+		return
+	}
+	p, err := api.tl.LoadPerson(r.Context(), personID)
+	if err == sql.ErrNoRows {
+		api.writeError(w, http.StatusNotFound, fmt.Errorf("person not found: %d", personID))
+		return
+	}
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	api.writeJSON(w, p)
+}
+
+func (api *apiHandler) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts, err := api.tl.Accounts()
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// only expose what identifies the account, never its authorization
+	type apiAccount struct {
+		ID           int64  `json:"id"`
+		DataSourceID string `json:"data_source_id"`
+		UserID       string `json:"user_id"`
+	}
+	list := []apiAccount{}
+	for _, acc := range accounts {
+		list = append(list, apiAccount{
+			ID:           acc.ID,
+			DataSourceID: acc.DataSourceID,
+			UserID:       acc.UserID,
+		})
+	}
+	api.writeJSON(w, list)
+}
+
+func (api *apiHandler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseItemQuery(r)
+	if err != nil {
+		api.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sq := SearchQuery{
+		Text:   r.FormValue("q"),
+		Filter: filter,
+		Limit:  filter.Limit,
+	}
+	if offset := r.FormValue("offset"); offset != "" {
+		sq.Offset, err = strconv.Atoi(offset)
+		if err != nil || sq.Offset < 0 {
+			api.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %s", offset))
+			return
+		}
+	}
+	if sq.Text == "" {
+		api.writeError(w, http.StatusBadRequest, fmt.Errorf("missing search query (q)"))
+		return
+	}
+
+	results, err := api.tl.Search(r.Context(), sq)
+	if err == ErrSearchUnavailable || err == ErrSearchEncrypted {
+		api.writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		api.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type apiSearchResult struct {
+		Item    ItemRow `json:"item"`
+		Snippet string  `json:"snippet"`
+		Rank    float64 `json:"rank"`
+	}
+	list := []apiSearchResult{}
+	for _, sr := range results {
+		list = append(list, apiSearchResult{sr.Item, sr.Snippet, sr.Rank})
+	}
+	api.writeJSON(w, list)
+}
+
+// parseItemQuery reads an ItemQuery from the query string of r.
+func parseItemQuery(r *http.Request) (ItemQuery, error) {
+	var q ItemQuery
+	form := r.URL.Query()
+
+	for _, bound := range []struct {
+		param string
+		dest  **time.Time
+	}{
+		{"start", &q.Timeframe.Since},
+		{"end", &q.Timeframe.Until},
+	} {
+		val := form.Get(bound.param)
+		if val == "" {
+			continue
+		}
+		ts, err := parseAPITime(val)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s: %v", bound.param, err)
+		}
+		*bound.dest = &ts
+	}
+
+	for _, val := range form["account"] {
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid account ID: %s", val)
+		}
+		q.AccountIDs = append(q.AccountIDs, id)
+	}
+	for _, val := range form["person"] {
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid person ID: %s", val)
+		}
+		q.PersonIDs = append(q.PersonIDs, id)
+	}
+	q.DataSourceIDs = form["data_source"]
+	for _, val := range form["class"] {
+		if _, ok := itemClassNames[val]; !ok {
+			return q, fmt.Errorf("unknown item class: %s", val)
+		}
+		q.Classes = append(q.Classes, ParseItemClass(val))
+	}
+
+	if val := form.Get("reverse"); val != "" {
+		reverse, err := strconv.ParseBool(val)
+		if err != nil {
+			return q, fmt.Errorf("invalid reverse: %s", val)
+		}
+		q.Reverse = reverse
+	}
+	if val := form.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			return q, fmt.Errorf("invalid limit: %s", val)
+		}
+		if limit > maxAPILimit {
+			limit = maxAPILimit
+		}
+		q.Limit = limit
+	}
+	q.Cursor = form.Get("cursor")
+
+	return q, nil
+}
+
+// parseAPITime parses an RFC 3339 timestamp or Unix seconds.
+func parseAPITime(val string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+func (api *apiHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		log.Printf("[ERROR] Writing API response: %v", err)
+	}
+}
+
+func (api *apiHandler) writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		log.Printf("[ERROR] API: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// maxAPILimit is the maximum number of items
+// the API returns in a single response.
+const maxAPILimit = 1000
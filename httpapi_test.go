@@ -0,0 +1,89 @@
+package timeliner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeDataFileHeaders(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		item        testItem
+		contentType string
+		attachment  bool
+	}{
+		{
+			item:        testItem{fileName: "notes.txt", file: "just text"},
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			item:        testItem{fileName: "page.html", file: "<script>alert(1)</script>"},
+			contentType: "text/html; charset=utf-8",
+			attachment:  true,
+		},
+		{
+			item:        testItem{fileName: "drawing.svg", file: `<svg xmlns="http://www.w3.org/2000/svg"></svg>`},
+			contentType: "image/svg+xml",
+			attachment:  true,
+		},
+		{
+			// no extension, so the type is sniffed from the content
+			item:        testItem{fileName: "download", file: "<html><script>alert(1)</script></html>"},
+			contentType: "text/html; charset=utf-8",
+			attachment:  true,
+		},
+	}
+	var graphs []*ItemGraph
+	for i := range tests {
+		tests[i].item.id = fmt.Sprintf("item%d", i)
+		tests[i].item.ts = ts.Add(time.Duration(i) * time.Hour)
+		tests[i].item.class = ClassPost
+		graphs = append(graphs, NewItemGraph(tests[i].item))
+	}
+	testGetAll(t, tl, "me", graphs...)
+
+	res, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Items) != len(tests) {
+		t.Fatalf("expected %d items, got %d", len(tests), len(res.Items))
+	}
+
+	handler := NewAPIHandler(tl)
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/items/%d/data", res.Items[i].ID), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("test %d: expected status 200, got %d: %s", i, rec.Code, rec.Body.String())
+			continue
+		}
+		if body := rec.Body.String(); body != test.item.file {
+			t.Errorf("test %d: expected body %q, got %q", i, test.item.file, body)
+		}
+		h := rec.Header()
+		if ct := h.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("test %d: expected Content-Type %q, got %q", i, test.contentType, ct)
+		}
+		if v := h.Get("X-Content-Type-Options"); v != "nosniff" {
+			t.Errorf("test %d: expected X-Content-Type-Options nosniff, got %q", i, v)
+		}
+		if v := h.Get("Content-Security-Policy"); v != "sandbox" {
+			t.Errorf("test %d: expected Content-Security-Policy sandbox, got %q", i, v)
+		}
+		disposition := h.Get("Content-Disposition")
+		if attachment := strings.HasPrefix(disposition, "attachment;"); attachment != test.attachment {
+			t.Errorf("test %d: expected attachment=%t, got Content-Disposition %q", i, test.attachment, disposition)
+		}
+	}
+}
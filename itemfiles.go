@@ -1,9 +1,7 @@
 package timeliner
 
 import (
-	"crypto/sha256"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	"hash"
 	"io"
@@ -11,14 +9,13 @@ import (
 	mathrand "math/rand"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 )
 
 // downloadItemFile ... TODO: finish godoc.
-func (t *Timeline) downloadItemFile(src io.ReadCloser, dest *os.File, h hash.Hash) (int64, error) {
+func (t *Timeline) downloadItemFile(src io.ReadCloser, dest io.WriteCloser, dataFile string, h hash.Hash) (int64, error) {
 	if src == nil {
 		return 0, fmt.Errorf("missing reader with which to download file")
 	}
@@ -33,12 +30,13 @@ func (t *Timeline) downloadItemFile(src io.ReadCloser, dest *os.File, h hash.Has
 
 	n, err := io.Copy(dest, tr)
 	if err != nil {
-		os.Remove(dest.Name())
+		dest.Close()
+		t.store.Remove(dataFile)
 		return n, fmt.Errorf("copying contents: %v", err)
 	}
-	if err := dest.Sync(); err != nil {
-		os.Remove(dest.Name())
-		return n, fmt.Errorf("syncing file: %v", err)
+	if err := dest.Close(); err != nil {
+		t.store.Remove(dataFile)
+		return n, fmt.Errorf("finishing file: %v", err)
 	}
 
 	// TODO: If mime type is photo or video, extract most important EXIF data and return it for storage in DB?
@@ -51,25 +49,23 @@ func (t *Timeline) downloadItemFile(src io.ReadCloser, dest *os.File, h hash.Has
 // with its plain, canonical data file name, then improvising
 // and making unique if necessary. If there is no error, the
 // return value is always a usable data file name.
-func (t *Timeline) openUniqueCanonicalItemDataFile(it Item, dataSourceID string) (*os.File, *string, error) {
+func (t *Timeline) openUniqueCanonicalItemDataFile(it Item, dataSourceID string) (io.WriteCloser, *string, error) {
 	if dataSourceID == "" {
 		return nil, nil, fmt.Errorf("missing service ID")
 	}
 
 	dir := t.canonicalItemDataFileDir(it, dataSourceID)
+	return t.openUniqueDataFile(path.Join(dir, t.canonicalItemDataFileName(it, dataSourceID)))
+}
 
-	err := os.MkdirAll(t.fullpath(dir), 0700)
-	if err != nil {
-		return nil, nil, fmt.Errorf("making directory for data file: %v", err)
-	}
-
-	tryPath := path.Join(dir, t.canonicalItemDataFileName(it, dataSourceID))
+// openUniqueDataFile creates a data file named tryPath, or, if
+// that name is taken, the first available name that is made by
+// adding a number to it.
+func (t *Timeline) openUniqueDataFile(tryPath string) (io.WriteCloser, *string, error) {
 	lastAppend := path.Ext(tryPath)
 
 	for i := 0; i < 100; i++ {
-		fullFilePath := t.fullpath(filepath.FromSlash(tryPath))
-
-		f, err := os.OpenFile(fullFilePath, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+		f, err := t.store.Create(tryPath)
 		if os.IsExist(err) {
 			ext := path.Ext(tryPath)
 			tryPath = strings.TrimSuffix(tryPath, lastAppend)
@@ -158,10 +154,13 @@ func (t *Timeline) ensureDataFileNameShortEnough(filename string) string {
 	return filename
 }
 
+// replaceWithExisting deletes the data file named canonical if an identical
+// file (by checksum) is already stored for another item, and returns the name
+// of the data file the item should use: either the existing one or canonical.
 // TODO:/NOTE: If changing a file name, all items with same data_hash must also be updated to use same file name
-func (t *Timeline) replaceWithExisting(canonical *string, checksumBase64 string, itemRowID int64) error {
+func (t *Timeline) replaceWithExisting(canonical *string, checksumBase64 string, itemRowID int64) (*string, error) {
 	if canonical == nil || *canonical == "" || checksumBase64 == "" {
-		return fmt.Errorf("missing data filename and/or hash of contents")
+		return canonical, fmt.Errorf("missing data filename and/or hash of contents")
 	}
 
 	var existingDatafile *string
@@ -169,56 +168,44 @@ func (t *Timeline) replaceWithExisting(canonical *string, checksumBase64 string,
 		WHERE data_hash = ? AND id != ? LIMIT 1`,
 		checksumBase64, itemRowID).Scan(&existingDatafile)
 	if err == sql.ErrNoRows {
-		return nil // file is unique; carry on
+		return canonical, nil // file is unique; carry on
 	}
 	if err != nil {
-		return fmt.Errorf("querying DB: %v", err)
+		return canonical, fmt.Errorf("querying DB: %v", err)
 	}
 
 	// file is a duplicate!
 
 	if existingDatafile == nil {
 		// ... that's weird, how's this possible? it has a hash but no file name recorded
-		return fmt.Errorf("item with matching hash is missing data file name; hash: %s", checksumBase64)
+		return canonical, fmt.Errorf("item with matching hash is missing data file name; hash: %s", checksumBase64)
 	}
 
 	// ensure the existing file is still the same
-	h := sha256.New()
-	f, err := os.Open(t.fullpath(*existingDatafile))
-	if err != nil {
-		return fmt.Errorf("opening existing file: %v", err)
-	}
-	defer f.Close()
-
-	_, err = io.Copy(h, f)
+	b64ExistingFileHash, err := t.hashDataFile(*existingDatafile)
 	if err != nil {
-		return fmt.Errorf("checking file integrity: %v", err)
+		return canonical, fmt.Errorf("checking file integrity: %v", err)
 	}
 
-	existingFileHash := h.Sum(nil)
-	b64ExistingFileHash := base64.StdEncoding.EncodeToString(existingFileHash)
-
 	// if the existing file was modified; restore it with
 	// what we just downloaded, which presumably succeeded
 	if checksumBase64 != b64ExistingFileHash {
 		log.Printf("[INFO] Restoring modified data file: %s was '%s' but is now '%s'",
-			*existingDatafile, checksumBase64, existingFileHash)
-		err := os.Rename(t.fullpath(*canonical), t.fullpath(*existingDatafile))
+			*existingDatafile, checksumBase64, b64ExistingFileHash)
+		err := t.store.Rename(*canonical, *existingDatafile)
 		if err != nil {
-			return fmt.Errorf("replacing modified data file: %v", err)
+			return canonical, fmt.Errorf("replacing modified data file: %v", err)
 		}
 	}
 
 	// everything checks out; delete the newly-downloaded file
 	// and use the existing file instead of duplicating it
-	err = os.Remove(t.fullpath(*canonical))
+	err = t.store.Remove(*canonical)
 	if err != nil {
-		return fmt.Errorf("removing duplicate data file: %v", err)
+		return canonical, fmt.Errorf("removing duplicate data file: %v", err)
 	}
 
-	canonical = existingDatafile
-
-	return nil
+	return existingDatafile, nil
 }
 
 // randomString returns a string of n random characters.
@@ -241,12 +228,27 @@ func randomString(n int, sameCase bool) string {
 	return string(b)
 }
 
-func (t *Timeline) fullpath(canonicalDatafileName string) string {
-	return filepath.Join(t.repoDir, filepath.FromSlash(canonicalDatafileName))
+// OpenDataFile opens the data file of ir for reading. If the item
+// has no data file, or its download was not completed, an error
+// satisfying os.IsNotExist is returned.
+func (t *Timeline) OpenDataFile(ir ItemRow) (BlobFile, error) {
+	if ir.DataFile == nil || ir.DataHash == nil {
+		return nil, &os.PathError{Op: "open", Path: fmt.Sprintf("data file of item %d", ir.ID), Err: os.ErrNotExist}
+	}
+	return t.store.Open(*ir.DataFile)
+}
+
+// StatDataFile returns information about the data file
+// of ir, as stored in the timeline's BlobStore.
+func (t *Timeline) StatDataFile(ir ItemRow) (os.FileInfo, error) {
+	if ir.DataFile == nil || ir.DataHash == nil {
+		return nil, &os.PathError{Op: "stat", Path: fmt.Sprintf("data file of item %d", ir.ID), Err: os.ErrNotExist}
+	}
+	return t.store.Stat(*ir.DataFile)
 }
 
 func (t *Timeline) datafileExists(canonicalDatafileName string) bool {
-	_, err := os.Stat(t.fullpath(canonicalDatafileName))
+	_, err := t.store.Stat(canonicalDatafileName)
 	return !os.IsNotExist(err)
 }
 
@@ -3,7 +3,11 @@ package timeliner
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"path"
+	"reflect"
 	"time"
 )
 
@@ -144,6 +148,46 @@ const (
 	ClassMessage
 )
 
+// String returns the name of the item class.
+func (ic ItemClass) String() string {
+	for name, class := range itemClassNames {
+		if class == ic {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the item class as its name.
+func (ic ItemClass) MarshalText() ([]byte, error) {
+	return []byte(ic.String()), nil
+}
+
+// UnmarshalText decodes an item class from its name.
+func (ic *ItemClass) UnmarshalText(text []byte) error {
+	*ic = ParseItemClass(string(text))
+	return nil
+}
+
+// ParseItemClass returns the item class with the given
+// name, as returned by ItemClass.String. Unrecognized
+// names are parsed as ClassUnknown.
+func ParseItemClass(name string) ItemClass {
+	return itemClassNames[name]
+}
+
+var itemClassNames = map[string]ItemClass{
+	"unknown":         ClassUnknown,
+	"image":           ClassImage,
+	"video":           ClassVideo,
+	"audio":           ClassAudio,
+	"post":            ClassPost,
+	"location":        ClassLocation,
+	"email":           ClassEmail,
+	"private_message": ClassPrivateMessage,
+	"message":         ClassMessage,
+}
+
 // These are the standard relationships that Timeliner
 // recognizes. Using these known relationships is not
 // required, but it makes it easier to translate them to
@@ -157,29 +201,49 @@ var (
 
 // ItemRow has the structure of an item's row in our DB.
 type ItemRow struct {
-	ID         int64
-	AccountID  int64
-	OriginalID string
-	PersonID   int64
-	Timestamp  time.Time
-	Stored     time.Time
-	Modified   *time.Time
-	Class      ItemClass
-	MIMEType   *string
-	DataText   *string
-	DataFile   *string
-	DataHash   *string // base64-encoded SHA-256
-	Metadata   *Metadata
+	ID         int64      `json:"id"`
+	AccountID  int64      `json:"account_id"`
+	OriginalID string     `json:"original_id"`
+	PersonID   int64      `json:"person_id"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Stored     time.Time  `json:"stored"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Class      ItemClass  `json:"class"`
+	MIMEType   *string    `json:"mime_type,omitempty"`
+	DataText   *string    `json:"data_text,omitempty"`
+	DataFile   *string    `json:"data_file,omitempty"`
+	DataHash   *string    `json:"data_hash,omitempty"` // base64-encoded SHA-256
+	Metadata   *Metadata  `json:"metadata,omitempty"`
 	Location
 
+	// In the blobs layout, the path the data file would
+	// have in the canonical layout, without the "data/"
+	// prefix; it is used to make a friendlier view of the
+	// data files, which are otherwise named by checksum.
+	ViewPath *string `json:"view_path,omitempty"`
+
 	metaGob []byte // use Metadata.(encode/decode)
 	item    Item
 }
 
+// DataFileName returns the name of the item's data file
+// as it should be shown to people: the last component of
+// its view path if it has one, or of its data file. It
+// returns an empty string if the item has no data file.
+func (ir ItemRow) DataFileName() string {
+	if ir.ViewPath != nil && *ir.ViewPath != "" {
+		return path.Base(*ir.ViewPath)
+	}
+	if ir.DataFile != nil && *ir.DataFile != "" {
+		return path.Base(*ir.DataFile)
+	}
+	return ""
+}
+
 // Location contains location information.
 type Location struct {
-	Latitude  *float64
-	Longitude *float64
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
 }
 
 // ItemGraph is an item with optional connections to other items.
@@ -242,11 +306,19 @@ type ItemGraph struct {
 	// In other words, this is a best-effort field;
 	// useful for forming relationships of existing
 	// items, but without access to the actual items
-	// themselves. If you have the items involved in
-	// the relationships, use Edges instead.
+	// themselves. Items that were sent on the item
+	// channel before this graph are stored before
+	// its relations are added. If you have the items
+	// involved in the relationships, use Edges instead.
 	//
 	// Optional.
 	Relations []RawRelation
+
+	// If not nil, this graph is not from the data
+	// source; it carries a checkpoint through the
+	// item channel, so that the checkpoint can be
+	// saved after the items listed before it.
+	checkpoint *checkpointMarker
 }
 
 // NewItemGraph returns a new node/graph.
@@ -362,63 +434,203 @@ type CollectionItem struct {
 type Metadata struct {
 	// A hash or etag provided by the service to
 	// make it easy to know if it has changed
-	ServiceHash []byte
+	ServiceHash []byte `json:"service_hash,omitempty"`
 
 	// Locations
-	LocationAccuracy int
-	Altitude         int // meters
-	AltitudeAccuracy int
-	Heading          int // degrees
-	Velocity         int
+	LocationAccuracy int `json:"location_accuracy,omitempty"`
+	Altitude         int `json:"altitude,omitempty"` // meters
+	AltitudeAccuracy int `json:"altitude_accuracy,omitempty"`
+	Heading          int `json:"heading,omitempty"` // degrees
+	Velocity         int `json:"velocity,omitempty"`
 
-	GeneralArea string // natural language description of a location
+	GeneralArea string `json:"general_area,omitempty"` // natural language description of a location
 
 	// Photos and videos
-	EXIF map[string]interface{}
+	EXIF map[string]interface{} `json:"exif,omitempty"`
 	// TODO: Should we have some of the "most important" EXIF fields explicitly here?
 
-	Width  int
-	Height int
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
 
 	// TODO: Google Photos (how many of these belong in EXIF?)
-	CameraMake      string
-	CameraModel     string
-	FocalLength     float64
-	ApertureFNumber float64
-	ISOEquivalent   int
-	ExposureTime    time.Duration
+	CameraMake      string        `json:"camera_make,omitempty"`
+	CameraModel     string        `json:"camera_model,omitempty"`
+	FocalLength     float64       `json:"focal_length,omitempty"`
+	ApertureFNumber float64       `json:"aperture_f_number,omitempty"`
+	ISOEquivalent   int           `json:"iso_equivalent,omitempty"`
+	ExposureTime    time.Duration `json:"exposure_time,omitempty"`
 
-	FPS float64 // Frames Per Second
+	FPS float64 `json:"fps,omitempty"` // Frames Per Second
 
 	// Posts (Facebook so far)
-	Link        string
-	Description string
-	Name        string
-	ParentID    string
-	StatusType  string
-	Type        string
-
-	Shares int // aka "Retweets" or "Reshares"
-	Likes  int
+	Link        string `json:"link,omitempty"`
+	Description string `json:"description,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ParentID    string `json:"parent_id,omitempty"`
+	StatusType  string `json:"status_type,omitempty"`
+	Type        string `json:"type,omitempty"`
+
+	Shares int `json:"shares,omitempty"` // aka "Retweets" or "Reshares"
+	Likes  int `json:"likes,omitempty"`
+}
+
+// isEmpty returns true if no fields of m are set.
+func (m *Metadata) isEmpty() bool {
+	return reflect.DeepEqual(*m, Metadata{})
 }
 
 func (m *Metadata) encode() ([]byte, error) {
-	// then encode the actual data, and trim off
-	// schema from the beginning
 	buf := new(bytes.Buffer)
 	err := gob.NewEncoder(buf).Encode(m)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes()[len(metadataGobPrefix):], nil
+	// trim off the schema from the beginning, as well as the
+	// length and type ID of the message; they are restored
+	// when decoding
+	_, fields, err := splitMetadataMessage(buf.Bytes()[len(metadataGobPrefix):])
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{metadataFormat}, fields...), nil
 }
 
 func (m *Metadata) decode(b []byte) error {
-	if b == nil {
-		return nil
+	_, err := m.decodeStored(b)
+	return err
+}
+
+// decodeStored decodes metadata b as stored in the database,
+// and reports whether it was stored in the original format (see
+// decodeLegacy). If it was, but it can't be recovered, the error
+// is errMetadataLost, and m is left empty.
+func (m *Metadata) decodeStored(b []byte) (legacy bool, err error) {
+	*m = Metadata{}
+	if len(b) == 0 {
+		return false, nil
+	}
+	if b[0] == metadataFormat {
+		return false, m.decodeFields(b[1:])
+	}
+	err = m.decodeLegacy(b)
+	if err != nil {
+		*m = Metadata{}
+	}
+	return true, err
+}
+
+// decodeFields decodes the fields of a Metadata message, with
+// the current type definition and type ID of Metadata, since
+// gob type IDs depend on the order in which types are first
+// encoded by the program.
+func (m *Metadata) decodeFields(fields []byte) error {
+	full := append([]byte{}, metadataGobPrefix...)
+	full = append(full, encodeGobUint(uint64(len(metadataTypeID)+len(fields)))...)
+	full = append(full, metadataTypeID...)
+	full = append(full, fields...)
+	*m = Metadata{}
+	return gob.NewDecoder(bytes.NewReader(full)).Decode(m)
+}
+
+// decodeLegacy decodes metadata b that was stored in the
+// original format, which trimmed as many bytes off the front
+// of the gob message as the message of an empty Metadata{}
+// has: one for its length, its type ID, and one for the end
+// of its fields. How many bytes the length of b's message took
+// follows from the length of b, so what is left of the header
+// can be skipped. But if the length took only one byte (for
+// messages shorter than 128 bytes), the first byte of the
+// fields, which is the number of the first field that is set,
+// was trimmed as well; then errMetadataLost is returned.
+func (m *Metadata) decodeLegacy(b []byte) error {
+	trim := len(legacyMetadataGobPrefix) - len(metadataGobPrefix)
+	typeLen := len(metadataTypeID)
+
+	for lenLen := 1; lenLen <= 9; lenLen++ {
+		// the message had lenLen+typeLen bytes of header,
+		// and b is all but the first trim bytes of it
+		fieldsLen := len(b) + trim - lenLen - typeLen
+		if fieldsLen < 0 || len(encodeGobUint(uint64(typeLen+fieldsLen))) != lenLen {
+			continue
+		}
+		if fieldsLen > len(b) {
+			return errMetadataLost
+		}
+		return m.decodeFields(b[len(b)-fieldsLen:])
+	}
+
+	return fmt.Errorf("metadata in the original format has an invalid length")
+}
+
+// splitMetadataMessage splits a gob message of Metadata
+// into its type ID and its fields, after checking that
+// its length matches.
+func splitMetadataMessage(msg []byte) (typeID, fields []byte, err error) {
+	length, n, err := decodeGobUint(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length != uint64(len(msg)-n) {
+		return nil, nil, fmt.Errorf("message length is %d, but %d bytes follow", length, len(msg)-n)
+	}
+	_, idLen, err := decodeGobUint(msg[n:]) // a signed int, but only its length matters
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding type ID: %v", err)
+	}
+	return msg[n : n+idLen], msg[n+idLen:], nil
+}
+
+// decodeGobUint decodes an unsigned integer as encoded
+// by gob from the beginning of b, and returns it along
+// with the number of bytes it took.
+func decodeGobUint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("no bytes to decode")
+	}
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1, nil
+	}
+	n := -int(int8(b[0]))
+	if n > 8 || len(b) < 1+n {
+		return 0, 0, fmt.Errorf("invalid unsigned integer")
+	}
+	var x uint64
+	for _, c := range b[1 : 1+n] {
+		x = x<<8 | uint64(c)
+	}
+	return x, 1 + n, nil
+}
+
+// encodeGobUint encodes x as an unsigned integer the way
+// gob does: as a single byte if it is small, otherwise as
+// its byte count, negated, followed by its bytes.
+func encodeGobUint(x uint64) []byte {
+	if x < 0x80 {
+		return []byte{byte(x)}
+	}
+	var bs []byte
+	for ; x > 0; x >>= 8 {
+		bs = append([]byte{byte(x)}, bs...)
 	}
-	fullGob := append(metadataGobPrefix, b...)
-	return gob.NewDecoder(bytes.NewReader(fullGob)).Decode(m)
+	return append([]byte{byte(-len(bs))}, bs...)
 }
 
-var metadataGobPrefix []byte
+// metadataGobPrefix is the gob-encoded type definition of
+// Metadata; it is omitted when storing encoded metadata.
+// legacyMetadataGobPrefix is the longer prefix that was
+// omitted in the original format (see decodeLegacy), and
+// metadataTypeID is the gob-encoded type ID of Metadata.
+var metadataGobPrefix, legacyMetadataGobPrefix, metadataTypeID []byte
+
+// metadataFormat is the first byte of metadata as it is stored
+// in the database, followed by the fields of its gob message.
+// Metadata stored in the original format never starts with it:
+// that starts with a gob unsigned integer, of which the first
+// byte is below 0x80 or above 0xF7, or with the rest of the
+// message's type ID, which is small and even (type IDs are
+// encoded as signed integers).
+const metadataFormat = 0x81
+
+// errMetadataLost is returned when metadata stored in the
+// original format lost too much to be recovered.
+var errMetadataLost = errors.New("metadata was stored in the original format, which lost part of it, and can't be recovered")
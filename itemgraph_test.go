@@ -0,0 +1,202 @@
+package timeliner
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataEncodeDecode(t *testing.T) {
+	for i, m := range []Metadata{
+		{},
+		{Name: "hello"},
+		{ServiceHash: []byte("etag"), Likes: 3, Shares: 2},
+		{EXIF: map[string]interface{}{"Make": "Camera", "FNumber": 1.8}, Width: 4000, Height: 3000},
+		{Description: strings.Repeat("long ", 100), ExposureTime: time.Second / 60},
+	} {
+		b, err := m.encode()
+		if err != nil {
+			t.Fatalf("test %d: encoding: %v", i, err)
+		}
+		var out Metadata
+		legacy, err := out.decodeStored(b)
+		if err != nil {
+			t.Fatalf("test %d: decoding: %v", i, err)
+		}
+		if legacy {
+			t.Errorf("test %d: expected current format", i)
+		}
+		if !reflect.DeepEqual(out, m) {
+			t.Errorf("test %d: expected %+v, got %+v", i, m, out)
+		}
+
+		// the type ID of Metadata depends on the order in which
+		// a program first encodes types, so it is not stored
+		if b[0] != metadataFormat || bytes.Contains(b, metadataTypeID) {
+			t.Errorf("test %d: expected format byte followed by fields only, got %x", i, b)
+		}
+	}
+}
+
+// encodeBaselineMetadata encodes m as the original version of
+// Metadata.encode did, trimming the encoding of Metadata{}.
+func encodeBaselineMetadata(t *testing.T, m Metadata) []byte {
+	t.Helper()
+	tdBuf := new(bytes.Buffer)
+	err := gob.NewEncoder(tdBuf).Encode(Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()[tdBuf.Len():]
+}
+
+func TestMetadataDecodeBaseline(t *testing.T) {
+	for i, test := range []struct {
+		meta Metadata
+		lost bool
+	}{
+		// messages of 128 bytes or more lost only their header
+		{meta: Metadata{Description: strings.Repeat("a", 150), Likes: 2}},
+		{meta: Metadata{Description: strings.Repeat("b", 300), Name: "name"}},
+		{meta: Metadata{Description: strings.Repeat("c", 70000)}},
+
+		// shorter messages lost the number of their first field
+		{meta: Metadata{EXIF: map[string]interface{}{"Make": "Camera"}}, lost: true},
+		{meta: Metadata{ServiceHash: []byte("etag"), Link: "http://example.com", Likes: 4}, lost: true},
+		{meta: Metadata{Name: "hello"}, lost: true},
+		{meta: Metadata{Likes: 3, Shares: 2}, lost: true},
+	} {
+		var out Metadata
+		legacy, err := out.decodeStored(encodeBaselineMetadata(t, test.meta))
+		if !legacy {
+			t.Errorf("test %d: expected original format", i)
+		}
+		if test.lost {
+			if err != errMetadataLost {
+				t.Errorf("test %d: expected errMetadataLost, got %v", i, err)
+			}
+			if !reflect.DeepEqual(out, Metadata{}) {
+				t.Errorf("test %d: expected empty metadata, got %+v", i, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: decoding: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.meta) {
+			t.Errorf("test %d: expected %+v, got %+v", i, test.meta, out)
+		}
+	}
+
+	// the original format is told apart by its first byte alone,
+	// whatever the length of the message and its first field
+	lengths := []int{65530, 65540}
+	for n := 1; n < 300; n++ {
+		lengths = append(lengths, n)
+	}
+	for _, n := range lengths {
+		for _, m := range []Metadata{
+			{ServiceHash: bytes.Repeat([]byte{metadataFormat}, n)},
+			{Altitude: -n - 1, Description: strings.Repeat("\x81", n)},
+			{FocalLength: float64(n) + 0.5, Name: strings.Repeat("x", n)},
+			{Description: strings.Repeat("y", n)},
+		} {
+			b := encodeBaselineMetadata(t, m)
+			if b[0] == metadataFormat {
+				t.Errorf("metadata in the original format starts with the format byte: %+v", m)
+			}
+			var out Metadata
+			legacy, err := out.decodeStored(b)
+			if !legacy || (err != nil && err != errMetadataLost) {
+				t.Errorf("decoding metadata in the original format: legacy=%t err=%v", legacy, err)
+			}
+			if err == nil && !reflect.DeepEqual(out, m) {
+				t.Errorf("expected %+v, got %+v", m, out)
+			}
+		}
+	}
+}
+
+func TestFsckLegacyMetadata(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	recoverable := Metadata{Description: strings.Repeat("d", 200)}
+	lost := Metadata{Name: "hello"}
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "recoverable", ts: ts, class: ClassPost, meta: &recoverable}),
+		NewItemGraph(testItem{id: "lost", ts: ts, class: ClassPost, meta: &lost}))
+
+	// store their metadata as the original version did
+	itemIDs := make(map[string]int64)
+	for originalID, m := range map[string]Metadata{"recoverable": recoverable, "lost": lost} {
+		var id int64
+		err := tl.db.QueryRow(`SELECT id FROM items WHERE original_id=?`, originalID).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tl.db.Exec(`UPDATE items SET metadata=? WHERE id=?`, encodeBaselineMetadata(t, m), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itemIDs[originalID] = id
+	}
+
+	// the item whose metadata was lost can still be read
+	ir, err := tl.LoadItem(context.Background(), itemIDs["lost"])
+	if err != nil {
+		t.Fatalf("loading item with lost metadata: %v", err)
+	}
+	if !reflect.DeepEqual(*ir.Metadata, Metadata{}) {
+		t.Errorf("expected empty metadata, got %+v", ir.Metadata)
+	}
+	ir, err = tl.LoadItem(context.Background(), itemIDs["recoverable"])
+	if err != nil {
+		t.Fatalf("loading item with recoverable metadata: %v", err)
+	}
+	if !reflect.DeepEqual(*ir.Metadata, recoverable) {
+		t.Errorf("expected %+v, got %+v", recoverable, ir.Metadata)
+	}
+
+	report, err := tl.Fsck(context.Background(), FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := make(map[int64]FsckProblem)
+	for _, p := range report.Problems {
+		if p.Kind == FsckLegacyMetadata {
+			problems[p.ItemID] = p
+		}
+	}
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems with legacy metadata, got %+v", report.Problems)
+	}
+	if !problems[itemIDs["recoverable"]].Repaired {
+		t.Errorf("expected recoverable metadata to be repaired")
+	}
+	if problems[itemIDs["lost"]].Repaired {
+		t.Errorf("expected lost metadata not to be repaired")
+	}
+
+	var stored []byte
+	err = tl.db.QueryRow(`SELECT metadata FROM items WHERE id=?`, itemIDs["recoverable"]).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Metadata
+	legacy, err := m.decodeStored(stored)
+	if err != nil || legacy || !reflect.DeepEqual(m, recoverable) {
+		t.Errorf("expected repaired metadata in current format, got %+v (legacy=%t err=%v)", m, legacy, err)
+	}
+}
@@ -0,0 +1,95 @@
+package timeliner
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is the name of the file in the repository folder
+// which is locked by the process that has the timeline open for
+// writing. The file contains that process's PID.
+const lockFileName = "timeliner.lock"
+
+// InUseError is returned by Open if another process has the
+// timeline open for writing. Only one process can write to a
+// timeline at a time, but it can be opened read-only.
+type InUseError struct {
+	Repo string // the repository folder
+	PID  int    // the process holding the lock, or 0 if unknown
+}
+
+func (e *InUseError) Error() string {
+	holder := "another process"
+	if e.PID > 0 {
+		holder += fmt.Sprintf(" (PID %d)", e.PID)
+	}
+	return fmt.Sprintf("repository %s is in use by %s; only one process can write to it at a time",
+		e.Repo, holder)
+}
+
+// repoLock is an OS-level advisory lock on a repository.
+// The OS releases it if the process exits without
+// unlocking it, so it never has to be cleaned up.
+type repoLock struct {
+	f *os.File
+}
+
+// lockRepo takes the exclusive lock on the repository in repo,
+// failing immediately with an *InUseError if another process
+// already has it.
+func lockRepo(repo string) (*repoLock, error) {
+	lockPath := filepath.Join(repo, lockFileName)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %v", err)
+	}
+	err = lockFile(f)
+	if err == errLockHeld {
+		f.Close()
+		return nil, &InUseError{Repo: repo, PID: lockHolder(lockPath)}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %v", lockPath, err)
+	}
+
+	// the PID is only informational, so it's
+	// OK if it can't be written for some reason
+	if f.Truncate(0) == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &repoLock{f: f}, nil
+}
+
+// unlock releases the lock.
+func (l *repoLock) unlock() error {
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// lockHolder returns the PID in the lock file at
+// lockPath, or 0 if it cannot be read.
+func lockHolder(lockPath string) int {
+	contents, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// errLockHeld is returned by lockFile if
+// another process holds the lock.
+var errLockHeld = errors.New("lock is held by another process")
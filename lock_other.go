@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package timeliner
+
+import "os"
+
+// lockFile does nothing, since advisory
+// locks are not supported on this platform.
+func lockFile(f *os.File) error { return nil }
+
+// unlockFile does nothing.
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,54 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows
+// +build darwin dragonfly freebsd linux netbsd openbsd windows
+
+package timeliner
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLockRepo(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "post", ts: time.Now(), class: ClassPost, text: "hello"}))
+	dir := tl.repoDir
+
+	_, err := Open(dir)
+	inUse, ok := err.(*InUseError)
+	if !ok {
+		t.Fatalf("expected second writer to get *InUseError, got %v", err)
+	}
+	if inUse.Repo != dir || inUse.PID != os.Getpid() {
+		t.Errorf("expected repository %s in use by PID %d, got %+v", dir, os.Getpid(), inUse)
+	}
+
+	// readers don't need the lock, and can't write
+	ro, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("opening read-only while in use: %v", err)
+	}
+	ir := loadTestItem(t, ro, "post")
+	if ir.DataText == nil || *ir.DataText != "hello" {
+		t.Errorf("expected to read item, got %+v", ir)
+	}
+	if _, err := ro.db.Exec(`DELETE FROM items`); err == nil {
+		t.Error("expected read-only timeline to refuse writes")
+	}
+	ro.Close()
+
+	// the lock is released when the writer closes the
+	// timeline, or fails to open it
+	tl.Close()
+	_, err = OpenWithOptions(dir, Options{Secret: []byte("passphrase")})
+	if err == nil {
+		t.Fatal("expected opening unencrypted repository with a secret to fail")
+	}
+	again, err := Open(dir)
+	if err != nil {
+		t.Fatalf("opening after writer closed: %v", err)
+	}
+	again.Close()
+}
@@ -0,0 +1,46 @@
+package timeliner
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive lock on f without waiting. The
+// locked byte is far past the end of the file, since other
+// processes could not read the PID in it if it were locked.
+func lockFile(f *os.File) error {
+	ol := &syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	r1, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately,
+		0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		if err == errorLockViolation {
+			return errLockHeld
+		}
+		return err
+	}
+	return nil
+}
+
+// unlockFile releases the lock on f.
+func unlockFile(f *os.File) error {
+	ol := &syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	r1, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
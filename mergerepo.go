@@ -0,0 +1,758 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MergeRepoOptions configures how another repository
+// is merged into a timeline.
+type MergeRepoOptions struct {
+	// How items that are already in the timeline are
+	// merged with the same items from the other
+	// repository. See MergeRepository.
+	Merge MergeOptions
+
+	Verbose bool
+}
+
+// MergeRepoStats counts what was merged from
+// another repository.
+type MergeRepoStats struct {
+	AccountsNew      int   `json:"accounts_new"`       // accounts added to the timeline
+	PersonsNew       int   `json:"persons_new"`        // persons added to the timeline
+	ItemsNew         int64 `json:"items_new"`          // items added to the timeline
+	ItemsMerged      int64 `json:"items_merged"`       // items merged into existing items
+	ItemsSkipped     int64 `json:"items_skipped"`      // existing items that were modified locally, so left alone
+	ItemsFailed      int64 `json:"items_failed"`       // items that could not be merged
+	DataFilesCopied  int   `json:"data_files_copied"`  // data files copied into the timeline
+	DataFilesMissing int   `json:"data_files_missing"` // data files that were incomplete, missing, or corrupt in the other repository
+	BytesCopied      int64 `json:"bytes_copied"`       // total size of the data files copied
+	Relationships    int   `json:"relationships"`      // relationships added
+	Collections      int   `json:"collections"`        // collections added
+}
+
+// MergeRepository merges the other timeline into t: its accounts,
+// persons and their identities, items, relationships, collections,
+// and data files, but not its trash or history. Credentials of its
+// accounts are copied only if t has none for the account. Both
+// timelines must be open (and unlocked, if encrypted); other is only
+// read from. Merging the same repository again only adds what is
+// new since.
+//
+// Persons are the same if they share an identity, and accounts are
+// the same if they have the same data source and user ID. An item is
+// the same as an item in t if it has the same original ID on the same
+// account; or, if opt.Merge.SoftMerge is enabled, if it is likely to
+// be the same item, as defined by MergeOptions. Items that are the
+// same are merged like a soft merge: by default, the values of the
+// existing item are kept, and only its missing values are filled in
+// from the other item; opt.Merge can prefer the other item's text,
+// metadata, data file, or (for soft merges) ID instead. Items in t
+// that were modified locally are left alone.
+//
+// Data files are copied into t, where they are deduplicated by
+// checksum as usual. A data file of an existing item that is replaced
+// is left for Fsck to clean up if nothing else uses it. If a data file
+// is incomplete, missing, or corrupt in other, its item is merged as
+// if its download did not complete, so that it can be downloaded again.
+func (t *Timeline) MergeRepository(ctx context.Context, other *Timeline, opt MergeRepoOptions) (MergeRepoStats, error) {
+	thisDir, err := filepath.Abs(t.repoDir)
+	if err != nil {
+		return MergeRepoStats{}, err
+	}
+	otherDir, err := filepath.Abs(other.repoDir)
+	if err != nil {
+		return MergeRepoStats{}, err
+	}
+	if thisDir == otherDir {
+		return MergeRepoStats{}, fmt.Errorf("cannot merge a repository into itself")
+	}
+
+	m := &repoMerger{
+		t:        t,
+		other:    other,
+		opt:      opt,
+		accounts: make(map[int64]mergedAccount),
+		persons:  make(map[int64]int64),
+		items:    make(map[int64]int64),
+		// checksums can only be compared if they are made
+		// the same way, which they aren't if either
+		// repository is encrypted (they're keyed)
+		sameHashes: t.keys == nil && other.keys == nil,
+	}
+
+	err = m.mergeAccounts(ctx)
+	if err != nil {
+		return m.stats, fmt.Errorf("merging accounts: %v", err)
+	}
+	err = m.mergePersons(ctx)
+	if err != nil {
+		return m.stats, fmt.Errorf("merging persons: %v", err)
+	}
+	err = m.mergeItems(ctx)
+	if err != nil {
+		return m.stats, fmt.Errorf("merging items: %v", err)
+	}
+	err = m.mergeRelationships(ctx)
+	if err != nil {
+		return m.stats, fmt.Errorf("merging relationships: %v", err)
+	}
+	err = m.mergeCollections(ctx)
+	if err != nil {
+		return m.stats, fmt.Errorf("merging collections: %v", err)
+	}
+
+	return m.stats, nil
+}
+
+// repoMerger merges another repository into a timeline.
+// Since row IDs differ between repositories, it maps the
+// row IDs of the other repository to those in the timeline
+// as rows are merged.
+type repoMerger struct {
+	t, other   *Timeline
+	opt        MergeRepoOptions
+	sameHashes bool
+
+	accounts map[int64]mergedAccount // by account row ID in other
+	persons  map[int64]int64         // person row IDs, other to t
+	items    map[int64]int64         // item row IDs, other to t
+
+	stats MergeRepoStats
+}
+
+// mergedAccount is an account of the other repository
+// as it is in the timeline.
+type mergedAccount struct {
+	id           int64 // row ID in the timeline
+	dataSourceID string
+}
+
+func (m *repoMerger) mergeAccounts(ctx context.Context) error {
+	// accounts refer to their data sources
+	dsRows, err := m.other.db.QueryContext(ctx, `SELECT id, name FROM data_sources`)
+	if err != nil {
+		return fmt.Errorf("querying data sources: %v", err)
+	}
+	defer dsRows.Close()
+	for dsRows.Next() {
+		var id, name string
+		err := dsRows.Scan(&id, &name)
+		if err != nil {
+			return fmt.Errorf("scanning data source: %v", err)
+		}
+		_, err = m.t.db.Exec(`INSERT OR IGNORE INTO data_sources (id, name) VALUES (?, ?)`, id, name)
+		if err != nil {
+			return fmt.Errorf("saving data source record: %v", err)
+		}
+	}
+	if err = dsRows.Err(); err != nil {
+		return fmt.Errorf("iterating data source rows: %v", err)
+	}
+
+	accounts, err := m.other.Accounts()
+	if err != nil {
+		return err
+	}
+	for _, acc := range accounts {
+		res, err := m.t.db.Exec(`INSERT OR IGNORE INTO accounts (data_source_id, user_id) VALUES (?, ?)`,
+			acc.DataSourceID, acc.UserID)
+		if err != nil {
+			return fmt.Errorf("inserting account %s: %v", acc, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			m.stats.AccountsNew++
+		}
+		var id int64
+		err = m.t.db.QueryRow(`SELECT id FROM accounts WHERE data_source_id=? AND user_id=? LIMIT 1`,
+			acc.DataSourceID, acc.UserID).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("getting row ID of account %s: %v", acc, err)
+		}
+		m.accounts[acc.ID] = mergedAccount{id: id, dataSourceID: acc.DataSourceID}
+
+		// keep any credentials the timeline already has
+		creds, err := m.t.loadCredentials(acc)
+		if err != nil {
+			return err
+		}
+		if creds != nil {
+			continue
+		}
+		creds, err = m.other.loadCredentials(acc)
+		if err != nil {
+			return err
+		}
+		if creds != nil {
+			err = m.t.creds.Store(acc.DataSourceID, acc.UserID, creds)
+			if err != nil {
+				return fmt.Errorf("storing credentials of %s: %v", acc, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *repoMerger) mergePersons(ctx context.Context) error {
+	persons, err := m.other.Persons(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range persons {
+		// a person who shares an identity is the same person
+		var personID int64
+		for _, ident := range p.Identities {
+			err := m.t.db.QueryRow(`SELECT person_id FROM person_identities
+				WHERE data_source_id=? AND user_id=? LIMIT 1`,
+				ident.DataSourceID, ident.UserID).Scan(&personID)
+			if err == nil {
+				break
+			}
+			if err != sql.ErrNoRows {
+				return fmt.Errorf("querying person identity: %v", err)
+			}
+		}
+
+		// without any identities, the name is all there is
+		if personID == 0 && len(p.Identities) == 0 {
+			err := m.t.db.QueryRow(`SELECT id FROM persons
+				WHERE name=? AND id NOT IN (SELECT person_id FROM person_identities)
+				LIMIT 1`, p.Name).Scan(&personID)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("querying person by name: %v", err)
+			}
+		}
+
+		if personID == 0 {
+			res, err := m.t.db.Exec(`INSERT INTO persons (name) VALUES (?)`, p.Name)
+			if err != nil {
+				return fmt.Errorf("adding new person: %v", err)
+			}
+			personID, err = res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("getting person ID: %v", err)
+			}
+			m.stats.PersonsNew++
+		}
+
+		// add the identities that no person has yet
+		for _, ident := range p.Identities {
+			_, err := m.t.db.Exec(`INSERT INTO person_identities (person_id, data_source_id, user_id)
+				SELECT ?, ?, ?
+				WHERE NOT EXISTS (SELECT 1 FROM person_identities WHERE data_source_id=? AND user_id=?)`,
+				personID, ident.DataSourceID, ident.UserID, ident.DataSourceID, ident.UserID)
+			if err != nil {
+				return fmt.Errorf("adding person identity: %v", err)
+			}
+		}
+
+		m.persons[p.ID] = personID
+	}
+
+	return nil
+}
+
+func (m *repoMerger) mergeItems(ctx context.Context) error {
+	rows, err := m.other.db.QueryContext(ctx, `SELECT `+itemRowColumns+` FROM items ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("querying items: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		oir, err := m.other.scanItemRow(rows)
+		if err != nil {
+			return err
+		}
+		rowID, err := m.mergeItem(oir)
+		if err != nil {
+			log.Printf("[ERROR] Merging item: %v (item_id=%d original_id=%s)", err, oir.ID, oir.OriginalID)
+			m.stats.ItemsFailed++
+			continue
+		}
+		m.items[oir.ID] = rowID
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating item rows: %v", err)
+	}
+
+	return nil
+}
+
+// mergeItem merges oir, an item of the other repository, into
+// the timeline, and returns its row ID in the timeline.
+func (m *repoMerger) mergeItem(oir ItemRow) (int64, error) {
+	acc, ok := m.accounts[oir.AccountID]
+	if !ok {
+		return 0, fmt.Errorf("account not found (account_id=%d)", oir.AccountID)
+	}
+	personID, ok := m.persons[oir.PersonID]
+	if !ok {
+		return 0, fmt.Errorf("person not found (person_id=%d)", oir.PersonID)
+	}
+
+	// the item is the same as an existing one if it has the
+	// same original ID on the same account, or, if enabled,
+	// if it is likely to be the same
+	ir, err := m.loadItemRow(`account_id=? AND original_id=?`, acc.id, oir.OriginalID)
+	if err != nil {
+		return 0, fmt.Errorf("checking for item in database: %v", err)
+	}
+	var doingSoftMerge bool
+	if ir.ID == 0 && m.opt.Merge.SoftMerge {
+		ir, err = m.softMatch(acc, oir)
+		if err != nil {
+			return 0, fmt.Errorf("soft merge: %v", err)
+		}
+		doingSoftMerge = ir.ID > 0
+	}
+
+	if ir.ID > 0 && ir.Modified != nil {
+		if m.opt.Verbose {
+			log.Printf("[DEBUG] Skipping merge into item that was modified locally (item_id=%d item_row_id=%d)",
+				oir.ID, ir.ID)
+		}
+		m.stats.ItemsSkipped++
+		return ir.ID, nil
+	}
+
+	// decide whether to copy the data file; as when processing,
+	// an existing item only gets the other item's data file if it
+	// doesn't have one, or if new data files are preferred
+	copyDataFile := oir.DataFile != nil
+	if copyDataFile && ir.ID > 0 && ir.DataFile != nil && ir.DataHash != nil {
+		copyDataFile = m.opt.Merge.PreferNewDataFile && oir.DataHash != nil
+		if copyDataFile {
+			same, err := m.sameDataFile(oir, *ir.DataHash)
+			if err != nil {
+				return 0, err
+			}
+			copyDataFile = !same
+		}
+	}
+
+	var dataFile, dataHash, viewPath *string
+	if copyDataFile {
+		dataFile, dataHash, viewPath, err = m.copyDataFile(acc, oir, ir.ID)
+		if err != nil {
+			return 0, fmt.Errorf("copying data file: %v", err)
+		}
+	}
+
+	dataText := m.t.sealText("data_text", oir.DataText)
+	metaGob := m.t.sealColumn("metadata", oir.metaGob)
+
+	if ir.ID == 0 {
+		var modified *int64
+		if oir.Modified != nil {
+			mod := oir.Modified.Unix()
+			modified = &mod
+		}
+		res, err := m.t.db.Exec(`INSERT INTO items
+			(account_id, original_id, person_id, timestamp, stored, modified,
+				class, mime_type, data_text, data_file, data_hash, metadata,
+				latitude, longitude, view_path)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			acc.id, oir.OriginalID, personID, oir.Timestamp.Unix(), oir.Stored.Unix(), modified,
+			oir.Class, oir.MIMEType, dataText, dataFile, dataHash, metaGob,
+			oir.Latitude, oir.Longitude, viewPath)
+		if err != nil {
+			m.removeDataFile(dataFile)
+			return 0, fmt.Errorf("inserting item: %v", err)
+		}
+		ir.ID, err = res.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("getting item row ID: %v", err)
+		}
+		m.stats.ItemsNew++
+	} else {
+		// like a soft merge, prefer existing values by default
+		originalID := ir.OriginalID
+		if doingSoftMerge && m.opt.Merge.PreferNewID {
+			originalID = oir.OriginalID
+		}
+		fieldDataText, fieldMetadata := "COALESCE(data_text, ?)", "COALESCE(metadata, ?)"
+		if m.opt.Merge.PreferNewDataText {
+			fieldDataText = "COALESCE(?, data_text)"
+		}
+		if m.opt.Merge.PreferNewMetadata {
+			fieldMetadata = "COALESCE(?, metadata)"
+		}
+		dataFileFields := ""
+		args := []interface{}{originalID, oir.Timestamp.Unix(), oir.Class, oir.MIMEType,
+			dataText, metaGob, oir.Latitude, oir.Longitude}
+		// don't replace a complete data file with one that couldn't be copied
+		if copyDataFile && (dataHash != nil || ir.DataHash == nil) {
+			dataFileFields = ", data_file=?, data_hash=?, view_path=?"
+			args = append(args, dataFile, dataHash, viewPath)
+		}
+		args = append(args, ir.ID)
+		_, err = m.t.db.Exec(`UPDATE items
+			SET original_id=?,
+				timestamp=COALESCE(timestamp, ?),
+				class=COALESCE(class, ?),
+				mime_type=COALESCE(mime_type, ?),
+				data_text=`+fieldDataText+`,
+				metadata=`+fieldMetadata+`,
+				latitude=COALESCE(latitude, ?),
+				longitude=COALESCE(longitude, ?)`+dataFileFields+`
+			WHERE id=?`, args...) // TODO: LIMIT 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+		if err != nil {
+			m.removeDataFile(dataFile)
+			return 0, fmt.Errorf("updating item: %v (item_row_id=%d)", err, ir.ID)
+		}
+		m.stats.ItemsMerged++
+	}
+
+	// keep the search index in sync with the stored values
+	err = m.t.indexItem(m.t.db, ir.ID)
+	if err != nil {
+		return 0, fmt.Errorf("updating search index: %v", err)
+	}
+
+	if m.opt.Verbose {
+		log.Printf("[DEBUG] Merged item (item_id=%d item_row_id=%d soft_merge=%t data_file=%t)",
+			oir.ID, ir.ID, doingSoftMerge, copyDataFile)
+	}
+
+	return ir.ID, nil
+}
+
+// softMatch returns the only item of the account in the timeline
+// that is likely to be the same as oir by the same criteria as
+// a soft merge, or an empty ItemRow if there is none.
+func (m *repoMerger) softMatch(acc mergedAccount, oir ItemRow) (ItemRow, error) {
+	var filenameLikePattern *string
+	if name := oir.DataFileName(); name != "" {
+		temp := "%/" + name
+		filenameLikePattern = &temp
+	}
+	var dataHash *string
+	if m.sameHashes {
+		dataHash = oir.DataHash
+	}
+
+	where := `account_id=? AND timestamp=? AND (data_text=? OR data_file LIKE ? OR view_path LIKE ? OR data_hash=?) AND original_id != ?`
+	args := []interface{}{acc.id, oir.Timestamp.Unix(), m.t.sealText("data_text", oir.DataText),
+		filenameLikePattern, filenameLikePattern, dataHash, oir.OriginalID}
+
+	var numMatches int
+	err := m.t.db.QueryRow(`SELECT COUNT(1) FROM items WHERE `+where, args...).Scan(&numMatches)
+	if err != nil {
+		return ItemRow{}, fmt.Errorf("querying for candidate row: %v", err)
+	}
+	if numMatches == 0 {
+		return ItemRow{}, nil
+	}
+	if numMatches > 1 {
+		return ItemRow{}, fmt.Errorf("ambiguous match with %d existing items - unable to merge", numMatches)
+	}
+	return m.loadItemRow(where, args...)
+}
+
+// loadItemRow loads the item in the timeline that matches the
+// where clause, or returns an empty ItemRow if there is none.
+func (m *repoMerger) loadItemRow(where string, args ...interface{}) (ItemRow, error) {
+	row := m.t.db.QueryRow(`SELECT `+itemRowColumns+` FROM items WHERE `+where+` LIMIT 1`, args...)
+	ir, err := m.t.scanItemRow(row)
+	if err == sql.ErrNoRows {
+		return ItemRow{}, nil
+	}
+	return ir, err
+}
+
+// sameDataFile returns true if the data file of oir has the
+// checksum dataHash in the timeline. If the checksums are not
+// made the same way in both repositories, the file is read.
+func (m *repoMerger) sameDataFile(oir ItemRow, dataHash string) (bool, error) {
+	if m.sameHashes {
+		return *oir.DataHash == dataHash, nil
+	}
+	checksum, err := hashFile(m.other.store, m.t.newDataHash(), *oir.DataFile)
+	if err != nil {
+		// the data file can't be copied either; the
+		// existing one is as good as it gets
+		log.Printf("[ERROR] Reading data file %s of other repository: %v", *oir.DataFile, err)
+		return true, nil
+	}
+	return checksum == dataHash, nil
+}
+
+// copyDataFile copies the data file of oir into the timeline
+// for the item with the given row ID (0 if it is new), and
+// returns the values of its data_file, data_hash, and view_path
+// columns. If the data file is incomplete, missing, or corrupt,
+// its name is returned without a checksum, as for a download
+// that did not complete.
+func (m *repoMerger) copyDataFile(acc mergedAccount, oir ItemRow, itemRowID int64) (dataFile, dataHash, viewPath *string, err error) {
+	// the path the data file has in the canonical layout, without
+	// the "data/" prefix; it is also its view path in the blobs layout
+	vp := strings.TrimPrefix(*oir.DataFile, "data/")
+	if oir.ViewPath != nil && *oir.ViewPath != "" {
+		vp = *oir.ViewPath
+	} else if isBlob(*oir.DataFile) {
+		vp = path.Join(fmt.Sprintf("%04d", oir.Timestamp.Year()), fmt.Sprintf("%02d", oir.Timestamp.Month()),
+			acc.dataSourceID, path.Base(*oir.DataFile))
+	}
+	vp = m.t.safeViewPath(vp)
+	if name := path.Base(vp); name == "." || name == "/" {
+		vp = path.Join(vp, randomString(24, false))
+	}
+	canonical := path.Join("data", vp)
+	if m.t.layout == LayoutBlobs {
+		viewPath = &vp
+	}
+
+	if oir.DataHash == nil {
+		m.stats.DataFilesMissing++
+		return &canonical, nil, viewPath, nil
+	}
+
+	// if the timeline already has the exact same file, use it
+	if m.sameHashes {
+		var existing string
+		err := m.t.db.QueryRow(`SELECT data_file FROM items
+			WHERE data_hash=? AND data_file IS NOT NULL LIMIT 1`, *oir.DataHash).Scan(&existing)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, nil, fmt.Errorf("querying DB: %v", err)
+		}
+		if err == nil && m.t.datafileExists(existing) {
+			return &existing, oir.DataHash, viewPath, nil
+		}
+	}
+
+	src, err := m.other.store.Open(*oir.DataFile)
+	if err != nil {
+		log.Printf("[ERROR] Opening data file %s of other repository: %v", *oir.DataFile, err)
+		m.stats.DataFilesMissing++
+		return &canonical, nil, viewPath, nil
+	}
+	defer src.Close()
+
+	var dest io.WriteCloser
+	var tmpName *string
+	if m.t.layout == LayoutBlobs {
+		dest, tmpName, err = m.t.openBlobTmpFile()
+	} else {
+		dest, tmpName, err = m.t.openUniqueDataFile(canonical)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// verify the file against its checksum in the other
+	// repository as it is copied, since it may be corrupt
+	otherHash := m.other.newDataHash()
+	h := m.t.newDataHash()
+	n, err := m.t.downloadItemFile(ioutil.NopCloser(io.TeeReader(src, otherHash)), dest, *tmpName, h)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if base64.StdEncoding.EncodeToString(otherHash.Sum(nil)) != *oir.DataHash {
+		log.Printf("[ERROR] Data file %s of other repository: %v", *oir.DataFile, errChecksumMismatch)
+		m.t.store.Remove(*tmpName)
+		m.stats.DataFilesMissing++
+		return &canonical, nil, viewPath, nil
+	}
+	b64hash := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	if m.t.layout == LayoutBlobs {
+		blob, err := m.t.storeBlob(*tmpName, b64hash)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dataFile = &blob
+	} else {
+		// if the exact same file (byte-for-byte) already exists,
+		// delete this copy and reuse the existing one
+		dataFile, err = m.t.replaceWithExisting(tmpName, b64hash, itemRowID)
+		if err != nil {
+			m.t.store.Remove(*tmpName)
+			return nil, nil, nil, err
+		}
+	}
+
+	m.stats.DataFilesCopied++
+	m.stats.BytesCopied += n
+
+	return dataFile, &b64hash, viewPath, nil
+}
+
+// removeDataFile removes a data file that was copied for an
+// item that could not be stored, unless it is used by others.
+func (m *repoMerger) removeDataFile(dataFile *string) {
+	if dataFile == nil || isBlob(*dataFile) {
+		return
+	}
+	var count int
+	err := m.t.db.QueryRow(`SELECT COUNT(1) FROM items WHERE data_file=?`, *dataFile).Scan(&count)
+	if err == nil && count == 0 {
+		m.t.store.Remove(*dataFile)
+	}
+}
+
+func (m *repoMerger) mergeRelationships(ctx context.Context) error {
+	rows, err := m.other.db.QueryContext(ctx, `SELECT from_person_id, from_item_id,
+		to_person_id, to_item_id, directed, label FROM relationships ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("querying relationships: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fromPerson, fromItem, toPerson, toItem *int64
+		var directed *bool
+		var label string
+		err := rows.Scan(&fromPerson, &fromItem, &toPerson, &toItem, &directed, &label)
+		if err != nil {
+			return fmt.Errorf("scanning relationship: %v", err)
+		}
+
+		// skip relationships of items that weren't merged
+		if !mapRowID(m.persons, fromPerson) || !mapRowID(m.items, fromItem) ||
+			!mapRowID(m.persons, toPerson) || !mapRowID(m.items, toItem) {
+			continue
+		}
+
+		res, err := m.t.db.Exec(`INSERT OR IGNORE INTO relationships
+			(from_person_id, from_item_id, to_person_id, to_item_id, directed, label)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			fromPerson, fromItem, toPerson, toItem, directed, label)
+		if err != nil {
+			return fmt.Errorf("storing relationship: %v", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			m.stats.Relationships++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating relationship rows: %v", err)
+	}
+
+	return nil
+}
+
+func (m *repoMerger) mergeCollections(ctx context.Context) error {
+	rows, err := m.other.db.QueryContext(ctx, `SELECT id, account_id, original_id, name, description, modified
+		FROM collections ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("querying collections: %v", err)
+	}
+	defer rows.Close()
+
+	collections := make(map[int64]int64) // row IDs, other to t
+	for rows.Next() {
+		var id, accountID int64
+		var originalID, name, description *string
+		var modified *int64
+		err := rows.Scan(&id, &accountID, &originalID, &name, &description, &modified)
+		if err != nil {
+			return fmt.Errorf("scanning collection: %v", err)
+		}
+		acc, ok := m.accounts[accountID]
+		if !ok {
+			continue
+		}
+
+		// like items, collections are the same if they have the
+		// same original ID on the same account; without an original
+		// ID, a collection can't be matched, so it is always added
+		var collID int64
+		if originalID != nil {
+			err = m.t.db.QueryRow(`SELECT id FROM collections WHERE account_id=? AND original_id=? LIMIT 1`,
+				acc.id, *originalID).Scan(&collID)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("querying collection: %v", err)
+			}
+		}
+		if collID > 0 {
+			_, err = m.t.db.Exec(`UPDATE collections
+				SET name=COALESCE(name, ?), description=COALESCE(description, ?)
+				WHERE id=?`, name, description, collID)
+			if err != nil {
+				return fmt.Errorf("updating collection: %v", err)
+			}
+		} else {
+			res, err := m.t.db.Exec(`INSERT INTO collections
+				(account_id, original_id, name, description, modified) VALUES (?, ?, ?, ?, ?)`,
+				acc.id, originalID, name, description, modified)
+			if err != nil {
+				return fmt.Errorf("inserting collection: %v", err)
+			}
+			collID, err = res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("getting collection row ID: %v", err)
+			}
+			m.stats.Collections++
+		}
+		collections[id] = collID
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating collection rows: %v", err)
+	}
+	rows.Close()
+
+	itemRows, err := m.other.db.QueryContext(ctx, `SELECT item_id, collection_id, position
+		FROM collection_items ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("querying collection items: %v", err)
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var itemID, collectionID int64
+		var position int
+		err := itemRows.Scan(&itemID, &collectionID, &position)
+		if err != nil {
+			return fmt.Errorf("scanning collection item: %v", err)
+		}
+		itemRowID, ok := m.items[itemID]
+		if !ok {
+			continue
+		}
+		collID, ok := collections[collectionID]
+		if !ok {
+			continue
+		}
+		_, err = m.t.db.Exec(`INSERT OR IGNORE INTO collection_items
+			(item_id, collection_id, position)
+			VALUES (?, ?, ?)`,
+			itemRowID, collID, position)
+		if err != nil {
+			return fmt.Errorf("adding item to collection: %v", err)
+		}
+	}
+	if err = itemRows.Err(); err != nil {
+		return fmt.Errorf("iterating collection item rows: %v", err)
+	}
+
+	return nil
+}
+
+// mapRowID replaces the row ID that id points to with the row
+// ID it maps to in ids, and returns false if it is not in ids.
+// A nil id is left alone.
+func mapRowID(ids map[int64]int64, id *int64) bool {
+	if id == nil {
+		return true
+	}
+	mapped, ok := ids[*id]
+	if !ok {
+		return false
+	}
+	*id = mapped
+	return true
+}
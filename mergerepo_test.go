@@ -0,0 +1,99 @@
+package timeliner
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMergeRepository(t *testing.T) {
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "post", ts: ts, class: ClassPost, text: "hello"}),
+		NewItemGraph(testItem{id: "photo", ts: ts, class: ClassImage, fileName: "photo.jpg", file: "jpeg data"}))
+
+	// the other repository has another account first, so
+	// that its row IDs differ from those in the timeline
+	other, otherCleanup := openTestTimeline(t, Options{}, "someone", "me")
+	defer otherCleanup()
+	testGetAll(t, other, "someone",
+		NewItemGraph(testItem{id: "their post", ts: ts, class: ClassPost, text: "hi"}))
+	note := NewItemGraph(testItem{id: "note", ts: ts, class: ClassPost, text: "same photo"})
+	note.Add(testItem{id: "copy", ts: ts, class: ClassImage, fileName: "copy.jpg", file: "jpeg data"}, RelAttached)
+	testGetAll(t, other, "me",
+		NewItemGraph(testItem{id: "post", ts: ts, class: ClassPost, text: "hello again"}),
+		note)
+
+	count := func(query string, args ...interface{}) int {
+		t.Helper()
+		var n int
+		err := tl.db.QueryRow(query, args...).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	stats, err := tl.MergeRepository(context.Background(), other, MergeRepoOptions{})
+	if err != nil {
+		t.Fatalf("merging: %v", err)
+	}
+	expected := MergeRepoStats{AccountsNew: 1, PersonsNew: 1, ItemsNew: 3, ItemsMerged: 1, Relationships: 1}
+	if stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	// the person of the shared identity is not duplicated
+	if n := count(`SELECT COUNT(*) FROM persons`); n != 2 {
+		t.Errorf("expected 2 persons, got %d", n)
+	}
+	if n := count(`SELECT COUNT(*) FROM person_identities WHERE data_source_id=? AND user_id='me'`, testDataSourceID); n != 1 {
+		t.Errorf("expected 1 identity of the shared person, got %d", n)
+	}
+
+	// row IDs are those of the timeline
+	post := loadTestItem(t, tl, "post")
+	photo := loadTestItem(t, tl, "photo")
+	cp := loadTestItem(t, tl, "copy")
+	if cp.AccountID != post.AccountID || cp.PersonID != post.PersonID {
+		t.Errorf("expected merged item to be on account %d of person %d, got account %d of person %d",
+			post.AccountID, post.PersonID, cp.AccountID, cp.PersonID)
+	}
+	if post.DataText == nil || *post.DataText != "hello" {
+		t.Errorf("expected text of existing item to be kept, got %v", post.DataText)
+	}
+	rels, err := tl.ItemRelationships(context.Background(), cp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rels) != 1 || rels[0].FromItemID == nil || *rels[0].FromItemID != loadTestItem(t, tl, "note").ID ||
+		rels[0].ToItemID == nil || *rels[0].ToItemID != cp.ID {
+		t.Errorf("expected relationship from note to copy, got %+v", rels)
+	}
+
+	// the same data file is only stored once
+	if cp.DataFile == nil || photo.DataFile == nil || *cp.DataFile != *photo.DataFile {
+		t.Errorf("expected data file to be deduplicated, got %v and %v", cp.DataFile, photo.DataFile)
+	}
+	if n := count(`SELECT COUNT(DISTINCT data_file) FROM items WHERE data_file IS NOT NULL`); n != 1 {
+		t.Errorf("expected 1 data file, got %d", n)
+	}
+
+	// merging again adds nothing
+	stats, err = tl.MergeRepository(context.Background(), other, MergeRepoOptions{})
+	if err != nil {
+		t.Fatalf("merging again: %v", err)
+	}
+	expected = MergeRepoStats{ItemsMerged: 4}
+	if stats != expected {
+		t.Errorf("merging again: expected %+v, got %+v", expected, stats)
+	}
+	for table, n := range map[string]int{"accounts": 2, "persons": 2, "items": 5, "relationships": 1} {
+		if got := count(`SELECT COUNT(*) FROM ` + table); got != n {
+			t.Errorf("merging again: expected %d %s, got %d", n, table, got)
+		}
+	}
+}
@@ -18,9 +18,13 @@ var OAuth2AppSource func(providerID string, scopes []string) (oauth2client.App,
 // HTTP requests that are authenticated with an oauth2.Token
 // stored with the account acc.
 func (acc Account) NewOAuth2HTTPClient() (*http.Client, error) {
-	// load the existing token for this account from the database
+	// load the existing token for this account from the credential store
+	authBytes, err := acc.t.loadCredentials(acc)
+	if err != nil {
+		return nil, err
+	}
 	var tkn *oauth2.Token
-	err := UnmarshalGob(acc.authorization, &tkn)
+	err = UnmarshalGob(authBytes, &tkn)
 	if err != nil {
 		return nil, fmt.Errorf("gob-decoding OAuth2 token: %v", err)
 	}
@@ -42,12 +46,11 @@ func (acc Account) NewOAuth2HTTPClient() (*http.Client, error) {
 
 	// finally, create an HTTP client that authenticates using the token,
 	// but wrapping the underlying token source so we can persist any
-	// changes to the database
+	// changes to the credential store
 	return oauth2.NewClient(context.Background(), &persistedTokenSource{
-		tl:        acc.t,
-		ts:        src,
-		accountID: acc.ID,
-		token:     tkn,
+		acc:   acc,
+		ts:    src,
+		token: tkn,
 	}), nil
 }
 
@@ -67,12 +70,11 @@ func authorizeWithOAuth2(oc OAuth2) ([]byte, error) {
 
 // persistedTokenSource wraps a TokenSource for
 // a particular account and persists any changes
-// to the account's token to the database.
+// to the account's token to the credential store.
 type persistedTokenSource struct {
-	tl        *Timeline
-	ts        oauth2.TokenSource
-	accountID int64
-	token     *oauth2.Token
+	acc   Account
+	ts    oauth2.TokenSource
+	token *oauth2.Token
 }
 
 func (ps *persistedTokenSource) Token() (*oauth2.Token, error) {
@@ -81,7 +83,7 @@ func (ps *persistedTokenSource) Token() (*oauth2.Token, error) {
 		return tkn, err
 	}
 
-	// store an updated token in the DB
+	// store an updated token
 	if tkn.AccessToken != ps.token.AccessToken {
 		ps.token = tkn
 
@@ -90,7 +92,7 @@ func (ps *persistedTokenSource) Token() (*oauth2.Token, error) {
 			return nil, fmt.Errorf("gob-encoding new OAuth2 token: %v", err)
 		}
 
-		_, err = ps.tl.db.Exec(`UPDATE accounts SET authorization=? WHERE id=?`, authBytes, ps.accountID)
+		err = ps.acc.t.creds.Store(ps.acc.DataSourceID, ps.acc.UserID, authBytes)
 		if err != nil {
 			return nil, fmt.Errorf("storing refreshed OAuth2 token: %v", err)
 		}
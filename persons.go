@@ -1,16 +1,17 @@
 package timeliner
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
 
 // getPerson returns the person mapped to userID on service.
 // If the person does not exist, it is created.
-func (t *Timeline) getPerson(dataSourceID, userID, name string) (Person, error) {
+func getPerson(db querier, dataSourceID, userID, name string) (Person, error) {
 	// first, load the person
 	var p Person
-	err := t.db.QueryRow(`SELECT persons.id, persons.name
+	err := db.QueryRow(`SELECT persons.id, persons.name
 		FROM persons, person_identities
 		WHERE person_identities.data_source_id=?
 			AND person_identities.user_id=?
@@ -19,7 +20,7 @@ func (t *Timeline) getPerson(dataSourceID, userID, name string) (Person, error)
 	if err == sql.ErrNoRows {
 		// person does not exist; create this mapping - TODO: do in a transaction
 		p = Person{Name: name}
-		res, err := t.db.Exec(`INSERT INTO persons (name) VALUES (?)`, p.Name)
+		res, err := db.Exec(`INSERT INTO persons (name) VALUES (?)`, p.Name)
 		if err != nil {
 			return Person{}, fmt.Errorf("adding new person: %v", err)
 		}
@@ -27,7 +28,7 @@ func (t *Timeline) getPerson(dataSourceID, userID, name string) (Person, error)
 		if err != nil {
 			return Person{}, fmt.Errorf("getting person ID: %v", err)
 		}
-		_, err = t.db.Exec(`INSERT OR IGNORE INTO person_identities
+		_, err = db.Exec(`INSERT OR IGNORE INTO person_identities
 			(person_id, data_source_id, user_id) VALUES (?, ?, ?)`,
 			p.ID, dataSourceID, userID)
 		if err != nil {
@@ -38,7 +39,7 @@ func (t *Timeline) getPerson(dataSourceID, userID, name string) (Person, error)
 	}
 
 	// now get all the person's identities
-	rows, err := t.db.Query(`SELECT id, person_id, data_source_id, user_id
+	rows, err := db.Query(`SELECT id, person_id, data_source_id, user_id
 		FROM person_identities WHERE person_id=?`, p.ID)
 	if err != nil {
 		return Person{}, fmt.Errorf("selecting person's known identities: %v", err)
@@ -61,15 +62,100 @@ func (t *Timeline) getPerson(dataSourceID, userID, name string) (Person, error)
 
 // Person represents a person.
 type Person struct {
-	ID         int64
-	Name       string
-	Identities []PersonIdentity
+	ID         int64            `json:"id"`
+	Name       string           `json:"name"`
+	Identities []PersonIdentity `json:"identities,omitempty"`
 }
 
 // PersonIdentity is a way to map a user ID on a service to a person.
 type PersonIdentity struct {
-	ID           int64
-	PersonID     string
-	DataSourceID string
-	UserID       string
+	ID           int64  `json:"id"`
+	PersonID     string `json:"person_id"`
+	DataSourceID string `json:"data_source_id"`
+	UserID       string `json:"user_id"`
+}
+
+// Persons returns all the persons in the timeline with
+// their identities, ordered by row ID.
+func (t *Timeline) Persons(ctx context.Context) ([]Person, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT id, COALESCE(name, '') FROM persons ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying persons: %v", err)
+	}
+	defer rows.Close()
+
+	var persons []Person
+	index := make(map[int64]int)
+	for rows.Next() {
+		var p Person
+		err := rows.Scan(&p.ID, &p.Name)
+		if err != nil {
+			return nil, fmt.Errorf("scanning person: %v", err)
+		}
+		index[p.ID] = len(persons)
+		persons = append(persons, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating person rows: %v", err)
+	}
+	rows.Close()
+
+	identRows, err := t.db.QueryContext(ctx, `SELECT id, person_id, data_source_id, user_id
+		FROM person_identities ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying person identities: %v", err)
+	}
+	defer identRows.Close()
+	for identRows.Next() {
+		var ident PersonIdentity
+		var personID int64
+		err := identRows.Scan(&ident.ID, &personID, &ident.DataSourceID, &ident.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("scanning person identity: %v", err)
+		}
+		ident.PersonID = fmt.Sprintf("%d", personID)
+		if i, ok := index[personID]; ok {
+			persons[i].Identities = append(persons[i].Identities, ident)
+		}
+	}
+	if err = identRows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating person identity rows: %v", err)
+	}
+
+	return persons, nil
+}
+
+// LoadPerson loads the person with the given row ID along with
+// their identities. If there is no such person, sql.ErrNoRows
+// is returned.
+func (t *Timeline) LoadPerson(ctx context.Context, personID int64) (Person, error) {
+	p := Person{ID: personID}
+	err := t.db.QueryRowContext(ctx, `SELECT COALESCE(name, '') FROM persons WHERE id=? LIMIT 1`,
+		personID).Scan(&p.Name)
+	if err == sql.ErrNoRows {
+		return Person{}, err
+	}
+	if err != nil {
+		return Person{}, fmt.Errorf("loading person: %v", err)
+	}
+
+	rows, err := t.db.QueryContext(ctx, `SELECT id, person_id, data_source_id, user_id
+		FROM person_identities WHERE person_id=? ORDER BY id`, personID)
+	if err != nil {
+		return Person{}, fmt.Errorf("querying person identities: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ident PersonIdentity
+		err := rows.Scan(&ident.ID, &ident.PersonID, &ident.DataSourceID, &ident.UserID)
+		if err != nil {
+			return Person{}, fmt.Errorf("scanning person identity: %v", err)
+		}
+		p.Identities = append(p.Identities, ident)
+	}
+	if err = rows.Err(); err != nil {
+		return Person{}, fmt.Errorf("iterating person identity rows: %v", err)
+	}
+
+	return p, nil
 }
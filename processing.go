@@ -2,13 +2,15 @@ package timeliner
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,27 +18,66 @@ import (
 // beginProcessing starts workers to process items that are
 // obtained from ac. It returns a WaitGroup which blocks until
 // all workers have finished, and a channel into which the
-// service should pipe its items.
-func (wc *WrappedClient) beginProcessing(cc concurrentCuckoo, po ProcessingOptions) (*sync.WaitGroup, chan<- *ItemGraph) {
+// service should pipe its items. If pl is not nil, the items
+// are recorded in it as they are received, before they are
+// processed. Once ctx is cancelled, items that are received
+// are no longer processed, but the workers keep draining the
+// channel until it is closed, so the service is not blocked.
+func (wc *WrappedClient) beginProcessing(ctx context.Context, pl *pruneListing, po ProcessingOptions, rt *runTracker) (*sync.WaitGroup, chan<- *ItemGraph) {
+	workers := po.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	batchSize := po.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
 	wg := new(sync.WaitGroup)
-	ch := make(chan *ItemGraph)
 
-	const workers = 2 // TODO: Make configurable?
+	// buffer the channel so that the data source can list
+	// items while the workers are busy storing a batch;
+	// otherwise batches would rarely fill up
+	ch := make(chan *ItemGraph, batchSize*workers)
+
+	// checkpoints are sent through the channel (see
+	// Checkpoint) so that they are saved in order
+	wc.itemChan = ch
+	ct := newCheckpointTracker(wc)
+
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			for ig := range ch {
-				_, err := wc.processItemGraph(ig, &recursiveState{
-					timestamp: time.Now(),
-					procOpt:   po,
-					seen:      make(map[*ItemGraph]int64),
-					idmap:     make(map[string]int64),
-					cuckoo:    cc,
-				})
-				if err != nil {
-					log.Printf("[ERROR] %s: processing item graph: %v", wc.acc, err)
+			for {
+				batch, single, seq, ok := ct.next(ctx, ch, batchSize)
+				if !ok {
+					return
+				}
+				if relatesToListedItems(batch...) || relatesToListedItems(single) {
+					// the items must be stored before they can be related
+					ct.waitForEarlier(seq)
 				}
+				if len(batch) > 0 {
+					wc.tl.batchMu.Lock()
+					pl.add(wc.tl.db, batch...)
+					wc.tl.batchMu.Unlock()
+				}
+				if len(batch) > 0 && po.DryRun {
+					// nothing is written, so there is nothing to batch
+					for _, ig := range batch {
+						wc.processGraph(wc.tl.db, ig, po, rt)
+					}
+				} else if len(batch) > 0 {
+					wc.processBatch(batch, po, rt)
+				}
+				if single != nil {
+					wc.tl.batchMu.Lock()
+					pl.add(wc.tl.db, single)
+					wc.tl.batchMu.Unlock()
+					wc.processGraph(batchLockedDB{wc.tl.db, wc.tl.batchMu}, single, po, rt)
+				}
+				ct.done(seq)
 			}
 		}(i)
 	}
@@ -44,20 +85,430 @@ func (wc *WrappedClient) beginProcessing(cc concurrentCuckoo, po ProcessingOptio
 	return wg, ch
 }
 
+// checkpointMarker is a checkpoint of the data source's
+// listing, in the order it was sent among the items.
+type checkpointMarker struct {
+	data []byte
+}
+
+// checkpointTracker saves the checkpoints that come through
+// the item channel only after all the items received before
+// them have been processed; otherwise, resuming from a saved
+// checkpoint after an interruption could skip items that
+// were listed but not yet stored. It also lets batches wait
+// for the ones received before them (see waitForEarlier).
+type checkpointTracker struct {
+	wc *WrappedClient
+
+	// held while receiving, so that batches
+	// are numbered in the order of the channel
+	recvMu sync.Mutex
+
+	mu       sync.Mutex
+	nextSeq  int64
+	inFlight map[int64]struct{}
+	pending  []pendingCheckpoint
+	doneCond *sync.Cond // signaled when a batch is done
+}
+
+func newCheckpointTracker(wc *WrappedClient) *checkpointTracker {
+	ct := &checkpointTracker{wc: wc, inFlight: make(map[int64]struct{})}
+	ct.doneCond = sync.NewCond(&ct.mu)
+	return ct
+}
+
+// pendingCheckpoint is a checkpoint that can be saved
+// once all batches numbered lower than seq are done.
+type pendingCheckpoint struct {
+	seq  int64
+	data []byte
+}
+
+// next receives the next batch of items from ch (see nextBatch)
+// and numbers it. Checkpoint markers are taken out of the batch
+// and kept until they can be saved. It returns false when ch is
+// closed. Once ctx is cancelled, received items and checkpoints
+// are discarded, and next only returns when ch is closed.
+func (ct *checkpointTracker) next(ctx context.Context, ch <-chan *ItemGraph, batchSize int) ([]*ItemGraph, *ItemGraph, int64, bool) {
+	ct.recvMu.Lock()
+	defer ct.recvMu.Unlock()
+
+	for {
+		received, single := nextBatch(ch, batchSize)
+		if len(received) == 0 && single == nil {
+			return nil, nil, 0, false
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+
+		var batch []*ItemGraph
+		var checkpoints [][]byte
+		for _, ig := range received {
+			if ig.checkpoint != nil {
+				checkpoints = append(checkpoints, ig.checkpoint.data)
+				continue
+			}
+			batch = append(batch, ig)
+		}
+
+		ct.mu.Lock()
+		if len(batch) == 0 && single == nil {
+			// only checkpoints; they follow the batches already numbered
+			for _, data := range checkpoints {
+				ct.pending = append(ct.pending, pendingCheckpoint{seq: ct.nextSeq, data: data})
+			}
+			ct.saveReady()
+			ct.mu.Unlock()
+			continue
+		}
+		seq := ct.nextSeq
+		ct.nextSeq++
+		ct.inFlight[seq] = struct{}{}
+		for _, data := range checkpoints {
+			// the batch may have items listed after the checkpoint,
+			// but waiting for them too does no harm
+			ct.pending = append(ct.pending, pendingCheckpoint{seq: seq + 1, data: data})
+		}
+		ct.mu.Unlock()
+
+		return batch, single, seq, true
+	}
+}
+
+// done marks the batch numbered seq as processed, and saves
+// the latest checkpoint that no longer waits for any batch.
+func (ct *checkpointTracker) done(seq int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.inFlight, seq)
+	ct.saveReady()
+	ct.doneCond.Broadcast()
+}
+
+// waitForEarlier blocks until all batches numbered lower
+// than seq have been processed. This cannot deadlock, as
+// batches only wait for ones that were received earlier.
+func (ct *checkpointTracker) waitForEarlier(seq int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for ct.lowestInFlight() < seq {
+		ct.doneCond.Wait()
+	}
+}
+
+// lowestInFlight returns the number of the earliest batch
+// that is still being processed, or the number of the next
+// batch if there are none. It must be called with ct.mu locked.
+func (ct *checkpointTracker) lowestInFlight() int64 {
+	lowest := ct.nextSeq
+	for seq := range ct.inFlight {
+		if seq < lowest {
+			lowest = seq
+		}
+	}
+	return lowest
+}
+
+// saveReady saves the latest pending checkpoint whose batches
+// have all been processed, and forgets the ones before it.
+// It must be called with ct.mu locked.
+func (ct *checkpointTracker) saveReady() {
+	lowest := ct.lowestInFlight()
+	ready := -1
+	for i, p := range ct.pending {
+		if p.seq > lowest {
+			break
+		}
+		ready = i
+	}
+	if ready < 0 {
+		return
+	}
+	ct.wc.saveCheckpoint(ct.pending[ready].data)
+	ct.pending = ct.pending[ready+1:]
+}
+
+// nextBatch receives up to batchSize item graphs from ch which
+// can be stored together in a transaction. It blocks until at
+// least one graph is received or ch is closed, then takes only
+// the graphs that are ready without waiting. Because downloading
+// data files can take a long time, a graph that has data files is
+// never put into a batch; if one is received, it is returned as
+// single, and the batch ends. If ch is closed and drained, both
+// return values are empty.
+func nextBatch(ch <-chan *ItemGraph, batchSize int) (batch []*ItemGraph, single *ItemGraph) {
+	ig, ok := <-ch
+	if !ok {
+		return nil, nil
+	}
+	for {
+		if hasDataFiles(ig, make(map[*ItemGraph]struct{})) {
+			return batch, ig
+		}
+		batch = append(batch, ig)
+		if len(batch) >= batchSize {
+			return batch, nil
+		}
+		select {
+		case ig, ok = <-ch:
+			if !ok {
+				return batch, nil
+			}
+		default:
+			return batch, nil
+		}
+	}
+}
+
+// relatesToListedItems returns true if any of the graphs has
+// raw relations to items by their IDs, other than the graph's
+// own node item. Such items were listed before the graph, so
+// they may not have been stored yet.
+func relatesToListedItems(graphs ...*ItemGraph) bool {
+	for _, ig := range graphs {
+		if ig == nil {
+			continue
+		}
+		var ownID string
+		if ig.Node != nil {
+			ownID = ig.Node.ID()
+		}
+		for _, rr := range ig.Relations {
+			if (rr.FromItemID != "" && rr.FromItemID != ownID) ||
+				(rr.ToItemID != "" && rr.ToItemID != ownID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDataFiles returns true if any item in ig, including connected
+// items and items in its collections, has a data file name.
+func hasDataFiles(ig *ItemGraph, seen map[*ItemGraph]struct{}) bool {
+	if ig == nil {
+		return false
+	}
+	if _, ok := seen[ig]; ok {
+		return false
+	}
+	seen[ig] = struct{}{}
+	if ig.Node != nil && ig.Node.DataFileName() != nil {
+		return true
+	}
+	for connectedIG := range ig.Edges {
+		if hasDataFiles(connectedIG, seen) {
+			return true
+		}
+	}
+	for _, coll := range ig.Collections {
+		for _, cit := range coll.Items {
+			if cit.Item != nil && cit.Item.DataFileName() != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processBatch stores all the item graphs in batch in a single
+// transaction. Each graph is processed within a savepoint, so
+// that if one fails, it does not prevent the others from being
+// stored.
+func (wc *WrappedClient) processBatch(batch []*ItemGraph, po ProcessingOptions, rt *runTracker) {
+	wc.tl.batchMu.Lock()
+	defer wc.tl.batchMu.Unlock()
+
+	tx, err := wc.tl.db.Begin()
+	if err != nil {
+		log.Printf("[ERROR] %s: beginning transaction: %v; processing %d item graphs individually",
+			wc.acc, err, len(batch))
+		for _, ig := range batch {
+			wc.processGraph(wc.tl.db, ig, po, rt)
+		}
+		return
+	}
+
+	// the same few statements are run for every item, so
+	// preparing them once per batch saves a lot of time
+	db := &stmtCacheTx{Tx: tx, stmts: make(map[string]*sql.Stmt)}
+
+	// if the transaction fails, none of the items in it are
+	// stored, so stats are only final once it is committed
+	var stored []*recursiveState
+	var stats RunStats
+	discard := func() {
+		tx.Rollback()
+		rt.add(stats.failed())
+	}
+
+	for _, ig := range batch {
+		_, err = tx.Exec(`SAVEPOINT item_graph`)
+		if err != nil {
+			log.Printf("[ERROR] %s: creating savepoint: %v; discarding batch of %d item graphs",
+				wc.acc, err, len(batch))
+			discard()
+			return
+		}
+		state := wc.newRecursiveState(db, po, rt)
+		_, err = wc.processItemGraph(ig, state)
+		if err != nil {
+			log.Printf("[ERROR] %s: processing item graph: %v", wc.acc, err)
+			stats.add(state.stats.failed())
+			_, err = tx.Exec(`ROLLBACK TO item_graph`)
+			if err != nil {
+				log.Printf("[ERROR] %s: rolling back to savepoint: %v; discarding batch of %d item graphs",
+					wc.acc, err, len(batch))
+				discard()
+				return
+			}
+		} else {
+			stored = append(stored, state)
+			stats.add(state.stats)
+		}
+		_, err = tx.Exec(`RELEASE item_graph`)
+		if err != nil {
+			log.Printf("[ERROR] %s: releasing savepoint: %v; discarding batch of %d item graphs",
+				wc.acc, err, len(batch))
+			discard()
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("[ERROR] %s: committing batch of %d item graphs: %v", wc.acc, len(batch), err)
+		rt.add(stats.failed())
+		return
+	}
+
+	for _, state := range stored {
+		wc.trackLastItem(state)
+	}
+	rt.add(stats)
+}
+
+// processGraph stores ig using db, which is usually
+// the database itself rather than a transaction.
+func (wc *WrappedClient) processGraph(db querier, ig *ItemGraph, po ProcessingOptions, rt *runTracker) {
+	state := wc.newRecursiveState(db, po, rt)
+	_, err := wc.processItemGraph(ig, state)
+	rt.add(state.stats)
+	if err != nil {
+		log.Printf("[ERROR] %s: processing item graph: %v", wc.acc, err)
+		return
+	}
+	wc.trackLastItem(state)
+}
+
+func (wc *WrappedClient) newRecursiveState(db querier, po ProcessingOptions, rt *runTracker) *recursiveState {
+	return &recursiveState{
+		db:        db,
+		timestamp: time.Now(),
+		procOpt:   po,
+		seen:      make(map[*ItemGraph]int64),
+		idmap:     make(map[string]int64),
+		dryRun:    rt.dryRun,
+	}
+}
+
+// trackLastItem keeps track of the stored item with the highest
+// (latest, last, etc.) timestamp, so that get-latest operations
+// can be resumed after interruption without creating gaps in the
+// data that would never be filled in otherwise except with a
+// get-all... It must only be called once the items in state
+// have been committed to the database.
+func (wc *WrappedClient) trackLastItem(state *recursiveState) {
+	if state.lastItemRowID == 0 {
+		return
+	}
+	wc.lastItemMu.Lock()
+	if wc.lastItemTimestamp.IsZero() || wc.lastItemTimestamp.Before(state.lastItemTimestamp) {
+		wc.lastItemRowID = state.lastItemRowID
+		wc.lastItemTimestamp = state.lastItemTimestamp
+	}
+	wc.lastItemMu.Unlock()
+}
+
+// batchLockedDB is the database as used to store item graphs
+// that are not in a batch: each statement that writes waits for
+// its turn on batchMu, rather than for the database lock held
+// by the transaction of a batch, which can take long enough for
+// the statement to fail. The lock is not held in between, so
+// batches can be stored while data files are downloaded.
+type batchLockedDB struct {
+	*sql.DB
+	batchMu *sync.Mutex
+}
+
+func (db batchLockedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	db.batchMu.Lock()
+	defer db.batchMu.Unlock()
+	return db.DB.Exec(query, args...)
+}
+
+// stmtCacheTx is a transaction that prepares each query
+// only once and reuses the prepared statement. Statements
+// are closed when the transaction ends.
+type stmtCacheTx struct {
+	*sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func (tx *stmtCacheTx) stmt(query string) (*sql.Stmt, error) {
+	if stmt, ok := tx.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	tx.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (tx *stmtCacheTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+func (tx *stmtCacheTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (tx *stmtCacheTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		// let the error surface when the row is scanned
+		return tx.Tx.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
 type recursiveState struct {
+	db        querier // the database, or the transaction of a batch
 	timestamp time.Time
 	procOpt   ProcessingOptions
 	seen      map[*ItemGraph]int64 // value is the item's row ID
 	idmap     map[string]int64     // map an item's service ID to the row ID -- TODO: I don't love this... any better way?
 
-	// the cuckoo filter pointer lives for
-	// the duration of the entire operation;
-	// it is often nil, but if it is set,
-	// then the service-produced ID of each
-	// item should be added to the filter so
-	// that a prune can take place when the
-	// entire operation is complete
-	cuckoo concurrentCuckoo
+	// the stored item with the latest timestamp
+	lastItemRowID     int64
+	lastItemTimestamp time.Time
+
+	// what happened to the items of the graph
+	stats RunStats
+
+	// the items of a dry run (nil if not a dry run)
+	dryRun *dryRunItems
 }
 
 func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState) (int64, error) {
@@ -117,9 +568,13 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 				// store this item's ID for later
 				state.idmap[connectedIG.Node.ID()] = connectedIGRowID
 
+				if state.procOpt.DryRun {
+					continue
+				}
+
 				// insert relations to this connected node into DB
 				for _, rel := range relations {
-					_, err = wc.tl.db.Exec(`INSERT OR IGNORE INTO relationships
+					_, err = state.db.Exec(`INSERT OR IGNORE INTO relationships
 					(from_item_id, to_item_id, directed, label)
 					VALUES (?, ?, ?, ?)`,
 						igRowID, connectedIGRowID, !rel.Bidirectional, rel.Label)
@@ -141,7 +596,7 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 			coll.Items[i].itemRowID = state.idmap[it.Item.ID()]
 		}
 
-		err := wc.processCollection(coll, state.timestamp, state.procOpt)
+		err := wc.processCollection(state, coll)
 		if err != nil {
 			return 0, fmt.Errorf("processing collection: %v (original_id=%s)", err, coll.OriginalID)
 		}
@@ -153,8 +608,9 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 		var err error
 		if rr.FromItemID != "" {
 			// get each item's row ID from their data source item ID
-			fromItemRowID, err = wc.itemRowIDFromOriginalID(rr.FromItemID)
+			fromItemRowID, err = wc.itemRowIDFromOriginalID(state.db, rr.FromItemID)
 			if err == sql.ErrNoRows {
+				wc.skipRelation(state, rr, "item", rr.FromItemID)
 				continue // item does not exist in timeline; skip this relation
 			}
 			if err != nil {
@@ -162,8 +618,9 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 			}
 		}
 		if rr.ToItemID != "" {
-			toItemRowID, err = wc.itemRowIDFromOriginalID(rr.ToItemID)
+			toItemRowID, err = wc.itemRowIDFromOriginalID(state.db, rr.ToItemID)
 			if err == sql.ErrNoRows {
+				wc.skipRelation(state, rr, "item", rr.ToItemID)
 				continue // item does not exist in timeline; skip this relation
 			}
 			if err != nil {
@@ -171,8 +628,9 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 			}
 		}
 		if rr.FromPersonUserID != "" {
-			fromPersonRowID, err = wc.personRowIDFromUserID(rr.FromPersonUserID)
+			fromPersonRowID, err = wc.personRowIDFromUserID(state.db, rr.FromPersonUserID)
 			if err == sql.ErrNoRows {
+				wc.skipRelation(state, rr, "person", rr.FromPersonUserID)
 				continue // person does not exist in timeline; skip this relation
 			}
 			if err != nil {
@@ -180,8 +638,9 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 			}
 		}
 		if rr.ToPersonUserID != "" {
-			toPersonRowID, err = wc.personRowIDFromUserID(rr.ToPersonUserID)
+			toPersonRowID, err = wc.personRowIDFromUserID(state.db, rr.ToPersonUserID)
 			if err == sql.ErrNoRows {
+				wc.skipRelation(state, rr, "person", rr.ToPersonUserID)
 				continue // person does not exist in timeline; skip this relation
 			}
 			if err != nil {
@@ -189,8 +648,12 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 			}
 		}
 
+		if state.procOpt.DryRun {
+			continue
+		}
+
 		// store the relation
-		_, err = wc.tl.db.Exec(`INSERT OR IGNORE INTO relationships
+		_, err = state.db.Exec(`INSERT OR IGNORE INTO relationships
 					(from_person_id, from_item_id, to_person_id, to_item_id, directed, label)
 					VALUES (?, ?, ?, ?, ?, ?)`,
 			fromPersonRowID, fromItemRowID, toPersonRowID, toItemRowID, !rr.Bidirectional, rr.Label)
@@ -203,38 +666,40 @@ func (wc *WrappedClient) processItemGraph(ig *ItemGraph, state *recursiveState)
 	return igRowID, nil
 }
 
-func (wc *WrappedClient) processSingleItemGraphNode(it Item, state *recursiveState) (int64, error) {
-	if itemID := it.ID(); itemID != "" && state.cuckoo.Filter != nil {
-		state.cuckoo.Lock()
-		state.cuckoo.InsertUnique([]byte(itemID))
-		state.cuckoo.Unlock()
+// skipRelation logs that rr is skipped because the item or
+// person with the given ID is not in the timeline, if verbose.
+func (wc *WrappedClient) skipRelation(state *recursiveState, rr RawRelation, kind, id string) {
+	if state.procOpt.Verbose {
+		log.Printf("[DEBUG] %s: skipping %s relation: %s %s is not in the timeline",
+			wc.acc, rr.Label, kind, id)
 	}
+}
 
-	itemRowID, err := wc.storeItemFromService(it, state.timestamp, state.procOpt)
+func (wc *WrappedClient) processSingleItemGraphNode(it Item, state *recursiveState) (int64, error) {
+	itemRowID, err := wc.storeItemFromService(state, it, state.procOpt)
 	if err != nil {
+		state.stats.ItemsFailed++
 		return itemRowID, err
 	}
 
-	// item was stored successfully, so now keep track of the item with the highest
-	// (latest, last, etc.) timestamp, so that get-latest operations can be resumed
-	// after interruption without creating gaps in the data that would never be
-	// filled in otherwise except with a get-all...
+	// item was stored successfully, so now remember it if it is the latest
+	// one; it is tracked on wc once the item is committed (see trackLastItem)
 	itemTS := it.Timestamp()
-	wc.lastItemMu.Lock()
-	if wc.lastItemTimestamp.IsZero() || wc.lastItemTimestamp.Before(itemTS) {
-		wc.lastItemRowID = itemRowID
-		wc.lastItemTimestamp = itemTS
+	if state.lastItemTimestamp.IsZero() || state.lastItemTimestamp.Before(itemTS) {
+		state.lastItemRowID = itemRowID
+		state.lastItemTimestamp = itemTS
 	}
-	wc.lastItemMu.Unlock()
 
 	return itemRowID, nil
 }
 
-func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, procOpt ProcessingOptions) (int64, error) {
+func (wc *WrappedClient) storeItemFromService(state *recursiveState, it Item, procOpt ProcessingOptions) (int64, error) {
 	if it == nil {
 		return 0, nil
 	}
 
+	state.stats.ItemsSeen++
+
 	itemOriginalID := it.ID()
 
 	// if enabled, prepare a "soft merge" - this operation finds an existing row that
@@ -247,7 +712,7 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 	var doingSoftMerge bool
 	if procOpt.Merge.SoftMerge {
 		var err error
-		itemOriginalID, doingSoftMerge, err = wc.softMerge(it, procOpt)
+		itemOriginalID, doingSoftMerge, err = wc.softMerge(state.db, it, procOpt)
 		if err != nil {
 			return 0, fmt.Errorf("soft merge: %v", err)
 		}
@@ -258,6 +723,10 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 	itemLocks.Lock(itemLockID)
 	defer itemLocks.Unlock(itemLockID)
 
+	if procOpt.DryRun {
+		return wc.dryRunItem(state, it, itemOriginalID, doingSoftMerge, procOpt)
+	}
+
 	// if there is a data file, prepare to download it
 	// and get its file name; but don't actually begin
 	// downloading it until after it is in the DB, since
@@ -283,7 +752,7 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 	// if the item is already in our DB, load it
 	var ir ItemRow
 	if itemOriginalID != "" {
-		ir, err = wc.loadItemRow(wc.acc.ID, itemOriginalID)
+		ir, err = wc.loadItemRow(state.db, wc.acc.ID, itemOriginalID)
 		if err != nil {
 			return 0, fmt.Errorf("checking for item in database: %v", err)
 		}
@@ -295,6 +764,7 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 					log.Printf("[DEBUG] %s: skipping processing of existing item (item_id=%s item_row_id=%d soft_merge=%t)",
 						wc.acc, itemOriginalID, ir.ID, doingSoftMerge)
 				}
+				state.stats.ItemsSkipped++
 				return ir.ID, nil
 			}
 
@@ -306,11 +776,18 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 
 			// if we are in fact processing this data file, move any old one out of the way temporarily
 			// as a safe measure, and also because our filename-generator will not allow a file to be
-			// overwritten, but we want to replace the existing file in this case...
-			if processDataFile {
-				origFile := wc.tl.fullpath(*ir.DataFile)
-				bakFile := wc.tl.fullpath(*ir.DataFile + ".bak")
-				err = os.Rename(origFile, bakFile)
+			// overwritten, but we want to replace the existing file in this case... (blobs are never
+			// overwritten, since their names are their checksums, but an old blob may still be used
+			// by other items, so it is left for fsck to clean up if it's not; only a partial download
+			// can be deleted right away)
+			if processDataFile && ir.DataFile != nil && isBlob(*ir.DataFile) {
+				if ir.DataHash == nil && path.Dir(*ir.DataFile) == blobsTmpFolder {
+					wc.tl.store.Remove(*ir.DataFile)
+				}
+			} else if processDataFile {
+				origFile := *ir.DataFile
+				bakFile := *ir.DataFile + ".bak"
+				err = wc.tl.store.Rename(origFile, bakFile)
 				if err != nil && !os.IsNotExist(err) {
 					return 0, fmt.Errorf("temporarily moving data file: %v", err)
 				}
@@ -321,12 +798,12 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 				// delete the old file altogether
 				defer func() {
 					if err == nil {
-						err := os.Remove(bakFile)
+						err := wc.tl.store.Remove(bakFile)
 						if err != nil && !os.IsNotExist(err) {
 							log.Printf("[ERROR] deleting data file backup: %v", err)
 						}
 					} else {
-						err := os.Rename(bakFile, origFile)
+						err := wc.tl.store.Rename(bakFile, origFile)
 						if err != nil && !os.IsNotExist(err) {
 							log.Printf("[ERROR] restoring original data file from backup: %v", err)
 						}
@@ -336,11 +813,16 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 		}
 	}
 
-	// get the filename for the data file if we are processing it
+	// get the filename for the data file if we are processing it; in
+	// the blobs layout, the file is named after it is downloaded
 	var dataFileName *string
-	var datafile *os.File
+	var datafile io.WriteCloser
 	if processDataFile {
-		datafile, dataFileName, err = wc.tl.openUniqueCanonicalItemDataFile(it, wc.ds.ID)
+		if wc.tl.layout == LayoutBlobs {
+			datafile, dataFileName, err = wc.tl.openBlobTmpFile()
+		} else {
+			datafile, dataFileName, err = wc.tl.openUniqueCanonicalItemDataFile(it, wc.ds.ID)
+		}
 		if err != nil {
 			return 0, fmt.Errorf("opening output data file: %v", err)
 		}
@@ -348,26 +830,32 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 	}
 
 	// prepare the item's DB row values
-	err = wc.fillItemRow(&ir, it, itemOriginalID, timestamp, dataFileName)
+	err = wc.fillItemRow(state.db, &ir, it, itemOriginalID, state.timestamp, dataFileName)
 	if err != nil {
 		return 0, fmt.Errorf("assembling item for storage: %v", err)
 	}
 
 	// run the database query to insert or update the item
-	err = wc.insertOrUpdateItem(ir, doingSoftMerge, procOpt)
+	err = wc.insertOrUpdateItem(state.db, ir, doingSoftMerge, procOpt)
 	if err != nil {
 		return 0, fmt.Errorf("storing item in database: %v (item_id=%v)", err, ir.OriginalID)
 	}
 
 	// get the item's row ID (this works regardless of whether the last query was an insert or an update)
 	var itemRowID int64
-	err = wc.tl.db.QueryRow(`SELECT id FROM items
+	err = state.db.QueryRow(`SELECT id FROM items
 		WHERE account_id=? AND original_id=? LIMIT 1`,
 		ir.AccountID, ir.OriginalID).Scan(&itemRowID)
 	if err != nil && err != sql.ErrNoRows {
 		return 0, fmt.Errorf("getting item row ID: %v", err)
 	}
 
+	// keep the search index in sync with the stored values
+	err = wc.tl.indexItem(state.db, itemRowID)
+	if err != nil {
+		return 0, fmt.Errorf("updating search index: %v", err)
+	}
+
 	if procOpt.Verbose {
 		log.Printf("[DEBUG] %s: stored or updated item in database (item_id=%s item_row_id=%d soft_merge=%t)",
 			wc.acc, itemOriginalID, itemRowID, doingSoftMerge)
@@ -376,30 +864,47 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 	// if there is a data file, download it and compute its checksum;
 	// then update the item's row in the DB with its name and checksum
 	if processDataFile {
-		h := sha256.New()
-		dataFileSize, err := wc.tl.downloadItemFile(rc, datafile, h)
+		h := wc.tl.newDataHash()
+		dataFileSize, err := wc.tl.downloadItemFile(rc, datafile, *dataFileName, h)
 		if err != nil {
 			return 0, fmt.Errorf("downloading data file: %v (item_id=%v)", err, itemRowID)
 		}
+		state.stats.BytesDownloaded += dataFileSize
 
 		// now that download is complete, compute its hash
 		dfHash := h.Sum(nil)
 		b64hash := base64.StdEncoding.EncodeToString(dfHash)
 
-		// if the exact same file (byte-for-byte) already exists,
-		// delete this copy and reuse the existing one
-		err = wc.tl.replaceWithExisting(dataFileName, b64hash, itemRowID)
-		if err != nil {
-			return 0, fmt.Errorf("replacing data file with identical existing file: %v", err)
+		var viewPath *string
+		if wc.tl.layout == LayoutBlobs {
+			// name the file by its checksum; if the exact same
+			// file already exists, this copy is simply deleted
+			blob, err := wc.tl.storeBlob(*dataFileName, b64hash)
+			if err != nil {
+				return 0, fmt.Errorf("storing data file: %v", err)
+			}
+			dataFileName = &blob
+			vp := path.Join(strings.TrimPrefix(wc.tl.canonicalItemDataFileDir(it, wc.ds.ID), "data/"),
+				wc.tl.canonicalItemDataFileName(it, wc.ds.ID))
+			viewPath = &vp
+		} else {
+			// if the exact same file (byte-for-byte) already exists,
+			// delete this copy and reuse the existing one
+			dataFileName, err = wc.tl.replaceWithExisting(dataFileName, b64hash, itemRowID)
+			if err != nil {
+				return 0, fmt.Errorf("replacing data file with identical existing file: %v", err)
+			}
 		}
 
 		// save the file's name and hash to confirm it was downloaded successfully
-		_, err = wc.tl.db.Exec(`UPDATE items SET data_hash=? WHERE id=?`, // TODO: LIMIT 1... (see https://github.com/mattn/go-sqlite3/pull/802)
-			b64hash, itemRowID)
+		_, err = state.db.Exec(`UPDATE items SET data_file=?, data_hash=?, view_path=? WHERE id=?`, // TODO: LIMIT 1... (see https://github.com/mattn/go-sqlite3/pull/802)
+			dataFileName, b64hash, viewPath, itemRowID)
 		if err != nil {
 			log.Printf("[ERROR] %s: updating item's data file hash in DB: %v; cleaning up data file: %s (item_id=%d)",
-				wc.acc, err, datafile.Name(), itemRowID)
-			os.Remove(wc.tl.fullpath(*dataFileName))
+				wc.acc, err, *dataFileName, itemRowID)
+			if !isBlob(*dataFileName) {
+				wc.tl.store.Remove(*dataFileName)
+			}
 		}
 
 		if procOpt.Verbose {
@@ -408,20 +913,29 @@ func (wc *WrappedClient) storeItemFromService(it Item, timestamp time.Time, proc
 		}
 	}
 
+	switch {
+	case doingSoftMerge:
+		state.stats.ItemsMerged++
+	case ir.ID > 0:
+		state.stats.ItemsUpdated++
+	default:
+		state.stats.ItemsNew++
+	}
+
 	return itemRowID, nil
 }
 
 func (wc *WrappedClient) shouldProcessExistingItem(it Item, dbItem ItemRow, doingSoftMerge bool, procOpt ProcessingOptions) bool {
 	// if integrity check is enabled and checksum mismatches, always reprocess
 	if procOpt.Integrity && dbItem.DataFile != nil && dbItem.DataHash != nil {
-		datafile, err := os.Open(wc.tl.fullpath(*dbItem.DataFile))
+		datafile, err := wc.tl.store.Open(*dbItem.DataFile)
 		if err != nil {
 			log.Printf("[ERROR] %s: integrity check: opening existing data file: %v; reprocessing (item_id=%d)",
 				wc.acc, err, dbItem.ID)
 			return true
 		}
 		defer datafile.Close()
-		h := sha256.New()
+		h := wc.tl.newDataHash()
 		_, err = io.Copy(h, datafile)
 		if err != nil {
 			log.Printf("[ERROR] %s: integrity check: reading existing data file: %v; reprocessing (item_id=%d)",
@@ -464,7 +978,7 @@ func (wc *WrappedClient) shouldProcessExistingItem(it Item, dbItem ItemRow, doin
 	return procOpt.Reprocess || doingSoftMerge
 }
 
-func (wc *WrappedClient) fillItemRow(ir *ItemRow, it Item, itemOriginalID string, timestamp time.Time, canonicalDataFileName *string) error {
+func (wc *WrappedClient) fillItemRow(db querier, ir *ItemRow, it Item, itemOriginalID string, timestamp time.Time, canonicalDataFileName *string) error {
 	// unpack the item's information into values to use in the row
 
 	ownerID, ownerName := it.Owner()
@@ -475,7 +989,7 @@ func (wc *WrappedClient) fillItemRow(ir *ItemRow, it Item, itemOriginalID string
 		empty := ""
 		ownerName = &empty
 	}
-	person, err := wc.tl.getPerson(wc.ds.ID, *ownerID, *ownerName)
+	person, err := getPerson(db, wc.ds.ID, *ownerID, *ownerName)
 	if err != nil {
 		return fmt.Errorf("getting person associated with item: %v", err)
 	}
@@ -539,7 +1053,7 @@ func (wc *WrappedClient) fillItemRow(ir *ItemRow, it Item, itemOriginalID string
 // downloading the file, obviously; since most data sources don't offer one, in practice soft
 // merges happen over timestamp plus filename or text data only). It returns the ID that must
 // be used when processing the item, and whether a soft merge is being performed or not.
-func (wc *WrappedClient) softMerge(it Item, procOpt ProcessingOptions) (string, bool, error) {
+func (wc *WrappedClient) softMerge(db querier, it Item, procOpt ProcessingOptions) (string, bool, error) {
 	var filenameLikePattern *string
 	if dataFileName := it.DataFileName(); dataFileName != nil {
 		temp := "%/" + *dataFileName
@@ -561,11 +1075,11 @@ func (wc *WrappedClient) softMerge(it Item, procOpt ProcessingOptions) (string,
 	var numMatches int
 	var rowID *int
 	var oldOriginalID *string
-	err = wc.tl.db.QueryRow(`SELECT COUNT(1), id, original_id
+	err = db.QueryRow(`SELECT COUNT(1), id, original_id
 			FROM items
 			WHERE account_id=? AND timestamp=? AND (data_text=? OR data_file LIKE ? OR data_hash=?) AND original_id != ?
 			LIMIT 1`,
-		wc.acc.ID, it.Timestamp().Unix(), dataText, filenameLikePattern, dataHash, newOriginalID).Scan(&numMatches, &rowID, &oldOriginalID)
+		wc.acc.ID, it.Timestamp().Unix(), wc.tl.sealText("data_text", dataText), filenameLikePattern, dataHash, newOriginalID).Scan(&numMatches, &rowID, &oldOriginalID)
 	if err == sql.ErrNoRows || numMatches == 0 {
 		return newOriginalID, false, nil
 	}
@@ -580,6 +1094,12 @@ func (wc *WrappedClient) softMerge(it Item, procOpt ProcessingOptions) (string,
 	// now we know there is exactly one match, so we are to perform a soft merge;
 	// we must honor the configured merge preferences especially regarding ID
 
+	// a dry run must not change the existing item's ID, but merging
+	// into it by its existing ID is the same as far as it can tell
+	if procOpt.DryRun {
+		return *oldOriginalID, true, nil
+	}
+
 	// if configured to keep existing ID, make sure the caller knows to use the
 	// existing/old ID rather than the ID associated with the current/new item
 	if !procOpt.Merge.PreferNewID {
@@ -590,7 +1110,7 @@ func (wc *WrappedClient) softMerge(it Item, procOpt ProcessingOptions) (string,
 	// now we know there is exactly 1 match and we are to use the new item's ID; set up merge by
 	// updating the item's original_id to the incoming item's ID value; this will cause the
 	// imminent INSERT query to find a conflict and perform a graceful merge with the incoming data
-	_, err = wc.tl.db.Exec(`UPDATE items SET original_id=? WHERE id=?`, newOriginalID, rowID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+	_, err = db.Exec(`UPDATE items SET original_id=? WHERE id=?`, newOriginalID, rowID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
 	if err != nil && err != sql.ErrNoRows {
 		return newOriginalID, false, fmt.Errorf("updating candidate row's original_id in DB: %v (id=%d old_original_id=%s new_original_id=%s)",
 			err, rowID, *oldOriginalID, newOriginalID)
@@ -601,25 +1121,45 @@ func (wc *WrappedClient) softMerge(it Item, procOpt ProcessingOptions) (string,
 	return newOriginalID, true, nil
 }
 
-func (wc *WrappedClient) processCollection(coll Collection, timestamp time.Time, procOpt ProcessingOptions) error {
+func (wc *WrappedClient) processCollection(state *recursiveState, coll Collection) error {
 	// never reprocess or check integrity when storing items in collections since the main processing handles that
+	procOpt := state.procOpt
 	procOpt.Reprocess = false
 	procOpt.Integrity = false
 
+	if procOpt.DryRun {
+		for _, cit := range coll.Items {
+			// items in the graph are already counted
+			if _, ok := state.idmap[cit.Item.ID()]; ok {
+				continue
+			}
+			_, err := wc.storeItemFromService(state, cit.Item, procOpt)
+			if err != nil {
+				state.stats.ItemsFailed++
+				return fmt.Errorf("adding item from collection to storage: %v", err)
+			}
+		}
+		if procOpt.Verbose {
+			log.Printf("[INFO] %s: dry run: would add %d items to collection (original_id=%s)",
+				wc.acc, len(coll.Items), coll.OriginalID)
+		}
+		return nil
+	}
+
 	// TODO: support soft merge (based on name, I guess)
-	_, err := wc.tl.db.Exec(`INSERT INTO collections
-		(account_id, original_id, name) VALUES (?, ?, ?)
+	_, err := state.db.Exec(`INSERT INTO collections
+		(account_id, original_id, name, description) VALUES (?, ?, ?, ?)
 		ON CONFLICT (account_id, original_id)
-		DO UPDATE SET name=?`,
-		wc.acc.ID, coll.OriginalID, coll.Name,
-		coll.Name)
+		DO UPDATE SET name=?, description=?`,
+		wc.acc.ID, coll.OriginalID, coll.Name, coll.Description,
+		coll.Name, coll.Description)
 	if err != nil {
 		return fmt.Errorf("inserting collection: %v", err)
 	}
 
 	// get the collection's row ID, regardless of whether it was inserted or updated
 	var collID int64
-	err = wc.tl.db.QueryRow(`SELECT id FROM collections
+	err = state.db.QueryRow(`SELECT id FROM collections
 			WHERE account_id=? AND original_id=? LIMIT 1`,
 		wc.acc.ID, coll.OriginalID).Scan(&collID)
 	if err != nil {
@@ -630,17 +1170,18 @@ func (wc *WrappedClient) processCollection(coll Collection, timestamp time.Time,
 	// (TODO: could batch this for faster inserts)
 	for _, cit := range coll.Items {
 		if cit.itemRowID == 0 {
-			itID, err := wc.storeItemFromService(cit.Item, timestamp, procOpt)
+			itID, err := wc.storeItemFromService(state, cit.Item, procOpt)
 			if err != nil {
+				state.stats.ItemsFailed++
 				return fmt.Errorf("adding item from collection to storage: %v", err)
 			}
 			cit.itemRowID = itID
 		}
 
-		_, err = wc.tl.db.Exec(`INSERT OR IGNORE INTO collection_items
+		_, err = state.db.Exec(`INSERT OR IGNORE INTO collection_items
 			(item_id, collection_id, position)
 			VALUES (?, ?, ?)`,
-			cit.itemRowID, collID, cit.Position, cit.Position)
+			cit.itemRowID, collID, cit.Position)
 		if err != nil {
 			return fmt.Errorf("adding item to collection: %v", err)
 		}
@@ -649,47 +1190,20 @@ func (wc *WrappedClient) processCollection(coll Collection, timestamp time.Time,
 	return nil
 }
 
-func (wc *WrappedClient) loadItemRow(accountID int64, originalID string) (ItemRow, error) {
-	var ir ItemRow
-	var metadataGob []byte
-	var ts, stored int64 // will convert from Unix timestamp
-	var modified *int64
-	err := wc.tl.db.QueryRow(`SELECT
-			id, account_id, original_id, person_id, timestamp, stored,
-			modified, class, mime_type, data_text, data_file, data_hash,
-			metadata, latitude, longitude
-		FROM items WHERE account_id=? AND original_id=? LIMIT 1`, accountID, originalID).Scan(
-		&ir.ID, &ir.AccountID, &ir.OriginalID, &ir.PersonID, &ts, &stored,
-		&modified, &ir.Class, &ir.MIMEType, &ir.DataText, &ir.DataFile, &ir.DataHash,
-		&metadataGob, &ir.Latitude, &ir.Longitude)
+func (wc *WrappedClient) loadItemRow(db querier, accountID int64, originalID string) (ItemRow, error) {
+	row := db.QueryRow(`SELECT `+itemRowColumns+`
+		FROM items WHERE account_id=? AND original_id=? LIMIT 1`, accountID, originalID)
+	ir, err := wc.tl.scanItemRow(row)
 	if err == sql.ErrNoRows {
 		return ItemRow{}, nil
 	}
-	if err != nil {
-		return ItemRow{}, fmt.Errorf("loading item: %v", err)
-	}
-
-	// the metadata is gob-encoded; decode it into the struct
-	ir.Metadata = new(Metadata)
-	err = ir.Metadata.decode(metadataGob)
-	if err != nil {
-		return ItemRow{}, fmt.Errorf("gob-decoding metadata: %v", err)
-	}
-
-	ir.Timestamp = time.Unix(ts, 0)
-	ir.Stored = time.Unix(stored, 0)
-	if modified != nil {
-		modTime := time.Unix(*modified, 0)
-		ir.Modified = &modTime
-	}
-
-	return ir, nil
+	return ir, err
 }
 
 // insertOrUpdateItem inserts the fully-populated ir into the database or, if there is a conflict on
 // the item's account_id and original_id, it updates the existing row. If softMerge is true, the
 // update is an additive merge defined by procOpt; otherwise, updates always replace the old values.
-func (wc *WrappedClient) insertOrUpdateItem(ir ItemRow, softMerge bool, procOpt ProcessingOptions) error {
+func (wc *WrappedClient) insertOrUpdateItem(db querier, ir ItemRow, softMerge bool, procOpt ProcessingOptions) error {
 	fieldPersonID, fieldTimestamp, fieldStored, fieldClass,
 		fieldMimeType, fieldDataText, fieldDataFile, fieldDataHash,
 		fieldMetadata, fieldLatitude, fieldLongitude := "?", "?", "?", "?", "?", "?", "?", "?", "?", "?", "?"
@@ -718,6 +1232,10 @@ func (wc *WrappedClient) insertOrUpdateItem(ir ItemRow, softMerge bool, procOpt
 		}
 	}
 
+	// text and metadata are encrypted if the repository is
+	dataText := wc.tl.sealText("data_text", ir.DataText)
+	metaGob := wc.tl.sealColumn("metadata", ir.metaGob)
+
 	// insert into the DB if it does not exist, and if it does, we update the existing
 	// row such that we usually prefer the new value, but if the new value is nil, keep
 	// the existing value (this is mostly an additive "merge" of the stored row with
@@ -725,7 +1243,7 @@ func (wc *WrappedClient) insertOrUpdateItem(ir ItemRow, softMerge bool, procOpt
 	// value with the new one); 'coalesce(?, field)' means "store new value if not null,
 	// otherwise keep existing value"; i.e. the incoming data is authoritative unless it
 	// is missing, in which case we keep what we have
-	_, err := wc.tl.db.Exec(`INSERT INTO items
+	_, err := db.Exec(`INSERT INTO items
 			(account_id, original_id, person_id, timestamp, stored,
 				class, mime_type, data_text, data_file, data_hash, metadata,
 				latitude, longitude)
@@ -743,27 +1261,29 @@ func (wc *WrappedClient) insertOrUpdateItem(ir ItemRow, softMerge bool, procOpt
 				latitude=`+fieldLatitude+`,
 				longitude=`+fieldLongitude,
 		ir.AccountID, ir.OriginalID, ir.PersonID, ir.Timestamp.Unix(), ir.Stored.Unix(),
-		ir.Class, ir.MIMEType, ir.DataText, ir.DataFile, ir.DataHash, ir.metaGob,
+		ir.Class, ir.MIMEType, dataText, ir.DataFile, ir.DataHash, metaGob,
 		ir.Latitude, ir.Longitude,
-		ir.PersonID, ir.Timestamp.Unix(), ir.Stored.Unix(), ir.Class, ir.MIMEType, ir.DataText,
-		ir.DataFile, ir.DataHash, ir.metaGob, ir.Latitude, ir.Longitude)
+		ir.PersonID, ir.Timestamp.Unix(), ir.Stored.Unix(), ir.Class, ir.MIMEType, dataText,
+		ir.DataFile, ir.DataHash, metaGob, ir.Latitude, ir.Longitude)
 
 	return err
 }
 
 // itemRowIDFromOriginalID returns an item's row ID from the ID
 // associated with the data source of wc, along with its original
-// item ID from that data source. If the item does not exist,
-// sql.ErrNoRows will be returned. A pointer is returned because
-// the column is nullable in the DB.
-func (wc *WrappedClient) itemRowIDFromOriginalID(originalID string) (*int64, error) {
+// item ID from that data source. If accounts on the data source
+// have items with the same ID, the one of wc's account is chosen.
+// If the item does not exist, sql.ErrNoRows will be returned. A
+// pointer is returned because the column is nullable in the DB.
+func (wc *WrappedClient) itemRowIDFromOriginalID(db querier, originalID string) (*int64, error) {
 	var rowID int64
-	err := wc.tl.db.QueryRow(`SELECT items.id
+	err := db.QueryRow(`SELECT items.id
 			FROM items, accounts
 			WHERE items.original_id=?
 				AND accounts.data_source_id=?
 				AND items.account_id = accounts.id
-			LIMIT 1`, originalID, wc.ds.ID).Scan(&rowID)
+			ORDER BY items.account_id=? DESC
+			LIMIT 1`, originalID, wc.ds.ID, wc.acc.ID).Scan(&rowID)
 	return &rowID, err
 }
 
@@ -771,9 +1291,9 @@ func (wc *WrappedClient) itemRowIDFromOriginalID(originalID string) (*int64, err
 // associated with the data source of wc. If the person does not exist,
 // sql.ErrNoRows will be returned. A pointer is returned because the
 // column is nullable in the DB.
-func (wc *WrappedClient) personRowIDFromUserID(userID string) (*int64, error) {
+func (wc *WrappedClient) personRowIDFromUserID(db querier, userID string) (*int64, error) {
 	var rowID int64
-	err := wc.tl.db.QueryRow(`SELECT person_id FROM person_identities
+	err := db.QueryRow(`SELECT person_id FROM person_identities
 		WHERE data_source_id=? AND user_id=? LIMIT 1`,
 		wc.ds.ID, userID).Scan(&rowID)
 	return &rowID, err
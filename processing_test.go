@@ -0,0 +1,430 @@
+package timeliner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// storedCheckpoint returns the checkpoint data saved
+// for the account with the given row ID, if any.
+func storedCheckpoint(t *testing.T, tl *Timeline, accountID int64) []byte {
+	t.Helper()
+	var chkpt []byte
+	err := tl.db.QueryRow(`SELECT checkpoint FROM accounts WHERE id=?`, accountID).Scan(&chkpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chkpt == nil {
+		return nil
+	}
+	var cw checkpointWrapper
+	err = UnmarshalGob(chkpt, &cw)
+	if err != nil {
+		t.Fatalf("decoding checkpoint: %v", err)
+	}
+	return cw.Data
+}
+
+func TestCheckpointTrackerOutOfOrder(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id string) *ItemGraph {
+		return NewItemGraph(testItem{id: id, ts: ts, class: ClassPost})
+	}
+
+	// the checkpoint is listed after items a and b, before c
+	ch := make(chan *ItemGraph, 4)
+	ch <- item("a")
+	ch <- item("b")
+	ch <- &ItemGraph{checkpoint: &checkpointMarker{data: []byte("after b")}}
+	ch <- item("c")
+	close(ch)
+
+	ct := newCheckpointTracker(&wc)
+	ctx := context.Background()
+	var seqs []int64
+	for _, expected := range []string{"a", "b", "c"} {
+		batch, single, seq, ok := ct.next(ctx, ch, 1)
+		if !ok || single != nil || len(batch) != 1 || batch[0].Node.ID() != expected {
+			t.Fatalf("expected a batch of item %s, got %v %v (ok=%t)", expected, batch, single, ok)
+		}
+		seqs = append(seqs, seq)
+	}
+	if _, _, _, ok := ct.next(ctx, ch, 1); ok {
+		t.Fatal("expected no more batches once the channel is closed")
+	}
+
+	// the workers finish b and c before a
+	ct.done(seqs[1])
+	ct.done(seqs[2])
+	if cp := storedCheckpoint(t, tl, wc.acc.ID); cp != nil {
+		t.Fatalf("expected no checkpoint while item a is in flight, got %q", cp)
+	}
+	ct.done(seqs[0])
+	if cp := storedCheckpoint(t, tl, wc.acc.ID); string(cp) != "after b" {
+		t.Fatalf("expected checkpoint once items a and b are done, got %q", cp)
+	}
+	if len(ct.pending) != 0 {
+		t.Errorf("expected no pending checkpoints, got %d", len(ct.pending))
+	}
+}
+
+func TestCheckpointTrackerWaitsOnlyForEarlierItems(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id string) *ItemGraph {
+		return NewItemGraph(testItem{id: id, ts: ts, class: ClassPost})
+	}
+
+	ch := make(chan *ItemGraph, 4)
+	ch <- item("a")
+	ch <- &ItemGraph{checkpoint: &checkpointMarker{data: []byte("after a")}}
+	ch <- item("b")
+	ch <- item("c")
+	close(ch)
+
+	ct := newCheckpointTracker(&wc)
+	ctx := context.Background()
+	_, _, seqA, _ := ct.next(ctx, ch, 1)
+	_, _, seqB, _ := ct.next(ctx, ch, 1)
+	_, _, seqC, _ := ct.next(ctx, ch, 1)
+
+	// items listed after the checkpoint don't hold it back
+	ct.done(seqC)
+	if cp := storedCheckpoint(t, tl, wc.acc.ID); cp != nil {
+		t.Fatalf("expected no checkpoint while item a is in flight, got %q", cp)
+	}
+	ct.done(seqA)
+	if cp := storedCheckpoint(t, tl, wc.acc.ID); string(cp) != "after a" {
+		t.Fatalf("expected checkpoint while only item b is in flight, got %q", cp)
+	}
+	ct.done(seqB)
+}
+
+// badLocationItem is an item that can't be stored,
+// because its location can't be obtained.
+type badLocationItem struct {
+	testItem
+}
+
+func (badLocationItem) Location() (*Location, error) {
+	return nil, errors.New("no location for you")
+}
+
+func TestProcessBatchRollsBackBadItem(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id string) testItem {
+		return testItem{id: id, ts: ts, class: ClassPost, text: "text of " + id}
+	}
+
+	// the root of the bad graph is stored before its
+	// attachment fails, so it must be rolled back too
+	bad := NewItemGraph(item("bad-root"))
+	bad.Add(badLocationItem{item("bad-attachment")}, RelAttached)
+	batch := []*ItemGraph{
+		NewItemGraph(item("good1")),
+		bad,
+		NewItemGraph(item("good2")),
+	}
+
+	po := ProcessingOptions{}
+	rt := newRunTracker(po)
+	wc.processBatch(batch, po, rt)
+	stats := rt.finish()
+
+	for _, test := range []struct {
+		originalID string
+		stored     bool
+	}{
+		{"good1", true},
+		{"good2", true},
+		{"bad-root", false},
+		{"bad-attachment", false},
+	} {
+		var count int
+		err := tl.db.QueryRow(`SELECT COUNT(*) FROM items WHERE original_id=?`, test.originalID).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := count > 0; stored != test.stored {
+			t.Errorf("item %s: expected stored=%t, got %d rows", test.originalID, test.stored, count)
+		}
+	}
+
+	var relationships int
+	err = tl.db.QueryRow(`SELECT COUNT(*) FROM relationships`).Scan(&relationships)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relationships != 0 {
+		t.Errorf("expected no relationships, got %d", relationships)
+	}
+
+	if stats.ItemsNew != 2 || stats.ItemsFailed == 0 {
+		t.Errorf("expected 2 new items and some failed, got %+v", stats)
+	}
+
+	// the good items count toward the last item of the account
+	if wc.lastItemRowID == 0 {
+		t.Errorf("expected last item to be tracked")
+	}
+
+	// the good items can be updated in another batch
+	// without being affected by the failed one
+	rt = newRunTracker(po)
+	wc.processBatch([]*ItemGraph{NewItemGraph(item("good1")), NewItemGraph(item("good3"))}, po, rt)
+	stats = rt.finish()
+	if stats.ItemsNew != 1 || stats.ItemsFailed != 0 {
+		t.Errorf("second batch: expected 1 new item and none failed, got %+v", stats)
+	}
+	var count int
+	err = tl.db.QueryRow(`SELECT COUNT(*) FROM items`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 items in total, got %d", count)
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id string) *ItemGraph {
+		return NewItemGraph(testItem{id: id, ts: ts, class: ClassPost})
+	}
+	withFile := NewItemGraph(testItem{id: "file", ts: ts, class: ClassImage, fileName: "a.jpg", file: "jpeg"})
+
+	ch := make(chan *ItemGraph, 10)
+	for _, ig := range []*ItemGraph{item("1"), item("2"), item("3"), item("4"), withFile, item("5")} {
+		ch <- ig
+	}
+	close(ch)
+
+	ids := func(batch []*ItemGraph) []string {
+		var ids []string
+		for _, ig := range batch {
+			ids = append(ids, ig.Node.ID())
+		}
+		return ids
+	}
+	for i, expected := range []struct {
+		batch  []string
+		single string
+	}{
+		{batch: []string{"1", "2", "3"}},
+		{batch: []string{"4"}, single: "file"},
+		{batch: []string{"5"}},
+		{},
+	} {
+		batch, single := nextBatch(ch, 3)
+		got := ids(batch)
+		if len(got) != len(expected.batch) {
+			t.Errorf("batch %d: expected %v, got %v", i, expected.batch, got)
+		} else {
+			for j := range got {
+				if got[j] != expected.batch[j] {
+					t.Errorf("batch %d: expected %v, got %v", i, expected.batch, got)
+					break
+				}
+			}
+		}
+		var singleID string
+		if single != nil {
+			singleID = single.Node.ID()
+		}
+		if singleID != expected.single {
+			t.Errorf("batch %d: expected single %q, got %q", i, expected.single, singleID)
+		}
+	}
+}
+
+func TestGetLatestInterrupted(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var graphs []*ItemGraph
+	for i := 0; i < 8; i++ {
+		graphs = append(graphs, NewItemGraph(testItem{
+			id:    fmt.Sprintf("item%d", i),
+			ts:    ts.Add(time.Duration(i) * time.Hour),
+			class: ClassPost,
+		}))
+	}
+	testGetAll(t, tl, "me", graphs[:2]...)
+	acc, err := tl.Account(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastItemID := func() int64 {
+		t.Helper()
+		var id int64
+		err := tl.db.QueryRow(`SELECT last_item_id FROM accounts WHERE id=?`, acc.ID).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	before := lastItemID()
+	if before != loadTestItem(t, tl, "item1").ID {
+		t.Fatalf("expected last item to be item1, got item row %d", before)
+	}
+
+	latest := func(ctx context.Context, wc *WrappedClient) (RunStats, error) {
+		return wc.GetLatest(ctx, ProcessingOptions{Workers: 1})
+	}
+	_, err = testInterrupted(t, tl, "me", graphs[2:], 2, latest)
+	if err != ErrInterrupted {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+	if cp := storedCheckpoint(t, tl, acc.ID); string(cp) != "after 2" {
+		t.Errorf("expected checkpoint to be kept, got %q", cp)
+	}
+	if after := lastItemID(); after != before {
+		t.Errorf("expected last item not to advance, got item row %d instead of %d", after, before)
+	}
+
+	// the next run resumes from the checkpoint, and
+	// only then advances the last item
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &checkpointRecorder{testClient: testClient{graphs: graphs[5:]}}
+	wc.Client = client
+	_, err = latest(context.Background(), &wc)
+	if err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	if string(client.checkpoint) != "after 2" {
+		t.Errorf("expected listing to resume from checkpoint, got %q", client.checkpoint)
+	}
+	if cp := storedCheckpoint(t, tl, acc.ID); cp != nil {
+		t.Errorf("expected checkpoint to be cleared, got %q", cp)
+	}
+	if after := lastItemID(); after != loadTestItem(t, tl, "item7").ID {
+		t.Errorf("expected last item to be item7, got item row %d", after)
+	}
+}
+
+// checkpointRecorder is a testClient that records
+// the checkpoint it is asked to resume from.
+type checkpointRecorder struct {
+	testClient
+	checkpoint []byte
+}
+
+func (c *checkpointRecorder) ListItems(ctx context.Context, ch chan<- *ItemGraph, opt ListingOptions) error {
+	c.checkpoint = opt.Checkpoint
+	return c.testClient.ListItems(ctx, ch, opt)
+}
+
+func TestSingleWaitsForBatchLock(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Client = &testClient{graphs: testItemsWithFiles("single")}
+
+	// while a batch is being stored, an item with a
+	// data file is not written to the database
+	tl.batchMu.Lock()
+	type result struct {
+		stats RunStats
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		stats, err := wc.GetAll(context.Background(), ProcessingOptions{Workers: 1})
+		done <- result{stats, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	var count int
+	err = tl.db.QueryRow(`SELECT COUNT(*) FROM items`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected item not to be stored while batch lock is held, got %d items", count)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected processing to wait for batch lock")
+	default:
+	}
+	tl.batchMu.Unlock()
+
+	res := <-done
+	if res.err != nil || res.stats.ItemsNew != 1 {
+		t.Errorf("expected 1 new item, got %+v (err=%v)", res.stats, res.err)
+	}
+	ir := loadTestItem(t, tl, "single")
+	if ir.DataHash == nil {
+		t.Error("expected data file to be downloaded")
+	}
+}
+
+func TestBatchesAndSinglesConcurrently(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	wc, err := tl.NewClient(testDataSourceID, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// items with data files are stored one at a time,
+	// while the items between them are batched
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var graphs []*ItemGraph
+	const n = 200
+	for i := 0; i < n; i++ {
+		it := testItem{id: fmt.Sprintf("item%d", i), ts: ts.Add(time.Duration(i) * time.Minute), class: ClassPost, text: "hello"}
+		if i%10 == 0 {
+			it.fileName = it.id + ".txt"
+			it.file = it.id
+		}
+		graphs = append(graphs, NewItemGraph(it))
+	}
+	wc.Client = &testClient{graphs: graphs}
+	stats, err := wc.GetAll(context.Background(), ProcessingOptions{Workers: 8, BatchSize: 5, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ItemsNew != n || stats.ItemsFailed != 0 {
+		t.Errorf("expected %d new items, got %+v", n, stats)
+	}
+
+	var count, files int
+	err = tl.db.QueryRow(`SELECT COUNT(*), COUNT(data_hash) FROM items`).Scan(&count, &files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n || files != n/10 {
+		t.Errorf("expected %d items with %d data files, got %d with %d", n, n/10, count, files)
+	}
+}
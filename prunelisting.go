@@ -0,0 +1,205 @@
+package timeliner
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pruneListing records the original IDs of the items listed
+// during a run that prunes, so that the account's items which
+// were not listed can be pruned at the end. The IDs are stored
+// in the database so that the listing can be resumed from a
+// checkpoint if it is interrupted; during a dry run, they are
+// only kept in memory.
+type pruneListing struct {
+	accountID int64
+	dryRun    bool
+	resumed   bool // whether the listing was resumed from a checkpoint
+
+	mu     sync.Mutex
+	ids    map[string]struct{} // only used for dry runs
+	failed bool                // if true, some listed IDs weren't recorded
+}
+
+// beginPruneListing prepares to record the items listed by a
+// run with the given options, and returns the listing if the
+// run prunes. If resuming is true, the run is resuming from a
+// checkpoint, and the listing continues the one that was
+// interrupted; that is only possible if the checkpoint was
+// saved by a run that was recording it. A run that does not
+// prune but resumes the checkpoint of an interrupted listing
+// ends that listing, since the items it lists are not
+// recorded; other runs leave it and its checkpoint alone, so
+// that it can still be resumed.
+func (wc *WrappedClient) beginPruneListing(procOpt ProcessingOptions, resuming bool) (*pruneListing, error) {
+	wc.pruning = procOpt.Prune && !procOpt.DryRun
+	resumingListing := resuming && wc.acc.cp != nil && wc.acc.cp.Pruning
+	wc.keepCheckpoint = !procOpt.Prune && !resuming && wc.acc.cp != nil && wc.acc.cp.Pruning
+
+	if !procOpt.Prune {
+		if procOpt.DryRun || !resumingListing {
+			return nil, nil
+		}
+		return nil, wc.endPruneListing()
+	}
+
+	pl := &pruneListing{
+		accountID: wc.acc.ID,
+		dryRun:    procOpt.DryRun,
+		resumed:   resuming,
+	}
+	if procOpt.DryRun {
+		pl.ids = make(map[string]struct{})
+	}
+
+	if resuming {
+		var started int64
+		err := wc.tl.db.QueryRow(`SELECT started FROM prune_listings WHERE account_id=? LIMIT 1`,
+			wc.acc.ID).Scan(&started)
+		if err == sql.ErrNoRows || (err == nil && !resumingListing) {
+			return nil, fmt.Errorf("resuming from a checkpoint of a run that did not record the items it listed; " +
+				"can't prune until a complete listing has been done")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("querying prune listing: %v", err)
+		}
+		if procOpt.Verbose {
+			log.Printf("[INFO] %s: resuming listing of items to prune that began %s",
+				wc.acc, time.Unix(started, 0))
+		}
+		return pl, nil
+	}
+
+	if procOpt.DryRun {
+		return pl, nil
+	}
+
+	// start over with a new listing
+	err := wc.endPruneListing()
+	if err != nil {
+		return nil, err
+	}
+	_, err = wc.tl.db.Exec(`INSERT INTO prune_listings (account_id, started) VALUES (?, ?)`,
+		wc.acc.ID, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("recording start of prune listing: %v", err)
+	}
+
+	return pl, nil
+}
+
+// endPruneListing deletes the account's prune listing, if any.
+func (wc *WrappedClient) endPruneListing() error {
+	_, err := wc.tl.db.Exec(`DELETE FROM prune_listings WHERE account_id=?`, wc.acc.ID)
+	if err != nil {
+		return fmt.Errorf("deleting prune listing: %v", err)
+	}
+	_, err = wc.tl.db.Exec(`DELETE FROM prune_seen WHERE account_id=?`, wc.acc.ID)
+	if err != nil {
+		return fmt.Errorf("deleting items seen by prune listing: %v", err)
+	}
+	return nil
+}
+
+// add records the original IDs of all the items in igs,
+// including connected items and items in collections. It
+// should be called before they are processed, since the
+// items were listed whether or not they can be stored.
+func (pl *pruneListing) add(db *sql.DB, igs ...*ItemGraph) {
+	if pl == nil {
+		return
+	}
+
+	seen := make(map[*ItemGraph]struct{})
+	var ids []string
+	for _, ig := range igs {
+		ids = listedItemIDs(ig, seen, ids)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.dryRun {
+		for _, id := range ids {
+			pl.ids[id] = struct{}{}
+		}
+		return
+	}
+
+	err := pl.insert(db, ids)
+	if err != nil {
+		log.Printf("[ERROR] Recording %d listed items for prune: %v", len(ids), err)
+		pl.failed = true
+	}
+}
+
+func (pl *pruneListing) insert(db *sql.DB, ids []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO prune_seen (account_id, original_id) VALUES (?, ?)`)
+	if err != nil {
+		return fmt.Errorf("preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		_, err = stmt.Exec(pl.accountID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// listedItemIDs appends the original IDs of the items in
+// ig to ids and returns the result.
+func listedItemIDs(ig *ItemGraph, seen map[*ItemGraph]struct{}, ids []string) []string {
+	if ig == nil {
+		return ids
+	}
+	if _, ok := seen[ig]; ok {
+		return ids
+	}
+	seen[ig] = struct{}{}
+	if ig.Node != nil {
+		if id := ig.Node.ID(); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	for connectedIG := range ig.Edges {
+		ids = listedItemIDs(connectedIG, seen, ids)
+	}
+	for _, coll := range ig.Collections {
+		for _, cit := range coll.Items {
+			if cit.Item == nil {
+				continue
+			}
+			if id := cit.Item.ID(); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// listed returns true if the item with the given
+// original ID was listed during this run; this
+// is only needed for dry runs, since otherwise the
+// listed IDs are queried from the database.
+func (pl *pruneListing) listed(originalID string) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	_, ok := pl.ids[originalID]
+	return ok
+}
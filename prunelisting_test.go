@@ -0,0 +1,118 @@
+package timeliner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneListingAcrossOtherRuns(t *testing.T) {
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var graphs []*ItemGraph
+	for i := 0; i < 10; i++ {
+		graphs = append(graphs, NewItemGraph(testItem{
+			id:    fmt.Sprintf("item%d", i),
+			ts:    ts.Add(time.Duration(i) * time.Hour),
+			class: ClassPost,
+		}))
+	}
+	until := ts.Add(100 * time.Hour)
+	prune := ProcessingOptions{Workers: 1, Prune: true, PruneMaxPercent: 100}
+	other := ProcessingOptions{Workers: 1, Timeframe: Timeframe{Until: &until}}
+
+	// setup stores all the items, then starts a listing to
+	// prune, which is interrupted after the first 4 items
+	setup := func(t *testing.T) (*Timeline, func()) {
+		tl, cleanup := openTestTimeline(t, Options{}, "me")
+		testGetAll(t, tl, "me", graphs...)
+		_, err := testInterrupted(t, tl, "me", graphs, 3, func(ctx context.Context, wc *WrappedClient) (RunStats, error) {
+			return wc.GetAll(ctx, prune)
+		})
+		if err != ErrInterrupted {
+			cleanup()
+			t.Fatalf("expected listing to be interrupted, got %v", err)
+		}
+		return tl, cleanup
+	}
+	getAll := func(t *testing.T, tl *Timeline, po ProcessingOptions, graphs []*ItemGraph) (RunStats, error) {
+		wc, err := tl.NewClient(testDataSourceID, "me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = &testClient{graphs: graphs}
+		return wc.GetAll(context.Background(), po)
+	}
+	listings := func(t *testing.T, tl *Timeline) int {
+		var count int
+		err := tl.db.QueryRow(`SELECT COUNT(*) FROM prune_listings`).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	t.Run("other run leaves listing alone", func(t *testing.T) {
+		tl, cleanup := setup(t)
+		defer cleanup()
+
+		_, err := getAll(t, tl, other, graphs)
+		if err != nil {
+			t.Fatalf("getting items with other parameters: %v", err)
+		}
+		if listings(t, tl) != 1 {
+			t.Fatal("expected prune listing to be kept")
+		}
+
+		// item9 is gone from the data source; the items
+		// listed before the interruption are not pruned
+		stats, err := getAll(t, tl, prune, graphs[4:9])
+		if err != nil {
+			t.Fatalf("resuming prune: %v", err)
+		}
+		if stats.ItemsPruned != 1 {
+			t.Errorf("expected 1 item pruned, got %d", stats.ItemsPruned)
+		}
+		trash, err := tl.Trash(context.Background(), "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trash) != 1 || trash[0].Item.OriginalID != "item9" {
+			t.Errorf("expected item9 in the trash, got %+v", trash)
+		}
+	})
+
+	t.Run("resuming without prune ends listing", func(t *testing.T) {
+		tl, cleanup := setup(t)
+		defer cleanup()
+
+		_, err := getAll(t, tl, ProcessingOptions{Workers: 1}, graphs[4:])
+		if err != nil {
+			t.Fatalf("resuming without prune: %v", err)
+		}
+		if listings(t, tl) != 0 {
+			t.Error("expected prune listing to be ended")
+		}
+	})
+
+	t.Run("checkpoint of other run can't be resumed to prune", func(t *testing.T) {
+		tl, cleanup := setup(t)
+		defer cleanup()
+
+		// the other run replaces the checkpoint with its own
+		_, err := testInterrupted(t, tl, "me", graphs, 5, func(ctx context.Context, wc *WrappedClient) (RunStats, error) {
+			return wc.GetAll(ctx, other)
+		})
+		if err != ErrInterrupted {
+			t.Fatalf("expected other run to be interrupted, got %v", err)
+		}
+
+		pruneOther := prune
+		pruneOther.Timeframe = other.Timeframe
+		_, err = getAll(t, tl, pruneOther, graphs[6:])
+		if err == nil || !strings.Contains(err.Error(), "did not record the items it listed") {
+			t.Errorf("expected resuming other run's checkpoint to prune to fail, got %v", err)
+		}
+	})
+}
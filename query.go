@@ -0,0 +1,369 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ItemQuery describes which items to read from the timeline
+// and in what order. All fields are optional; the zero value
+// lists all items in chronological order, DefaultQueryLimit
+// items at a time.
+type ItemQuery struct {
+	// Only items with timestamps within this timeframe are
+	// returned. Since is inclusive, Until is exclusive. The
+	// item ID fields of the timeframe are ignored.
+	Timeframe Timeframe
+
+	// Only items belonging to any of these accounts
+	// (by row ID) are returned.
+	AccountIDs []int64
+
+	// Only items from accounts on any of these data
+	// sources (by data source ID) are returned.
+	DataSourceIDs []string
+
+	// Only items owned by any of these persons (by
+	// row ID) are returned.
+	PersonIDs []int64
+
+	// Only items of any of these classes are returned.
+	Classes []ItemClass
+
+	// If true, items are returned in reverse chronological
+	// order (newest first) instead of oldest first.
+	Reverse bool
+
+	// The maximum number of items to return. If zero,
+	// DefaultQueryLimit is used.
+	Limit int
+
+	// A cursor obtained from a previous query's results,
+	// to resume the listing after that position. The
+	// direction in which the listing continues from the
+	// cursor is determined by Reverse.
+	Cursor string
+}
+
+// ItemResults is a page of items returned from a query.
+type ItemResults struct {
+	Items []ItemRow
+
+	// NextCursor continues the listing in the same direction
+	// after the last item in this page. It is empty if there
+	// are no more items.
+	NextCursor string
+
+	// PrevCursor is the position of the first item in this
+	// page. To page backward, query with this cursor and
+	// the opposite Reverse value. It is empty if the page
+	// has no items.
+	PrevCursor string
+}
+
+// QueryItems returns items from the timeline that match q.
+func (t *Timeline) QueryItems(ctx context.Context, q ItemQuery) (ItemResults, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+
+	where, args := q.filters()
+
+	// resume after the cursor's position, in whichever direction we're going
+	if q.Cursor != "" {
+		ts, rowID, err := decodeItemCursor(q.Cursor)
+		if err != nil {
+			return ItemResults{}, err
+		}
+		if q.Reverse {
+			where = append(where, "(timestamp < ? OR (timestamp = ? AND id < ?))")
+		} else {
+			where = append(where, "(timestamp > ? OR (timestamp = ? AND id > ?))")
+		}
+		args = append(args, ts, ts, rowID)
+	}
+
+	order := "ASC"
+	if q.Reverse {
+		order = "DESC"
+	}
+
+	query := `SELECT ` + itemRowColumns + ` FROM items`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp %s, id %s LIMIT ?", order, order)
+
+	// get one more than the limit so we know whether there's another page
+	args = append(args, limit+1)
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ItemResults{}, fmt.Errorf("querying items: %v", err)
+	}
+	defer rows.Close()
+
+	var results ItemResults
+	for rows.Next() {
+		ir, err := t.scanItemRow(rows)
+		if err != nil {
+			return ItemResults{}, err
+		}
+		results.Items = append(results.Items, ir)
+	}
+	if err = rows.Err(); err != nil {
+		return ItemResults{}, fmt.Errorf("iterating item rows: %v", err)
+	}
+
+	if len(results.Items) > limit {
+		results.Items = results.Items[:limit]
+		results.NextCursor = results.Items[limit-1].cursor()
+	}
+	if len(results.Items) > 0 {
+		results.PrevCursor = results.Items[0].cursor()
+	}
+
+	return results, nil
+}
+
+// filters returns the WHERE conditions and their arguments
+// which constrain a listing of items to those matching q,
+// not including the cursor. Column names are unqualified.
+func (q ItemQuery) filters() ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+
+	if q.Timeframe.Since != nil {
+		where = append(where, "timestamp >= ?")
+		args = append(args, q.Timeframe.Since.Unix())
+	}
+	if q.Timeframe.Until != nil {
+		where = append(where, "timestamp < ?")
+		args = append(args, q.Timeframe.Until.Unix())
+	}
+	if len(q.AccountIDs) > 0 {
+		where = append(where, "account_id IN "+sqlPlaceholders(len(q.AccountIDs)))
+		for _, id := range q.AccountIDs {
+			args = append(args, id)
+		}
+	}
+	if len(q.DataSourceIDs) > 0 {
+		where = append(where, "account_id IN (SELECT id FROM accounts WHERE data_source_id IN "+
+			sqlPlaceholders(len(q.DataSourceIDs))+")")
+		for _, id := range q.DataSourceIDs {
+			args = append(args, id)
+		}
+	}
+	if len(q.PersonIDs) > 0 {
+		where = append(where, "person_id IN "+sqlPlaceholders(len(q.PersonIDs)))
+		for _, id := range q.PersonIDs {
+			args = append(args, id)
+		}
+	}
+	if len(q.Classes) > 0 {
+		where = append(where, "class IN "+sqlPlaceholders(len(q.Classes)))
+		for _, class := range q.Classes {
+			args = append(args, class)
+		}
+	}
+
+	return where, args
+}
+
+// LoadItem loads the item with the given row ID. If there
+// is no such item, sql.ErrNoRows is returned.
+func (t *Timeline) LoadItem(ctx context.Context, rowID int64) (ItemRow, error) {
+	row := t.db.QueryRowContext(ctx, `SELECT `+itemRowColumns+` FROM items WHERE id=? LIMIT 1`, rowID)
+	return t.scanItemRow(row)
+}
+
+// Relationship is a relationship between items and/or persons.
+// Each end is either an item or a person, by row ID.
+type Relationship struct {
+	ID            int64  `json:"id"`
+	FromItemID    *int64 `json:"from_item_id,omitempty"`
+	FromPersonID  *int64 `json:"from_person_id,omitempty"`
+	ToItemID      *int64 `json:"to_item_id,omitempty"`
+	ToPersonID    *int64 `json:"to_person_id,omitempty"`
+	Label         string `json:"label"`
+	Bidirectional bool   `json:"bidirectional"`
+}
+
+// ItemRelationships returns the relationships to or from
+// the item with the given row ID.
+func (t *Timeline) ItemRelationships(ctx context.Context, itemID int64) ([]Relationship, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT id, from_item_id, from_person_id,
+		to_item_id, to_person_id, label, directed
+		FROM relationships WHERE from_item_id=? OR to_item_id=? ORDER BY id`, itemID, itemID)
+	if err != nil {
+		return nil, fmt.Errorf("querying relationships: %v", err)
+	}
+	defer rows.Close()
+
+	var rels []Relationship
+	for rows.Next() {
+		var rel Relationship
+		var directed *bool
+		err := rows.Scan(&rel.ID, &rel.FromItemID, &rel.FromPersonID,
+			&rel.ToItemID, &rel.ToPersonID, &rel.Label, &directed)
+		if err != nil {
+			return nil, fmt.Errorf("scanning relationship: %v", err)
+		}
+		rel.Bidirectional = directed != nil && !*directed
+		rels = append(rels, rel)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating relationship rows: %v", err)
+	}
+
+	return rels, nil
+}
+
+// CollectionMembership describes an item's place in a collection.
+type CollectionMembership struct {
+	CollectionID int64   `json:"collection_id"`
+	AccountID    int64   `json:"account_id"`
+	OriginalID   *string `json:"original_id,omitempty"`
+	Name         *string `json:"name,omitempty"`
+	Description  *string `json:"description,omitempty"`
+	Position     int     `json:"position"`
+}
+
+// ItemCollections returns the collections that the item
+// with the given row ID belongs to.
+func (t *Timeline) ItemCollections(ctx context.Context, itemID int64) ([]CollectionMembership, error) {
+	rows, err := t.db.QueryContext(ctx, `SELECT collections.id, collections.account_id,
+			collections.original_id, collections.name, collections.description,
+			collection_items.position
+		FROM collection_items, collections
+		WHERE collection_items.item_id=? AND collections.id = collection_items.collection_id
+		ORDER BY collections.id`, itemID)
+	if err != nil {
+		return nil, fmt.Errorf("querying collections: %v", err)
+	}
+	defer rows.Close()
+
+	var colls []CollectionMembership
+	for rows.Next() {
+		var cm CollectionMembership
+		err := rows.Scan(&cm.CollectionID, &cm.AccountID, &cm.OriginalID,
+			&cm.Name, &cm.Description, &cm.Position)
+		if err != nil {
+			return nil, fmt.Errorf("scanning collection: %v", err)
+		}
+		colls = append(colls, cm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating collection rows: %v", err)
+	}
+
+	return colls, nil
+}
+
+// cursor returns an opaque value representing the
+// position of ir in a chronological listing.
+func (ir ItemRow) cursor() string {
+	pos := strconv.FormatInt(ir.Timestamp.Unix(), 10) + ":" + strconv.FormatInt(ir.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(pos))
+}
+
+func decodeItemCursor(cursor string) (int64, int64, error) {
+	pos, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor: %v", err)
+	}
+	parts := strings.SplitN(string(pos), ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor timestamp: %v", err)
+	}
+	rowID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor row ID: %v", err)
+	}
+	return ts, rowID, nil
+}
+
+// itemRowColumns are the columns that scanItemRow expects,
+// in order.
+const itemRowColumns = `id, account_id, original_id, person_id, timestamp, stored,
+	modified, class, mime_type, data_text, data_file, data_hash,
+	metadata, latitude, longitude, view_path`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanItemRow scans an item row having the columns listed
+// in itemRowColumns, and decrypts and decodes its text and
+// metadata. If row is an *sql.Row with no results,
+// sql.ErrNoRows is returned as-is.
+func (t *Timeline) scanItemRow(row rowScanner) (ItemRow, error) {
+	var ir ItemRow
+	var metadataGob []byte
+	var ts, stored int64 // will convert from Unix timestamp
+	var modified *int64
+	err := row.Scan(&ir.ID, &ir.AccountID, &ir.OriginalID, &ir.PersonID, &ts, &stored,
+		&modified, &ir.Class, &ir.MIMEType, &ir.DataText, &ir.DataFile, &ir.DataHash,
+		&metadataGob, &ir.Latitude, &ir.Longitude, &ir.ViewPath)
+	if err == sql.ErrNoRows {
+		return ItemRow{}, err
+	}
+	if err != nil {
+		return ItemRow{}, fmt.Errorf("loading item: %v", err)
+	}
+
+	ir.DataText, err = t.openText("data_text", ir.DataText)
+	if err != nil {
+		return ItemRow{}, fmt.Errorf("%v (item_id=%d)", err, ir.ID)
+	}
+	metadataGob, err = t.openColumn("metadata", metadataGob)
+	if err != nil {
+		return ItemRow{}, fmt.Errorf("%v (item_id=%d)", err, ir.ID)
+	}
+
+	// the metadata is gob-encoded; decode it into the struct
+	ir.metaGob = metadataGob
+	ir.Metadata = new(Metadata)
+	err = ir.Metadata.decode(metadataGob)
+	if err == errMetadataLost {
+		// the rest of the item is still worth reading;
+		// fsck reports these items, too
+		log.Printf("[WARNING] Item %d: %v; get the item again with -reprocess", ir.ID, err)
+	} else if err != nil {
+		return ItemRow{}, fmt.Errorf("gob-decoding metadata: %v", err)
+	}
+
+	ir.Timestamp = time.Unix(ts, 0)
+	ir.Stored = time.Unix(stored, 0)
+	if modified != nil {
+		modTime := time.Unix(*modified, 0)
+		ir.Modified = &modTime
+	}
+
+	return ir, nil
+}
+
+// sqlPlaceholders returns a parenthesized list of n
+// query placeholders, for example "(?, ?, ?)".
+func sqlPlaceholders(n int) string {
+	if n <= 0 {
+		return "()"
+	}
+	return "(?" + strings.Repeat(", ?", n-1) + ")"
+}
+
+// DefaultQueryLimit is the maximum number of items
+// returned by a query if no limit is specified.
+const DefaultQueryLimit = 100
@@ -0,0 +1,126 @@
+package timeliner
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueryItemsPaging(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	// several items share a timestamp, so
+	// the cursor must also use the row ID
+	base := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	hours := []int{0, 1, 1, 1, 2, 3, 3}
+	var graphs []*ItemGraph
+	for i, h := range hours {
+		graphs = append(graphs, NewItemGraph(testItem{
+			id:    fmt.Sprintf("item%d", i),
+			ts:    base.Add(time.Duration(h) * time.Hour),
+			class: ClassPost,
+			text:  fmt.Sprintf("item %d", i),
+		}))
+	}
+	testGetAll(t, tl, "me", graphs...)
+
+	all, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Items) != len(hours) || all.NextCursor != "" {
+		t.Fatalf("expected %d items and no next cursor, got %d items and cursor %q",
+			len(hours), len(all.Items), all.NextCursor)
+	}
+	for i := 1; i < len(all.Items); i++ {
+		prev, cur := all.Items[i-1], all.Items[i]
+		if cur.Timestamp.Before(prev.Timestamp) || (cur.Timestamp.Equal(prev.Timestamp) && cur.ID <= prev.ID) {
+			t.Fatalf("items not in chronological order at %d: %+v then %+v", i, prev, cur)
+		}
+	}
+
+	// pageThrough pages through the items in the direction of
+	// reverse, 2 at a time, and returns their IDs in order
+	pageThrough := func(reverse bool) []int64 {
+		var ids []int64
+		var cursor string
+		for page := 0; ; page++ {
+			if page > len(hours) {
+				t.Fatalf("too many pages (reverse=%t)", reverse)
+			}
+			res, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 2, Reverse: reverse, Cursor: cursor})
+			if err != nil {
+				t.Fatalf("page %d (reverse=%t): %v", page, reverse, err)
+			}
+			for _, ir := range res.Items {
+				ids = append(ids, ir.ID)
+			}
+			if res.NextCursor == "" {
+				return ids
+			}
+			cursor = res.NextCursor
+		}
+	}
+
+	forward := pageThrough(false)
+	if len(forward) != len(all.Items) {
+		t.Fatalf("expected %d items paging forward, got %d", len(all.Items), len(forward))
+	}
+	for i, id := range forward {
+		if id != all.Items[i].ID {
+			t.Errorf("paging forward, item %d: expected ID %d, got %d", i, all.Items[i].ID, id)
+		}
+	}
+
+	reverse := pageThrough(true)
+	if len(reverse) != len(all.Items) {
+		t.Fatalf("expected %d items paging in reverse, got %d", len(all.Items), len(reverse))
+	}
+	for i, id := range reverse {
+		if expected := all.Items[len(all.Items)-1-i].ID; id != expected {
+			t.Errorf("paging in reverse, item %d: expected ID %d, got %d", i, expected, id)
+		}
+	}
+
+	// the previous cursor of a page leads back to the items before it
+	first, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 3, Cursor: first.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := tl.QueryItems(context.Background(), ItemQuery{Limit: 3, Reverse: true, Cursor: second.PrevCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Items) != 3 {
+		t.Fatalf("expected 3 items before the second page, got %d", len(back.Items))
+	}
+	for i, ir := range back.Items {
+		if expected := first.Items[2-i].ID; ir.ID != expected {
+			t.Errorf("paging back, item %d: expected ID %d, got %d", i, expected, ir.ID)
+		}
+	}
+}
+
+func TestQueryItemsInvalidCursor(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{})
+	defer cleanup()
+
+	for i, cursor := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("12345")),
+		base64.RawURLEncoding.EncodeToString([]byte("abc:1")),
+		base64.RawURLEncoding.EncodeToString([]byte("12345:abc")),
+	} {
+		_, err := tl.QueryItems(context.Background(), ItemQuery{Cursor: cursor})
+		if err == nil {
+			t.Errorf("test %d: expected error for cursor %q, got none", i, cursor)
+		}
+	}
+}
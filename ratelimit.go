@@ -16,7 +16,12 @@ type RateLimit struct {
 
 // NewRateLimitedRoundTripper adds rate limiting to rt based on the rate
 // limiting policy registered by the data source associated with acc.
+// All round trippers of the same account on the same timeline share
+// the rate limit, even if they are used by different clients.
 func (acc Account) NewRateLimitedRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	acc.t.rateLimitsMu.Lock()
+	defer acc.t.rateLimitsMu.Unlock()
+
 	rl, ok := acc.t.rateLimiters[acc.String()]
 
 	if !ok && acc.ds.RateLimit.RequestsPerHour > 0 {
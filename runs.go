@@ -0,0 +1,195 @@
+package timeliner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Run is a record of a single run of GetLatest,
+// GetAll, or Import for an account.
+type Run struct {
+	ID           int64      `json:"id"`
+	AccountID    int64      `json:"account_id"`
+	DataSourceID string     `json:"data_source_id"`
+	UserID       string     `json:"user_id"`
+	Command      string     `json:"command"`            // get-latest, get-all, or import
+	Filename     string     `json:"filename,omitempty"` // import only
+	Since        *time.Time `json:"since,omitempty"`    // start of the requested timeframe
+	Until        *time.Time `json:"until,omitempty"`    // end of the requested timeframe
+	Options      RunOptions `json:"options"`
+	Stats        RunStats   `json:"stats"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Finished returns true if the run has finished. A run
+// that is not finished is either still going, or the
+// process was killed before it could finish.
+func (r Run) Finished() bool {
+	return !r.Stats.Finished.IsZero()
+}
+
+// RunOptions are the processing options a run was started with.
+type RunOptions struct {
+	Reprocess bool         `json:"reprocess,omitempty"`
+	Prune     bool         `json:"prune,omitempty"`
+	Integrity bool         `json:"integrity,omitempty"`
+	Merge     MergeOptions `json:"merge"`
+	Workers   int          `json:"workers,omitempty"`
+	BatchSize int          `json:"batch_size,omitempty"`
+}
+
+// beginRun records the beginning of a run and returns its row ID,
+// or 0 if the run is not recorded. Failing to record a run should
+// not prevent it from happening, so errors are only logged.
+func (wc *WrappedClient) beginRun(command, filename string, procOpt ProcessingOptions) int64 {
+	if procOpt.DryRun {
+		return 0 // a dry run must not change the database
+	}
+
+	opts, err := json.Marshal(RunOptions{
+		Reprocess: procOpt.Reprocess,
+		Prune:     procOpt.Prune,
+		Integrity: procOpt.Integrity,
+		Merge:     procOpt.Merge,
+		Workers:   procOpt.Workers,
+		BatchSize: procOpt.BatchSize,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s: encoding options of run: %v", wc.acc, err)
+	}
+
+	var filenameVal *string
+	if filename != "" {
+		filenameVal = &filename
+	}
+
+	res, err := wc.tl.db.Exec(`INSERT INTO runs
+		(account_id, command, filename, since, until, options, started)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		wc.acc.ID, command, filenameVal, unixOrNil(procOpt.Timeframe.Since),
+		unixOrNil(procOpt.Timeframe.Until), string(opts), time.Now().Unix())
+	if err != nil {
+		log.Printf("[ERROR] %s: recording start of run: %v", wc.acc, err)
+		return 0
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("[ERROR] %s: getting ID of run: %v", wc.acc, err)
+		return 0
+	}
+	return runID
+}
+
+// endRun records the outcome of the run with the given row ID.
+func (wc *WrappedClient) endRun(runID int64, stats RunStats, runErr error) {
+	if runID == 0 {
+		return
+	}
+	var errMsg *string
+	if runErr != nil {
+		msg := runErr.Error()
+		errMsg = &msg
+	}
+	finished := stats.Finished
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	_, err := wc.tl.db.Exec(`UPDATE runs
+		SET finished=?, items_seen=?, items_new=?, items_updated=?, items_skipped=?,
+			items_merged=?, items_failed=?, items_pruned=?, bytes_downloaded=?, error=?
+		WHERE id=?`, // TODO: LIMIT 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+		finished.Unix(), stats.ItemsSeen, stats.ItemsNew, stats.ItemsUpdated, stats.ItemsSkipped,
+		stats.ItemsMerged, stats.ItemsFailed, stats.ItemsPruned, stats.BytesDownloaded, errMsg,
+		runID)
+	if err != nil {
+		log.Printf("[ERROR] %s: recording end of run: %v (run_id=%d)", wc.acc, err, runID)
+	}
+}
+
+// Runs returns the most recent runs, newest first, up to limit
+// (if limit > 0). If dataSourceID and userID are not empty,
+// only runs of that account are returned.
+func (t *Timeline) Runs(ctx context.Context, dataSourceID, userID string, limit int) ([]Run, error) {
+	q := `SELECT runs.id, runs.account_id, accounts.data_source_id, accounts.user_id,
+			runs.command, runs.filename, runs.since, runs.until, runs.options,
+			runs.started, runs.finished, runs.items_seen, runs.items_new,
+			runs.items_updated, runs.items_skipped, runs.items_merged,
+			runs.items_failed, runs.items_pruned, runs.bytes_downloaded, runs.error
+		FROM runs, accounts
+		WHERE runs.account_id = accounts.id`
+	var args []interface{}
+	if dataSourceID != "" || userID != "" {
+		q += ` AND accounts.data_source_id=? AND accounts.user_id=?`
+		args = append(args, dataSourceID, userID)
+	}
+	q += ` ORDER BY runs.started DESC, runs.id DESC`
+	if limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := t.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var r Run
+		var filename, opts, errMsg *string
+		var since, until, finished *int64
+		var started int64
+		err := rows.Scan(&r.ID, &r.AccountID, &r.DataSourceID, &r.UserID,
+			&r.Command, &filename, &since, &until, &opts,
+			&started, &finished, &r.Stats.ItemsSeen, &r.Stats.ItemsNew,
+			&r.Stats.ItemsUpdated, &r.Stats.ItemsSkipped, &r.Stats.ItemsMerged,
+			&r.Stats.ItemsFailed, &r.Stats.ItemsPruned, &r.Stats.BytesDownloaded, &errMsg)
+		if err != nil {
+			return nil, fmt.Errorf("scanning run: %v", err)
+		}
+		if filename != nil {
+			r.Filename = *filename
+		}
+		r.Since = timeOrNil(since)
+		r.Until = timeOrNil(until)
+		if opts != nil {
+			err = json.Unmarshal([]byte(*opts), &r.Options)
+			if err != nil {
+				return nil, fmt.Errorf("decoding options of run %d: %v", r.ID, err)
+			}
+		}
+		r.Stats.Started = time.Unix(started, 0)
+		if finished != nil {
+			r.Stats.Finished = time.Unix(*finished, 0)
+		}
+		if errMsg != nil {
+			r.Error = *errMsg
+		}
+		runs = append(runs, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating run rows: %v", err)
+	}
+
+	return runs, nil
+}
+
+func unixOrNil(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	ts := t.Unix()
+	return &ts
+}
+
+func timeOrNil(ts *int64) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := time.Unix(*ts, 0)
+	return &t
+}
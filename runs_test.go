@@ -0,0 +1,163 @@
+package timeliner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingClient fails to list items.
+type failingClient struct{}
+
+func (failingClient) ListItems(ctx context.Context, ch chan<- *ItemGraph, opt ListingOptions) error {
+	close(ch)
+	return errors.New("service unavailable")
+}
+
+func TestRuns(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me", "you")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := ts.AddDate(1, 0, 0)
+	graphs := []*ItemGraph{
+		NewItemGraph(testItem{id: "one", ts: ts, class: ClassPost, text: "one"}),
+		NewItemGraph(testItem{id: "two", ts: ts.Add(time.Hour), class: ClassPost, text: "two"}),
+		NewItemGraph(testItem{id: "three", ts: ts.Add(2 * time.Hour), class: ClassImage, fileName: "photo.jpg", file: "jpeg data"}),
+	}
+	newClient := func(userID string, cl Client) *WrappedClient {
+		t.Helper()
+		wc, err := tl.NewClient(testDataSourceID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = cl
+		return &wc
+	}
+
+	// a successful run
+	po := ProcessingOptions{Reprocess: true, Workers: 1, BatchSize: 7, Timeframe: Timeframe{Since: &ts, Until: &until},
+		Merge: MergeOptions{SoftMerge: true, PreferNewDataText: true}}
+	successStats, err := newClient("me", &testClient{graphs: graphs}).GetAll(context.Background(), po)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed one
+	_, failErr := newClient("me", failingClient{}).Import(context.Background(), "export.zip", ProcessingOptions{Workers: 1})
+	if failErr == nil {
+		t.Fatal("expected import to fail")
+	}
+
+	// an interrupted one
+	interruptedStats, err := testInterrupted(t, tl, "you", graphs, 1, func(ctx context.Context, wc *WrappedClient) (RunStats, error) {
+		return wc.GetLatest(ctx, ProcessingOptions{Workers: 1})
+	})
+	if err != ErrInterrupted {
+		t.Fatalf("expected run to be interrupted, got %v", err)
+	}
+
+	// one that is still going (or whose process was killed)
+	wc := newClient("you", &testClient{})
+	unfinishedID := wc.beginRun("get-all", "", ProcessingOptions{Prune: true})
+	if unfinishedID == 0 {
+		t.Fatal("expected run to be recorded")
+	}
+
+	// and a dry run, which is not recorded
+	_, err = newClient("me", &testClient{graphs: graphs}).GetAll(context.Background(), ProcessingOptions{Workers: 1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := tl.Runs(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 4 {
+		t.Fatalf("expected 4 runs, got %d: %+v", len(runs), runs)
+	}
+	unfinished, interrupted, failed, success := runs[0], runs[1], runs[2], runs[3]
+
+	// stats are stored to the second
+	sameStats := func(which string, got, expect RunStats) {
+		t.Helper()
+		if got.Started.Unix() != expect.Started.Unix() || got.Finished.Unix() != expect.Finished.Unix() {
+			t.Errorf("%s run: expected times %v to %v, got %v to %v", which,
+				expect.Started, expect.Finished, got.Started, got.Finished)
+		}
+		got.Started, got.Finished = expect.Started, expect.Finished
+		if got != expect {
+			t.Errorf("%s run: expected stats %+v, got %+v", which, expect, got)
+		}
+	}
+
+	if success.Command != "get-all" || success.UserID != "me" || success.DataSourceID != testDataSourceID ||
+		success.Error != "" || !success.Finished() {
+		t.Errorf("unexpected successful run: %+v", success)
+	}
+	expectOpts := RunOptions{Reprocess: true, Workers: 1, BatchSize: 7, Merge: po.Merge}
+	if success.Options != expectOpts {
+		t.Errorf("expected options %+v, got %+v", expectOpts, success.Options)
+	}
+	if success.Since == nil || !success.Since.Equal(ts) || success.Until == nil || !success.Until.Equal(until) {
+		t.Errorf("expected timeframe %v to %v, got %v to %v", ts, until, success.Since, success.Until)
+	}
+	if successStats.ItemsNew != 3 || successStats.BytesDownloaded == 0 {
+		t.Errorf("expected 3 new items with a download, got %+v", successStats)
+	}
+	sameStats("successful", success.Stats, successStats)
+
+	if failed.Command != "import" || failed.Filename != "export.zip" || failed.Error != failErr.Error() || !failed.Finished() {
+		t.Errorf("unexpected failed run: %+v", failed)
+	}
+
+	if interrupted.Command != "get-latest" || interrupted.UserID != "you" ||
+		interrupted.Error != ErrInterrupted.Error() || !interrupted.Finished() {
+		t.Errorf("unexpected interrupted run: %+v", interrupted)
+	}
+	if interruptedStats.ItemsNew < 2 {
+		t.Errorf("expected items before interruption to be stored, got %+v", interruptedStats)
+	}
+	sameStats("interrupted", interrupted.Stats, interruptedStats)
+
+	if unfinished.ID != unfinishedID || unfinished.Finished() || !unfinished.Options.Prune || unfinished.Stats.ItemsSeen != 0 {
+		t.Errorf("unexpected unfinished run: %+v", unfinished)
+	}
+
+	// runs can be limited and filtered by account
+	for i, test := range []struct {
+		userID string
+		limit  int
+		expect []int64
+	}{
+		{limit: 2, expect: []int64{unfinished.ID, interrupted.ID}},
+		{userID: "me", expect: []int64{failed.ID, success.ID}},
+		{userID: "you", limit: 1, expect: []int64{unfinished.ID}},
+		{userID: "nobody", expect: nil},
+	} {
+		var dataSourceID string
+		if test.userID != "" {
+			dataSourceID = testDataSourceID
+		}
+		runs, err := tl.Runs(context.Background(), dataSourceID, test.userID, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, r := range runs {
+			ids = append(ids, r.ID)
+		}
+		if len(ids) != len(test.expect) {
+			t.Errorf("test %d: expected runs %v, got %v", i, test.expect, ids)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != test.expect[j] {
+				t.Errorf("test %d: expected runs %v, got %v", i, test.expect, ids)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Package s3store implements a timeliner.BlobStore that keeps
+// data files as objects in a bucket of an S3-compatible object
+// storage service, such as Amazon S3 or MinIO, so that only the
+// index of the timeline needs to be stored locally.
+package s3store
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/timeliner"
+)
+
+// Config configures a Store.
+type Config struct {
+	// The URL of the service, for example
+	// "https://s3.us-east-1.amazonaws.com" or
+	// "http://localhost:9000". Buckets are
+	// addressed by path, not by host name.
+	Endpoint string
+
+	// The region of the bucket. Default: us-east-1
+	Region string
+
+	// The bucket in which to store data files.
+	// It must already exist.
+	Bucket string
+
+	// If set, the names of objects begin with
+	// this prefix, so that several timelines
+	// can share a bucket (for example "me/").
+	Prefix string
+
+	// The credentials with which requests are signed.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// The HTTP client to use. Default: http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Store is a timeliner.BlobStore that keeps files
+// in a bucket of an S3-compatible service.
+type Store struct {
+	cfg      Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// Interface guard
+var _ timeliner.BlobStore = (*Store)(nil)
+
+// New returns a new Store with the given configuration.
+func New(cfg Config) (*Store, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("missing endpoint")
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %v", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL: %s", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Store{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+// Create returns a writer that stages the file in a local
+// temporary file, since the size of an object must be known
+// when it is uploaded; it is uploaded when closed.
+func (s *Store) Create(name string) (io.WriteCloser, error) {
+	_, err := s.Stat(name)
+	if err == nil {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "timeliner_upload_")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %v", err)
+	}
+	return &upload{store: s, name: name, tmp: tmp}, nil
+}
+
+// Open opens the object for reading. Seeking is done
+// by requesting the rest of the object from the new
+// offset, the next time it is read.
+func (s *Store) Open(name string) (timeliner.BlobFile, error) {
+	resp, err := s.do("GET", name, nil, nil, nil)
+	if err != nil {
+		return nil, s.pathError("open", name, err)
+	}
+	return &Object{store: s, name: name, size: contentLength(resp), body: resp.Body}, nil
+}
+
+// Stat returns information about the object.
+func (s *Store) Stat(name string) (os.FileInfo, error) {
+	resp, err := s.do("HEAD", name, nil, nil, nil)
+	if err != nil {
+		return nil, s.pathError("stat", name, err)
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fileInfo{name: path.Base(name), size: contentLength(resp), modTime: modTime}, nil
+}
+
+// Remove deletes the object.
+func (s *Store) Remove(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil, nil)
+	if err != nil {
+		return s.pathError("remove", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies the object to its new name, then deletes it,
+// since objects can't be renamed.
+func (s *Store) Rename(from, to string) error {
+	header := http.Header{"X-Amz-Copy-Source": {s.objectPath(from)}}
+	resp, err := s.do("PUT", to, nil, header, nil)
+	if err != nil {
+		return s.pathError("rename", from, err)
+	}
+	defer resp.Body.Close()
+
+	// a copy can fail after the response status was sent
+	var result struct {
+		XMLName xml.Name
+		errorResponse
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("decoding copy result: %v", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return s.pathError("rename", from, result.errorResponse)
+	}
+
+	return s.Remove(from)
+}
+
+// List lists the objects of which the names are in the given
+// folder, one page of results at a time.
+func (s *Store) List(folder string, fn func(name string, info os.FileInfo) error) error {
+	prefix := s.cfg.Prefix + strings.TrimSuffix(folder, "/") + "/"
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return fmt.Errorf("listing %s: %v", folder, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding listing of %s: %v", folder, err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.cfg.Prefix)
+			err := fn(name, fileInfo{name: path.Base(name), size: obj.Size, modTime: obj.LastModified})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// objectPath returns the path of the object with
+// the given name, including the bucket, encoded for
+// use in a URL.
+func (s *Store) objectPath(name string) string {
+	p := "/" + s.cfg.Bucket + "/"
+	if name != "" {
+		p += s.cfg.Prefix + name
+	}
+	return uriEncode(p, false)
+}
+
+// do performs a signed request for the object with the given
+// name (or the bucket, if name is empty), and returns the
+// response if its status is successful. The response body is
+// closed if an error is returned.
+func (s *Store) do(method, name string, query url.Values, header http.Header, body io.ReadSeeker) (resp *http.Response, err error) {
+	u := *s.endpoint
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + s.objectPath(name)
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for field, vals := range header {
+		req.Header[field] = vals
+	}
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		_, err = body.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	signRequest(req, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, unsignedPayload, time.Now())
+
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		errResp := errorResponse{status: resp.StatusCode}
+		if method != "HEAD" {
+			xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&errResp)
+		}
+		return nil, errResp
+	}
+	return resp, nil
+}
+
+// contentLength returns the length of the
+// object (or the requested range of it).
+func contentLength(resp *http.Response) int64 {
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		return size
+	}
+	return resp.ContentLength
+}
+
+// pathError wraps err in an *os.PathError, so that
+// os.IsNotExist and os.IsExist work as expected.
+func (s *Store) pathError(op, name string, err error) error {
+	if errResp, ok := err.(errorResponse); ok {
+		switch {
+		case errResp.status == http.StatusNotFound:
+			err = os.ErrNotExist
+		case errResp.status == http.StatusPreconditionFailed:
+			err = os.ErrExist
+		}
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// errorResponse is an error returned by the service.
+type errorResponse struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e errorResponse) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("HTTP %d", e.status)
+	}
+	return fmt.Sprintf("HTTP %d: %s: %s", e.status, e.Code, e.Message)
+}
+
+// upload is a file being written to a Store.
+type upload struct {
+	store  *Store
+	name   string
+	tmp    *os.File
+	closed bool
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	return u.tmp.Write(p)
+}
+
+// Close uploads the file. The object is only created if it
+// still doesn't exist, in case it was created since Create.
+func (u *upload) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+
+	header := http.Header{"If-None-Match": {"*"}}
+	resp, err := u.store.do("PUT", u.name, nil, header, u.tmp)
+	if err != nil {
+		return u.store.pathError("create", u.name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Object is an object opened for reading from a Store.
+type Object struct {
+	store      *Store
+	name       string
+	size       int64
+	offset     int64         // offset of the next read
+	body       io.ReadCloser // the rest of the object, from bodyOffset
+	bodyOffset int64
+}
+
+// Read reads from the object, requesting it
+// anew from the current offset if needed.
+func (o *Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyOffset != o.offset {
+		if o.body != nil {
+			o.body.Close()
+			o.body = nil
+		}
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.store.do("GET", o.name, nil, header, nil)
+		if err != nil {
+			return 0, o.store.pathError("read", o.name, err)
+		}
+		o.body, o.bodyOffset = resp.Body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset of the next read.
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return o.offset, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return o.offset, fmt.Errorf("negative offset: %d", offset)
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// Close closes the object.
+func (o *Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// fileInfo describes an object.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return 0600 }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() interface{}   { return nil }
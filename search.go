@@ -0,0 +1,346 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SearchQuery describes a full-text search of the timeline.
+type SearchQuery struct {
+	// The text to search for. By default, each word is
+	// matched literally and all words must be present
+	// in an item for it to match.
+	Text string
+
+	// If true, Text is passed through as an SQLite FTS5
+	// query expression, enabling operators like OR, NOT,
+	// NEAR, phrase queries, and prefix queries ("foo*").
+	Raw bool
+
+	// Constrains the search to items matching these
+	// filters; only the timeframe, account, data source,
+	// person, and class fields are honored.
+	Filter ItemQuery
+
+	// The maximum number of results, and how many of the
+	// best results to skip (for pagination). If Limit is
+	// zero, DefaultQueryLimit is used.
+	Limit, Offset int
+
+	// The strings that surround matched terms in result
+	// snippets. If both are empty, "[" and "]" are used.
+	HighlightStart, HighlightEnd string
+}
+
+// SearchResult is an item that matched a search.
+type SearchResult struct {
+	Item ItemRow
+
+	// A short excerpt of the item's text or metadata
+	// with the matching terms highlighted.
+	Snippet string
+
+	// The relevance of the match; lower is better.
+	Rank float64
+}
+
+// Search performs a full-text search over items' text and
+// searchable metadata fields (name, description, and link),
+// returning the results ordered by relevance. Search is only
+// available if the program was built with SQLite's FTS5
+// extension (the "sqlite_fts5" build tag), and not in
+// encrypted repositories.
+func (t *Timeline) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	if t.keys != nil {
+		return nil, ErrSearchEncrypted
+	}
+	if !t.searchable {
+		return nil, ErrSearchUnavailable
+	}
+
+	matchExpr := q.Text
+	if !q.Raw {
+		matchExpr = ftsLiteralQuery(q.Text)
+	}
+	if matchExpr == "" {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	hlStart, hlEnd := q.HighlightStart, q.HighlightEnd
+	if hlStart == "" && hlEnd == "" {
+		hlStart, hlEnd = "[", "]"
+	}
+
+	args := []interface{}{hlStart, hlEnd, matchExpr}
+	where, filterArgs := q.Filter.filters()
+	args = append(args, filterArgs...)
+	args = append(args, limit, q.Offset)
+
+	query := `SELECT ` + itemRowColumns + `, fts.snip, fts.rank
+		FROM items
+		JOIN (SELECT rowid, snippet(items_fts, -1, ?, ?, '…', 16) AS snip, rank
+			FROM items_fts WHERE items_fts MATCH ?) AS fts
+		ON items.id = fts.rowid`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY fts.rank LIMIT ? OFFSET ?"
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching items: %v", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var sr SearchResult
+		var snippet *string
+		sr.Item, err = t.scanItemRow(searchRowScanner{rows, &snippet, &sr.Rank})
+		if err != nil {
+			return nil, err
+		}
+		if snippet != nil {
+			sr.Snippet = *snippet
+		}
+		results = append(results, sr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating search results: %v", err)
+	}
+
+	return results, nil
+}
+
+// searchRowScanner scans a row of search results, which
+// has the item's columns followed by the snippet and rank.
+type searchRowScanner struct {
+	rows    *sql.Rows
+	snippet **string
+	rank    *float64
+}
+
+func (s searchRowScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.snippet, s.rank)...)
+}
+
+// ftsLiteralQuery converts plain text into an FTS5 query that
+// matches all of its words literally, so that punctuation in
+// the input is not interpreted as query syntax.
+func ftsLiteralQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.Replace(word, `"`, `""`, -1)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// setUpSearchIndex creates the full-text search index if the
+// SQLite library supports FTS5, populating it from existing
+// items if it did not exist yet. It returns whether full-text
+// search is available.
+func (t *Timeline) setUpSearchIndex() (bool, error) {
+	db := t.db
+	var available bool
+	err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&available)
+	if err != nil {
+		return false, fmt.Errorf("checking for FTS5 support: %v", err)
+	}
+	if !available {
+		return false, nil
+	}
+
+	var exists int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type='table' AND name='items_fts' LIMIT 1`).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("checking for search index: %v", err)
+	}
+	if t.readOnly {
+		return exists > 0, nil
+	}
+
+	_, err = db.Exec(createSearchIndex)
+	if err != nil {
+		return false, fmt.Errorf("creating search index: %v", err)
+	}
+
+	if exists == 0 {
+		err = t.rebuildSearchIndex()
+		if err != nil {
+			return false, fmt.Errorf("populating search index: %v", err)
+		}
+	}
+
+	return true, nil
+}
+
+// RebuildSearchIndex discards the full-text search index and
+// populates it again from all items in the timeline. This is
+// only necessary if the timeline was modified by a program
+// that was built without FTS5 support.
+func (t *Timeline) RebuildSearchIndex() error {
+	if t.keys != nil {
+		return ErrSearchEncrypted
+	}
+	if !t.searchable {
+		return ErrSearchUnavailable
+	}
+	return t.rebuildSearchIndex()
+}
+
+func (t *Timeline) rebuildSearchIndex() error {
+	db := t.db
+	_, err := db.Exec(`DELETE FROM items_fts`)
+	if err != nil {
+		return fmt.Errorf("clearing search index: %v", err)
+	}
+
+	// we can't write to the DB while iterating rows (the table
+	// is locked), so load and index the items in batches
+	const batchSize = 1000
+	var lastRowID int64
+	for {
+		rows, err := db.Query(`SELECT `+itemRowColumns+` FROM items
+			WHERE id > ? ORDER BY id LIMIT ?`, lastRowID, batchSize)
+		if err != nil {
+			return fmt.Errorf("querying items: %v", err)
+		}
+		var batch []ItemRow
+		for rows.Next() {
+			ir, err := t.scanItemRow(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, ir)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("iterating item rows: %v", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("beginning transaction: %v", err)
+		}
+		for _, ir := range batch {
+			err = indexItemText(tx, ir)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("committing transaction: %v", err)
+		}
+
+		lastRowID = batch[len(batch)-1].ID
+	}
+}
+
+// indexItem updates the search index for the item with the given
+// row ID to reflect the item's current values in the database.
+func (t *Timeline) indexItem(db querier, rowID int64) error {
+	if !t.searchable {
+		return nil
+	}
+	row := db.QueryRow(`SELECT `+itemRowColumns+` FROM items WHERE id=? LIMIT 1`, rowID)
+	ir, err := t.scanItemRow(row)
+	if err == sql.ErrNoRows {
+		return unindexItem(db, rowID)
+	}
+	if err != nil {
+		return err
+	}
+	return indexItemText(db, ir)
+}
+
+// indexItemText replaces the search index entry for ir.
+func indexItemText(db execer, ir ItemRow) error {
+	err := unindexItem(db, ir.ID)
+	if err != nil {
+		return err
+	}
+
+	var dataText, name, description, link string
+	if ir.DataText != nil {
+		dataText = *ir.DataText
+	}
+	if ir.Metadata != nil {
+		name = ir.Metadata.Name
+		description = ir.Metadata.Description
+		link = ir.Metadata.Link
+	}
+	if dataText == "" && name == "" && description == "" && link == "" {
+		return nil
+	}
+
+	_, err = db.Exec(`INSERT INTO items_fts (rowid, data_text, name, description, link)
+		VALUES (?, ?, ?, ?, ?)`, ir.ID, dataText, name, description, link)
+	if err != nil {
+		return fmt.Errorf("indexing item text: %v (item_id=%d)", err, ir.ID)
+	}
+
+	return nil
+}
+
+// unindexItem removes the item with the given row ID from the
+// search index. Since the index is not updated automatically
+// by the database, it should be called whenever an item is
+// deleted (but stale entries are harmless, as they are
+// filtered out of search results).
+func unindexItem(db execer, rowID int64) error {
+	_, err := db.Exec(`DELETE FROM items_fts WHERE rowid=?`, rowID)
+	if err != nil {
+		return fmt.Errorf("removing item from search index: %v (item_id=%d)", err, rowID)
+	}
+	return nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// ErrSearchUnavailable is returned if full-text search is
+// not supported by the SQLite library the program was built
+// with. Build with the "sqlite_fts5" tag to enable it.
+var ErrSearchUnavailable = errors.New("full-text search is unavailable (build with the sqlite_fts5 tag to enable it)")
+
+// ErrSearchEncrypted is returned if full-text search is used
+// in an encrypted repository, since the search index would
+// reveal the text of items.
+var ErrSearchEncrypted = errors.New("full-text search is unavailable in encrypted repositories")
+
+// The search index is an FTS5 table whose rowid is the row ID
+// of the item it indexes; metadata fields are gob-encoded in
+// the items table, so the index is maintained by the program
+// instead of by triggers.
+const createSearchIndex = `
+CREATE VIRTUAL TABLE IF NOT EXISTS "items_fts" USING fts5(
+	"data_text",
+	"name",
+	"description",
+	"link",
+	tokenize = 'unicode61 remove_diacritics 1'
+);
+`
@@ -0,0 +1,26 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package timeliner
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSearchUnavailable(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	// items are stored all the same
+	testGetAll(t, tl, "me", NewItemGraph(testItem{id: "post", ts: time.Now(), class: ClassPost, text: "hello"}))
+
+	_, err := tl.Search(context.Background(), SearchQuery{Text: "hello"})
+	if err != ErrSearchUnavailable {
+		t.Errorf("expected ErrSearchUnavailable, got %v", err)
+	}
+	if err := tl.RebuildSearchIndex(); err != ErrSearchUnavailable {
+		t.Errorf("expected ErrSearchUnavailable rebuilding index, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package timeliner
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// searchIDs returns the original IDs of the items
+// that match text, in order of relevance.
+func searchIDs(t *testing.T, tl *Timeline, q SearchQuery) []string {
+	t.Helper()
+	results, err := tl.Search(context.Background(), q)
+	if err != nil {
+		t.Fatalf("searching for %q: %v", q.Text, err)
+	}
+	ids := []string{}
+	for _, sr := range results {
+		ids = append(ids, sr.Item.OriginalID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	if !tl.searchable {
+		t.Fatal("expected full-text search to be available")
+	}
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	testGetAll(t, tl, "me",
+		NewItemGraph(testItem{id: "fox", ts: ts, class: ClassPost,
+			text: "The quick brown fox jumps over the lazy dog"}),
+		NewItemGraph(testItem{id: "foxes", ts: ts, class: ClassPost,
+			text: "fox fox fox, a post about nothing but foxes and a fox"}),
+		NewItemGraph(testItem{id: "photo", ts: ts, class: ClassImage, fileName: "photo.jpg", file: "jpeg data",
+			meta: &Metadata{Name: "Café at dawn", Description: "a fox in the garden", Link: "https://example.com/garden"}}),
+		NewItemGraph(testItem{id: "quotes", ts: ts, class: ClassPost,
+			text: `she said "NOT now" and left (quietly)`}))
+
+	for i, test := range []struct {
+		q      SearchQuery
+		expect []string
+	}{
+		{q: SearchQuery{Text: "fox"}, expect: []string{"foxes", "fox", "photo"}},
+		{q: SearchQuery{Text: "quick fox"}, expect: []string{"fox"}},
+		{q: SearchQuery{Text: "FOX", Filter: ItemQuery{Classes: []ItemClass{ClassImage}}}, expect: []string{"photo"}},
+		{q: SearchQuery{Text: "cafe"}, expect: []string{"photo"}},
+		{q: SearchQuery{Text: "example.com"}, expect: []string{"photo"}},
+		{q: SearchQuery{Text: "elephant"}, expect: []string{}},
+		{q: SearchQuery{Text: "fox", Limit: 1, Offset: 1}, expect: []string{"fox"}},
+
+		// punctuation and operators are matched literally
+		{q: SearchQuery{Text: `"NOT now"`}, expect: []string{"quotes"}},
+		{q: SearchQuery{Text: "lazy OR garden"}, expect: []string{}},
+		{q: SearchQuery{Text: "(quietly)"}, expect: []string{"quotes"}},
+		{q: SearchQuery{Text: "fox*"}, expect: []string{"foxes", "fox", "photo"}},
+
+		// unless the query is raw
+		{q: SearchQuery{Text: "lazy OR garden", Raw: true}, expect: []string{"fox", "photo"}},
+		{q: SearchQuery{Text: "qui*", Raw: true}, expect: []string{"fox", "quotes"}},
+	} {
+		got := searchIDs(t, tl, test.q)
+		if test.q.Raw && len(test.expect) > 1 {
+			// ranks of these are too close to call
+			sort.Strings(got)
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("test %d: searching for %q: expected %v, got %v", i, test.q.Text, test.expect, got)
+		}
+	}
+
+	results, err := tl.Search(context.Background(), SearchQuery{Text: "lazy dog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Snippet != "The quick brown fox jumps over the [lazy] [dog]" {
+		t.Errorf("expected highlighted snippet, got %+v", results)
+	}
+	results, err = tl.Search(context.Background(), SearchQuery{Text: "garden", HighlightStart: "<b>", HighlightEnd: "</b>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Snippet != "a fox in the <b>garden</b>" {
+		t.Errorf("expected snippet of metadata with custom highlighting, got %+v", results)
+	}
+
+	if _, err := tl.Search(context.Background(), SearchQuery{Text: "  "}); err == nil {
+		t.Error("expected error for empty query")
+	}
+	if _, err := tl.Search(context.Background(), SearchQuery{Text: `"unbalanced`, Raw: true}); err == nil {
+		t.Error("expected error for invalid raw query")
+	}
+}
+
+func TestSearchIndexStaysInSync(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me", "you")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := func(id, text string) *ItemGraph {
+		return NewItemGraph(testItem{id: id, ts: ts, class: ClassPost, text: text})
+	}
+	getAll := func(userID string, po ProcessingOptions, graphs ...*ItemGraph) {
+		t.Helper()
+		wc, err := tl.NewClient(testDataSourceID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = &testClient{graphs: graphs}
+		po.Workers = 1
+		_, err = wc.GetAll(context.Background(), po)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(text string) []string {
+		t.Helper()
+		ids := searchIDs(t, tl, SearchQuery{Text: text})
+		sort.Strings(ids)
+		return ids
+	}
+	expect := func(text string, ids ...string) {
+		t.Helper()
+		if ids == nil {
+			ids = []string{}
+		}
+		if got := search(text); !reflect.DeepEqual(got, ids) {
+			t.Errorf("searching for %q: expected %v, got %v", text, ids, got)
+		}
+	}
+
+	getAll("me", ProcessingOptions{}, item("one", "apple"), item("two", "apple banana"), item("three", "cherry"))
+	getAll("you", ProcessingOptions{}, item("four", "apple"))
+	expect("apple", "four", "one", "two")
+
+	// updated items are indexed by their new text
+	getAll("me", ProcessingOptions{Reprocess: true}, item("one", "durian"), item("two", "apple banana"), item("three", "cherry"))
+	expect("apple", "four", "two")
+	expect("durian", "one")
+
+	// trashed items can't be found until they are restored
+	err := tl.trashItem(loadTestItem(t, tl, "two").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("banana")
+	trash, err := tl.Trash(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tl.RestoreTrash(context.Background(), []int64{trash[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("banana", "two")
+
+	// nor can pruned ones
+	getAll("me", ProcessingOptions{Prune: true, PruneMaxPercent: 100}, item("one", "durian"), item("two", "apple banana"))
+	expect("cherry")
+
+	// nor those of removed accounts
+	_, err = tl.RemoveAccount(context.Background(), testDataSourceID, "you")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("apple", "two")
+
+	// the index can be rebuilt from scratch
+	_, err = tl.db.Exec(`DELETE FROM items_fts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("apple")
+	err = tl.RebuildSearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("apple", "two")
+	expect("durian", "one")
+}
+
+func TestSearchEncrypted(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{Secret: []byte("passphrase")}, "me")
+	defer cleanup()
+	_, err := tl.Search(context.Background(), SearchQuery{Text: "anything"})
+	if err != ErrSearchEncrypted {
+		t.Errorf("expected ErrSearchEncrypted, got %v", err)
+	}
+	if err := tl.RebuildSearchIndex(); err != ErrSearchEncrypted {
+		t.Errorf("expected ErrSearchEncrypted rebuilding index, got %v", err)
+	}
+}
+
+func TestFTSLiteralQuery(t *testing.T) {
+	for i, test := range []struct {
+		input, expect string
+	}{
+		{input: "", expect: ""},
+		{input: "  ", expect: ""},
+		{input: "fox", expect: `"fox"`},
+		{input: " quick\tbrown  fox ", expect: `"quick" "brown" "fox"`},
+		{input: `say "hi"`, expect: `"say" """hi"""`},
+		{input: "NOT AND OR NEAR", expect: `"NOT" "AND" "OR" "NEAR"`},
+		{input: "fox* -dog ^cat col:val (x)", expect: `"fox*" "-dog" "^cat" "col:val" "(x)"`},
+	} {
+		if got := ftsLiteralQuery(test.input); got != test.expect {
+			t.Errorf("test %d: ftsLiteralQuery(%q): expected %s, got %s", i, test.input, test.expect, got)
+		}
+	}
+}
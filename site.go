@@ -0,0 +1,964 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SiteOptions configures the generation of a static site.
+type SiteOptions struct {
+	// Only items matching the timeframe, account, data
+	// source, person, and class fields of this query are
+	// included in the site.
+	Filter ItemQuery
+
+	// The time zone in which to group items into days and
+	// display their times. If nil, the local time zone is
+	// used.
+	Location *time.Location
+
+	// If true, data files are always copied into the site.
+	// Otherwise, they are hard-linked if possible (which is
+	// fast and takes no extra space), and copied only if
+	// linking fails, for example if the site is on another
+	// file system than the repository.
+	CopyDataFiles bool
+}
+
+// GenerateSite renders the items matching opt into a static
+// website in outDir, which can be browsed without a server.
+// The site has a page for each day, month, and year that has
+// items, a page for each person who owns items, and a page for
+// each collection (album). On day pages, replies and attachments
+// are shown as threads beneath the items they belong to.
+//
+// Data files are placed at the same paths relative to outDir as
+// they have in the repository. Existing files in outDir are
+// overwritten, but files that are not part of the site are left
+// alone, so a site can be regenerated into the same folder.
+func (t *Timeline) GenerateSite(ctx context.Context, outDir string, opt SiteOptions) error {
+	if opt.Location == nil {
+		opt.Location = time.Local
+	}
+
+	sg := &siteGenerator{
+		tl:        t,
+		ctx:       ctx,
+		outDir:    outDir,
+		opt:       opt,
+		persons:   make(map[int64]siteLink),
+		refs:      make(map[int64]siteLink),
+		dataFiles: make(map[string]struct{}),
+	}
+
+	err := os.MkdirAll(outDir, 0755)
+	if err != nil {
+		return fmt.Errorf("creating output folder: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(outDir, "style.css"), []byte(siteStylesheet), 0644)
+	if err != nil {
+		return fmt.Errorf("writing stylesheet: %v", err)
+	}
+
+	err = sg.generateDays()
+	if err != nil {
+		return fmt.Errorf("generating day pages: %v", err)
+	}
+	err = sg.generateCalendar()
+	if err != nil {
+		return fmt.Errorf("generating calendar pages: %v", err)
+	}
+	err = sg.generatePersons()
+	if err != nil {
+		return fmt.Errorf("generating person pages: %v", err)
+	}
+	err = sg.generateCollections()
+	if err != nil {
+		return fmt.Errorf("generating collection pages: %v", err)
+	}
+
+	return nil
+}
+
+// siteGenerator holds the state of generating a site.
+type siteGenerator struct {
+	tl     *Timeline
+	ctx    context.Context
+	outDir string
+	opt    SiteOptions
+
+	days      []siteDay           // every day that has items, in order
+	persons   map[int64]siteLink  // person pages, by person row ID
+	refs      map[int64]siteLink  // links to items, by item row ID
+	dataFiles map[string]struct{} // data files already placed in the site
+}
+
+// siteDay is a day that has items.
+type siteDay struct {
+	date  time.Time // midnight
+	count int
+}
+
+func (d siteDay) path() string {
+	return d.date.Format("2006/01/02") + ".html"
+}
+
+// siteLink is a link to a page of the site, relative to its
+// root, or to an item (which includes the fragment).
+type siteLink struct {
+	URL   string
+	Text  string
+	Count int
+}
+
+// sitePage is the data with which a page is rendered.
+type sitePage struct {
+	Title       string
+	Description string
+	Root        string     // relative path from the page to the root of the site
+	Breadcrumbs []siteLink // links to the pages above this one
+	Prev, Next  *siteLink
+	Links       []siteLink // relative to the page, not the root
+	Items       []*siteItem
+}
+
+// siteItem is the data with which an item is rendered.
+type siteItem struct {
+	ID          int64
+	Anchor      string
+	URL         string // link to the item on its day page
+	When        string
+	Class       string
+	Person      siteLink
+	Text        string
+	Name        string
+	Description string
+	Link        string
+	Media       *siteMedia
+	MapURL      string
+	InReplyTo   *siteLink
+	AttachedTo  *siteLink
+	Quotes      []siteLink
+	ReplyLinks  []siteLink // replies on other days
+	Attachments []*siteItem
+	Replies     []*siteItem
+
+	parent *siteItem // the item this one is nested beneath, if any
+}
+
+// siteMedia is the data file of an item.
+type siteMedia struct {
+	Kind string // image, video, audio, or file
+	URL  string
+	Name string
+}
+
+// generateDays writes the day pages, reading all matching
+// items in chronological order and rendering each day's
+// items once the next day is reached.
+func (sg *siteGenerator) generateDays() error {
+	q := sg.opt.Filter
+	q.Reverse = false
+	q.Cursor = ""
+	q.Limit = 500
+
+	var day []ItemRow
+	var dayDate time.Time
+	var prev *siteDay
+
+	flush := func(next *time.Time) error {
+		if len(day) == 0 {
+			return nil
+		}
+		sd := siteDay{date: dayDate, count: len(day)}
+		err := sg.writeDay(sd, day, prev, next)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dayDate.Format("2006-01-02"), err)
+		}
+		sg.days = append(sg.days, sd)
+		prev = &sg.days[len(sg.days)-1]
+		day = nil
+		return nil
+	}
+
+	for {
+		if err := sg.ctx.Err(); err != nil {
+			return err
+		}
+
+		results, err := sg.tl.QueryItems(sg.ctx, q)
+		if err != nil {
+			return err
+		}
+
+		for _, ir := range results.Items {
+			date := sg.date(ir.Timestamp)
+			if !date.Equal(dayDate) {
+				err := flush(&date)
+				if err != nil {
+					return err
+				}
+				dayDate = date
+			}
+			day = append(day, ir)
+		}
+
+		if results.NextCursor == "" {
+			break
+		}
+		q.Cursor = results.NextCursor
+	}
+
+	return flush(nil)
+}
+
+// writeDay renders the page for a day having the given items.
+func (sg *siteGenerator) writeDay(sd siteDay, rows []ItemRow, prev *siteDay, next *time.Time) error {
+	items := make(map[int64]*siteItem)
+	var ordered []*siteItem
+	for _, ir := range rows {
+		si, err := sg.item(ir, "3:04 PM")
+		if err != nil {
+			return err
+		}
+		items[ir.ID] = si
+		ordered = append(ordered, si)
+	}
+
+	err := sg.threadDay(sd, items)
+	if err != nil {
+		return fmt.Errorf("loading relationships: %v", err)
+	}
+
+	page := sitePage{
+		Title: sd.date.Format("Monday, January 2, 2006"),
+		Root:  "../../",
+		Breadcrumbs: []siteLink{
+			{URL: sd.date.Format("2006") + "/index.html", Text: sd.date.Format("2006")},
+			{URL: sd.date.Format("2006/01") + "/index.html", Text: sd.date.Format("January")},
+		},
+	}
+	if prev != nil {
+		page.Prev = &siteLink{URL: prev.path(), Text: prev.date.Format("Jan 2, 2006")}
+	}
+	if next != nil {
+		nextDay := siteDay{date: *next}
+		page.Next = &siteLink{URL: nextDay.path(), Text: next.Format("Jan 2, 2006")}
+	}
+	for _, si := range ordered {
+		if si.parent == nil {
+			page.Items = append(page.Items, si)
+		}
+	}
+
+	return sg.writePage(sd.path(), siteTemplates.items, page)
+}
+
+// threadDay connects the items of a day according to their
+// relationships: replies and attachments on the same day are
+// nested beneath the items they belong to, and other related
+// items are linked.
+func (sg *siteGenerator) threadDay(sd siteDay, items map[int64]*siteItem) error {
+	start, end := sd.date.Unix(), sd.date.AddDate(0, 0, 1).Unix()
+	rows, err := sg.tl.db.QueryContext(sg.ctx, `SELECT from_item_id, to_item_id, label
+		FROM relationships
+		WHERE from_item_id IS NOT NULL AND to_item_id IS NOT NULL
+			AND label IN (?, ?, ?)
+			AND (from_item_id IN (SELECT id FROM items WHERE timestamp >= ? AND timestamp < ?)
+				OR to_item_id IN (SELECT id FROM items WHERE timestamp >= ? AND timestamp < ?))
+		ORDER BY id`,
+		RelReplyTo.Label, RelQuotes.Label, RelAttached.Label, start, end, start, end)
+	if err != nil {
+		return err
+	}
+	type rel struct {
+		from, to int64
+		label    string
+	}
+	var rels []rel
+	for rows.Next() {
+		var r rel
+		err := rows.Scan(&r.from, &r.to, &r.label)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		rels = append(rels, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range rels {
+		from, to := items[r.from], items[r.to]
+
+		switch r.label {
+		case RelReplyTo.Label:
+			if from != nil && to != nil && nest(from, to) {
+				to.Replies = append(to.Replies, from)
+				continue
+			}
+			if from != nil {
+				ref, err := sg.itemRef(r.to)
+				if err != nil {
+					return err
+				}
+				from.InReplyTo = ref
+			}
+			if to != nil {
+				ref, err := sg.itemRef(r.from)
+				if err != nil {
+					return err
+				}
+				if ref != nil {
+					to.ReplyLinks = append(to.ReplyLinks, *ref)
+				}
+			}
+
+		case RelAttached.Label:
+			if from != nil && to != nil && nest(to, from) {
+				from.Attachments = append(from.Attachments, to)
+				continue
+			}
+			if to != nil {
+				ref, err := sg.itemRef(r.from)
+				if err != nil {
+					return err
+				}
+				to.AttachedTo = ref
+			}
+
+		case RelQuotes.Label:
+			if from != nil {
+				ref, err := sg.itemRef(r.to)
+				if err != nil {
+					return err
+				}
+				if ref != nil {
+					from.Quotes = append(from.Quotes, *ref)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// nest marks child as being shown beneath parent, unless
+// child is already nested or doing so would make a cycle.
+func nest(child, parent *siteItem) bool {
+	if child == parent || child.parent != nil {
+		return false
+	}
+	for p := parent; p != nil; p = p.parent {
+		if p == child {
+			return false
+		}
+	}
+	child.parent = parent
+	return true
+}
+
+// item converts ir to the data with which it is rendered,
+// placing its data file in the site if it has one. The
+// item's time is displayed in the given layout.
+func (sg *siteGenerator) item(ir ItemRow, timeLayout string) (*siteItem, error) {
+	ts := ir.Timestamp.In(sg.opt.Location)
+	si := &siteItem{
+		ID:     ir.ID,
+		Anchor: "item-" + strconv.FormatInt(ir.ID, 10),
+		When:   ts.Format(timeLayout),
+		Class:  ir.Class.String(),
+	}
+	si.URL = siteDay{date: sg.date(ir.Timestamp)}.path() + "#" + si.Anchor
+
+	person, err := sg.person(ir.PersonID)
+	if err != nil {
+		return nil, fmt.Errorf("loading person: %v", err)
+	}
+	si.Person = person
+
+	if ir.DataText != nil {
+		si.Text = *ir.DataText
+	}
+	if ir.Metadata != nil {
+		si.Name = ir.Metadata.Name
+		si.Description = ir.Metadata.Description
+		si.Link = ir.Metadata.Link
+	}
+	if ir.Latitude != nil && ir.Longitude != nil {
+		si.MapURL = fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=16/%f/%f",
+			*ir.Latitude, *ir.Longitude, *ir.Latitude, *ir.Longitude)
+	}
+
+	// only completely downloaded data files are usable
+	if ir.DataFile != nil && ir.DataHash != nil {
+		err := sg.placeDataFile(*ir.DataFile)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %v", ir.ID, err)
+		}
+		si.Media = &siteMedia{
+			Kind: mediaKind(ir),
+			URL:  (&url.URL{Path: *ir.DataFile}).EscapedPath(),
+			Name: ir.DataFileName(),
+		}
+	}
+
+	return si, nil
+}
+
+// mediaKind returns how the data file of ir should be displayed.
+func mediaKind(ir ItemRow) string {
+	switch ir.Class {
+	case ClassImage:
+		return "image"
+	case ClassVideo:
+		return "video"
+	case ClassAudio:
+		return "audio"
+	}
+	if ir.MIMEType != nil {
+		if i := strings.Index(*ir.MIMEType, "/"); i > 0 {
+			switch kind := (*ir.MIMEType)[:i]; kind {
+			case "image", "video", "audio":
+				return kind
+			}
+		}
+	}
+	return "file"
+}
+
+// placeDataFile hard-links or copies the data file with the
+// given canonical name into the site, if not done already.
+func (sg *siteGenerator) placeDataFile(dataFile string) error {
+	if _, ok := sg.dataFiles[dataFile]; ok {
+		return nil
+	}
+	sg.dataFiles[dataFile] = struct{}{}
+
+	dst := filepath.Join(sg.outDir, filepath.FromSlash(dataFile))
+
+	srcInfo, err := sg.tl.store.Stat(dataFile)
+	if os.IsNotExist(err) {
+		return nil // nothing to show, but not fatal
+	}
+	if err != nil {
+		return err
+	}
+
+	// skip files that were already placed by a previous run
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if os.SameFile(srcInfo, dstInfo) ||
+			(dstInfo.Size() == srcInfo.Size() && !dstInfo.ModTime().Before(srcInfo.ModTime())) {
+			return nil
+		}
+		err = os.Remove(dst)
+		if err != nil {
+			return fmt.Errorf("replacing data file: %v", err)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("making folder for data file: %v", err)
+	}
+
+	// data files can only be linked if they are local
+	if ls, ok := sg.tl.store.(localStore); ok && !sg.opt.CopyDataFiles {
+		if err := os.Link(ls.path(dataFile), dst); err == nil {
+			return nil
+		}
+	}
+
+	return sg.copyDataFile(dataFile, dst)
+}
+
+func (sg *siteGenerator) copyDataFile(src, dst string) error {
+	in, err := sg.tl.store.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return fmt.Errorf("copying %s: %v", src, err)
+	}
+
+	return out.Close()
+}
+
+// person returns a link to the page of the person
+// with the given row ID, named for the person.
+func (sg *siteGenerator) person(personID int64) (siteLink, error) {
+	if link, ok := sg.persons[personID]; ok {
+		return link, nil
+	}
+
+	var name *string
+	var userID *string
+	err := sg.tl.db.QueryRowContext(sg.ctx, `SELECT persons.name,
+			(SELECT user_id FROM person_identities WHERE person_id=persons.id ORDER BY id LIMIT 1)
+		FROM persons WHERE id=? LIMIT 1`, personID).Scan(&name, &userID)
+	if err != nil && err != sql.ErrNoRows {
+		return siteLink{}, err
+	}
+
+	link := siteLink{
+		URL:  "persons/" + strconv.FormatInt(personID, 10) + ".html",
+		Text: "Unknown",
+	}
+	if name != nil && *name != "" {
+		link.Text = *name
+	} else if userID != nil {
+		link.Text = *userID
+	}
+
+	sg.persons[personID] = link
+	return link, nil
+}
+
+// itemRef returns a link to the item with the given row ID on
+// its day page, or nil if the item is not part of the site.
+func (sg *siteGenerator) itemRef(rowID int64) (*siteLink, error) {
+	if link, ok := sg.refs[rowID]; ok {
+		return &link, nil
+	}
+
+	ir, err := sg.tl.LoadItem(sg.ctx, rowID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !sg.included(ir) {
+		return nil, nil
+	}
+
+	link := siteLink{
+		URL:  siteDay{date: sg.date(ir.Timestamp)}.path() + "#item-" + strconv.FormatInt(ir.ID, 10),
+		Text: itemSummary(ir, sg.opt.Location),
+	}
+	sg.refs[rowID] = link
+
+	return &link, nil
+}
+
+// included returns whether ir matches the filter of the site.
+func (sg *siteGenerator) included(ir ItemRow) bool {
+	f := sg.opt.Filter
+	if f.Timeframe.Since != nil && ir.Timestamp.Before(*f.Timeframe.Since) {
+		return false
+	}
+	if f.Timeframe.Until != nil && !ir.Timestamp.Before(*f.Timeframe.Until) {
+		return false
+	}
+	if len(f.AccountIDs) > 0 && !containsInt64(f.AccountIDs, ir.AccountID) {
+		return false
+	}
+	if len(f.PersonIDs) > 0 && !containsInt64(f.PersonIDs, ir.PersonID) {
+		return false
+	}
+	if len(f.Classes) > 0 {
+		var found bool
+		for _, class := range f.Classes {
+			if class == ir.Class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.DataSourceIDs) > 0 {
+		var dsID string
+		err := sg.tl.db.QueryRowContext(sg.ctx, `SELECT data_source_id FROM accounts WHERE id=? LIMIT 1`,
+			ir.AccountID).Scan(&dsID)
+		if err != nil || !containsString(f.DataSourceIDs, dsID) {
+			return false
+		}
+	}
+	return true
+}
+
+// itemSummary returns a short description of ir for use as link text.
+func itemSummary(ir ItemRow, loc *time.Location) string {
+	var s string
+	switch {
+	case ir.DataText != nil && *ir.DataText != "":
+		s = *ir.DataText
+	case ir.Metadata != nil && ir.Metadata.Name != "":
+		s = ir.Metadata.Name
+	case ir.DataFile != nil:
+		s = ir.DataFileName()
+	default:
+		s = ir.Class.String() + " from " + ir.Timestamp.In(loc).Format("Jan 2, 2006 3:04 PM")
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	const maxLen = 80
+	if utf8.RuneCountInString(s) > maxLen {
+		s = string([]rune(s)[:maxLen-1]) + "…"
+	}
+	return s
+}
+
+// generateCalendar writes the index page, which lists the
+// years, and the page of each year and month, which list
+// the months and days that have items.
+func (sg *siteGenerator) generateCalendar() error {
+	var years []siteLink
+	for i := 0; i < len(sg.days); {
+		year := sg.days[i].date.Year()
+
+		var months []siteLink
+		var yearCount int
+		for i < len(sg.days) && sg.days[i].date.Year() == year {
+			month := sg.days[i].date.Month()
+			monthDate := sg.days[i].date
+
+			var days []siteLink
+			var monthCount int
+			for i < len(sg.days) && sg.days[i].date.Year() == year && sg.days[i].date.Month() == month {
+				d := sg.days[i]
+				days = append(days, siteLink{
+					URL:   d.date.Format("02") + ".html",
+					Text:  d.date.Format("Monday, January 2"),
+					Count: d.count,
+				})
+				monthCount += d.count
+				i++
+			}
+
+			err := sg.writePage(monthDate.Format("2006/01")+"/index.html", siteTemplates.list, sitePage{
+				Title: monthDate.Format("January 2006"),
+				Root:  "../../",
+				Breadcrumbs: []siteLink{
+					{URL: monthDate.Format("2006") + "/index.html", Text: monthDate.Format("2006")},
+				},
+				Links: days,
+			})
+			if err != nil {
+				return err
+			}
+
+			months = append(months, siteLink{
+				URL:   monthDate.Format("01") + "/index.html",
+				Text:  monthDate.Format("January"),
+				Count: monthCount,
+			})
+			yearCount += monthCount
+		}
+
+		err := sg.writePage(strconv.Itoa(year)+"/index.html", siteTemplates.list, sitePage{
+			Title: strconv.Itoa(year),
+			Root:  "../",
+			Links: months,
+		})
+		if err != nil {
+			return err
+		}
+
+		years = append(years, siteLink{
+			URL:   strconv.Itoa(year) + "/index.html",
+			Text:  strconv.Itoa(year),
+			Count: yearCount,
+		})
+	}
+
+	return sg.writePage("index.html", siteTemplates.list, sitePage{
+		Title: "Timeline",
+		Links: years,
+	})
+}
+
+// generatePersons writes a page for each person who owns items
+// in the site, and an index page that lists them.
+func (sg *siteGenerator) generatePersons() error {
+	rows, err := sg.tl.db.QueryContext(sg.ctx, `SELECT DISTINCT person_id FROM items ORDER BY person_id`)
+	if err != nil {
+		return err
+	}
+	var personIDs []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		personIDs = append(personIDs, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var persons []siteLink
+	for _, personID := range personIDs {
+		link, err := sg.person(personID)
+		if err != nil {
+			return err
+		}
+
+		q := sg.opt.Filter
+		q.PersonIDs = []int64{personID}
+		count, err := sg.writeItemPages(link, q)
+		if err != nil {
+			return fmt.Errorf("person %d: %v", personID, err)
+		}
+		if count > 0 {
+			link.Count = count
+			persons = append(persons, link)
+		}
+	}
+
+	// the links are relative to the root, but the index is in the folder
+	for i := range persons {
+		persons[i].URL = path.Base(persons[i].URL)
+	}
+
+	return sg.writePage("persons/index.html", siteTemplates.list, sitePage{
+		Title: "People",
+		Root:  "../",
+		Links: persons,
+	})
+}
+
+// writeItemPages writes the items of a person matching q, newest
+// first, into pages of up to siteItemsPerPage items, the first of
+// which is at link.URL. It returns the number of items written.
+func (sg *siteGenerator) writeItemPages(link siteLink, q ItemQuery) (int, error) {
+	q.Reverse = true
+	q.Cursor = ""
+	q.Limit = siteItemsPerPage
+
+	var count int
+	for pageNum := 1; ; pageNum++ {
+		if err := sg.ctx.Err(); err != nil {
+			return count, err
+		}
+
+		results, err := sg.tl.QueryItems(sg.ctx, q)
+		if err != nil {
+			return count, err
+		}
+		if len(results.Items) == 0 {
+			return count, nil
+		}
+
+		page := sitePage{
+			Title: link.Text,
+			Root:  "../",
+			Breadcrumbs: []siteLink{
+				{URL: "persons/index.html", Text: "People"},
+			},
+		}
+		for _, ir := range results.Items {
+			si, err := sg.item(ir, "Jan 2, 2006 3:04 PM")
+			if err != nil {
+				return count, err
+			}
+			page.Items = append(page.Items, si)
+		}
+		count += len(results.Items)
+
+		if pageNum > 1 {
+			page.Prev = &siteLink{URL: pagePath(link.URL, pageNum-1), Text: "Newer"}
+			page.Title += fmt.Sprintf(" (page %d)", pageNum)
+		}
+		if results.NextCursor != "" {
+			page.Next = &siteLink{URL: pagePath(link.URL, pageNum+1), Text: "Older"}
+		}
+
+		err = sg.writePage(pagePath(link.URL, pageNum), siteTemplates.items, page)
+		if err != nil {
+			return count, err
+		}
+
+		if results.NextCursor == "" {
+			return count, nil
+		}
+		q.Cursor = results.NextCursor
+	}
+}
+
+// pagePath returns the path of the given page number of a
+// listing whose first page is at first.
+func pagePath(first string, pageNum int) string {
+	if pageNum <= 1 {
+		return first
+	}
+	ext := path.Ext(first)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(first, ext), pageNum, ext)
+}
+
+// generateCollections writes a page for each collection that has
+// items in the site, with its items in order, and an index page
+// that lists the collections.
+func (sg *siteGenerator) generateCollections() error {
+	rows, err := sg.tl.db.QueryContext(sg.ctx, `SELECT id, name, description
+		FROM collections ORDER BY name, id`)
+	if err != nil {
+		return err
+	}
+	type collection struct {
+		id                int64
+		name, description *string
+	}
+	var collections []collection
+	for rows.Next() {
+		var c collection
+		err := rows.Scan(&c.id, &c.name, &c.description)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		collections = append(collections, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var links []siteLink
+	for _, c := range collections {
+		page := sitePage{
+			Title: "Untitled album",
+			Root:  "../",
+			Breadcrumbs: []siteLink{
+				{URL: "collections/index.html", Text: "Albums"},
+			},
+		}
+		if c.name != nil && *c.name != "" {
+			page.Title = *c.name
+		}
+		if c.description != nil {
+			page.Description = *c.description
+		}
+
+		page.Items, err = sg.collectionItems(c.id)
+		if err != nil {
+			return fmt.Errorf("collection %d: %v", c.id, err)
+		}
+		if len(page.Items) == 0 {
+			continue
+		}
+
+		pagePath := "collections/" + strconv.FormatInt(c.id, 10) + ".html"
+		err = sg.writePage(pagePath, siteTemplates.items, page)
+		if err != nil {
+			return err
+		}
+
+		links = append(links, siteLink{
+			URL:   path.Base(pagePath),
+			Text:  page.Title,
+			Count: len(page.Items),
+		})
+	}
+
+	return sg.writePage("collections/index.html", siteTemplates.list, sitePage{
+		Title: "Albums",
+		Root:  "../",
+		Links: links,
+	})
+}
+
+// collectionItems returns the items of the collection
+// with the given row ID that are part of the site, in
+// the order of the collection.
+func (sg *siteGenerator) collectionItems(collectionID int64) ([]*siteItem, error) {
+	where, args := sg.opt.Filter.filters()
+	query := `SELECT ` + itemRowColumns + ` FROM
+		(SELECT items.*, collection_items.position AS position
+			FROM items, collection_items
+			WHERE collection_items.collection_id=? AND items.id = collection_items.item_id)`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY position, timestamp, id"
+	args = append([]interface{}{collectionID}, args...)
+
+	rows, err := sg.tl.db.QueryContext(sg.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var irs []ItemRow
+	for rows.Next() {
+		ir, err := sg.tl.scanItemRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		irs = append(irs, ir)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var items []*siteItem
+	for _, ir := range irs {
+		si, err := sg.item(ir, "Jan 2, 2006 3:04 PM")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, si)
+	}
+
+	return items, nil
+}
+
+// date returns midnight of the day of ts in the site's time zone.
+func (sg *siteGenerator) date(ts time.Time) time.Time {
+	y, m, d := ts.In(sg.opt.Location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, sg.opt.Location)
+}
+
+// writePage renders page with tpl into the file at
+// pagePath, which is relative to the site's root.
+func (sg *siteGenerator) writePage(pagePath string, tpl *template.Template, page sitePage) error {
+	fpath := filepath.Join(sg.outDir, filepath.FromSlash(pagePath))
+	err := os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		return fmt.Errorf("making folder for page: %v", err)
+	}
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("creating page: %v", err)
+	}
+	defer f.Close()
+
+	err = tpl.Execute(f, page)
+	if err != nil {
+		return fmt.Errorf("rendering %s: %v", pagePath, err)
+	}
+
+	return f.Close()
+}
+
+// siteItemsPerPage is the maximum number of items
+// on each page of a person's items.
+const siteItemsPerPage = 200
@@ -0,0 +1,134 @@
+package timeliner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateSite(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	photo := testItem{id: "photo", ts: day.Add(11 * time.Hour), class: ClassImage, fileName: "photo.jpg", file: "jpeg data",
+		meta: &Metadata{Name: "<b>Café</b>", Description: `"quoted" & <i>`, Link: "javascript:alert(1)"}}
+	photoGraph := NewItemGraph(photo)
+	name := "<Summer>"
+	photoGraph.Collections = []Collection{{OriginalID: "album", Name: &name, Items: []CollectionItem{{Item: photo}}}}
+	reply := NewItemGraph(testItem{id: "reply", ts: day.Add(12 * time.Hour), class: ClassPost, text: "nice"})
+	reply.Add(testItem{id: "post", ts: day.Add(10 * time.Hour), class: ClassPost, text: `<script>alert("x")</script> & more`}, RelReplyTo)
+	testGetAll(t, tl, "me",
+		photoGraph,
+		reply,
+		NewItemGraph(testItem{id: "later", ts: day.AddDate(0, 1, 2), class: ClassPost, text: "later"}))
+
+	site := filepath.Join(dir, "site")
+	err = tl.GenerateSite(context.Background(), site, SiteOptions{Location: time.UTC})
+	if err != nil {
+		t.Fatalf("generating site: %v", err)
+	}
+
+	read := func(pagePath string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(filepath.Join(site, filepath.FromSlash(pagePath)))
+		if err != nil {
+			t.Fatalf("reading page: %v", err)
+		}
+		return string(b)
+	}
+	expectIn := func(pagePath, page string, substrings ...string) {
+		t.Helper()
+		for _, s := range substrings {
+			if !strings.Contains(page, s) {
+				t.Errorf("expected %s to contain %q, but it is:\n%s", pagePath, s, page)
+			}
+		}
+	}
+
+	ir := loadTestItem(t, tl, "photo")
+	person := "persons/" + strconv.FormatInt(ir.PersonID, 10) + ".html"
+	var collID int64
+	err = tl.db.QueryRow(`SELECT id FROM collections WHERE original_id='album'`).Scan(&collID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	album := "collections/" + strconv.FormatInt(collID, 10) + ".html"
+
+	// the calendar links down to the days
+	expectIn("index.html", read("index.html"), `<a href="2019/index.html">2019</a> <span class="count">4</span>`)
+	expectIn("2019/index.html", read("2019/index.html"),
+		`<a href="01/index.html">January</a> <span class="count">3</span>`,
+		`<a href="02/index.html">February</a> <span class="count">1</span>`)
+	expectIn("2019/01/index.html", read("2019/01/index.html"),
+		`<a href="01.html">Tuesday, January 1</a> <span class="count">3</span>`)
+	expectIn("persons/index.html", read("persons/index.html"), `<a href="`+filepath.Base(person)+`">`)
+	expectIn("collections/index.html", read("collections/index.html"),
+		`<a href="`+filepath.Base(album)+`">&lt;Summer&gt;</a> <span class="count">1</span>`)
+	expectIn(person, read(person), `id="item-`+strconv.FormatInt(ir.ID, 10)+`"`)
+	expectIn(album, read(album), `<h1>&lt;Summer&gt;</h1>`, `src="../`+*ir.DataFile+`"`)
+	if _, err := os.Stat(filepath.Join(site, "style.css")); err != nil {
+		t.Errorf("expected stylesheet: %v", err)
+	}
+
+	// the reply is nested beneath the post, and days link to each other
+	page := read("2019/01/01.html")
+	expectIn("2019/01/01.html", page,
+		`<div class="replies">`,
+		`<a class="next" href="../../2019/02/03.html">Feb 3, 2019 →</a>`,
+		`src="../../`+*ir.DataFile+`"`)
+	if strings.Index(page, `class="replies"`) > strings.Index(page, "nice") {
+		t.Error("expected reply to be nested beneath the post")
+	}
+	expectIn("2019/02/03.html", read("2019/02/03.html"), `<a class="prev" href="../../2019/01/01.html">← Jan 1, 2019</a>`)
+
+	// text and metadata are escaped
+	expectIn("2019/01/01.html", page,
+		`&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; more`,
+		`<h2>&lt;b&gt;Café&lt;/b&gt;</h2>`,
+		`&#34;quoted&#34; &amp; &lt;i&gt;`,
+		`href="#ZgotmplZ"`)
+	for _, raw := range []string{"<script>", "<b>Café", "<i>", `href="javascript:`} {
+		if strings.Contains(page, raw) {
+			t.Errorf("expected %q to be escaped", raw)
+		}
+	}
+
+	// the data file is linked at the same path as in the repository
+	repoInfo, err := os.Stat(filepath.Join(tl.repoDir, filepath.FromSlash(*ir.DataFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteInfo, err := os.Stat(filepath.Join(site, filepath.FromSlash(*ir.DataFile)))
+	if err != nil {
+		t.Fatalf("expected data file in site: %v", err)
+	}
+	if !os.SameFile(repoInfo, siteInfo) {
+		t.Error("expected data file to be hard-linked")
+	}
+
+	// or copied there
+	copied := filepath.Join(dir, "copied")
+	err = tl.GenerateSite(context.Background(), copied, SiteOptions{Location: time.UTC, CopyDataFiles: true})
+	if err != nil {
+		t.Fatalf("generating site with copies: %v", err)
+	}
+	copyPath := filepath.Join(copied, filepath.FromSlash(*ir.DataFile))
+	contents, err := ioutil.ReadFile(copyPath)
+	if err != nil || string(contents) != "jpeg data" {
+		t.Errorf("expected copied data file, got %q (err=%v)", contents, err)
+	}
+	if copyInfo, err := os.Stat(copyPath); err == nil && os.SameFile(repoInfo, copyInfo) {
+		t.Error("expected data file to be copied, not linked")
+	}
+}
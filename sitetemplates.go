@@ -0,0 +1,183 @@
+package timeliner
+
+import "html/template"
+
+// siteTemplates are the templates of the pages of a
+// static site. All of them render a sitePage.
+var siteTemplates = struct {
+	items *template.Template // a list of items, with any threads
+	list  *template.Template // a list of links to other pages
+}{
+	items: siteTemplate(siteItemsContent),
+	list:  siteTemplate(siteListContent),
+}
+
+// siteTemplate returns the page layout with the given
+// template defined as the content of the page.
+func siteTemplate(content string) *template.Template {
+	tpl := template.Must(template.New("page").Funcs(template.FuncMap{
+		"itemData": func(root string, item *siteItem) siteItemData {
+			return siteItemData{Root: root, siteItem: item}
+		},
+	}).Parse(siteLayout))
+	template.Must(tpl.Parse(siteItemTemplate))
+	return template.Must(tpl.Parse(content))
+}
+
+// siteItemData is what the item template renders: an item and
+// the relative path to the root of the site from the page.
+type siteItemData struct {
+	Root string
+	*siteItem
+}
+
+const siteLayout = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+</head>
+<body>
+<header>
+	<nav>
+		<a href="{{.Root}}index.html">Timeline</a>
+		<a href="{{.Root}}persons/index.html">People</a>
+		<a href="{{.Root}}collections/index.html">Albums</a>
+	</nav>
+	{{- if .Breadcrumbs}}
+	<div class="breadcrumbs">
+		{{- range .Breadcrumbs}}<a href="{{$.Root}}{{.URL}}">{{.Text}}</a> › {{end -}}
+	</div>
+	{{- end}}
+	<h1>{{.Title}}</h1>
+	{{- if .Description}}
+	<p class="description">{{.Description}}</p>
+	{{- end}}
+</header>
+<main>
+{{template "content" .}}
+</main>
+{{- if or .Prev .Next}}
+<footer class="pager">
+	{{- if .Prev}}<a class="prev" href="{{.Root}}{{.Prev.URL}}">← {{.Prev.Text}}</a>{{end}}
+	{{- if .Next}}<a class="next" href="{{.Root}}{{.Next.URL}}">{{.Next.Text}} →</a>{{end}}
+</footer>
+{{- end}}
+</body>
+</html>
+`
+
+const siteItemTemplate = `{{define "item" -}}
+<article class="item {{.Class}}" id="{{.Anchor}}">
+	<div class="meta">
+		<a class="person" href="{{.Root}}{{.Person.URL}}">{{.Person.Text}}</a>
+		<a class="time" href="{{.Root}}{{.URL}}">{{.When}}</a>
+		{{- if .MapURL}} <a class="map" href="{{.MapURL}}">map</a>{{end}}
+	</div>
+	{{- if .InReplyTo}}
+	<div class="context">In reply to <a href="{{.Root}}{{.InReplyTo.URL}}">{{.InReplyTo.Text}}</a></div>
+	{{- end}}
+	{{- if .AttachedTo}}
+	<div class="context">Attached to <a href="{{.Root}}{{.AttachedTo.URL}}">{{.AttachedTo.Text}}</a></div>
+	{{- end}}
+	{{- if .Name}}
+	<h2>{{.Name}}</h2>
+	{{- end}}
+	{{- if .Text}}
+	<div class="text">{{.Text}}</div>
+	{{- end}}
+	{{- with .Media}}
+	<div class="media">
+		{{- if eq .Kind "image"}}<a href="{{$.Root}}{{.URL}}"><img src="{{$.Root}}{{.URL}}" alt="{{.Name}}" loading="lazy"></a>
+		{{- else if eq .Kind "video"}}<video src="{{$.Root}}{{.URL}}" controls preload="metadata"></video>
+		{{- else if eq .Kind "audio"}}<audio src="{{$.Root}}{{.URL}}" controls preload="none"></audio>
+		{{- else}}<a href="{{$.Root}}{{.URL}}">{{.Name}}</a>{{end}}
+	</div>
+	{{- end}}
+	{{- if .Description}}
+	<div class="text">{{.Description}}</div>
+	{{- end}}
+	{{- if .Link}}
+	<div class="link"><a href="{{.Link}}">{{.Link}}</a></div>
+	{{- end}}
+	{{- range .Quotes}}
+	<blockquote><a href="{{$.Root}}{{.URL}}">{{.Text}}</a></blockquote>
+	{{- end}}
+	{{- if .Attachments}}
+	<div class="attachments">
+		{{- range .Attachments}}
+		{{template "item" (itemData $.Root .)}}
+		{{- end}}
+	</div>
+	{{- end}}
+	{{- if .Replies}}
+	<div class="replies">
+		{{- range .Replies}}
+		{{template "item" (itemData $.Root .)}}
+		{{- end}}
+	</div>
+	{{- end}}
+	{{- if .ReplyLinks}}
+	<div class="context">Replies:
+		{{- range .ReplyLinks}} <a href="{{$.Root}}{{.URL}}">{{.Text}}</a>{{end}}
+	</div>
+	{{- end}}
+</article>
+{{- end}}`
+
+const siteItemsContent = `{{define "content" -}}
+{{range .Items}}
+{{template "item" (itemData $.Root .)}}
+{{- end}}
+{{- end}}`
+
+const siteListContent = `{{define "content" -}}
+{{if .Links -}}
+<ul class="links">
+	{{- range .Links}}
+	<li><a href="{{.URL}}">{{.Text}}</a>{{if .Count}} <span class="count">{{.Count}}</span>{{end}}</li>
+	{{- end}}
+</ul>
+{{- else -}}
+<p>Nothing here yet.</p>
+{{- end}}
+{{- end}}`
+
+const siteStylesheet = `body {
+	font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif;
+	max-width: 800px;
+	margin: 0 auto;
+	padding: 1em;
+	color: #222;
+	background: #fafafa;
+}
+a { color: #1a5fb4; text-decoration: none; }
+a:hover { text-decoration: underline; }
+nav a { margin-right: 1em; font-weight: bold; }
+.breadcrumbs { margin-top: 1em; color: #666; }
+h1 { margin: .5em 0; }
+ul.links { list-style: none; padding: 0; }
+ul.links li { padding: .4em 0; border-bottom: 1px solid #e5e5e5; }
+.count { float: right; color: #888; }
+.item {
+	background: #fff;
+	border: 1px solid #e0e0e0;
+	border-radius: 6px;
+	padding: .8em 1em;
+	margin: 1em 0;
+}
+.item .meta { font-size: .9em; color: #666; }
+.item .meta a { margin-right: .8em; }
+.item .person { font-weight: bold; }
+.item h2 { font-size: 1.1em; margin: .5em 0; }
+.item .text { white-space: pre-wrap; margin: .5em 0; }
+.item .context { font-size: .9em; color: #666; margin: .4em 0; }
+.item .media img, .item .media video { max-width: 100%; border-radius: 4px; }
+.item blockquote { border-left: 3px solid #ccc; margin: .5em 0; padding-left: .8em; }
+.attachments .item, .replies .item { margin: .6em 0; }
+.replies { border-left: 3px solid #e5e5e5; padding-left: .8em; }
+.pager { display: flex; justify-content: space-between; margin: 2em 0; }
+.pager .next { margin-left: auto; }
+`
@@ -0,0 +1,83 @@
+package timeliner
+
+import (
+	"sync"
+	"time"
+)
+
+// RunStats summarizes the work done by a single run of
+// GetAll, GetLatest, or Import. Each item is counted at
+// most once as new, updated, skipped, merged, or failed.
+type RunStats struct {
+	ItemsSeen       int64     `json:"items_seen"`       // items received from the data source
+	ItemsNew        int64     `json:"items_new"`        // items added to the timeline
+	ItemsUpdated    int64     `json:"items_updated"`    // existing items that were reprocessed
+	ItemsSkipped    int64     `json:"items_skipped"`    // existing items that were left alone
+	ItemsMerged     int64     `json:"items_merged"`     // items soft-merged into existing items
+	ItemsFailed     int64     `json:"items_failed"`     // items that could not be stored
+	ItemsPruned     int64     `json:"items_pruned"`     // items deleted because they're gone from the data source
+	BytesDownloaded int64     `json:"bytes_downloaded"` // total size of data files downloaded
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished,omitempty"` // zero until the run is over
+}
+
+// add adds the counts of other to rs.
+func (rs *RunStats) add(other RunStats) {
+	rs.ItemsSeen += other.ItemsSeen
+	rs.ItemsNew += other.ItemsNew
+	rs.ItemsUpdated += other.ItemsUpdated
+	rs.ItemsSkipped += other.ItemsSkipped
+	rs.ItemsMerged += other.ItemsMerged
+	rs.ItemsFailed += other.ItemsFailed
+	rs.ItemsPruned += other.ItemsPruned
+	rs.BytesDownloaded += other.BytesDownloaded
+}
+
+// failed returns the stats of a run in which all
+// the items counted by rs were not stored after all
+// (for example, because their transaction failed).
+func (rs RunStats) failed() RunStats {
+	return RunStats{ItemsSeen: rs.ItemsSeen, ItemsFailed: rs.ItemsSeen}
+}
+
+// runTracker accumulates the stats of a run and
+// reports them to the progress callback, if any.
+type runTracker struct {
+	mu       sync.Mutex
+	stats    RunStats
+	progress func(RunStats)
+	dryRun   *dryRunItems // only set for dry runs
+}
+
+func newRunTracker(procOpt ProcessingOptions) *runTracker {
+	rt := &runTracker{
+		stats:    RunStats{Started: time.Now()},
+		progress: procOpt.Progress,
+	}
+	if procOpt.DryRun {
+		rt.dryRun = &dryRunItems{ids: make(map[string]struct{})}
+	}
+	return rt
+}
+
+// add adds delta to the run's stats and reports progress.
+func (rt *runTracker) add(delta RunStats) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.stats.add(delta)
+	if rt.progress != nil {
+		rt.progress(rt.stats)
+	}
+}
+
+// finish marks the run as finished, reports progress
+// one last time, and returns the final stats.
+func (rt *runTracker) finish() RunStats {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.stats.Finished = time.Now()
+	if rt.progress != nil {
+		rt.progress(rt.stats)
+	}
+	return rt.stats
+}
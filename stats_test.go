@@ -0,0 +1,91 @@
+package timeliner
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunStats(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	one := testItem{id: "one", ts: ts, class: ClassPost, text: "one"}
+	two := testItem{id: "two", ts: ts.Add(time.Hour), class: ClassPost, text: "two"}
+	photo := testItem{id: "photo", ts: ts.Add(2 * time.Hour), class: ClassImage, fileName: "photo.jpg", file: "jpeg data"}
+	graphs := func(items ...Item) []*ItemGraph {
+		var igs []*ItemGraph
+		for _, it := range items {
+			igs = append(igs, NewItemGraph(it))
+		}
+		return igs
+	}
+
+	for i, test := range []struct {
+		po     ProcessingOptions
+		items  []Item
+		expect RunStats
+	}{
+		{
+			items:  []Item{one, two, photo},
+			expect: RunStats{ItemsSeen: 3, ItemsNew: 3, BytesDownloaded: int64(len(photo.file))},
+		},
+		{
+			items:  []Item{one, two, photo},
+			expect: RunStats{ItemsSeen: 3, ItemsSkipped: 3},
+		},
+		{
+			po:     ProcessingOptions{Reprocess: true},
+			items:  []Item{one, two, photo},
+			expect: RunStats{ItemsSeen: 3, ItemsUpdated: 3, BytesDownloaded: int64(len(photo.file))},
+		},
+		{
+			// the same item under another ID is merged into the existing one
+			po: ProcessingOptions{Merge: MergeOptions{SoftMerge: true}},
+			items: []Item{
+				testItem{id: "one again", ts: one.ts, class: ClassPost, text: "one"},
+				testItem{id: "three", ts: ts.Add(3 * time.Hour), class: ClassPost, text: "three"},
+				two,
+				badLocationItem{testItem{id: "bad", ts: ts, class: ClassPost, text: "bad"}},
+			},
+			expect: RunStats{ItemsSeen: 4, ItemsNew: 1, ItemsMerged: 1, ItemsSkipped: 1, ItemsFailed: 1},
+		},
+	} {
+		wc, err := tl.NewClient(testDataSourceID, "me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = &testClient{graphs: graphs(test.items...)}
+
+		// progress is reported as the counts grow
+		var reports []RunStats
+		test.po.Workers = 1
+		test.po.Progress = func(rs RunStats) { reports = append(reports, rs) }
+
+		stats, err := wc.GetAll(context.Background(), test.po)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if stats.Started.IsZero() || stats.Finished.Before(stats.Started) {
+			t.Errorf("test %d: expected start and finish times, got %v and %v", i, stats.Started, stats.Finished)
+		}
+		stats.Started, stats.Finished = time.Time{}, time.Time{}
+		if stats != test.expect {
+			t.Errorf("test %d: expected %+v, got %+v", i, test.expect, stats)
+		}
+
+		if len(reports) < 2 {
+			t.Fatalf("test %d: expected progress to be reported for each item, got %d reports", i, len(reports))
+		}
+		for j := 1; j < len(reports); j++ {
+			if reports[j].ItemsSeen < reports[j-1].ItemsSeen {
+				t.Errorf("test %d: expected progress to grow, but report %d has %d items after %d",
+					i, j, reports[j].ItemsSeen, reports[j-1].ItemsSeen)
+			}
+		}
+		if last := reports[len(reports)-1]; last.Finished.IsZero() || last.ItemsSeen != test.expect.ItemsSeen {
+			t.Errorf("test %d: expected last progress report to be final, got %+v", i, last)
+		}
+	}
+}
@@ -25,10 +25,10 @@ import (
 	"io"
 	"log"
 	mathrand "math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
-
-	cuckoo "github.com/seiflotfy/cuckoofilter"
 )
 
 func init() {
@@ -41,26 +41,150 @@ func init() {
 type Timeline struct {
 	db           *sql.DB
 	repoDir      string
+	store        BlobStore // where data files are kept
 	rateLimiters map[string]RateLimit
+	rateLimitsMu *sync.Mutex
+	searchable   bool     // whether full-text search is available
+	layout       string   // how data files are stored; see LayoutCanonical and LayoutBlobs
+	keys         *keyring // if the repository is encrypted
+	creds        CredentialStore
+	readOnly     bool
+	lock         *repoLock // nil if read-only
+
+	// SQLite allows only one writer at a time; batches
+	// wait their turn on this lock, which is much faster
+	// than polling the database until it is unlocked
+	batchMu *sync.Mutex
 }
 
 // Open creates/opens a timeline at the given
 // repository directory. Timelines should always
 // be Close()'d for a clean shutdown when done.
 func Open(repo string) (*Timeline, error) {
-	db, err := openDB(repo)
+	return OpenWithOptions(repo, Options{})
+}
+
+// OpenWithStore is like Open, but the data files of the
+// timeline are kept in store instead of the repository
+// directory, unless store is nil. The same store should
+// be used every time the timeline is opened.
+func OpenWithStore(repo string, store BlobStore) (*Timeline, error) {
+	return OpenWithOptions(repo, Options{Store: store})
+}
+
+// Options configures how a timeline is opened.
+type Options struct {
+	// Where the data files of the timeline are kept.
+	// The same store should be used every time the
+	// timeline is opened. Default: the repository
+	// directory
+	Store BlobStore
+
+	// The passphrase, or contents of a key file, that
+	// unlocks an encrypted repository. If the repository
+	// is new, it is encrypted with it; if the repository
+	// is not new and not encrypted, ErrNotEncrypted is
+	// returned (see EnableEncryption).
+	Secret []byte
+
+	// Where the credentials of accounts (such as OAuth2
+	// tokens) are kept. Default: the database
+	Credentials CredentialStore
+
+	// Open the timeline only for reading. Only one process
+	// can have a timeline open for writing at a time (others
+	// get an *InUseError), but any number of processes can
+	// read it, even while it is being written to. The
+	// repository must already exist.
+	ReadOnly bool
+}
+
+// OpenWithOptions is like Open, but with options.
+func OpenWithOptions(repo string, opts Options) (*Timeline, error) {
+	if opts.ReadOnly {
+		_, err := os.Stat(filepath.Join(repo, "index.db"))
+		if err != nil {
+			return nil, fmt.Errorf("no repository in %s: %v", repo, err)
+		}
+		return openTimeline(repo, opts)
+	}
+
+	err := os.MkdirAll(repo, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("making repository directory: %v", err)
+	}
+	lock, err := lockRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTimeline(repo, opts)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	t.lock = lock
+	return t, nil
+}
+
+// openTimeline opens the timeline in repo, which
+// must be locked unless it is opened read-only.
+func openTimeline(repo string, opts Options) (*Timeline, error) {
+	store := opts.Store
+	if store == nil {
+		store = NewLocalStore(repo)
+	}
+	db, err := openDB(repo, opts.ReadOnly)
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %v", err)
 	}
-	return &Timeline{
+	layout, err := loadLayout(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	keys, err := loadKeyring(db, opts.Secret)
+	if err == nil && keys == nil && len(opts.Secret) > 0 {
+		if opts.ReadOnly {
+			err = ErrNotEncrypted
+		} else {
+			keys, err = encryptNewRepository(db, opts.Secret)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	t := &Timeline{
 		db:           db,
 		repoDir:      repo,
+		store:        store,
 		rateLimiters: make(map[string]RateLimit),
-	}, nil
+		rateLimitsMu: new(sync.Mutex),
+		layout:       layout,
+		readOnly:     opts.ReadOnly,
+		batchMu:      new(sync.Mutex),
+	}
+	t.creds = opts.Credentials
+	if t.creds == nil {
+		t.creds = dbCredentialStore{t}
+	}
+	if keys != nil {
+		// the search index would reveal the text of items
+		t.keys = keys
+		t.store = encryptedStore{BlobStore: store, keys: keys}
+	} else {
+		t.searchable, err = t.setUpSearchIndex()
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("setting up search index: %v", err)
+		}
+	}
+	return t, nil
 }
 
 // Close frees up resources allocated from Open.
 func (t *Timeline) Close() error {
+	t.rateLimitsMu.Lock()
 	for key, rl := range t.rateLimiters {
 		if rl.ticker != nil {
 			rl.ticker.Stop()
@@ -68,15 +192,18 @@ func (t *Timeline) Close() error {
 		}
 		delete(t.rateLimiters, key)
 	}
+	t.rateLimitsMu.Unlock()
+	var err error
 	if t.db != nil {
-		return t.db.Close()
+		err = t.db.Close()
 	}
-	return nil
-}
-
-type concurrentCuckoo struct {
-	*cuckoo.Filter
-	*sync.Mutex
+	if t.lock != nil {
+		if lerr := t.lock.unlock(); err == nil {
+			err = lerr
+		}
+		t.lock = nil
+	}
+	return err
 }
 
 // FakeCloser turns an io.Reader into an io.ReadCloser
@@ -101,22 +228,43 @@ type ctxKey string
 // wrappedClientCtxKey is how the context value is accessed.
 var wrappedClientCtxKey ctxKey = "wrapped_client"
 
+// dryRunCtxKey is set to true in the context of a dry run.
+var dryRunCtxKey ctxKey = "dry_run"
+
 // CheckpointFn is a function that saves a checkpoint.
 type CheckpointFn func(checkpoint []byte) error
 
 // Checkpoint saves a checkpoint for the processing associated
 // with the provided context. It overwrites any previous
-// checkpoint. Any errors are logged.
+// checkpoint. Any errors are logged. The checkpoint is saved
+// once the items sent to the processing channel before it
+// have been stored, so a data source should call Checkpoint
+// from the goroutine that sends its items.
 func Checkpoint(ctx context.Context, checkpoint []byte) {
 	wc, ok := ctx.Value(wrappedClientCtxKey).(*WrappedClient)
-
 	if !ok {
-		log.Printf("[ERROR][%s/%s] Checkpoint function not available; got type %T (%#v)",
-			wc.ds.ID, wc.acc.UserID, wc, wc)
+		log.Printf("[ERROR] Checkpoint function not available; got type %T (%#v)",
+			ctx.Value(wrappedClientCtxKey), ctx.Value(wrappedClientCtxKey))
+		return
+	}
+
+	// a dry run must not change anything
+	if dryRun, _ := ctx.Value(dryRunCtxKey).(bool); dryRun {
 		return
 	}
 
-	chkpt, err := MarshalGob(checkpointWrapper{wc.commandParams, checkpoint})
+	if wc.itemChan != nil {
+		wc.itemChan <- &ItemGraph{checkpoint: &checkpointMarker{data: checkpoint}}
+		return
+	}
+
+	wc.saveCheckpoint(checkpoint)
+}
+
+// saveCheckpoint writes checkpoint to the account
+// in the database, with wc's command parameters.
+func (wc *WrappedClient) saveCheckpoint(checkpoint []byte) {
+	chkpt, err := MarshalGob(checkpointWrapper{wc.commandParams, checkpoint, wc.pruning})
 	if err != nil {
 		log.Printf("[ERROR][%s/%s] Encoding checkpoint wrapper: %v", wc.ds.ID, wc.acc.UserID, err)
 		return
@@ -128,6 +276,9 @@ func Checkpoint(ctx context.Context, checkpoint []byte) {
 		log.Printf("[ERROR][%s/%s] Checkpoint: %v", wc.ds.ID, wc.acc.UserID, err)
 		return
 	}
+
+	// the checkpoint of any interrupted prune listing is gone now
+	wc.keepCheckpoint = false
 }
 
 // checkpointWrapper stores a provider's checkpoint along with the
@@ -135,10 +286,12 @@ func Checkpoint(ctx context.Context, checkpoint []byte) {
 // will only be loaded and restored to the provider on next run if
 // the parameters match, because it doesn't make sense to restore a
 // process that has different, potentially conflicting, parameters,
-// such as timeframe.
+// such as timeframe. Pruning is true if the run was recording a
+// prune listing, which can only be resumed along with its checkpoint.
 type checkpointWrapper struct {
-	Params string
-	Data   []byte
+	Params  string
+	Data    []byte
+	Pruning bool
 }
 
 // ProcessingOptions configures how item processing is carried out.
@@ -149,8 +302,52 @@ type ProcessingOptions struct {
 	Timeframe Timeframe
 	Merge     MergeOptions
 	Verbose   bool
+
+	// The number of goroutines that process items
+	// concurrently; default is DefaultWorkers.
+	Workers int
+
+	// The maximum number of item graphs to store in a
+	// single database transaction; default is
+	// DefaultBatchSize. Committing items in batches is
+	// much faster than committing each one by itself.
+	// Item graphs with data files are always stored
+	// on their own, outside of any batch, so that the
+	// database is not locked while files download.
+	BatchSize int
+
+	// If set, Progress is called with the stats of the
+	// run so far whenever they change, and once more
+	// when the run is finished. Calls are never made
+	// concurrently, but they may come from different
+	// goroutines. It should return quickly, as item
+	// processing waits for it.
+	Progress func(RunStats)
+
+	// If true, nothing is changed: items are listed and
+	// compared with the timeline to count (and log) what
+	// would be added, updated, merged, or pruned, but the
+	// database and data files are left untouched, and the
+	// run is not recorded in the history. Data files are
+	// not downloaded.
+	DryRun bool
+
+	// Pruned items are moved to the trash, but as a
+	// precaution against incomplete listings, a prune
+	// is aborted if it would trash more than this
+	// percentage of the account's items; default is
+	// DefaultPruneMaxPercent. Use 100 to allow any.
+	PruneMaxPercent int
 }
 
+// Default processing concurrency, batch size, and
+// maximum percentage of an account to prune.
+const (
+	DefaultWorkers         = 2
+	DefaultBatchSize       = 100
+	DefaultPruneMaxPercent = 10
+)
+
 // MergeOptions configures how items are merged. By
 // default, items are not merged; if an item with a
 // duplicate ID is encountered, it will be replaced
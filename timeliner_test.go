@@ -0,0 +1,189 @@
+package timeliner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDataSourceID is the ID of the data source that tests
+// add accounts with. Its clients list nothing; tests replace
+// the Client of a WrappedClient with a *testClient.
+const testDataSourceID = "test"
+
+func init() {
+	err := RegisterDataSource(DataSource{
+		ID:   testDataSourceID,
+		Name: "Test",
+		Authenticate: func(userID string) ([]byte, error) {
+			return []byte("credentials of " + userID), nil
+		},
+		NewClient: func(acc Account) (Client, error) {
+			return new(testClient), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testClient lists its graphs, then closes the channel.
+type testClient struct {
+	graphs []*ItemGraph
+
+	// if set, it is called after the graph at index i
+	// has been sent, for example to make a checkpoint
+	afterSend func(ctx context.Context, i int)
+}
+
+func (c *testClient) ListItems(ctx context.Context, ch chan<- *ItemGraph, opt ListingOptions) error {
+	defer close(ch)
+	for i, ig := range c.graphs {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ch <- ig:
+		}
+		if c.afterSend != nil {
+			c.afterSend(ctx, i)
+		}
+	}
+	return nil
+}
+
+// testItem is an item with the given values. If
+// fileName is set, its data file contains file. If
+// owner is not set, the item belongs to the account.
+type testItem struct {
+	id       string
+	ts       time.Time
+	class    ItemClass
+	text     string
+	fileName string
+	file     string
+	meta     *Metadata
+	owner    string
+}
+
+func (ti testItem) ID() string                { return ti.id }
+func (ti testItem) Timestamp() time.Time      { return ti.ts }
+func (ti testItem) Class() ItemClass          { return ti.class }
+func (ti testItem) DataFileHash() []byte      { return nil }
+func (ti testItem) DataFileMIMEType() *string { return nil }
+func (ti testItem) Location() (*Location, error) {
+	return nil, nil
+}
+
+func (ti testItem) Owner() (*string, *string) {
+	if ti.owner == "" {
+		return nil, nil
+	}
+	return &ti.owner, nil
+}
+
+func (ti testItem) DataText() (*string, error) {
+	if ti.text == "" {
+		return nil, nil
+	}
+	return &ti.text, nil
+}
+
+func (ti testItem) DataFileName() *string {
+	if ti.fileName == "" {
+		return nil
+	}
+	return &ti.fileName
+}
+
+func (ti testItem) DataFileReader() (io.ReadCloser, error) {
+	if ti.fileName == "" {
+		return nil, nil
+	}
+	return ioutil.NopCloser(strings.NewReader(ti.file)), nil
+}
+
+func (ti testItem) Metadata() (*Metadata, error) {
+	return ti.meta, nil
+}
+
+// openTestTimeline opens a new timeline in a temporary
+// directory, with an account for each of the given user
+// IDs. Call the returned function to close and remove it.
+func openTestTimeline(t *testing.T, opts Options, userIDs ...string) (*Timeline, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "timeliner_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("opening timeline: %v", err)
+	}
+	for _, userID := range userIDs {
+		err := tl.AddAccount(testDataSourceID, userID)
+		if err != nil {
+			tl.Close()
+			os.RemoveAll(dir)
+			t.Fatalf("adding account: %v", err)
+		}
+	}
+	return tl, func() {
+		tl.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testGetAll stores the given items with a client for
+// the account of userID, one worker at a time so that
+// row IDs are assigned in order.
+func testGetAll(t *testing.T, tl *Timeline, userID string, graphs ...*ItemGraph) RunStats {
+	t.Helper()
+	wc, err := tl.NewClient(testDataSourceID, userID)
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	wc.Client = &testClient{graphs: graphs}
+	stats, err := wc.GetAll(context.Background(), ProcessingOptions{Workers: 1})
+	if err != nil {
+		t.Fatalf("getting all items: %v", err)
+	}
+	return stats
+}
+
+// testInterrupted runs run with a client for the account of
+// userID that lists graphs, and interrupts it once the graph
+// at index stopAfter has been listed and a checkpoint made
+// after it has been saved.
+func testInterrupted(t *testing.T, tl *Timeline, userID string, graphs []*ItemGraph, stopAfter int,
+	run func(context.Context, *WrappedClient) (RunStats, error)) (RunStats, error) {
+	t.Helper()
+	wc, err := tl.NewClient(testDataSourceID, userID)
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wc.Client = &testClient{
+		graphs: graphs,
+		afterSend: func(ctx context.Context, i int) {
+			if i != stopAfter {
+				return
+			}
+			checkpoint := fmt.Sprintf("after %d", i)
+			Checkpoint(ctx, []byte(checkpoint))
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+				if string(storedCheckpoint(t, tl, wc.acc.ID)) == checkpoint {
+					break
+				}
+			}
+			cancel()
+		},
+	}
+	return run(ctx, &wc)
+}
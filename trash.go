@@ -0,0 +1,427 @@
+package timeliner
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// TrashedItem is an item that was pruned from the timeline.
+// It can be restored until the trash is emptied.
+type TrashedItem struct {
+	ID           int64     `json:"id"` // ID of the trash entry, not of the item
+	Trashed      time.Time `json:"trashed"`
+	DataSourceID string    `json:"data_source_id"`
+	UserID       string    `json:"user_id"`
+
+	// The item as it was when it was trashed;
+	// its ID is the row ID it had at the time.
+	Item ItemRow `json:"item"`
+
+	// Where the item's data file is kept in the
+	// trash folder, if the item was the only one
+	// using it (otherwise the file stays where
+	// it is, since other items still need it).
+	QuarantinedFile *string `json:"quarantined_file,omitempty"`
+}
+
+// trashItem moves the item with the given row ID into the trash,
+// along with its relationships and places in collections. If no
+// other item uses its data file, the file is moved into the
+// trash folder, so that it can be restored with the item.
+func (t *Timeline) trashItem(rowID int64) error {
+	// the item's links are removed from their tables along with
+	// the item, so they are kept with it in the trash instead
+	rels, err := t.ItemRelationships(context.Background(), rowID)
+	if err != nil {
+		return err
+	}
+	relsJSON, err := json.Marshal(rels)
+	if err != nil {
+		return fmt.Errorf("encoding relationships: %v", err)
+	}
+	colls, err := t.ItemCollections(context.Background(), rowID)
+	if err != nil {
+		return err
+	}
+	collsJSON, err := json.Marshal(colls)
+	if err != nil {
+		return fmt.Errorf("encoding collections: %v", err)
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO trash
+		(trashed, item_id, account_id, original_id, person_id, timestamp, stored,
+			modified, class, mime_type, data_text, data_file, data_hash, metadata,
+			latitude, longitude, view_path, relationships, collections)
+		SELECT ?, `+itemRowColumns+`, ?, ?
+		FROM items WHERE id=?`,
+		time.Now().Unix(), string(relsJSON), string(collsJSON), rowID)
+	if err != nil {
+		return fmt.Errorf("copying item into trash: %v", err)
+	}
+	trashID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting ID of trashed item: %v", err)
+	}
+
+	// find out whether this item has a data
+	// file and is the only one referencing it
+	var count int
+	var dataFile *string
+	err = tx.QueryRow(`SELECT COUNT(*), data_file FROM items
+		WHERE data_file = (SELECT data_file FROM items
+							WHERE id=? AND data_file IS NOT NULL
+							AND data_file != "" LIMIT 1)`,
+		rowID).Scan(&count, &dataFile)
+	if err != nil {
+		return fmt.Errorf("querying count of rows sharing data file: %v", err)
+	}
+	var quarantined *string
+	if count == 1 && t.datafileExists(*dataFile) {
+		q := path.Join(trashFolder, strconv.FormatInt(trashID, 10), path.Base(*dataFile))
+		quarantined = &q
+		_, err = tx.Exec(`UPDATE trash SET quarantined_file=? WHERE id=?`, q, trashID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+		if err != nil {
+			return fmt.Errorf("recording quarantined data file: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM items WHERE id=?`, rowID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+	if err != nil {
+		return fmt.Errorf("deleting item from DB: %v", err)
+	}
+
+	if t.searchable {
+		err = unindexItem(tx, rowID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if quarantined != nil {
+		err = t.store.Rename(*dataFile, *quarantined)
+		if err != nil {
+			return fmt.Errorf("moving data file to trash: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		if quarantined != nil {
+			t.store.Rename(*quarantined, *dataFile)
+		}
+		return fmt.Errorf("committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Trash returns the items in the trash, most recently trashed
+// first, up to limit (if limit > 0). If dataSourceID and userID
+// are not empty, only items of that account are returned.
+func (t *Timeline) Trash(ctx context.Context, dataSourceID, userID string, limit int) ([]TrashedItem, error) {
+	q := `SELECT trash.item_id, trash.account_id, trash.original_id, trash.person_id,
+			trash.timestamp, trash.stored, trash.modified, trash.class, trash.mime_type,
+			trash.data_text, trash.data_file, trash.data_hash, trash.metadata,
+			trash.latitude, trash.longitude, trash.view_path,
+			trash.id, trash.trashed, accounts.data_source_id, accounts.user_id,
+			trash.quarantined_file
+		FROM trash, accounts
+		WHERE trash.account_id = accounts.id`
+	var args []interface{}
+	if dataSourceID != "" || userID != "" {
+		q += ` AND accounts.data_source_id=? AND accounts.user_id=?`
+		args = append(args, dataSourceID, userID)
+	}
+	q += ` ORDER BY trash.trashed DESC, trash.id DESC`
+	if limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := t.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying trash: %v", err)
+	}
+	defer rows.Close()
+
+	var items []TrashedItem
+	for rows.Next() {
+		var ti TrashedItem
+		var trashed int64
+		ti.Item, err = t.scanItemRow(trashRowScanner{rows, &ti, &trashed})
+		if err != nil {
+			return nil, err
+		}
+		ti.Trashed = time.Unix(trashed, 0)
+		items = append(items, ti)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating trash rows: %v", err)
+	}
+
+	return items, nil
+}
+
+// trashRowScanner scans a row of the trash, which has the
+// item's columns followed by those of the trash entry.
+type trashRowScanner struct {
+	rows    *sql.Rows
+	ti      *TrashedItem
+	trashed *int64
+}
+
+func (s trashRowScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, &s.ti.ID, s.trashed, &s.ti.DataSourceID,
+		&s.ti.UserID, &s.ti.QuarantinedFile)...)
+}
+
+// RestoreTrash restores the trashed items with the given trash
+// IDs to the timeline, along with their data files. Their
+// relationships and places in collections are restored too,
+// as long as whatever is on the other end still exists. An
+// item can't be restored if it has been stored again since
+// it was trashed. It returns the number of items restored,
+// which are the first ones of trashIDs if there is an error.
+func (t *Timeline) RestoreTrash(ctx context.Context, trashIDs []int64) (int, error) {
+	for i, trashID := range trashIDs {
+		err := t.restoreTrashedItem(ctx, trashID)
+		if err != nil {
+			return i, fmt.Errorf("restoring item %d from trash: %v", trashID, err)
+		}
+	}
+	return len(trashIDs), nil
+}
+
+func (t *Timeline) restoreTrashedItem(ctx context.Context, trashID int64) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var itemID, accountID int64
+	var originalID string
+	var dataFile, quarantined, relsJSON, collsJSON *string
+	err = tx.QueryRow(`SELECT item_id, account_id, original_id, data_file,
+			quarantined_file, relationships, collections
+		FROM trash WHERE id=? LIMIT 1`, trashID).Scan(&itemID, &accountID,
+		&originalID, &dataFile, &quarantined, &relsJSON, &collsJSON)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such item in the trash")
+	}
+	if err != nil {
+		return fmt.Errorf("loading trashed item: %v", err)
+	}
+
+	var stored int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM items WHERE account_id=? AND original_id=?`,
+		accountID, originalID).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("checking for item in database: %v", err)
+	}
+	if stored > 0 {
+		return fmt.Errorf("item has been stored again since it was trashed (original_id=%s); empty the trash instead", originalID)
+	}
+
+	// keep the item's row ID if it is still free, so
+	// that anything that refers to it is still right
+	newID := &itemID
+	if rowExists(tx, "items", &itemID) {
+		newID = nil
+	}
+	res, err := tx.Exec(`INSERT INTO items (`+itemRowColumns+`)
+		SELECT ?, account_id, original_id, person_id, timestamp, stored,
+			modified, class, mime_type, data_text, data_file, data_hash,
+			metadata, latitude, longitude, view_path
+		FROM trash WHERE id=?`, newID, trashID)
+	if err != nil {
+		return fmt.Errorf("copying item out of trash: %v", err)
+	}
+	rowID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting row ID of restored item: %v", err)
+	}
+
+	err = restoreItemLinks(tx, itemID, rowID, relsJSON, collsJSON)
+	if err != nil {
+		return err
+	}
+
+	err = t.indexItem(tx, rowID)
+	if err != nil {
+		return fmt.Errorf("updating search index: %v", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM trash WHERE id=?`, trashID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+	if err != nil {
+		return fmt.Errorf("deleting item from trash: %v", err)
+	}
+
+	// a blob is named by its contents, so if the same blob has
+	// been stored again since, the quarantined copy isn't needed
+	var restoreFile bool
+	if quarantined != nil {
+		if t.datafileExists(*dataFile) {
+			if !isBlob(*dataFile) {
+				return fmt.Errorf("another file is already at the item's data file path: %s", *dataFile)
+			}
+		} else {
+			err = t.store.Rename(*quarantined, *dataFile)
+			if err != nil {
+				return fmt.Errorf("moving data file out of trash: %v", err)
+			}
+			restoreFile = true
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		if restoreFile {
+			t.store.Rename(*dataFile, *quarantined)
+		}
+		return fmt.Errorf("committing transaction: %v", err)
+	}
+
+	if quarantined != nil && !restoreFile {
+		t.store.Remove(*quarantined)
+	}
+
+	return nil
+}
+
+// restoreItemLinks restores the relationships and collection
+// memberships of a restored item, whose row ID was oldID when
+// it was trashed and is now newID. Links to rows that no longer
+// exist are skipped.
+func restoreItemLinks(tx *sql.Tx, oldID, newID int64, relsJSON, collsJSON *string) error {
+	if relsJSON != nil {
+		var rels []Relationship
+		err := json.Unmarshal([]byte(*relsJSON), &rels)
+		if err != nil {
+			return fmt.Errorf("decoding relationships: %v", err)
+		}
+		for _, rel := range rels {
+			if rel.FromItemID != nil && *rel.FromItemID == oldID {
+				rel.FromItemID = &newID
+			}
+			if rel.ToItemID != nil && *rel.ToItemID == oldID {
+				rel.ToItemID = &newID
+			}
+			if !rowExists(tx, "items", rel.FromItemID) || !rowExists(tx, "items", rel.ToItemID) ||
+				!rowExists(tx, "persons", rel.FromPersonID) || !rowExists(tx, "persons", rel.ToPersonID) {
+				continue
+			}
+			_, err = tx.Exec(`INSERT OR IGNORE INTO relationships
+				(from_person_id, from_item_id, to_person_id, to_item_id, directed, label)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				rel.FromPersonID, rel.FromItemID, rel.ToPersonID, rel.ToItemID,
+				!rel.Bidirectional, rel.Label)
+			if err != nil {
+				return fmt.Errorf("restoring relationship: %v", err)
+			}
+		}
+	}
+
+	if collsJSON != nil {
+		var colls []CollectionMembership
+		err := json.Unmarshal([]byte(*collsJSON), &colls)
+		if err != nil {
+			return fmt.Errorf("decoding collections: %v", err)
+		}
+		for _, cm := range colls {
+			if !rowExists(tx, "collections", &cm.CollectionID) {
+				continue
+			}
+			_, err = tx.Exec(`INSERT OR IGNORE INTO collection_items
+				(item_id, collection_id, position)
+				VALUES (?, ?, ?)`,
+				newID, cm.CollectionID, cm.Position)
+			if err != nil {
+				return fmt.Errorf("restoring place in collection: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rowExists returns true if id is nil or if the table has a
+// row with that ID. The table name must not come from input.
+func rowExists(db querier, table string, id *int64) bool {
+	if id == nil {
+		return true
+	}
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE id=?`, *id).Scan(&count)
+	return err == nil && count > 0
+}
+
+// EmptyTrash permanently deletes the items in the trash, and
+// their quarantined data files, of the given account, or of
+// all accounts if dataSourceID and userID are empty. It
+// returns the number of items deleted.
+func (t *Timeline) EmptyTrash(ctx context.Context, dataSourceID, userID string) (int, error) {
+	q := `SELECT trash.id, trash.quarantined_file FROM trash, accounts
+		WHERE trash.account_id = accounts.id`
+	var args []interface{}
+	if dataSourceID != "" || userID != "" {
+		q += ` AND accounts.data_source_id=? AND accounts.user_id=?`
+		args = append(args, dataSourceID, userID)
+	}
+
+	// the table would be locked while iterating
+	// its rows, so read them all before deleting
+	rows, err := t.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return 0, fmt.Errorf("querying trash: %v", err)
+	}
+	type trashEntry struct {
+		id          int64
+		quarantined *string
+	}
+	var entries []trashEntry
+	for rows.Next() {
+		var te trashEntry
+		err := rows.Scan(&te.id, &te.quarantined)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning trash row: %v", err)
+		}
+		entries = append(entries, te)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating trash rows: %v", err)
+	}
+
+	for i, te := range entries {
+		if te.quarantined != nil {
+			err := t.store.Remove(*te.quarantined)
+			if err != nil && !os.IsNotExist(err) {
+				return i, fmt.Errorf("deleting quarantined data file: %v (trash_id=%d)", err, te.id)
+			}
+		}
+		_, err := t.db.ExecContext(ctx, `DELETE FROM trash WHERE id=?`, te.id) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+		if err != nil {
+			return i, fmt.Errorf("deleting item from trash: %v (trash_id=%d)", err, te.id)
+		}
+	}
+
+	return len(entries), nil
+}
+
+// trashFolder is the folder within the repository
+// where the data files of trashed items are kept.
+const trashFolder = "trash"
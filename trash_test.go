@@ -0,0 +1,196 @@
+package timeliner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	photo := testItem{id: "photo", ts: ts, class: ClassImage, fileName: "photo.jpg", file: "jpeg data"}
+	ig := NewItemGraph(testItem{id: "post", ts: ts, class: ClassPost, text: "look at this"})
+	ig.Add(photo, RelAttached)
+	ig.Collections = []Collection{
+		{OriginalID: "album", Items: []CollectionItem{{Item: photo, Position: 2}}},
+	}
+	testGetAll(t, tl, "me", ig)
+
+	var photoID int64
+	err := tl.db.QueryRow(`SELECT id FROM items WHERE original_id='photo'`).Scan(&photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := tl.LoadItem(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.DataFile == nil || !tl.datafileExists(*before.DataFile) {
+		t.Fatalf("expected photo to have a data file, got %v", before.DataFile)
+	}
+	rels, err := tl.ItemRelationships(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colls, err := tl.ItemCollections(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rels) != 1 || len(colls) != 1 {
+		t.Fatalf("expected 1 relationship and 1 collection, got %+v and %+v", rels, colls)
+	}
+
+	err = tl.trashItem(photoID)
+	if err != nil {
+		t.Fatalf("trashing item: %v", err)
+	}
+
+	if _, err := tl.LoadItem(context.Background(), photoID); err == nil {
+		t.Error("expected trashed item to be gone")
+	}
+	if r, _ := tl.ItemRelationships(context.Background(), photoID); len(r) != 0 {
+		t.Errorf("expected relationships of trashed item to be gone, got %+v", r)
+	}
+	if c, _ := tl.ItemCollections(context.Background(), photoID); len(c) != 0 {
+		t.Errorf("expected trashed item to be out of its collection, got %+v", c)
+	}
+	if tl.datafileExists(*before.DataFile) {
+		t.Error("expected data file to be moved out of place")
+	}
+
+	trash, err := tl.Trash(context.Background(), testDataSourceID, "me", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Item.ID != photoID || trash[0].QuarantinedFile == nil {
+		t.Fatalf("expected the photo in the trash with its data file, got %+v", trash)
+	}
+	quarantined := *trash[0].QuarantinedFile
+	if !tl.datafileExists(quarantined) {
+		t.Fatalf("expected quarantined data file at %s", quarantined)
+	}
+
+	n, err := tl.RestoreTrash(context.Background(), []int64{trash[0].ID})
+	if err != nil || n != 1 {
+		t.Fatalf("restoring from trash: restored %d: %v", n, err)
+	}
+
+	after, err := tl.LoadItem(context.Background(), photoID)
+	if err != nil {
+		t.Fatalf("loading restored item: %v", err)
+	}
+	if after.OriginalID != "photo" || after.DataFile == nil || *after.DataFile != *before.DataFile ||
+		after.DataHash == nil || *after.DataHash != *before.DataHash {
+		t.Errorf("expected restored item like %+v, got %+v", before, after)
+	}
+	restoredRels, err := tl.ItemRelationships(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restoredRels) != 1 {
+		t.Fatalf("expected 1 restored relationship, got %+v", restoredRels)
+	}
+	restoredRels[0].ID = rels[0].ID // row ID of the link is new
+	if !reflect.DeepEqual(restoredRels, rels) {
+		t.Errorf("expected relationships %+v, got %+v", rels, restoredRels)
+	}
+	restoredColls, err := tl.ItemCollections(context.Background(), photoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restoredColls, colls) {
+		t.Errorf("expected collections %+v, got %+v", colls, restoredColls)
+	}
+
+	if tl.datafileExists(quarantined) {
+		t.Error("expected quarantined data file to be moved back")
+	}
+	f, err := tl.OpenDataFile(after)
+	if err != nil {
+		t.Fatalf("opening restored data file: %v", err)
+	}
+	contents, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != photo.file {
+		t.Errorf("expected data file to contain %q, got %q", photo.file, contents)
+	}
+
+	trash, err = tl.Trash(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Errorf("expected empty trash, got %+v", trash)
+	}
+}
+
+func TestPruneMaxPercent(t *testing.T) {
+	tl, cleanup := openTestTimeline(t, Options{}, "me")
+	defer cleanup()
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var graphs []*ItemGraph
+	for i := 0; i < 20; i++ {
+		graphs = append(graphs, NewItemGraph(testItem{
+			id:    fmt.Sprintf("item%d", i),
+			ts:    ts.Add(time.Duration(i) * time.Hour),
+			class: ClassPost,
+		}))
+	}
+	testGetAll(t, tl, "me", graphs...)
+
+	// 5 of the 20 items are no longer listed
+	getAllPrune := func(maxPercent int) (RunStats, error) {
+		wc, err := tl.NewClient(testDataSourceID, "me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc.Client = &testClient{graphs: graphs[:15]}
+		return wc.GetAll(context.Background(), ProcessingOptions{
+			Workers:         1,
+			Prune:           true,
+			PruneMaxPercent: maxPercent,
+		})
+	}
+	counts := func() (items, trashed, listings int) {
+		t.Helper()
+		for table, count := range map[string]*int{"items": &items, "trash": &trashed, "prune_listings": &listings} {
+			err := tl.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(count)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	_, err := getAllPrune(0)
+	if err == nil || !strings.Contains(err.Error(), "refusing to prune 5 of 20") {
+		t.Fatalf("expected prune to be refused, got %v", err)
+	}
+	if items, trashed, listings := counts(); items != 20 || trashed != 0 || listings != 1 {
+		t.Fatalf("after refused prune: expected 20 items, none trashed and the listing kept; got %d, %d and %d",
+			items, trashed, listings)
+	}
+
+	stats, err := getAllPrune(25)
+	if err != nil {
+		t.Fatalf("pruning up to 25%%: %v", err)
+	}
+	if stats.ItemsPruned != 5 {
+		t.Errorf("expected 5 items pruned, got %d", stats.ItemsPruned)
+	}
+	if items, trashed, listings := counts(); items != 15 || trashed != 5 || listings != 0 {
+		t.Fatalf("after prune: expected 15 items, 5 trashed and no listing; got %d, %d and %d",
+			items, trashed, listings)
+	}
+}
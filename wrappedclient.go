@@ -3,13 +3,11 @@ package timeliner
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
-
-	cuckoo "github.com/seiflotfy/cuckoofilter"
 )
 
 // WrappedClient wraps a Client instance with unexported
@@ -31,22 +29,48 @@ type WrappedClient struct {
 	// some providers (like Google Photos) even return errors if you
 	// query a "next page" with different parameters
 	commandParams string
+
+	// whether the run in progress is recording a prune
+	// listing; saved with its checkpoints
+	pruning bool
+
+	// whether the account's checkpoint belongs to the interrupted
+	// prune listing of another run, and must not be cleared
+	keepCheckpoint bool
+
+	// the channel of the listing in progress, if any, through
+	// which checkpoints are sent to be saved in order
+	itemChan chan<- *ItemGraph
 }
 
+// ErrInterrupted is returned when a listing is stopped because
+// its context was cancelled. The items that were listed before
+// then are stored, and the checkpoint of the listing (if the data
+// source supports checkpoints) is kept, so running the same
+// command again resumes it.
+var ErrInterrupted = errors.New("interrupted; run the same command again to resume")
+
 // GetLatest gets the most recent items from wc. It does not prune or
 // reprocess; only meant for a quick pull (error will be returned if
 // procOpt is not compatible). If there are no items pulled yet, all
 // items will be pulled. If procOpt.Timeframe.Until is not nil, the
 // latest only up to that timestamp will be pulled, and if until is
-// after the latest item, no items will be pulled.
-func (wc *WrappedClient) GetLatest(ctx context.Context, procOpt ProcessingOptions) error {
+// after the latest item, no items will be pulled. It returns the
+// stats of the run, even if there is an error.
+func (wc *WrappedClient) GetLatest(ctx context.Context, procOpt ProcessingOptions) (stats RunStats, err error) {
+	runID := wc.beginRun("get-latest", "", procOpt)
+	defer func() { wc.endRun(runID, stats, err) }()
+
 	if ctx == nil {
 		ctx = context.Background()
 	}
 	ctx = context.WithValue(ctx, wrappedClientCtxKey, wc)
+	ctx = context.WithValue(ctx, dryRunCtxKey, procOpt.DryRun)
+
+	rt := newRunTracker(procOpt)
 
 	if procOpt.Reprocess || procOpt.Prune || procOpt.Integrity || procOpt.Timeframe.Since != nil {
-		return fmt.Errorf("get-latest does not support -reprocess, -prune, -integrity, or -start")
+		return rt.finish(), fmt.Errorf("get-latest does not support -reprocess, -prune, -integrity, or -start")
 	}
 
 	// get date and original ID of the most recent item for this
@@ -54,10 +78,10 @@ func (wc *WrappedClient) GetLatest(ctx context.Context, procOpt ProcessingOption
 	var mostRecentTimestamp int64
 	var mostRecentOriginalID string
 	if wc.acc.lastItemID != nil {
-		err := wc.tl.db.QueryRow(`SELECT timestamp, original_id
+		err = wc.tl.db.QueryRow(`SELECT timestamp, original_id
 		FROM items WHERE id=? LIMIT 1`, *wc.acc.lastItemID).Scan(&mostRecentTimestamp, &mostRecentOriginalID)
 		if err != nil && err != sql.ErrNoRows {
-			return fmt.Errorf("getting most recent item: %v", err)
+			return rt.finish(), fmt.Errorf("getting most recent item: %v", err)
 		}
 	}
 
@@ -68,7 +92,7 @@ func (wc *WrappedClient) GetLatest(ctx context.Context, procOpt ProcessingOption
 		timeframe.Since = &ts
 		if timeframe.Until != nil && timeframe.Until.Before(ts) {
 			// most recent item is already after "until"/end date; nothing to do
-			return nil
+			return rt.finish(), nil
 		}
 	}
 	if mostRecentOriginalID != "" {
@@ -77,79 +101,104 @@ func (wc *WrappedClient) GetLatest(ctx context.Context, procOpt ProcessingOption
 
 	checkpoint := wc.prepareCheckpoint(timeframe)
 
-	wg, ch := wc.beginProcessing(concurrentCuckoo{}, procOpt)
+	_, err = wc.beginPruneListing(procOpt, checkpoint != nil)
+	if err != nil {
+		return rt.finish(), err
+	}
 
-	err := wc.Client.ListItems(ctx, ch, ListingOptions{
+	err = wc.listItems(ctx, nil, procOpt, rt, ListingOptions{
 		Timeframe:  timeframe,
 		Checkpoint: checkpoint,
 		Verbose:    procOpt.Verbose,
 	})
 	if err != nil {
-		return fmt.Errorf("getting items from service: %v", err)
+		return rt.finish(), err
 	}
 
-	// wait for processing to complete
-	wg.Wait()
-
-	err = wc.successCleanup()
+	err = wc.successCleanup(procOpt)
 	if err != nil {
-		return fmt.Errorf("processing completed, but error cleaning up: %v", err)
+		return rt.finish(), fmt.Errorf("processing completed, but error cleaning up: %v", err)
 	}
 
-	return nil
+	return rt.finish(), nil
 }
 
 // GetAll gets all the items using wc. If procOpt.Reprocess is true, items that
 // are already in the timeline will be re-processed. If procOpt.Prune is true,
-// items that are not listed on the data source by wc will be removed
-// from the timeline at the end of the listing. If procOpt.Integrity is true,
+// items that are not listed on the data source by wc will be moved to the trash
+// at the end of the listing, which can be resumed from a checkpoint. If procOpt.Integrity is true,
 // all items that are listed by wc that exist in the timeline and which
 // consist of a data file will be opened and checked for integrity; if
-// the file has changed, it will be reprocessed.
-func (wc *WrappedClient) GetAll(ctx context.Context, procOpt ProcessingOptions) error {
+// the file has changed, it will be reprocessed. It returns the stats
+// of the run, even if there is an error.
+func (wc *WrappedClient) GetAll(ctx context.Context, procOpt ProcessingOptions) (stats RunStats, err error) {
+	runID := wc.beginRun("get-all", "", procOpt)
+	defer func() { wc.endRun(runID, stats, err) }()
+
+	rt := newRunTracker(procOpt)
 	if wc.Client == nil {
-		return fmt.Errorf("no client")
+		return rt.finish(), fmt.Errorf("no client")
 	}
 	if ctx == nil {
 		ctx = context.Background()
 	}
 	ctx = context.WithValue(ctx, wrappedClientCtxKey, wc)
-
-	var cc concurrentCuckoo
-	if procOpt.Prune {
-		cc.Filter = cuckoo.NewFilter(10000000) // 10mil = ~16 MB on 64-bit
-		cc.Mutex = new(sync.Mutex)
-	}
+	ctx = context.WithValue(ctx, dryRunCtxKey, procOpt.DryRun)
 
 	checkpoint := wc.prepareCheckpoint(procOpt.Timeframe)
 
-	wg, ch := wc.beginProcessing(cc, procOpt)
+	pl, err := wc.beginPruneListing(procOpt, checkpoint != nil)
+	if err != nil {
+		return rt.finish(), err
+	}
 
-	err := wc.Client.ListItems(ctx, ch, ListingOptions{
+	err = wc.listItems(ctx, pl, procOpt, rt, ListingOptions{
 		Checkpoint: checkpoint,
 		Timeframe:  procOpt.Timeframe,
 		Verbose:    procOpt.Verbose,
 	})
 	if err != nil {
-		return fmt.Errorf("getting items from service: %v", err)
+		return rt.finish(), err
 	}
 
-	// wait for processing to complete
-	wg.Wait()
-
-	err = wc.successCleanup()
+	err = wc.successCleanup(procOpt)
 	if err != nil {
-		return fmt.Errorf("processing completed, but error cleaning up: %v", err)
+		return rt.finish(), fmt.Errorf("processing completed, but error cleaning up: %v", err)
 	}
 
 	// commence prune, if requested
 	if procOpt.Prune {
-		err := wc.doPrune(cc)
+		err := wc.doPrune(pl, procOpt, rt)
 		if err != nil {
-			return fmt.Errorf("processing completed, but error pruning: %v", err)
+			return rt.finish(), fmt.Errorf("processing completed, but error pruning: %v", err)
 		}
 	}
 
+	return rt.finish(), nil
+}
+
+// listItems lists items from the data source with opt and processes
+// them, and waits for processing to complete; items that were listed
+// before an error are still worth keeping. If ctx was cancelled, the
+// listing is not complete, even if the data source returned no error,
+// so ErrInterrupted is returned; the caller must then keep the
+// checkpoint, so that the next run can resume, and not advance the
+// last item or prune.
+func (wc *WrappedClient) listItems(ctx context.Context, pl *pruneListing, procOpt ProcessingOptions, rt *runTracker, opt ListingOptions) error {
+	wg, ch := wc.beginProcessing(ctx, pl, procOpt, rt)
+	err := wc.Client.ListItems(ctx, ch, opt)
+	wg.Wait()
+	wc.itemChan = nil
+
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	if err != nil {
+		if opt.Filename != "" {
+			return fmt.Errorf("importing: %v", err)
+		}
+		return fmt.Errorf("getting items from service: %v", err)
+	}
 	return nil
 }
 
@@ -166,20 +215,26 @@ func (wc *WrappedClient) prepareCheckpoint(tf Timeframe) []byte {
 	return wc.acc.cp.Data
 }
 
-func (wc *WrappedClient) successCleanup() error {
+func (wc *WrappedClient) successCleanup(procOpt ProcessingOptions) error {
+	if procOpt.DryRun {
+		return nil
+	}
+
 	// clear checkpoint
-	_, err := wc.tl.db.Exec(`UPDATE accounts SET checkpoint=NULL WHERE id=?`, wc.acc.ID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
-	if err != nil {
-		return fmt.Errorf("clearing checkpoint: %v", err)
+	if !wc.keepCheckpoint {
+		_, err := wc.tl.db.Exec(`UPDATE accounts SET checkpoint=NULL WHERE id=?`, wc.acc.ID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
+		if err != nil {
+			return fmt.Errorf("clearing checkpoint: %v", err)
+		}
+		wc.acc.checkpoint = nil
 	}
-	wc.acc.checkpoint = nil
 
 	// update the last item ID, to advance the window for future get-latest operations
 	wc.lastItemMu.Lock()
 	lastItemID := wc.lastItemRowID
 	wc.lastItemMu.Unlock()
 	if lastItemID > 0 {
-		_, err = wc.tl.db.Exec(`UPDATE accounts SET last_item_id=? WHERE id=?`, lastItemID, wc.acc.ID) // TODO: limit 1
+		_, err := wc.tl.db.Exec(`UPDATE accounts SET last_item_id=? WHERE id=?`, lastItemID, wc.acc.ID) // TODO: limit 1
 		if err != nil {
 			return fmt.Errorf("advancing most recent item ID: %v", err)
 		}
@@ -191,91 +246,123 @@ func (wc *WrappedClient) successCleanup() error {
 // Import is like GetAll but for a locally-stored archive or export file that can
 // simply be opened and processed, rather than needing to run over a network. See
 // the godoc for GetAll. This is only for data sources that support Import.
-func (wc *WrappedClient) Import(ctx context.Context, filename string, procOpt ProcessingOptions) error {
+func (wc *WrappedClient) Import(ctx context.Context, filename string, procOpt ProcessingOptions) (stats RunStats, err error) {
+	runID := wc.beginRun("import", filename, procOpt)
+	defer func() { wc.endRun(runID, stats, err) }()
+
+	rt := newRunTracker(procOpt)
 	if wc.Client == nil {
-		return fmt.Errorf("no client")
+		return rt.finish(), fmt.Errorf("no client")
 	}
-
-	var cc concurrentCuckoo
-	if procOpt.Prune {
-		cc.Filter = cuckoo.NewFilter(10000000) // 10mil = ~16 MB on 64-bit
-		cc.Mutex = new(sync.Mutex)
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	ctx = context.WithValue(ctx, dryRunCtxKey, procOpt.DryRun)
 
-	wg, ch := wc.beginProcessing(cc, procOpt)
+	pl, err := wc.beginPruneListing(procOpt, len(wc.acc.checkpoint) > 0)
+	if err != nil {
+		return rt.finish(), err
+	}
 
-	err := wc.Client.ListItems(ctx, ch, ListingOptions{
+	err = wc.listItems(ctx, pl, procOpt, rt, ListingOptions{
 		Filename:   filename,
 		Checkpoint: wc.acc.checkpoint,
 		Timeframe:  procOpt.Timeframe,
 		Verbose:    procOpt.Verbose,
 	})
 	if err != nil {
-		return fmt.Errorf("importing: %v", err)
+		return rt.finish(), err
 	}
 
-	// wait for processing to complete
-	wg.Wait()
-
-	err = wc.successCleanup()
+	err = wc.successCleanup(procOpt)
 	if err != nil {
-		return fmt.Errorf("processing completed, but error cleaning up: %v", err)
+		return rt.finish(), fmt.Errorf("processing completed, but error cleaning up: %v", err)
 	}
 
 	// commence prune, if requested
 	if procOpt.Prune {
-		err := wc.doPrune(cc)
+		err := wc.doPrune(pl, procOpt, rt)
 		if err != nil {
-			return fmt.Errorf("processing completed, but error pruning: %v", err)
+			return rt.finish(), fmt.Errorf("processing completed, but error pruning: %v", err)
 		}
 	}
 
-	return nil
+	return rt.finish(), nil
 }
 
-func (wc *WrappedClient) doPrune(cuckoo concurrentCuckoo) error {
-	// absolutely do not allow a prune to happen if the account
-	// has a checkpoint; this is because we don't store the cuckoo
-	// filter with checkpoints, meaning that the list of items
-	// that have been seen is INCOMPLETE, and pruning on that
-	// would lead to data loss. TODO: Find a way to store the
-	// cuckoo filter with a checkpoint...
-	var ckpt []byte
-	err := wc.tl.db.QueryRow(`SELECT checkpoint FROM accounts WHERE id=? LIMIT 1`,
-		wc.acc.ID).Scan(&ckpt)
-	if err != nil {
-		return fmt.Errorf("querying checkpoint: %v", err)
-	}
-	if len(ckpt) > 0 {
-		return fmt.Errorf("checkpoint exists; refusing to prune for fear of incomplete item listing")
+// doPrune moves the account's items that were not seen in the
+// listing to the trash, unless that would be more than the
+// maximum percentage of the account's items.
+func (wc *WrappedClient) doPrune(pl *pruneListing, procOpt ProcessingOptions, rt *runTracker) error {
+	if pl.failed {
+		return fmt.Errorf("some listed items could not be recorded; refusing to prune for fear of incomplete item listing")
 	}
 
-	// deleting items can't happen while iterating the rows
-	// since the database table locks; i.e. those two operations
-	// are in conflict, so we can't do the delete until we
-	// close the result rows; hence, we have to load each
-	// item to delete into memory (sigh) and then delete after
-	// the listing is complete
-	itemsToDelete, err := wc.listItemsToDelete(cuckoo)
+	itemsToDelete, total, err := wc.listItemsToDelete(pl)
 	if err != nil {
 		return fmt.Errorf("listing items to delete: %v", err)
 	}
 
+	// a listing that is much shorter than expected is more
+	// likely a problem with the listing than a mass deletion
+	// on the data source, so don't act on it, and keep it
+	// as it is so that it can be looked into
+	maxPercent := procOpt.PruneMaxPercent
+	if maxPercent <= 0 {
+		maxPercent = DefaultPruneMaxPercent
+	}
+	if total > 0 && len(itemsToDelete)*100 > total*maxPercent {
+		return fmt.Errorf("refusing to prune %d of %d items (more than %d%% of the account)",
+			len(itemsToDelete), total, maxPercent)
+	}
+
+	// the listing is complete, so it is no longer needed
+	if !pl.dryRun {
+		err = wc.endPruneListing()
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, rowID := range itemsToDelete {
-		err := wc.deleteItem(rowID)
+		if pl.dryRun {
+			log.Printf("[INFO] %s: dry run: would move item to trash (item_row_id=%d)", wc.acc, rowID)
+			rt.add(RunStats{ItemsPruned: 1})
+			continue
+		}
+		err := wc.tl.trashItem(rowID)
 		if err != nil {
-			log.Printf("[ERROR][%s/%s] Deleting item: %v (item_id=%d)",
+			log.Printf("[ERROR][%s/%s] Moving item to trash: %v (item_id=%d)",
 				wc.ds.ID, wc.acc.UserID, err, rowID)
+			continue
 		}
+		rt.add(RunStats{ItemsPruned: 1})
 	}
 
 	return nil
 }
 
-func (wc *WrappedClient) listItemsToDelete(cuckoo concurrentCuckoo) ([]int64, error) {
-	rows, err := wc.tl.db.Query(`SELECT id, original_id FROM items WHERE account_id=?`, wc.acc.ID)
+// listItemsToDelete returns the row IDs of the account's items that
+// were not seen in the listing, and the total number of its items.
+func (wc *WrappedClient) listItemsToDelete(pl *pruneListing) ([]int64, int, error) {
+	var total int
+	err := wc.tl.db.QueryRow(`SELECT COUNT(*) FROM items WHERE account_id=?`, wc.acc.ID).Scan(&total)
 	if err != nil {
-		return nil, fmt.Errorf("selecting all items from account: %v (account_id=%d)", err, wc.acc.ID)
+		return nil, 0, fmt.Errorf("counting items of account: %v (account_id=%d)", err, wc.acc.ID)
+	}
+
+	// the items listed during a dry run are only in memory, but
+	// if it resumed a listing, those listed before are in the DB
+	q := `SELECT id, original_id FROM items WHERE account_id=? AND original_id != ''`
+	args := []interface{}{wc.acc.ID}
+	if !pl.dryRun || pl.resumed {
+		q += ` AND original_id NOT IN (SELECT original_id FROM prune_seen WHERE account_id=?)`
+		args = append(args, wc.acc.ID)
+	}
+
+	rows, err := wc.tl.db.Query(q, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("selecting unlisted items from account: %v (account_id=%d)", err, wc.acc.ID)
 	}
 	defer rows.Close()
 
@@ -285,52 +372,18 @@ func (wc *WrappedClient) listItemsToDelete(cuckoo concurrentCuckoo) ([]int64, er
 		var originalID string
 		err := rows.Scan(&rowID, &originalID)
 		if err != nil {
-			return nil, fmt.Errorf("scanning item: %v", err)
+			return nil, 0, fmt.Errorf("scanning item: %v", err)
 		}
-		if originalID == "" {
+		if pl.dryRun && pl.listed(originalID) {
 			continue
 		}
-		cuckoo.Lock()
-		existsOnService := cuckoo.Lookup([]byte(originalID))
-		cuckoo.Unlock()
-		if !existsOnService {
-			itemsToDelete = append(itemsToDelete, rowID)
-		}
+		itemsToDelete = append(itemsToDelete, rowID)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating item rows: %v", err)
+		return nil, 0, fmt.Errorf("iterating item rows: %v", err)
 	}
 
-	return itemsToDelete, nil
-}
-
-func (wc *WrappedClient) deleteItem(rowID int64) error {
-	// before deleting the row, find out whether this item
-	// has a data file and is the only one referencing it
-	var count int
-	var dataFile string
-	err := wc.tl.db.QueryRow(`SELECT COUNT(*), data_file FROM items
-		WHERE data_file = (SELECT data_file FROM items
-							WHERE id=? AND data_file IS NOT NULL
-							AND data_file != "" LIMIT 1)`,
-		rowID).Scan(&count, &dataFile)
-	if err != nil {
-		return fmt.Errorf("querying count of rows sharing data file: %v", err)
-	}
-
-	_, err = wc.tl.db.Exec(`DELETE FROM items WHERE id=?`, rowID) // TODO: limit 1 (see https://github.com/mattn/go-sqlite3/pull/802)
-	if err != nil {
-		return fmt.Errorf("deleting item from DB: %v", err)
-	}
-
-	if count == 1 {
-		err := os.Remove(wc.tl.fullpath(dataFile))
-		if err != nil {
-			return fmt.Errorf("deleting associated data file from disk: %v", err)
-		}
-	}
-
-	return nil
+	return itemsToDelete, total, nil
 }
 
 // DataSourceName returns the name of the data source wc was created from.